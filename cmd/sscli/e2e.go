@@ -0,0 +1,192 @@
+package main
+
+// 端到端加密, 与服务端/static/e2e页面使用相同的格式, 服务端只保存密文:
+//   基础nonce(12) | 数据块...
+//   明文按1MB分块, 每块使用AES-256-GCM加密, nonce为基础nonce的最后4字节与块序号异或, 附加数据为[是否最后一块]
+//   明文内容为: 文件信息长度(4字节大端) | 文件信息json {name, type, size} | 文件内容
+// 分享链接格式: ${server}/static/e2e#${取件码}.${base64url(密钥)}
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const (
+	e2eChunkSize = 1 << 20
+	e2eTagSize   = 16
+	e2eNonceSize = 12
+)
+
+// 加密内容中的文件信息
+type e2eInfo struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	Size int64  `json:"size"`
+}
+
+// 生成分享链接
+func e2eLink(server string, code string, key []byte) string {
+	return fmt.Sprintf("%s/static/e2e#%s.%s", server, code, base64.RawURLEncoding.EncodeToString(key))
+}
+
+// 解析分享链接, 返回服务地址、取件码和密钥
+func parseE2eLink(link string) (server string, code string, key []byte, err error) {
+	i := strings.Index(link, "/static/e2e#")
+	if i < 0 {
+		return "", "", nil, errors.New("not an e2e link")
+	}
+	parts := strings.SplitN(link[i+len("/static/e2e#"):], ".", 2)
+	if len(parts) != 2 {
+		return "", "", nil, errors.New("bad e2e link")
+	}
+	key, err = base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || len(key) != 32 {
+		return "", "", nil, errors.New("bad e2e key")
+	}
+	return link[:i], parts[0], key, nil
+}
+
+func e2eChunkNonce(base []byte, index uint32, final bool) ([]byte, []byte) {
+	nonce := append([]byte(nil), base...)
+	binary.BigEndian.PutUint32(nonce[8:], binary.BigEndian.Uint32(nonce[8:])^index)
+	ad := []byte{0}
+	if final {
+		ad[0] = 1
+	}
+	return nonce, ad
+}
+
+func newE2eAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// 加密src并写入dst, 返回随机生成的密钥
+func e2eEncrypt(dst io.Writer, src io.Reader, info e2eInfo) ([]byte, error) {
+	key := make([]byte, 32)
+	base := make([]byte, e2eNonceSize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(base); err != nil {
+		return nil, err
+	}
+	aead, err := newE2eAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	infoBytes, err := json.Marshal(info)
+	if err != nil {
+		return nil, err
+	}
+	prefix := make([]byte, 4, 4+len(infoBytes))
+	binary.BigEndian.PutUint32(prefix, uint32(len(infoBytes)))
+	prefix = append(prefix, infoBytes...)
+	plain := bufio.NewReaderSize(io.MultiReader(strings.NewReader(string(prefix)), src), e2eChunkSize)
+
+	if _, err = dst.Write(base); err != nil {
+		return nil, err
+	}
+	chunk := make([]byte, e2eChunkSize)
+	for index := uint32(0); ; index++ {
+		n, err := io.ReadFull(plain, chunk)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return nil, err
+		}
+		final := n < len(chunk)
+		if !final {
+			if _, peekErr := plain.Peek(1); peekErr == io.EOF {
+				final = true
+			}
+		}
+		nonce, ad := e2eChunkNonce(base, index, final)
+		if _, err = dst.Write(aead.Seal(nil, nonce, chunk[:n], ad)); err != nil {
+			return nil, err
+		}
+		if final {
+			return key, nil
+		}
+	}
+}
+
+// 解密数据流, 返回文件信息和文件内容
+func e2eDecrypt(src io.Reader, key []byte) (*e2eInfo, io.Reader, error) {
+	aead, err := newE2eAEAD(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	reader := bufio.NewReaderSize(src, e2eChunkSize+e2eTagSize)
+	base := make([]byte, e2eNonceSize)
+	if _, err = io.ReadFull(reader, base); err != nil {
+		return nil, nil, err
+	}
+	plain := &e2eReader{src: reader, aead: aead, base: base}
+	head := make([]byte, 4)
+	if _, err = io.ReadFull(plain, head); err != nil {
+		return nil, nil, err
+	}
+	infoBytes := make([]byte, binary.BigEndian.Uint32(head))
+	if len(infoBytes) > e2eChunkSize {
+		return nil, nil, errors.New("bad e2e file info")
+	}
+	if _, err = io.ReadFull(plain, infoBytes); err != nil {
+		return nil, nil, err
+	}
+	var info e2eInfo
+	if err = json.Unmarshal(infoBytes, &info); err != nil {
+		return nil, nil, err
+	}
+	return &info, plain, nil
+}
+
+// 逐块解密的读取器
+type e2eReader struct {
+	src   *bufio.Reader
+	aead  cipher.AEAD
+	base  []byte
+	index uint32
+	plain []byte
+	done  bool
+}
+
+func (r *e2eReader) Read(p []byte) (int, error) {
+	for len(r.plain) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		chunk := make([]byte, e2eChunkSize+e2eTagSize)
+		n, err := io.ReadFull(r.src, chunk)
+		if err == io.EOF {
+			return 0, io.ErrUnexpectedEOF
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return 0, err
+		}
+		final := n < len(chunk)
+		if !final {
+			if _, peekErr := r.src.Peek(1); peekErr == io.EOF {
+				final = true
+			}
+		}
+		nonce, ad := e2eChunkNonce(r.base, r.index, final)
+		if r.plain, err = r.aead.Open(nil, nonce, chunk[:n], ad); err != nil {
+			return 0, errors.New("decrypt failed: wrong key or damaged data")
+		}
+		r.index++
+		r.done = final
+	}
+	n := copy(p, r.plain)
+	r.plain = r.plain[n:]
+	return n, nil
+}
@@ -0,0 +1,597 @@
+package main
+
+// static文件服务的命令行客户端
+// Usage:
+//   sscli config -server http://localhost:80      保存服务地址
+//   sscli upload ./a.tar.gz                        上传文件, 中断后再次执行同样的命令可断点续传
+//   tar cz dir | sscli upload -name dir.tar.gz -   从标准输入上传
+//   sscli upload -e ./secret.pdf                   端到端加密后上传, 密钥只保存在输出的链接中
+//   sscli download abcdefgh                        按取件码下载, -o - 输出到标准输出; 也可以传入加密分享的链接
+//   sscli list                                     列出自己上传的文件
+//   sscli delete abcdefgh                          删除自己上传的文件
+// 管理口令在第一次上传时自动生成并保存在~/.sscli.json中, 也可以通过-token参数或SSCLI_TOKEN环境变量指定
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const chunkSize = 8 << 20 // 断点续传时每个请求上传的数据量
+
+// 保存在~/.sscli.json中的配置
+type cliConfig struct {
+	Server string            `json:"server"`
+	Token  string            `json:"token"`
+	Resume map[string]string `json:"resume"` // 未完成的上传, 文件标识 -> 上传地址
+}
+
+// 服务端的响应格式
+type respStruct struct {
+	Status  int             `json:"status"`
+	Msg     string          `json:"msg"`
+	PayLoad json.RawMessage `json:"payLoad"`
+}
+
+type uploadResult struct {
+	Code        string `json:"code"`
+	FileName    string `json:"fileName"`
+	Size        int64  `json:"size"`
+	Hash        string `json:"hash"`
+	DownloadURL string `json:"downloadUrl"`
+	PreviewURL  string `json:"previewUrl"`
+	ExpireAt    int64  `json:"expireAt"`
+	DeleteURL   string `json:"deleteUrl"`
+}
+
+var (
+	conf       cliConfig
+	configPath string
+	client     = &http.Client{}
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	home, _ := os.UserHomeDir()
+	configPath = filepath.Join(home, ".sscli.json")
+	loadConfig()
+
+	cmd, args := os.Args[1], os.Args[2:]
+	flags := flag.NewFlagSet(cmd, flag.ExitOnError)
+	server := flags.String("server", "", "服务地址, 如 http://localhost:80")
+	token := flags.String("token", "", "管理口令, 至少16个字符")
+	name := flags.String("name", "stdin", "从标准输入上传时使用的文件名")
+	output := flags.String("o", "", "下载保存的路径, '-'代表标准输出")
+	encrypt := flags.Bool("e", false, "上传前在本地加密, 不支持断点续传")
+	flags.Parse(args)
+	if *server != "" {
+		conf.Server = strings.TrimRight(*server, "/")
+	} else if env := os.Getenv("SSCLI_SERVER"); env != "" {
+		conf.Server = strings.TrimRight(env, "/")
+	}
+	if *token != "" {
+		conf.Token = *token
+	} else if env := os.Getenv("SSCLI_TOKEN"); env != "" {
+		conf.Token = env
+	}
+
+	var err error
+	switch cmd {
+	case "config":
+		err = saveConfig()
+	case "upload":
+		if flags.NArg() != 1 {
+			err = errors.New("usage: sscli upload [-e] [-name fileName] <file|->")
+			break
+		}
+		if *encrypt {
+			err = uploadEncrypted(flags.Arg(0), *name)
+		} else {
+			err = upload(flags.Arg(0), *name)
+		}
+	case "download":
+		if flags.NArg() != 1 {
+			err = errors.New("usage: sscli download [-o path|-] <code|url>")
+			break
+		}
+		if strings.Contains(flags.Arg(0), "/static/e2e#") {
+			err = downloadEncrypted(flags.Arg(0), *output)
+		} else {
+			err = download(flags.Arg(0), *output)
+		}
+	case "list":
+		err = list()
+	case "delete":
+		if flags.NArg() != 1 {
+			err = errors.New("usage: sscli delete <code>")
+			break
+		}
+		err = remove(flags.Arg(0))
+	default:
+		usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, `usage: sscli <command> [options] [args]
+commands:
+  config   -server URL [-token TOKEN]   保存服务地址和管理口令
+  upload   [-e] [-name NAME] <file|->    上传文件, 支持断点续传; '-'代表从标准输入读取; -e 端到端加密
+  download [-o PATH|-] <code|url>        按取件码或加密分享的链接下载文件
+  list                                   列出自己上传的文件
+  delete   <code>                        删除自己上传的文件`)
+}
+
+// ------------------- 配置 ---------------------
+
+func loadConfig() {
+	bytes, err := ioutil.ReadFile(configPath)
+	if err == nil {
+		json.Unmarshal(bytes, &conf)
+	}
+	if conf.Resume == nil {
+		conf.Resume = make(map[string]string)
+	}
+}
+
+func saveConfig() error {
+	bytes, err := json.MarshalIndent(conf, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(configPath, bytes, 0600)
+}
+
+// 获取管理口令, 没有时生成一个并保存
+func getToken() (string, error) {
+	if conf.Token != "" {
+		return conf.Token, nil
+	}
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	conf.Token = hex.EncodeToString(buf)
+	fmt.Fprintf(os.Stderr, "generate manage token and save to %s\n", configPath)
+	return conf.Token, saveConfig()
+}
+
+// ------------------- 命令 ---------------------
+
+// 上传文件, 普通文件使用断点续传, 标准输入以流的方式上传
+func upload(src string, stdinName string) error {
+	if conf.Server == "" {
+		return errors.New("server not set, run: sscli config -server URL")
+	}
+	token, err := getToken()
+	if err != nil {
+		return err
+	}
+	var result uploadResult
+	if src == "-" {
+		err = uploadStream(os.Stdin, stdinName, token, &result)
+	} else {
+		err = uploadResumable(src, token, &result)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "upload success: name=%s size=%d sha256=%s\n", result.FileName, result.Size, result.Hash)
+	if result.ExpireAt > 0 {
+		fmt.Fprintf(os.Stderr, "expire at: %s\n", time.Unix(result.ExpireAt, 0).Format("2006-01-02 15:04:05"))
+	}
+	fmt.Fprintf(os.Stderr, "preview: %s\n", result.PreviewURL)
+	fmt.Fprintf(os.Stderr, "delete: curl -X DELETE '%s'\n", result.DeleteURL)
+	fmt.Println(result.DownloadURL)
+	return nil
+}
+
+// 在本地加密后上传, 服务端只保存密文, 输出带密钥的分享链接
+func uploadEncrypted(src string, stdinName string) error {
+	if conf.Server == "" {
+		return errors.New("server not set, run: sscli config -server URL")
+	}
+	token, err := getToken()
+	if err != nil {
+		return err
+	}
+	info := e2eInfo{Name: stdinName}
+	var reader io.Reader = os.Stdin
+	if src != "-" {
+		file, err := os.Open(src)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		stat, err := file.Stat()
+		if err != nil {
+			return err
+		}
+		info = e2eInfo{Name: filepath.Base(src), Size: stat.Size()}
+		reader = file
+	}
+	info.Type = mime.TypeByExtension(filepath.Ext(info.Name))
+
+	var key []byte
+	pipeReader, pipeWriter := io.Pipe()
+	go func() {
+		var err error
+		key, err = e2eEncrypt(pipeWriter, reader, info)
+		pipeWriter.CloseWithError(err)
+	}()
+	var result uploadResult
+	if err = uploadStream(pipeReader, "e2e.bin", token, &result); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "\nupload success: name=%s encrypted size=%d\n", info.Name, result.Size)
+	if result.ExpireAt > 0 {
+		fmt.Fprintf(os.Stderr, "expire at: %s\n", time.Unix(result.ExpireAt, 0).Format("2006-01-02 15:04:05"))
+	}
+	fmt.Fprintf(os.Stderr, "delete: curl -X DELETE '%s'\n", result.DeleteURL)
+	fmt.Println(e2eLink(conf.Server, result.Code, key))
+	return nil
+}
+
+// 以multipart表单的方式上传数据流, 不支持续传
+func uploadStream(src io.Reader, fileName string, token string, result *uploadResult) error {
+	reader, writer := io.Pipe()
+	form := multipart.NewWriter(writer)
+	go func() {
+		part, err := form.CreateFormFile("file", fileName)
+		if err == nil {
+			_, err = io.Copy(part, newProgress(src, -1))
+		}
+		if err == nil {
+			err = form.Close()
+		}
+		writer.CloseWithError(err)
+	}()
+	req, err := http.NewRequest(http.MethodPost, conf.Server+"/static/upload?format=json", reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.Header.Set("X-Manage-Token", token)
+	return doJson(req, result)
+}
+
+// 断点续传: 创建或恢复上传会话, 从服务端已接收的位置开始分块上传
+func uploadResumable(src string, token string, result *uploadResult) error {
+	file, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	absPath, _ := filepath.Abs(src)
+	resumeKey := fmt.Sprintf("%s|%d|%d", absPath, info.Size(), info.ModTime().Unix())
+
+	uploadURL := conf.Resume[resumeKey]
+	offset, err := getUploadOffset(uploadURL, token)
+	if err != nil { // 没有可恢复的会话, 创建新的
+		var session struct {
+			UploadURL string `json:"uploadUrl"`
+		}
+		query := url.Values{"fileName": {filepath.Base(src)}, "size": {fmt.Sprint(info.Size())}}
+		var req *http.Request
+		req, err = http.NewRequest(http.MethodPost, conf.Server+"/static/upload/session?"+query.Encode(), nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("X-Manage-Token", token)
+		if err = doJson(req, &session); err != nil {
+			return err
+		}
+		uploadURL, offset = session.UploadURL, 0
+		conf.Resume[resumeKey] = uploadURL
+		saveConfig()
+	} else {
+		fmt.Fprintf(os.Stderr, "resume upload from %d bytes\n", offset)
+	}
+
+	bar := newProgress(file, info.Size())
+	bar.done = offset
+	for retry := 0; ; {
+		if _, err = file.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+		size := info.Size() - offset
+		if size > chunkSize {
+			size = chunkSize
+		}
+		var req *http.Request
+		req, err = http.NewRequest(http.MethodPatch, uploadURL, io.LimitReader(bar, size))
+		if err != nil {
+			return err
+		}
+		req.ContentLength = size
+		req.Header.Set("Upload-Offset", fmt.Sprint(offset))
+		req.Header.Set("X-Manage-Token", token)
+		var payload json.RawMessage
+		err = doJson(req, &payload)
+		if err != nil {
+			// 网络中断等错误时查询服务端的进度后重试
+			if retry++; retry > 3 {
+				return fmt.Errorf("%v, run the same command again to resume", err)
+			}
+			fmt.Fprintf(os.Stderr, "\nupload failed, retry: %v\n", err)
+			time.Sleep(time.Duration(retry) * time.Second)
+			if offset, err = getUploadOffset(uploadURL, token); err != nil {
+				return err
+			}
+			bar.done = offset
+			continue
+		}
+		retry = 0
+		offset += size
+		if offset >= info.Size() {
+			delete(conf.Resume, resumeKey)
+			saveConfig()
+			fmt.Fprintln(os.Stderr)
+			return json.Unmarshal(payload, result)
+		}
+	}
+}
+
+// 查询上传会话已接收的字节数
+func getUploadOffset(uploadURL string, token string) (int64, error) {
+	if uploadURL == "" {
+		return 0, errors.New("no upload session")
+	}
+	req, err := http.NewRequest(http.MethodHead, uploadURL, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("X-Manage-Token", token)
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("get upload offset failed: status=%d", resp.StatusCode)
+	}
+	return strconv.ParseInt(resp.Header.Get("Upload-Offset"), 10, 64)
+}
+
+// 按取件码下载文件, output为空时使用上传时的文件名保存在当前目录
+func download(code string, output string) error {
+	if conf.Server == "" && !strings.Contains(code, "/") {
+		return errors.New("server not set, run: sscli config -server URL")
+	}
+	downloadURL := code
+	if !strings.Contains(code, "/") {
+		downloadURL = fmt.Sprintf("%s/static/download/%s", conf.Server, code)
+	}
+	resp, err := client.Get(downloadURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	disposition := resp.Header.Get("Content-Disposition")
+	if resp.StatusCode != http.StatusOK || disposition == "" { // 文件不存在时服务端返回文本提示
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("download failed: status=%d msg=%s", resp.StatusCode, bytes.TrimSpace(msg))
+	}
+	if output == "" {
+		// 旧版本服务端返回的文件名没有加引号, 无法解析时使用下载地址中的文件名
+		if _, params, err := mime.ParseMediaType(disposition); err == nil {
+			output = path.Base(params["filename"])
+		}
+		if output == "" || output == "." || output == "/" {
+			output = path.Base(resp.Request.URL.Path)
+		}
+	}
+	var dst io.Writer = os.Stdout
+	if output != "-" {
+		file, err := os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		dst = file
+	}
+	if _, err = io.Copy(dst, newProgress(resp.Body, resp.ContentLength)); err != nil {
+		return err
+	}
+	if output != "-" {
+		fmt.Fprintf(os.Stderr, "\nsave to %s\n", output)
+	}
+	return nil
+}
+
+// 下载加密分享的文件并在本地解密, output为空时使用原始文件名保存在当前目录
+func downloadEncrypted(link string, output string) error {
+	server, code, key, err := parseE2eLink(link)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Get(fmt.Sprintf("%s/static/download/%s", server, url.PathEscape(code)))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Disposition") == "" {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("download failed: status=%d msg=%s", resp.StatusCode, bytes.TrimSpace(msg))
+	}
+	info, plain, err := e2eDecrypt(newProgress(resp.Body, resp.ContentLength), key)
+	if err != nil {
+		return err
+	}
+	if output == "" {
+		output = filepath.Base(info.Name)
+		if output == "" || output == "." || output == string(filepath.Separator) {
+			output = code
+		}
+	}
+	var dst io.Writer = os.Stdout
+	if output != "-" {
+		file, err := os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		dst = file
+	}
+	if _, err = io.Copy(dst, plain); err != nil {
+		if output != "-" {
+			os.Remove(output) // 不保留解密失败的内容
+		}
+		return err
+	}
+	if output != "-" {
+		fmt.Fprintf(os.Stderr, "\nsave to %s\n", output)
+	}
+	return nil
+}
+
+// 列出自己上传的文件
+func list() error {
+	var files []struct {
+		Code      string `json:"code"`
+		FileName  string `json:"fileName"`
+		Size      int64  `json:"size"`
+		Timestamp int64  `json:"timestamp"`
+		ExpireAt  int64  `json:"expireAt"`
+	}
+	req, err := newTokenRequest(http.MethodGet, "/static/mine")
+	if err != nil {
+		return err
+	}
+	if err = doJson(req, &files); err != nil {
+		return err
+	}
+	fmt.Printf("%-10s %-20s %-20s %12s  %s\n", "CODE", "UPLOAD", "EXPIRE", "SIZE", "NAME")
+	for _, f := range files {
+		expire := "-"
+		if f.ExpireAt > 0 {
+			expire = time.Unix(f.ExpireAt, 0).Format("2006-01-02 15:04:05")
+		}
+		fmt.Printf("%-10s %-20s %-20s %12d  %s\n", f.Code, time.Unix(f.Timestamp, 0).Format("2006-01-02 15:04:05"),
+			expire, f.Size, f.FileName)
+	}
+	return nil
+}
+
+// 删除自己上传的文件
+func remove(code string) error {
+	req, err := newTokenRequest(http.MethodDelete, "/static/delete/"+code)
+	if err != nil {
+		return err
+	}
+	if err = doJson(req, nil); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "delete success: code=%s\n", code)
+	return nil
+}
+
+// ------------------- 工具 ---------------------
+
+// 创建携带管理口令的请求
+func newTokenRequest(method string, uri string) (*http.Request, error) {
+	if conf.Server == "" || conf.Token == "" {
+		return nil, errors.New("server or token not set, run: sscli config -server URL -token TOKEN")
+	}
+	req, err := http.NewRequest(method, conf.Server+uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Manage-Token", conf.Token)
+	return req, nil
+}
+
+// 发送请求并将响应中的payLoad解析到result
+func doJson(req *http.Request, result interface{}) error {
+	req.Header.Set("Accept", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	var data respStruct
+	if err = json.Unmarshal(body, &data); err != nil {
+		return fmt.Errorf("unexpect response: status=%d body=%.200s", resp.StatusCode, body)
+	}
+	if data.Status != 0 {
+		return fmt.Errorf("server error: %s", data.Msg)
+	}
+	if result == nil || len(data.PayLoad) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data.PayLoad, result)
+}
+
+// 在标准错误输出中显示读取进度, 标准错误输出不是终端时不显示
+type progress struct {
+	reader io.Reader
+	total  int64 // 小于0代表未知
+	done   int64
+	last   time.Time
+	show   bool
+}
+
+func newProgress(reader io.Reader, total int64) *progress {
+	info, err := os.Stderr.Stat()
+	return &progress{
+		reader: reader,
+		total:  total,
+		show:   err == nil && info.Mode()&os.ModeCharDevice != 0,
+	}
+}
+
+func (p *progress) Read(buf []byte) (int, error) {
+	n, err := p.reader.Read(buf)
+	p.done += int64(n)
+	if p.show && (time.Since(p.last) > 200*time.Millisecond || err == io.EOF) {
+		p.last = time.Now()
+		if p.total > 0 {
+			fmt.Fprintf(os.Stderr, "\r%s / %s  %.1f%%", humanSize(p.done), humanSize(p.total), float64(p.done)*100/float64(p.total))
+		} else {
+			fmt.Fprintf(os.Stderr, "\r%s", humanSize(p.done))
+		}
+	}
+	return n, err
+}
+
+func humanSize(size int64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	value := float64(size)
+	i := 0
+	for value >= 1024 && i < len(units)-1 {
+		value /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f%s", value, units[i])
+}
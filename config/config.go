@@ -14,7 +14,34 @@ type mailConfig struct {
 	MailPort int    `xml:"mail_port"`
 	MailPass string `xml:"mail_pass"`
 	MailHost string `xml:"mail_host"` // 代理服务器地址
-	MailTo   string `xml:"mail_to"`   // 接收邮件的地址
+	MailTo   string `xml:"mail_to"`   // 接收邮件的地址, 没有配置接收人时作为唯一的接收人
+
+	FromName    string `xml:"mail_from_name"`    // 发件人的显示名称, 默认CallDriver
+	Workers     int    `xml:"mail_workers"`      // 同时发送邮件的连接数, 默认2
+	Retry       int    `xml:"mail_retry"`        // 发送失败后最多重试的次数, 默认5
+	RetryDelay  int64  `xml:"mail_retry_delay"`  // 第一次重试的等待时间(秒), 之后每次翻倍, 默认30
+	IdleTimeout int64  `xml:"mail_idle_timeout"` // SMTP连接空闲多久后关闭(秒), 默认30
+	TemplateDir string `xml:"mail_template_dir"` // 自定义邮件模板的目录, 见toolbox/mailTemplate.go
+	LogDays     int64  `xml:"mail_log_days"`     // 发送记录的保留天数, 默认30
+
+	Recipients []MailRecipientConfig `xml:"mail_recipient"`
+	Routes     []MailRouteConfig     `xml:"mail_route"`
+	Digest     int64                 `xml:"mail_digest"` // 低优先级事件合并为摘要发送的间隔(分钟), 默认60
+}
+
+// 邮件接收人, 可以配置多个
+type MailRecipientConfig struct {
+	Name    string `xml:"name"`    // 名称, 唯一, 在路由规则中引用
+	Address string `xml:"address"` // 邮箱地址, 同时允许该地址通过回复邮件回复callDriver的消息
+	Quiet   string `xml:"quiet"`   // 免打扰时段, 如 23:00-08:00, 期间的事件在时段结束后合并发送, 为空时不限制
+}
+
+// 邮件路由规则, 事件匹配多条规则时发送给所有规则的接收人, 同一接收人使用匹配最精确的规则的优先级
+// 事件类型: callDriver.message(新消息) | callDriver.digest(合并的新消息) | alert(告警) | upload(文件上传) | codeMaster.submit(提交作品)
+type MailRouteConfig struct {
+	Event      string   `xml:"event"`     // 事件类型, 以.*结尾时匹配前缀, *匹配所有事件
+	Recipients []string `xml:"recipient"` // 接收人名称, 为空时发送给所有接收人
+	Priority   string   `xml:"priority"`  // urgent(忽略免打扰时段) | normal(默认, 立即发送) | low(合并到摘要中定期发送)
 }
 
 // 备注：目录路径配置,约定目录路径以/结尾
@@ -28,6 +55,113 @@ type serverConfig struct {
 	RestartBashPath string `xml:"restart_bash_path"` // 重启程序的脚本路径
 }
 
+// 静态文件存储的配额配置, 容量单位为MB, 0代表不限制
+type quotaConfig struct {
+	ShareQuota   int64 `xml:"share_quota"`    // 匿名上传(static服务)的总容量
+	NetdishQuota int64 `xml:"netdish_quota"`  // 个人网盘的总容量
+	ManageQuota  int64 `xml:"manage_quota"`   // manage页面上传的总容量
+	ShareIPQuota int64 `xml:"share_ip_quota"` // 每个IP每天可匿名上传的容量
+	ShareEvict   bool  `xml:"share_evict"`    // 超出配额时是否淘汰最旧的文件, 否则拒绝上传
+	NetdishEvict bool  `xml:"netdish_evict"`
+	ManageEvict  bool  `xml:"manage_evict"`
+	ChatQuota    int64 `xml:"chat_quota"` // callDriver聊天附件的总容量
+	ChatEvict    bool  `xml:"chat_evict"`
+	ShareExpire  int64 `xml:"share_expire"` // 匿名上传的有效期(小时), 0代表不过期
+
+	ShareIPSessions int `xml:"share_ip_sessions"` // 每个IP同时未完成的断点续传会话数, 默认5
+
+	ArchiveMaxSize    int64 `xml:"archive_max_size"`    // 上传压缩包解压后的最大总大小, 默认1024
+	ArchiveMaxEntries int   `xml:"archive_max_entries"` // 上传压缩包的最大文件数, 默认1000
+}
+
+// 上传文件的存储后端配置
+type storageConfig struct {
+	Driver        string `xml:"storage_driver"`    // 存储后端 [local|s3], 默认为local, 即保存在StatisPath下
+	S3Endpoint    string `xml:"s3_endpoint"`       // S3兼容服务的地址, 如 http://127.0.0.1:9000
+	S3Region      string `xml:"s3_region"`         // 默认为us-east-1
+	S3Bucket      string `xml:"s3_bucket"`         // 存储桶名称
+	S3AccessKey   string `xml:"s3_access_key"`     // 访问密钥
+	S3SecretKey   string `xml:"s3_secret_key"`     // 访问密钥
+	S3Prefix      string `xml:"s3_prefix"`         // 对象key的公共前缀
+	S3PathStyle   bool   `xml:"s3_path_style"`     // 是否使用路径形式的地址, 使用MinIO时需要开启
+	PresignExpire int64  `xml:"s3_presign_expire"` // 下载链接的有效期(秒), 默认600
+	EncryptAtRest bool   `xml:"encrypt_at_rest"`   // 是否加密保存新上传的文件
+	MasterKey     string `xml:"master_key"`        // 加密数据密钥的主密钥, 32字节的hex或base64, 环境变量SS_MASTER_KEY优先
+}
+
+// 个人网盘的WebDAV服务配置, 用户名为空时不开启
+type webdavConfig struct {
+	User      string `xml:"webdav_user"`
+	Password  string `xml:"webdav_password"`
+	AuthLimit int    `xml:"webdav_auth_limit"` // 每个IP每10分钟允许认证失败的次数, 默认10
+}
+
+// 匿名上传文件的病毒扫描配置, 扫描器为空时不扫描
+type scanConfig struct {
+	Driver    string `xml:"scan_driver"`     // 扫描器 [clamd|eicar], eicar只识别EICAR测试文件, 用于在没有clamd的环境中测试
+	ClamdAddr string `xml:"clamd_addr"`      // clamd的地址, 如 unix:/var/run/clamav/clamd.ctl 或 tcp:127.0.0.1:3310
+	Timeout   int64  `xml:"scan_timeout"`    // 单个文件的扫描超时(秒), 默认60
+	FailClose bool   `xml:"scan_fail_close"` // 扫描出错时是否同样隔离文件
+}
+
+// callDriver应用的配置
+type callDriverConfig struct {
+	VisitorSecret string `xml:"visitor_secret"`    // 签名访客身份cookie的密钥, 为空时每次启动随机生成, 重启后访客身份失效
+	ReplyAddress  string `xml:"reply_address"`     // 接收邮件回复的地址, 如 calldriver@example.com, 通知邮件的回复地址为其子地址 calldriver+token@example.com
+	ReplyListen   string `xml:"reply_smtp_listen"` // 接收邮件回复的SMTP监听地址, 如 127.0.0.1:2525, 由邮件服务器转发, 为空时不接收
+	MailVisitor   bool   `xml:"mail_visitor"`      // 是否将Boss的回复发送到访客留下的邮箱
+
+	AttachMaxSize  int64    `xml:"attach_max_size"`  // 单个附件的最大大小(KB), 默认5120
+	AttachMaxCount int      `xml:"attach_max_count"` // 每条消息最多的附件数, 默认4
+	AttachTypes    []string `xml:"attach_type"`      // 允许的附件类型, 为空时允许所有支持的类型, 见handler/chatAttachment.go
+
+	RetentionDays int64  `xml:"retention_days"` // 聊天记录的保留天数, 超过的记录由后台任务处理, 0为永久保留
+	RetentionMode string `xml:"retention_mode"` // 超过保留期限的记录的处理方式: archive(移到归档集合, 默认) | delete(直接删除)
+}
+
+// 新消息通知渠道的配置, 可以配置多个
+// 类型: email(按邮件路由规则发送) | webhook(通用json) | telegram | dingtalk(钉钉机器人) | wecom(企业微信机器人)
+type NotifyChannelConfig struct {
+	Name     string `xml:"name"`     // 渠道名称, 唯一
+	Type     string `xml:"type"`     // 渠道类型
+	Enable   bool   `xml:"enable"`   // 是否默认开启, 可以在后台临时开关
+	URL      string `xml:"url"`      // webhook地址; telegram为API地址, 默认 https://api.telegram.org
+	Token    string `xml:"token"`    // telegram的机器人token
+	ChatID   string `xml:"chat_id"`  // telegram的chat_id
+	Secret   string `xml:"secret"`   // 钉钉机器人的加签密钥; 通用webhook的签名密钥
+	Template string `xml:"template"` // 通知内容的模板(text/template), 为空时使用默认模板
+}
+
+// 消息通知的配置, 没有配置任何渠道时默认使用email渠道
+type notifyConfig struct {
+	Channels []NotifyChannelConfig `xml:"notify_channel"`
+	Retry    int                   `xml:"notify_retry"`   // 发送失败后的重试次数, 默认3
+	Timeout  int64                 `xml:"notify_timeout"` // 单次发送的超时(秒), 默认10
+	Digest   int64                 `xml:"notify_digest"`  // 合并通知的间隔(分钟), 间隔内的消息合并为一条通知, 默认0即每条消息立即通知
+}
+
+// callDriver的反垃圾配置, 数量限制为0时使用默认值, 小于0时不限制
+type antiSpamConfig struct {
+	Window         int64    `xml:"spam_window"`          // 发送次数的统计窗口(秒), 默认600
+	IPLimit        int      `xml:"spam_ip_limit"`        // 窗口内每个ip最多发送的消息数, 默认30
+	VisitorLimit   int      `xml:"spam_visitor_limit"`   // 窗口内每个访客最多发送的消息数, 默认20
+	ChallengeAfter int      `xml:"spam_challenge_after"` // 窗口内发送的消息数达到该数量后需要先完成工作量证明, 默认5
+	PowBits        int      `xml:"spam_pow_bits"`        // 工作量证明要求哈希值的前导零比特数, 默认16
+	DupWindow      int64    `xml:"spam_dup_window"`      // 拒绝重复消息的窗口(秒), 默认3600
+	Keywords       []string `xml:"spam_keyword"`         // 包含这些关键词(不区分大小写)的消息进入审核队列
+	BlockDomains   []string `xml:"spam_block_domain"`    // 包含这些域名(及其子域名)链接的消息进入审核队列
+	HoldURL        bool     `xml:"spam_hold_url"`        // 包含任何链接的消息都进入审核队列
+}
+
+// codeMaster的用户账号配置
+type codeMasterConfig struct {
+	SessionSecret string `xml:"cm_session_secret"`  // 签名登录cookie的密钥, 为空时每次启动随机生成, 重启后需要重新登录
+	SessionDays   int64  `xml:"cm_session_days"`    // 登录的有效天数, 默认30
+	AvatarMaxSize int64  `xml:"cm_avatar_max_size"` // 上传头像的大小上限(KB), 默认2048
+	LoginLimit    int    `xml:"cm_login_limit"`     // 每个ip在10分钟内最多失败的登录次数, 默认10
+	Register      string `xml:"cm_register"`        // 是否开放注册: open(默认) | close
+}
+
 type databaseConfig struct {
 	UseMongo    bool   `xml:"useMongo"`    // 是否链接mongo数据库
 	MongoURL    string `xml:"mongoUrl"`    // 链接mongoDB的URI
@@ -37,27 +171,155 @@ type databaseConfig struct {
 var MailConfig mailConfig
 var ServerConfig serverConfig
 var DataBaseConfig databaseConfig
+var QuotaConfig quotaConfig
+var StorageConfig storageConfig
+var WebdavConfig webdavConfig
+var ScanConfig scanConfig
+var CallDriverConfig callDriverConfig
+var NotifyConfig notifyConfig
+var AntiSpamConfig antiSpamConfig
+var CodeMasterConfig codeMasterConfig
 
 func init() {
-	xmlFile, err := os.Open("./config/config.xml")
+	b, err := ioutil.ReadFile("./config/config.xml")
 	if err != nil {
 		logs.Critical("Error opening config file: %v", err)
 		os.Exit(1)
 		return
 	}
-	defer xmlFile.Close()
-
-	b, _ := ioutil.ReadAll(xmlFile)
 	xml.Unmarshal(b, &MailConfig)
 	xml.Unmarshal(b, &ServerConfig)
 	xml.Unmarshal(b, &DataBaseConfig)
+	xml.Unmarshal(b, &QuotaConfig)
+	xml.Unmarshal(b, &StorageConfig)
+	xml.Unmarshal(b, &WebdavConfig)
+	xml.Unmarshal(b, &ScanConfig)
+	xml.Unmarshal(b, &CallDriverConfig)
+	xml.Unmarshal(b, &NotifyConfig)
+	xml.Unmarshal(b, &AntiSpamConfig)
+	xml.Unmarshal(b, &CodeMasterConfig)
 
 	// 一些检查和修正
 	ServerConfig.StaticPath = strings.TrimRight(ServerConfig.StaticPath, "/") + "/"
 	ServerConfig.ServerURL = strings.TrimRight(ServerConfig.ServerURL, "/")
+	if QuotaConfig.ArchiveMaxSize <= 0 {
+		QuotaConfig.ArchiveMaxSize = 1024
+	}
+	if QuotaConfig.ArchiveMaxEntries <= 0 {
+		QuotaConfig.ArchiveMaxEntries = 1000
+	}
+	if QuotaConfig.ShareIPSessions <= 0 {
+		QuotaConfig.ShareIPSessions = 5
+	}
+	if StorageConfig.Driver == "" {
+		StorageConfig.Driver = "local"
+	}
+	if StorageConfig.PresignExpire <= 0 {
+		StorageConfig.PresignExpire = 600
+	}
+	if MailConfig.FromName == "" {
+		MailConfig.FromName = "CallDriver"
+	}
+	if MailConfig.Workers <= 0 {
+		MailConfig.Workers = 2
+	}
+	if MailConfig.Retry <= 0 {
+		MailConfig.Retry = 5
+	}
+	if MailConfig.RetryDelay <= 0 {
+		MailConfig.RetryDelay = 30
+	}
+	if MailConfig.IdleTimeout <= 0 {
+		MailConfig.IdleTimeout = 30
+	}
+	if MailConfig.LogDays <= 0 {
+		MailConfig.LogDays = 30
+	}
+	if len(MailConfig.Recipients) == 0 && MailConfig.MailTo != "" {
+		MailConfig.Recipients = []MailRecipientConfig{{Name: "me", Address: MailConfig.MailTo}}
+	}
+	if len(MailConfig.Routes) == 0 {
+		MailConfig.Routes = []MailRouteConfig{{Event: "*"}}
+	}
+	if MailConfig.Digest <= 0 {
+		MailConfig.Digest = 60
+	}
+	if WebdavConfig.AuthLimit <= 0 {
+		WebdavConfig.AuthLimit = 10
+	}
+	if ScanConfig.Timeout <= 0 {
+		ScanConfig.Timeout = 60
+	}
+	if NotifyConfig.Retry <= 0 {
+		NotifyConfig.Retry = 3
+	}
+	if NotifyConfig.Timeout <= 0 {
+		NotifyConfig.Timeout = 10
+	}
+	if len(NotifyConfig.Channels) == 0 {
+		NotifyConfig.Channels = []NotifyChannelConfig{{Name: "email", Type: "email", Enable: true}}
+	}
+	if CallDriverConfig.AttachMaxSize <= 0 {
+		CallDriverConfig.AttachMaxSize = 5120
+	}
+	if CallDriverConfig.AttachMaxCount <= 0 {
+		CallDriverConfig.AttachMaxCount = 4
+	}
+	if CallDriverConfig.RetentionMode != "delete" {
+		CallDriverConfig.RetentionMode = "archive"
+	}
+	if AntiSpamConfig.Window <= 0 {
+		AntiSpamConfig.Window = 600
+	}
+	if AntiSpamConfig.IPLimit == 0 {
+		AntiSpamConfig.IPLimit = 30
+	}
+	if AntiSpamConfig.VisitorLimit == 0 {
+		AntiSpamConfig.VisitorLimit = 20
+	}
+	if AntiSpamConfig.ChallengeAfter == 0 {
+		AntiSpamConfig.ChallengeAfter = 5
+	}
+	if AntiSpamConfig.PowBits <= 0 {
+		AntiSpamConfig.PowBits = 16
+	}
+	if AntiSpamConfig.DupWindow <= 0 {
+		AntiSpamConfig.DupWindow = 3600
+	}
+	if CodeMasterConfig.SessionDays <= 0 {
+		CodeMasterConfig.SessionDays = 30
+	}
+	if CodeMasterConfig.AvatarMaxSize <= 0 {
+		CodeMasterConfig.AvatarMaxSize = 2048
+	}
+	if CodeMasterConfig.LoginLimit <= 0 {
+		CodeMasterConfig.LoginLimit = 10
+	}
+	if CodeMasterConfig.Register != "close" {
+		CodeMasterConfig.Register = "open"
+	}
+	if key := os.Getenv("SS_MASTER_KEY"); key != "" {
+		StorageConfig.MasterKey = key
+	}
 
 	logs.Info("MailConfig: %+v", MailConfig)
 	logs.Info("ServerConfig: %+v", ServerConfig)
 	logs.Info("DataBaseConfig: %+v", DataBaseConfig)
+	logs.Info("QuotaConfig: %+v", QuotaConfig)
+	logs.Info("StorageConfig: driver=%s endpoint=%s bucket=%s encrypt=%v", StorageConfig.Driver, StorageConfig.S3Endpoint, StorageConfig.S3Bucket, StorageConfig.EncryptAtRest)
+	logs.Info("WebdavConfig: user=%s authLimit=%d", WebdavConfig.User, WebdavConfig.AuthLimit)
+	logs.Info("ScanConfig: %+v", ScanConfig)
+	logs.Info("CallDriverConfig: visitorSecret=%v replyAddress=%s replyListen=%s mailVisitor=%v attachMaxSize=%d attachMaxCount=%d attachTypes=%v retentionDays=%d retentionMode=%s",
+		CallDriverConfig.VisitorSecret != "", CallDriverConfig.ReplyAddress, CallDriverConfig.ReplyListen, CallDriverConfig.MailVisitor,
+		CallDriverConfig.AttachMaxSize, CallDriverConfig.AttachMaxCount, CallDriverConfig.AttachTypes,
+		CallDriverConfig.RetentionDays, CallDriverConfig.RetentionMode)
+	logs.Info("NotifyConfig: retry=%d timeout=%d digest=%d", NotifyConfig.Retry, NotifyConfig.Timeout, NotifyConfig.Digest)
+	logs.Info("AntiSpamConfig: %+v", AntiSpamConfig)
+	logs.Info("CodeMasterConfig: sessionSecret=%v sessionDays=%d avatarMaxSize=%d loginLimit=%d register=%s",
+		CodeMasterConfig.SessionSecret != "", CodeMasterConfig.SessionDays, CodeMasterConfig.AvatarMaxSize,
+		CodeMasterConfig.LoginLimit, CodeMasterConfig.Register)
+	for _, c := range NotifyConfig.Channels {
+		logs.Info("NotifyChannel: name=%s type=%s enable=%v", c.Name, c.Type, c.Enable)
+	}
 	logs.Info("config init success...")
 }
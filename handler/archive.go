@@ -0,0 +1,368 @@
+package handler
+
+// 个人网盘的压缩包功能: 将选中的文件或整个目录打包下载, 以及上传压缩包并在服务端解压
+// 打包时直接写入响应不产生临时文件; 解压前先完整检查一遍压缩包, 防止路径穿越(zip-slip)以及超出大小和数量限制
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"../config"
+	tb "../toolbox"
+	"github.com/astaxie/beego/logs"
+)
+
+// 本身已压缩过的文件类型, 打包为zip时不再压缩
+var compressedExts = map[string]bool{
+	".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".webp": true,
+	".mp3": true, ".mp4": true, ".mkv": true, ".mov": true, ".webm": true,
+	".zip": true, ".gz": true, ".tgz": true, ".rar": true, ".7z": true, ".xz": true, ".bz2": true,
+}
+
+var errBadArchiveEntry = errors.New("bad archive entry name")
+
+// 压缩包中的一个条目
+type archiveEntry struct {
+	Name      string
+	Size      int64
+	IsDir     bool
+	IsRegular bool // 是否为普通文件, 符号链接等其他类型会被忽略
+	Open      func() (io.ReadCloser, error)
+}
+
+// 服务端工具-个人网盘：将多个文件或一个目录打包下载
+// format: zip|tar.gz; folder不为空时打包整个目录, 否则打包所有fileNames参数指定的文件
+// Example: /bsapi/tool/netdish/archive/download?format=zip&fileNames=a.txt&fileNames=doc/b.md
+func netDishArchiveDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	var err error
+	var resp respStruct
+	for loop := true; loop; loop = false {
+		r.ParseForm()
+		format := r.Form.Get("format")
+		folder := strings.Trim(r.Form.Get("folder"), "/")
+		fileNames := r.Form["fileNames"]
+		if format != "zip" && format != "tar.gz" {
+			err = fmt.Errorf("unexpect format: format=%q", format)
+			break
+		}
+		var files []storedFile
+		var entryNames []string
+		files, entryNames, err = collectArchiveFiles(folder, fileNames)
+		if err != nil {
+			break
+		}
+		archiveName := fmt.Sprintf("netdish_%s.%s", time.Now().Format("20060102150405"), format)
+		if folder != "" {
+			archiveName = fmt.Sprintf("%s.%s", path.Base(folder), format)
+		}
+		logs.Info("netdish archive download: name=%s files=%d", archiveName, len(files))
+		w.Header().Set("content-disposition", tb.ContentDisposition("attachment", archiveName))
+		if format == "zip" {
+			w.Header().Set("Content-Type", "application/zip")
+			err = writeZipArchive(w, files, entryNames)
+		} else {
+			w.Header().Set("Content-Type", "application/gzip")
+			err = writeTarGzArchive(w, files, entryNames)
+		}
+		// 响应已开始写入, 出错时只能记录日志
+		if err != nil {
+			logs.Error("write archive failed: name=%s error=%v", archiveName, err)
+		}
+		return
+	}
+	logs.Error("netdish archive download failed: error=%v form=%v", err, r.Form)
+	resp.Status = -1
+	resp.Msg = fmt.Sprint(err)
+	responseJson(&w, resp)
+}
+
+// 服务端工具-个人网盘：上传一个zip/tar.gz/tar压缩包并解压到folder目录
+// overwrite为true时覆盖同名文件, 否则跳过
+func netDishArchiveUploadHandler(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Files   []string `json:"files"`   // 解压出的文件
+		Skipped []string `json:"skipped"` // 因同名而跳过的文件
+	}
+	var err error
+	var resp respStruct
+	for loop := true; loop; loop = false {
+		err = r.ParseMultipartForm(5 << 20)
+		if err != nil {
+			logs.Error("Parse form fail: err=%v", err)
+			break
+		}
+		folder := strings.Trim(r.FormValue("folder"), "/")
+		overwrite := r.FormValue("overwrite") == "true"
+		if _, err = staticFS.Resolve(folder); err != nil {
+			break
+		}
+		var header *multipart.FileHeader
+		for _, files := range r.MultipartForm.File {
+			if len(files) == 1 && header == nil {
+				header = files[0]
+				continue
+			}
+			err = errors.New("only one archive file is allowed")
+		}
+		if err != nil {
+			break
+		}
+		if header == nil {
+			err = errors.New("archive file not found")
+			break
+		}
+		var file multipart.File
+		file, err = header.Open()
+		if err != nil {
+			break
+		}
+		defer file.Close()
+		logs.Info("netdish archive upload: name=%s size=%d folder=%s", header.Filename, header.Size, folder)
+
+		// 第一遍只检查文件名、数量以及解压后的总大小
+		var total int64
+		var count int
+		err = walkArchive(file, header.Size, header.Filename, func(e archiveEntry) error {
+			if e.IsDir || !e.IsRegular { // 目录会在写入文件时自动创建
+				return nil
+			}
+			if _, err := archiveTargetName(folder, e.Name); err != nil {
+				return err
+			}
+			count++
+			total += e.Size
+			if count > config.QuotaConfig.ArchiveMaxEntries {
+				return fmt.Errorf("too many files in archive: limit=%d", config.QuotaConfig.ArchiveMaxEntries)
+			}
+			if total > config.QuotaConfig.ArchiveMaxSize<<20 {
+				return fmt.Errorf("archive too large after extract: limit=%dMB", config.QuotaConfig.ArchiveMaxSize)
+			}
+			return nil
+		})
+		if err != nil {
+			break
+		}
+		var release func()
+		release, err = reserveSpace(areaNetdish, total, "")
+		if err != nil {
+			break
+		}
+		defer release()
+
+		// 第二遍解压, 每个文件最多读取其声明的大小
+		err = walkArchive(file, header.Size, header.Filename, func(e archiveEntry) error {
+			if e.IsDir || !e.IsRegular {
+				return nil
+			}
+			target, _ := archiveTargetName(folder, e.Name)
+			reader, err := e.Open()
+			if err != nil {
+				return err
+			}
+			defer reader.Close()
+			limited := &io.LimitedReader{R: reader, N: e.Size + 1}
+			_, size, err := saveStoredFile(target, areaNetdish, limited, overwrite)
+			if err == errFileExist {
+				payload.Skipped = append(payload.Skipped, target)
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if size > e.Size {
+				removeStoredFile(target)
+				return fmt.Errorf("archive entry larger than declared: name=%s", e.Name)
+			}
+			payload.Files = append(payload.Files, target)
+			return nil
+		})
+		logs.Info("netdish archive extracted: name=%s files=%d skipped=%d error=%v",
+			header.Filename, len(payload.Files), len(payload.Skipped), err)
+		resp.PayLoad = payload
+	}
+	if err != nil {
+		logs.Error("netdish archive upload failed: error=%v", err)
+		resp.Status = -1
+		resp.Msg = fmt.Sprint(err)
+	}
+	responseJson(&w, resp)
+}
+
+// 获取需要打包的文件以及它们在压缩包中的名字
+// 打包目录时以目录名作为压缩包内的顶层目录, 打包选中的文件时保留其相对路径
+func collectArchiveFiles(folder string, fileNames []string) ([]storedFile, []string, error) {
+	files := make([]storedFile, 0)
+	entryNames := make([]string, 0)
+	if folder != "" {
+		all, err := findStoredFiles("", folder+"/", "", 0)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, f := range all {
+			files = append(files, f)
+			entryNames = append(entryNames, path.Join(path.Base(folder), strings.TrimPrefix(f.Name, folder+"/")))
+		}
+	} else {
+		for _, name := range fileNames {
+			info, err := statStoredFile(name)
+			if err != nil {
+				return nil, nil, fmt.Errorf("file not found: name=%s error=%v", name, err)
+			}
+			files = append(files, *info)
+			entryNames = append(entryNames, name)
+		}
+	}
+	if len(files) == 0 {
+		return nil, nil, errors.New("no file to archive")
+	}
+	return files, entryNames, nil
+}
+
+// 将文件打包为zip写入w
+func writeZipArchive(w io.Writer, files []storedFile, entryNames []string) error {
+	zw := zip.NewWriter(w)
+	for i, f := range files {
+		header := &zip.FileHeader{
+			Name:     entryNames[i],
+			Method:   zip.Deflate,
+			Modified: time.Unix(f.Timestamp, 0),
+		}
+		if compressedExts[strings.ToLower(path.Ext(f.Name))] {
+			header.Method = zip.Store
+		}
+		writer, err := zw.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+		if err = copyStoredFile(writer, f.Name); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// 将文件打包为tar.gz写入w
+func writeTarGzArchive(w io.Writer, files []storedFile, entryNames []string) error {
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+	for i, f := range files {
+		err := tw.WriteHeader(&tar.Header{
+			Name:     entryNames[i],
+			Mode:     0644,
+			Size:     f.Size,
+			ModTime:  time.Unix(f.Timestamp, 0),
+			Typeflag: tar.TypeReg,
+		})
+		if err != nil {
+			return err
+		}
+		if err = copyStoredFile(tw, f.Name); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+// 将StaticPath下文件的内容写入w
+func copyStoredFile(w io.Writer, name string) error {
+	reader, err := openStoredFile(name)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	_, err = io.Copy(w, reader)
+	return err
+}
+
+// 遍历压缩包中的条目, 根据文件名后缀判断格式
+func walkArchive(file multipart.File, size int64, fileName string, fn func(e archiveEntry) error) error {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	lowerName := strings.ToLower(fileName)
+	switch {
+	case strings.HasSuffix(lowerName, ".zip"):
+		zr, err := zip.NewReader(file, size)
+		if err != nil {
+			return err
+		}
+		for _, f := range zr.File {
+			err = fn(archiveEntry{
+				Name:      f.Name,
+				Size:      int64(f.UncompressedSize64),
+				IsDir:     f.FileInfo().IsDir(),
+				IsRegular: f.Mode().IsRegular(),
+				Open:      f.Open,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case strings.HasSuffix(lowerName, ".tar.gz"), strings.HasSuffix(lowerName, ".tgz"), strings.HasSuffix(lowerName, ".tar"):
+		var reader io.Reader = file
+		if !strings.HasSuffix(lowerName, ".tar") {
+			gr, err := gzip.NewReader(file)
+			if err != nil {
+				return err
+			}
+			defer gr.Close()
+			reader = gr
+		}
+		tr := tar.NewReader(reader)
+		for {
+			header, err := tr.Next()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			err = fn(archiveEntry{
+				Name:      header.Name,
+				Size:      header.Size,
+				IsDir:     header.Typeflag == tar.TypeDir,
+				IsRegular: header.FileInfo().Mode().IsRegular(),
+				Open:      func() (io.ReadCloser, error) { return ioutil.NopCloser(tr), nil },
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return fmt.Errorf("unsupported archive format: name=%s", fileName)
+}
+
+// 计算压缩包条目解压后的路径, 拒绝绝对路径、'..'以及会落到保留目录的条目
+// 同样拒绝与匿名上传或聊天附件同名的条目, 这些文件属于其他区域且保存前需要扫描病毒
+func archiveTargetName(folder string, entryName string) (string, error) {
+	name := strings.TrimPrefix(entryName, "./")
+	if name == "" || strings.HasPrefix(name, "/") || strings.ContainsAny(name, "\\\x00") {
+		return "", fmt.Errorf("%v: %q", errBadArchiveEntry, entryName)
+	}
+	for _, seg := range strings.Split(name, "/") {
+		if seg == ".." {
+			return "", fmt.Errorf("%v: %q", errBadArchiveEntry, entryName)
+		}
+	}
+	target := path.Join(folder, path.Clean(name))
+	if shareFileReg.MatchString(target) || chatFileReg.MatchString(target) {
+		return "", fmt.Errorf("%v: %q", errBadArchiveEntry, entryName)
+	}
+	if _, err := staticFS.Resolve(target); err != nil {
+		return "", fmt.Errorf("%v: %q error=%v", errBadArchiveEntry, entryName, err)
+	}
+	return target, nil
+}
@@ -5,21 +5,24 @@ import (
 	"bufio"
 	"encoding/json"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"mime/multipart"
 	"net"
 	"net/http"
 	"os"
 	"os/exec"
+	"path"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	"../toolbox"
 
 	"errors"
 
 	"../config"
+	"../model"
 	"../rpc"
 
 	"github.com/astaxie/beego/logs"
@@ -38,6 +41,16 @@ func BossAPIHandler(w http.ResponseWriter, r *http.Request) {
 		netDishFileOpeHandler(w, r)
 	case "bsapi/tool/netdish/upload":
 		netDishFileUploadHandler(w, r)
+	case "bsapi/tool/netdish/archive/download":
+		netDishArchiveDownloadHandler(w, r)
+	case "bsapi/tool/netdish/archive/upload":
+		netDishArchiveUploadHandler(w, r)
+	case "bsapi/tool/storage/usage":
+		storageUsageHandler(w, r)
+	case "bsapi/tool/share/list":
+		shareUploadListHandler(w, r)
+	case "bsapi/tool/share/ope":
+		shareUploadOpeHandler(w, r)
 	case "bsapi/manage/ipWhiteList/list":
 		ipWhitelistHandler(w, r)
 	case "bsapi/manage/ipWhiteList/ope":
@@ -46,6 +59,16 @@ func BossAPIHandler(w http.ResponseWriter, r *http.Request) {
 		systemSettingHandler(w, r)
 	case "bsapi/manage/systemSetting/status":
 		getSystemStting(w, r)
+	case "bsapi/manage/notify/list":
+		notifyChannelListHandler(w, r)
+	case "bsapi/manage/notify/ope":
+		notifyChannelOpeHandler(w, r)
+	case "bsapi/manage/mail/list":
+		mailLogHandler(w, r)
+	case "bsapi/manage/mail/ope":
+		mailOpeHandler(w, r)
+	case "bsapi/manage/mail/recipients":
+		mailRecipientsHandler(w, r)
 	case "bsapi/monitor/rpc/overview":
 		getRpcOverview(w, r)
 	case "bsapi/monitor/rpc/ope":
@@ -100,22 +123,23 @@ func netDishListFilesHandler(w http.ResponseWriter, r *http.Request) {
 			Name      string `json:"fileName"`
 			Size      int64  `json:"size"`
 			Timestamp int64  `json:"timestamp"`
+			IsDir     bool   `json:"isDir"`
 		}
+		// dir为要列出的目录, 为空时列出根目录
+		dir := r.URL.Query().Get("dir")
 		var payLoad []fileInfo
-		var filesInfos []os.FileInfo
-		filesInfos, err = ioutil.ReadDir(config.ServerConfig.StaticPath)
+		var entries []storedEntry
+		entries, err = listStoredDir(dir)
 		if err != nil {
-			logs.Error("Read dir fail: path=%s error=%v", config.ServerConfig.StaticPath, err)
+			logs.Error("Read dir fail: dir=%s error=%v", dir, err)
 			break
 		}
-		for _, info := range filesInfos {
-			if info.IsDir() {
-				continue
-			}
+		for _, f := range entries {
 			payLoad = append(payLoad, fileInfo{
-				Name:      info.Name(),
-				Size:      info.Size(),
-				Timestamp: info.ModTime().Unix(),
+				Name:      f.Name,
+				Size:      f.Size,
+				Timestamp: f.Timestamp,
+				IsDir:     f.IsDir,
 			})
 		}
 		resp.PayLoad = payLoad
@@ -145,25 +169,23 @@ func netDishFileOpeHandler(w http.ResponseWriter, r *http.Request) {
 			err = fmt.Errorf("unexpect opeType: req=%+v", req)
 			break
 		}
-		targetPath := config.ServerConfig.StaticPath + req.FileName
-		var info os.FileInfo
-		info, err = os.Stat(targetPath)
+		var info *storedFile
+		info, err = statStoredFile(req.FileName)
 		if err != nil {
 			break
 		}
-		if info.IsDir() {
-			err = fmt.Errorf("can't delete a floder: req=%+v", req)
-			break
-		}
 		// 提供文件下载
 		if req.OpeType == "download" {
-			logs.Info("netdish download file: path=%s", targetPath)
-			toolbox.ServerFile2(&w, targetPath)
+			logs.Info("netdish download file: name=%s", req.FileName)
+			err = serveStoredFile(w, r, req.FileName, path.Base(req.FileName), false)
+			if err != nil {
+				logs.Error("netdish download failed: name=%s error=%v", req.FileName, err)
+			}
 			return
 		}
 		// 删除指定文件
-		err = os.Remove(targetPath)
-		logs.Info("netdish remove file: path=%s info=%+v error=%v", targetPath, info, err)
+		err = removeStoredFile(req.FileName)
+		logs.Info("netdish remove file: info=%+v error=%v", info, err)
 	}
 	if err != nil {
 		logs.Error("fail to handle: error=%v req=%+v", err, req)
@@ -202,21 +224,19 @@ func netDishFileUploadHandler(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 			defer file.Close()
-			filePath := config.ServerConfig.StaticPath + v.Filename
-			_, err = os.Stat(filePath)
-			if err == nil {
-				err = fmt.Errorf("name already exist: %s", v.Filename)
-				return
-			}
-			var cur *os.File
-			cur, err = os.Create(filePath)
+			filePath := v.Filename
+			var release func()
+			release, err = reserveSpace(areaNetdish, v.Size, "")
 			if err != nil {
-				logs.Error("create file fial:　err=%v path=%s", err, filePath)
 				return
 			}
-			defer cur.Close()
 			var size int64
-			size, err = io.Copy(cur, file)
+			_, size, err = saveStoredFile(filePath, areaNetdish, file, false)
+			release()
+			if err == errFileExist {
+				err = fmt.Errorf("name already exist: %s", v.Filename)
+				return
+			}
 			if err != nil {
 				logs.Error("save file fail: err=%v path=%s size=%d", err, filePath, size)
 				return
@@ -228,6 +248,143 @@ func netDishFileUploadHandler(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
+// 服务端工具-存储统计：各区域的占用和配额，以及最大和最旧的文件
+func storageUsageHandler(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Areas   []areaUsage  `json:"areas"`
+		Largest []storedFile `json:"largest"`
+		Oldest  []storedFile `json:"oldest"`
+	}
+	var resp respStruct
+	var err error
+	for loop := true; loop; loop = false {
+		topN := 10
+		if payload.Areas, err = getAreaUsage(); err != nil {
+			break
+		}
+		if payload.Largest, err = findStoredFiles("", "", "-size", topN); err != nil {
+			break
+		}
+		if payload.Oldest, err = findStoredFiles("", "", "timeStamp", topN); err != nil {
+			break
+		}
+		resp.PayLoad = payload
+	}
+	if err != nil {
+		logs.Error("get storage usage failed: error=%v", err)
+		resp.Status = -1
+		resp.Msg = fmt.Sprint(err)
+	}
+	responseJson(&w, resp)
+}
+
+// 服务端工具-匿名上传：列出static服务收到的全部文件
+func shareUploadListHandler(w http.ResponseWriter, r *http.Request) {
+	type uploadInfo struct {
+		Code          string `json:"code"`
+		FileName      string `json:"fileName"` // 上传时的文件名
+		Size          int64  `json:"size"`
+		IP            string `json:"ip"`
+		Timestamp     int64  `json:"timestamp"`
+		ExpireAt      int64  `json:"expireAt"`
+		DownloadCount int64  `json:"downloadCount"`
+		LastAccess    int64  `json:"lastAccess"`
+		Exist         bool   `json:"exist"` // 文件是否还存在, 可能已因配额被淘汰或被隔离
+		ScanStatus    string `json:"scanStatus"`
+		ScanResult    string `json:"scanResult"`
+	}
+	var resp respStruct
+	var err error
+	for loop := true; loop; loop = false {
+		var records []model.FileUpload
+		records, err = model.GetAllUploadRecords()
+		if err != nil {
+			break
+		}
+		payload := make([]uploadInfo, 0, len(records))
+		for _, record := range records {
+			_, statErr := statStoredFile(record.Code + ".tmp")
+			payload = append(payload, uploadInfo{
+				Code:          record.Code,
+				FileName:      record.FileName,
+				Size:          record.Size,
+				IP:            record.IP,
+				Timestamp:     record.TimeStamp,
+				ExpireAt:      record.ExpireAt,
+				DownloadCount: record.DownloadCount,
+				LastAccess:    record.LastAccess,
+				Exist:         statErr == nil,
+				ScanStatus:    record.ScanStatus,
+				ScanResult:    record.ScanResult,
+			})
+		}
+		resp.PayLoad = payload
+	}
+	if err != nil {
+		logs.Error("list share uploads failed: error=%v", err)
+		resp.Status = -1
+		resp.Msg = fmt.Sprint(err)
+	}
+	responseJson(&w, resp)
+}
+
+// 服务端工具-匿名上传：撤销(删除)、延长有效期或放行被隔离的文件
+// opeType=revoke 删除文件及上传记录; opeType=extend 将有效期延长hours小时, hours为0时设为永不过期
+// opeType=release 将因病毒扫描被隔离的文件恢复为可下载
+func shareUploadOpeHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		OpeType string `json:"opeType"`
+		Code    string `json:"code"`
+		Hours   string `json:"hours"`
+	}
+	var resp respStruct
+	var err error
+	for loop := true; loop; loop = false {
+		err = toolbox.MustQueryFromRequest(r, &req)
+		if err != nil {
+			logs.Error("parse params fail: url=%s error=%v", r.URL, err)
+			break
+		}
+		var record model.FileUpload
+		record, err = model.GetUploadRecord(req.Code)
+		if err != nil {
+			break
+		}
+		switch req.OpeType {
+		case "revoke":
+			err = removeShareUpload(req.Code)
+		case "extend":
+			var hours int64
+			hours, err = strconv.ParseInt(req.Hours, 10, 64)
+			if err != nil || hours < 0 {
+				err = fmt.Errorf("unexpect hours: %q", req.Hours)
+				break
+			}
+			var expireAt int64
+			if hours > 0 {
+				base := time.Now().Unix()
+				if record.ExpireAt > base {
+					base = record.ExpireAt
+				}
+				expireAt = base + hours*3600
+			}
+			err = model.UpdateUploadExpire(req.Code, expireAt)
+			resp.PayLoad = expireAt
+		case "release":
+			err = releaseShareUpload(&record)
+		default:
+			err = fmt.Errorf("unexpect opeType: req=%+v", req)
+		}
+		logs.Info("share upload ope: req=%+v error=%v", req, err)
+	}
+	if err != nil {
+		logs.Error("fail to handle: error=%v req=%+v", err, req)
+		resp.Status = -1
+		resp.Msg = fmt.Sprint(err)
+	}
+	responseJson(&w, resp)
+}
+
 // 服务端配置-IP白名单配置:获取ip标记列表
 func ipWhitelistHandler(w http.ResponseWriter, r *http.Request) {
 	type payLoadStruct struct {
@@ -299,7 +456,7 @@ func getSystemStting(w http.ResponseWriter, r *http.Request) {
 		ServerStartTime int64 `json:"serverStartTime"`
 	}
 
-	payload.CallDriverEmail = sendCallDriverEmail
+	payload.CallDriverEmail = notifyTypeEnabled("email")
 	payload.AlertEmail = sendAlertEmail
 	payload.ServerStartTime = serverStartTime
 
@@ -336,11 +493,11 @@ func systemSettingHandler(w http.ResponseWriter, r *http.Request) {
 			} else {
 				logs.Info("exec success...")
 			}
-		case "callDriverEmail": // 更新配置参数sendCallDriverEmail
+		case "callDriverEmail": // 开关callDriver的email通知渠道
 			if req.Params == "true" {
-				sendCallDriverEmail = true
+				err = setNotifyTypeEnable("email", true)
 			} else if req.Params == "false" {
-				sendCallDriverEmail = false
+				err = setNotifyTypeEnable("email", false)
 			} else {
 				err = fmt.Errorf("unexpect params: params=%q", req.Params)
 			}
@@ -364,6 +521,136 @@ func systemSettingHandler(w http.ResponseWriter, r *http.Request) {
 	responseJson(&w, resp)
 }
 
+// 服务端配置-消息通知: 查看所有通知渠道的开关和发送情况
+func notifyChannelListHandler(w http.ResponseWriter, r *http.Request) {
+	var resp respStruct
+	resp.PayLoad = chatNotifier.Channels()
+	responseJson(&w, resp)
+}
+
+// 服务端配置-消息通知: 开关渠道或发送一条测试通知
+// 参数: opeType为enable|disable|test, name为渠道名称; 测试通知同步发送, 失败时返回原因
+func notifyChannelOpeHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		OpeType string `json:"opeType"`
+		Name    string `json:"name"`
+	}
+	var resp respStruct
+	var err error
+	for loop := true; loop; loop = false {
+		err = toolbox.MustQueryFromRequest(r, &req)
+		if err != nil {
+			logs.Error("parse params fail: url=%s error=%v", r.URL, err)
+			break
+		}
+		switch req.OpeType {
+		case "enable":
+			err = setNotifyEnable(req.Name, true)
+		case "disable":
+			err = setNotifyEnable(req.Name, false)
+		case "test":
+			err = chatNotifier.Test(req.Name, &toolbox.Notification{
+				Event:   "test",
+				Title:   "测试通知",
+				Nick:    myName,
+				Message: "这是一条测试通知, 收到说明渠道配置正确",
+				Time:    time.Now(),
+				Link:    config.ServerConfig.ServerURL + "/callDriver/boss",
+			})
+		default:
+			err = fmt.Errorf("unexpect opeType: req=%+v", req)
+		}
+		logs.Info("notify channel ope: req=%+v error=%v", req, err)
+	}
+	if err != nil {
+		resp.Status = -1
+		resp.Msg = fmt.Sprint(err)
+	}
+	responseJson(&w, resp)
+}
+
+// 服务端配置-邮件: 按时间倒序查看邮件的发送记录
+// 参数: status为pending|sent|failed, 为空时查看全部; limit可选, 默认50
+func mailLogHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Status string `json:"status"`
+		Limit  string `json:"limit"`
+	}
+	var resp respStruct
+	var err error
+	for loop := true; loop; loop = false {
+		err = toolbox.MustQueryFromRequest(r, &req)
+		if err != nil {
+			logs.Error("parse params fail: url=%s error=%v", r.URL, err)
+			break
+		}
+		limit := 50
+		if req.Limit != "" {
+			if limit, err = strconv.Atoi(req.Limit); err != nil || limit <= 0 || limit > 500 {
+				err = fmt.Errorf("unexpect limit: %q", req.Limit)
+				break
+			}
+		}
+		var mails []*toolbox.Mail
+		var total int
+		if mails, total, err = mailer.List(req.Status, limit); err != nil {
+			break
+		}
+		resp.PayLoad = map[string]interface{}{"mails": mails, "total": total}
+	}
+	if err != nil {
+		resp.Status = -1
+		resp.Msg = fmt.Sprint(err)
+	}
+	responseJson(&w, resp)
+}
+
+// 服务端配置-邮件: 重新发送失败的邮件, 发送测试邮件或立即发送所有接收人的摘要
+// 参数: opeType为resend|test|flush, resend时id为邮件id; test时name为接收人名称, 为空时发送给所有接收人
+// 邮件异步发送, 结果在发送记录中查看
+func mailOpeHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		OpeType string `json:"opeType"`
+		ID      string `json:"id"`
+		Name    string `json:"name"`
+	}
+	var resp respStruct
+	var err error
+	for loop := true; loop; loop = false {
+		err = toolbox.MustQueryFromRequest(r, &req)
+		if err != nil {
+			logs.Error("parse params fail: url=%s error=%v", r.URL, err)
+			break
+		}
+		switch req.OpeType {
+		case "resend":
+			err = mailer.Resend(req.ID)
+		case "test":
+			var ids []string
+			if ids, err = mailRouter.Test(req.Name); err == nil {
+				resp.PayLoad = ids
+			}
+		case "flush":
+			mailRouter.Flush(true)
+		default:
+			err = fmt.Errorf("unexpect opeType: req=%+v", req)
+		}
+		logs.Info("mail ope: req=%+v error=%v", req, err)
+	}
+	if err != nil {
+		resp.Status = -1
+		resp.Msg = fmt.Sprint(err)
+	}
+	responseJson(&w, resp)
+}
+
+// 服务端配置-邮件: 查看邮件接收人的免打扰状态和摘要中等待发送的事件数
+func mailRecipientsHandler(w http.ResponseWriter, r *http.Request) {
+	var resp respStruct
+	resp.PayLoad = mailRouter.Recipients()
+	responseJson(&w, resp)
+}
+
 // 服务端监控-RPC服务状况：查看状况
 func getRpcOverview(w http.ResponseWriter, r *http.Request) {
 	var resp respStruct
@@ -4,9 +4,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/mail"
 	"strconv"
 	"strings"
-	"time"
 
 	"../config"
 	"../model"
@@ -15,13 +15,18 @@ import (
 )
 
 type paramsType struct {
-	Nick string `json:"nick"`
-	Msg  string `json:"msg"`
+	Nick  string `json:"nick"`
+	Msg   string `json:"msg"`
+	Pow   string `json:"pow"`   // 工作量证明的challenge, 需要时才传
+	Nonce string `json:"nonce"` // 工作量证明的答案
+
+	Attachments string `json:"attachments"` // 已上传的附件文件名, 逗号分隔
 }
 
 type responseType struct {
-	Status int    `json:"status"`
-	Msg    string `json:"msg"`
+	Status  int         `json:"status"`
+	Msg     string      `json:"msg"`
+	PayLoad interface{} `json:"payLoad,omitempty"`
 }
 
 type CmdType struct {
@@ -43,6 +48,18 @@ func CallDriverHandler(w http.ResponseWriter, r *http.Request) {
 		callDriverReceiveMsg(w, r)
 	case "callDriver/getHistory":
 		callDriverGetChatHistroy(w, r)
+	case "callDriver/getProfile":
+		callDriverGetProfile(w, r)
+	case "callDriver/setProfile":
+		callDriverSetProfile(w, r)
+	case "callDriver/events":
+		callDriverEvents(w, r)
+	case "callDriver/typing":
+		callDriverTyping(w, r)
+	case "callDriver/ack":
+		callDriverAck(w, r)
+	case "callDriver/upload":
+		callDriverUpload(w, r)
 	case "callDriver/boss":
 		callDriverBossHtml(w, r)
 	case "callDriver/boss/getAll":
@@ -51,8 +68,35 @@ func CallDriverHandler(w http.ResponseWriter, r *http.Request) {
 		callDriverBossReply(w, r)
 	case "callDriver/boss/control":
 		callDriverSetMail(w, r)
+	case "callDriver/boss/events":
+		callDriverBossEvents(w, r)
+	case "callDriver/boss/typing":
+		callDriverBossTyping(w, r)
+	case "callDriver/boss/ack":
+		callDriverBossAck(w, r)
+	case "callDriver/boss/inbox":
+		callDriverBossInbox(w, r)
+	case "callDriver/boss/conv":
+		callDriverBossConversation(w, r)
+	case "callDriver/boss/held":
+		callDriverBossHeld(w, r)
+	case "callDriver/boss/moderate":
+		callDriverBossModerate(w, r)
+	case "callDriver/boss/upload":
+		callDriverBossUpload(w, r)
+	case "callDriver/boss/search":
+		callDriverBossSearch(w, r)
+	case "callDriver/boss/export":
+		callDriverBossExport(w, r)
 	default:
-		NotFoundHandler(w, r)
+		// 附件和缩略图: callDriver/file/${file}, callDriver/thumb/${file}
+		if strings.HasPrefix(url, "callDriver/file/") {
+			callDriverFile(w, r, "callDriver/file/", false)
+		} else if strings.HasPrefix(url, "callDriver/thumb/") {
+			callDriverFile(w, r, "callDriver/thumb/", true)
+		} else {
+			NotFoundHandler(w, r)
+		}
 	}
 }
 
@@ -62,6 +106,7 @@ func CallDriverHtml(w http.ResponseWriter, r *http.Request) {
 }
 
 // 接受来自callDriver应用的消息，保存到数据库并发送通知邮件
+// 访客第一次发送消息时生成访客身份, nick只作为显示的昵称
 func callDriverReceiveMsg(w http.ResponseWriter, r *http.Request) {
 	var req paramsType
 	var resp responseType
@@ -71,126 +116,214 @@ func callDriverReceiveMsg(w http.ResponseWriter, r *http.Request) {
 		// 解析参数
 		err = tb.MustQueryFromRequest(r, &req)
 		if err != nil {
-			logs.Error("Parse request fail: err=%v request=%v", r)
+			logs.Error("Parse request fail: err=%v request=%v", err, r)
 			break
 		}
-		req.Nick = strings.TrimSpace(req.Nick)
 		req.Msg = strings.TrimSpace(req.Msg)
 
 		// 参数检查
-		if len(req.Nick) < 2 || len(req.Msg) < 1 {
-			resp.Status = -1
-			resp.Msg = "nick or message is too short"
+		if req.Nick, err = checkVisitorNick(req.Nick); err != nil {
 			break
 		}
-		if req.Nick == myName {
-			resp.Status = -1
-			resp.Msg = "Sorry, you can't use it nick..."
+
+		// 已关闭的会话不能再发送消息
+		visitor := getOrCreateVisitorID(w, r)
+		conv, convErr := model.FindCallDriverConversation(visitor)
+		if convErr == nil && conv.Status == model.CallDriverConvClosed {
+			err = fmt.Errorf("Sorry, this conversation has been closed...")
+			break
+		}
+		var attachments []model.CallDriverAttachment
+		if attachments, err = getChatAttachments(visitor, req.Attachments); err != nil {
+			break
+		}
+		if len(req.Msg) < 1 && len(attachments) == 0 {
+			err = fmt.Errorf("message is too short")
 			break
 		}
 
-		// 保存聊天记录
-		err = model.InsertCallDriverMessage(req.Nick, myName, req.Msg, ip)
-		if err != nil {
-			logs.Error("Save to history fail: err=%v", err)
+		// 反垃圾检查, 需要工作量证明时返回challenge
+		var challenge *chatChallenge
+		if challenge, err = checkChatSpam(ip, visitor, req.Msg+" "+req.Attachments, req.Pow, req.Nonce); err != nil {
+			if challenge != nil {
+				resp.Status = chatStatusChallenge
+				resp.PayLoad = challenge
+			}
 			break
 		}
-		// 发送邮箱通知
-		if config.ServerConfig.IsTest || !sendCallDriverEmail {
-			logs.Info("Skip send email: isTest=%s  sendCallDriverEmail=%v", config.ServerConfig.IsTest, sendCallDriverEmail)
+		// 命中关键词或链接规则的消息进入审核队列
+		if reason := chatHoldReason(req.Msg); reason != "" {
+			if err = holdChatMessage(visitor, req.Nick, req.Msg, ip, reason, attachments); err != nil {
+				break
+			}
+			recordChatDup(ip, visitor, req.Msg+" "+req.Attachments)
+			resp.Status = chatStatusHeld
+			resp.Msg = "your message is waiting for review"
 			break
 		}
-		err = tb.SendToMySelf(req.Nick, req.Msg)
+
+		// 保存聊天记录
+		var record model.CallDriverChat
+		record, err = model.InsertCallDriverMessage(visitor, myName, req.Nick, req.Msg, ip, attachments)
 		if err != nil {
-			logs.Error("Send mail fail: err=%v req=%+v", err, req)
+			logs.Error("Save to history fail: err=%v", err)
+			break
+		}
+		recordChatDup(ip, visitor, req.Msg+" "+req.Attachments)
+		doneChatAttachments(attachments)
+		if conv, err = recordChatMessage(record, true); err != nil {
+			logs.Error("Update conversation fail: err=%v", err)
 			break
 		}
-		logs.Info("Send mail success")
+		// 异步发送新消息通知
+		notifyChatMessage(record, conv)
 	}
 
-	logs.Info("hendle new message result: req=%+v err=%v", req, err)
+	logs.Info("hendle new message result: req=%+v status=%d err=%v", req, resp.Status, err)
 
 	if err != nil {
-		resp.Status = -1
+		if resp.Status == 0 {
+			resp.Status = -1
+		}
 		resp.Msg = fmt.Sprint(err)
-	} else {
-		resp.Status = 0
 	}
 	bytes, _ := json.Marshal(resp)
 	fmt.Fprintf(w, "%s", bytes)
 }
 
-// 查询聊天记录
-func callDriverGetChatHistroy(w http.ResponseWriter, r *http.Request) {
-	type reqType struct {
-		Nick string `json:"nick"`
+// 检查访客的昵称, 返回去掉首尾空白后的昵称
+func checkVisitorNick(nick string) (string, error) {
+	nick = strings.TrimSpace(nick)
+	if len(nick) < 2 {
+		return "", fmt.Errorf("nick is too short")
 	}
-	type respType struct {
-		Status   int    `json:"status"` // 当有新消息时,status=1
-		Msg      string `json:"msg"`
-		ChatHtml string `json:"chatHtml"`
+	if nick == myName {
+		return "", fmt.Errorf("Sorry, you can't use it nick...")
 	}
-	var req reqType
-	var resp respType
-	var history []model.CallDriverChat
-	var err error
+	return nick, nil
+}
 
+// 查询访客自己的聊天记录, 分页参数见findChatPage
+func callDriverGetChatHistroy(w http.ResponseWriter, r *http.Request) {
+	var resp respStruct
+	var err error
 	for loop := true; loop; loop = false {
-		// 解析参数
-		err = tb.MustQueryFromRequest(r, &req)
+		var visitor string
+		visitor, err = getVisitorID(r)
 		if err != nil {
-			logs.Error("Parse request fail: err=%v request=%v", r)
 			break
 		}
-		req.Nick = strings.TrimSpace(req.Nick)
+		resp.PayLoad, err = findChatPage(r, visitor)
+	}
+	if err != nil {
+		logs.Warn("get history failed: error=%v url=%s", err, r.URL)
+		resp.Status = -1
+		resp.Msg = fmt.Sprint(err)
+	}
+	responseJson(&w, resp)
+}
 
-		// 参数检查
-		if len(req.Nick) < 2 {
-			resp.Status = -1
-			resp.Msg = "nick or message is too short"
-			break
+// 查询访客的资料, 没有访客身份时PayLoad为空
+func callDriverGetProfile(w http.ResponseWriter, r *http.Request) {
+	var resp respStruct
+	visitor, err := getVisitorID(r)
+	if err == nil {
+		var conv model.CallDriverConversation
+		conv, err = model.FindCallDriverConversation(visitor)
+		if err == nil {
+			resp.PayLoad = map[string]interface{}{"nick": conv.Visitor, "email": conv.Email, "status": conv.Status}
 		}
-		if req.Nick == myName {
-			resp.Status = -1
-			resp.Msg = "Sorry, you can't use it nick..."
+	}
+	if err != nil && err != errNoVisitor && err != model.ErrorNoRecord {
+		logs.Warn("get profile failed: error=%v", err)
+		resp.Status = -1
+		resp.Msg = fmt.Sprint(err)
+	}
+	responseJson(&w, resp)
+}
+
+// 修改访客的昵称和邮箱, 邮箱为空时不再接收回复通知
+func callDriverSetProfile(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Nick  string `json:"nick"`
+		Email string `json:"email"`
+	}
+	var resp respStruct
+	var err error
+	for loop := true; loop; loop = false {
+		if err = tb.MustQueryFromRequest(r, &req); err != nil {
 			break
 		}
-
-		// 查询记录
-		history, err = model.FindCallDriverMessage(req.Nick, 10)
-		if err != nil || history == nil {
-			logs.Error("get history fail: err=%v len=%v", err, len(history))
+		if req.Nick, err = checkVisitorNick(req.Nick); err != nil {
 			break
 		}
-		// 生成聊条记录html代码
-		divHtml := ""
-		resp.Status = 0
-		for idx := len(history) - 1; idx >= 0; idx-- {
-			v := history[idx]
-			if v.Status == 0 && v.From != req.Nick {
-				logs.Info("add new message remark")
-				resp.Status = 1
+		req.Email = strings.TrimSpace(req.Email)
+		if req.Email != "" {
+			if _, err = mail.ParseAddress(req.Email); err != nil {
+				err = fmt.Errorf("unexpect email: %q", req.Email)
+				break
 			}
-			tstr := time.Unix(v.TimeStamp, 0).Format("01-02 15:04")
-			className := "msgNick1"
-			if v.From != req.Nick {
-				className = "msgNick2"
-			}
-			divHtml += fmt.Sprintf(`<p class="msgTime">--------------------[  %s ]--------------------</p>
-			<p class="%s">%s: <span class="msgText">%s</span></p>
-			`, tstr, className, v.From, v.Message)
 		}
-		resp.Msg = divHtml
+		var visitor string
+		if visitor, err = getVisitorID(r); err != nil {
+			break
+		}
+		var conv model.CallDriverConversation
+		if conv, err = model.UpdateCallDriverVisitor(visitor, req.Nick, req.Email); err != nil {
+			break
+		}
+		publishChatConversation(conv)
+	}
+	if err != nil {
+		logs.Warn("set profile failed: error=%v url=%s", err, r.URL)
+		resp.Status = -1
+		resp.Msg = fmt.Sprint(err)
 	}
+	responseJson(&w, resp)
+}
+
+// 访客的实时消息推送
+func callDriverEvents(w http.ResponseWriter, r *http.Request) {
+	visitor, err := getVisitorID(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, err)
+		return
+	}
+	serveChatEvents(w, r, visitor)
+}
 
-	logs.Debug("get histroy result: req=%v err=%v", req, err)
+// 访客正在输入
+func callDriverTyping(w http.ResponseWriter, r *http.Request) {
+	var resp respStruct
+	visitor, err := getVisitorID(r)
+	if err == nil {
+		publishChatTyping(visitor, false)
+	} else {
+		resp.Status = -1
+		resp.Msg = fmt.Sprint(err)
+	}
+	responseJson(&w, resp)
+}
 
+// 访客确认收到或已读Boss的消息
+func callDriverAck(w http.ResponseWriter, r *http.Request) {
+	var resp respStruct
+	var err error
+	for loop := true; loop; loop = false {
+		var visitor string
+		visitor, err = getVisitorID(r)
+		if err != nil {
+			break
+		}
+		resp.PayLoad, err = ackChatMessage(r, visitor)
+	}
 	if err != nil {
+		logs.Warn("ack message failed: error=%v url=%s", err, r.URL)
 		resp.Status = -1
 		resp.Msg = fmt.Sprint(err)
 	}
-	bytes, _ := json.Marshal(resp)
-	fmt.Fprintf(w, "%s", bytes)
+	responseJson(&w, resp)
 }
 
 //================ Boss专用，需要IP白名单权限 =========================
@@ -204,13 +337,17 @@ func callDriverBossHtml(w http.ResponseWriter, r *http.Request) {
 	assetsHandler(w, "res/html/callDriverBoss.html")
 }
 
-// Boss回复消息
+// Boss回复消息, 参数: conv为会话id, msg为回复内容, attachments为已上传的附件文件名
 func callDriverBossReply(w http.ResponseWriter, r *http.Request) {
 	if !config.ServerConfig.IsTest && !IpMonitor.IsInWhiteList(r) {
 		w.WriteHeader(http.StatusNotAcceptable)
 		return
 	}
-	var req paramsType
+	var req struct {
+		Conv        string `json:"conv"`
+		Msg         string `json:"msg"`
+		Attachments string `json:"attachments"`
+	}
 	var resp responseType
 	var err error
 	ip, _ := tb.GetIpAndPort(r)
@@ -218,22 +355,28 @@ func callDriverBossReply(w http.ResponseWriter, r *http.Request) {
 		// 解析参数
 		err = tb.MustQueryFromRequest(r, &req)
 		if err != nil {
-			logs.Error("Parse request fail: err=%v request=%v", r)
+			logs.Error("Parse request fail: err=%v request=%v", err, r)
 			break
 		}
-		req.Nick = strings.TrimSpace(req.Nick)
 		req.Msg = strings.TrimSpace(req.Msg)
 
 		// 参数检查
-		if len(req.Nick) < 2 || len(req.Msg) < 1 {
-			resp.Status = -1
-			resp.Msg = "nick or message is too short"
+		var attachments []model.CallDriverAttachment
+		if attachments, err = getChatAttachments(myName, req.Attachments); err != nil {
+			break
 		}
-
-		// 保存聊天记录
-		err = model.InsertCallDriverMessage(myName, req.Nick, req.Msg, ip)
+		if len(req.Msg) < 1 && len(attachments) == 0 {
+			err = fmt.Errorf("message is too short")
+			break
+		}
+		var conv model.CallDriverConversation
+		conv, err = model.FindCallDriverConversation(strings.TrimSpace(req.Conv))
 		if err != nil {
-			logs.Error("Save to history fail: %v", err)
+			logs.Error("Find conversation fail: err=%v conv=%s", err, req.Conv)
+			break
+		}
+
+		if err = bossReplyConversation(conv, req.Msg, ip, attachments); err != nil {
 			break
 		}
 		logs.Info("reply success")
@@ -249,53 +392,64 @@ func callDriverBossReply(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "%s", bytes)
 }
 
-// Boss查看消息
+// Boss查看消息, conv不为空时只查看该会话的记录, 分页参数见findChatPage
 func callDriverGetAllChat(w http.ResponseWriter, r *http.Request) {
 	if !config.ServerConfig.IsTest && !IpMonitor.IsInWhiteList(r) {
 		w.WriteHeader(http.StatusNotAcceptable)
 		return
 	}
-	type respType struct {
-		Status   int    `json:"status"`
-		Msg      string `json:"msg"`
-		ChatHtml string `json:"chatHtml"`
-	}
-	var resp respType
-	var history []model.CallDriverChat
+	var resp respStruct
 	var err error
+	resp.PayLoad, err = findChatPage(r, strings.TrimSpace(r.URL.Query().Get("conv")))
+	if err != nil {
+		logs.Warn("get all chat failed: error=%v url=%s", err, r.URL)
+		resp.Status = -1
+		resp.Msg = fmt.Sprint(err)
+	}
+	responseJson(&w, resp)
+}
 
-	for loop := true; loop; loop = false {
-		// 查询记录
-		history, err = model.FindAllCallDriverMessage()
-		if err != nil || history == nil {
-			logs.Error("get history fail: err=%v len=%v", err, len(history))
-			break
-		}
-		// 生成聊条记录html代码
-		divHtml := ""
-		resp.Status = 0
-		for idx := len(history) - 1; idx >= 0; idx-- {
-			v := history[idx]
-			tstr := time.Unix(v.TimeStamp, 0).Format("01-02 15:04")
-			className := "msgNick1"
-			if v.From != myName {
-				className = "msgNick2"
-			}
-			divHtml += fmt.Sprintf(`<p class="msgTime">--------------------[  %s ]--------------------</p>
-			<p class="%s">%s: <span class="msgText">%s</span></p>
-			`, tstr, className, v.From, v.Message)
-		}
-		resp.Msg = divHtml
+// Boss的实时消息推送, 包含所有访客的消息
+func callDriverBossEvents(w http.ResponseWriter, r *http.Request) {
+	if !config.ServerConfig.IsTest && !IpMonitor.IsInWhiteList(r) {
+		w.WriteHeader(http.StatusNotAcceptable)
+		return
 	}
+	serveChatEvents(w, r, "")
+}
 
-	logs.Debug("get histroy result: err=%v", err)
+// Boss正在回复某个会话, 参数conv为会话id
+func callDriverBossTyping(w http.ResponseWriter, r *http.Request) {
+	if !config.ServerConfig.IsTest && !IpMonitor.IsInWhiteList(r) {
+		w.WriteHeader(http.StatusNotAcceptable)
+		return
+	}
+	var resp respStruct
+	conv, err := model.FindCallDriverConversation(strings.TrimSpace(r.URL.Query().Get("conv")))
+	if err == nil {
+		publishChatTyping(conv.ID, true)
+	} else {
+		resp.Status = -1
+		resp.Msg = fmt.Sprint(err)
+	}
+	responseJson(&w, resp)
+}
 
+// Boss确认收到或已读访客的消息
+func callDriverBossAck(w http.ResponseWriter, r *http.Request) {
+	if !config.ServerConfig.IsTest && !IpMonitor.IsInWhiteList(r) {
+		w.WriteHeader(http.StatusNotAcceptable)
+		return
+	}
+	var resp respStruct
+	var err error
+	resp.PayLoad, err = ackChatMessage(r, myName)
 	if err != nil {
+		logs.Warn("boss ack message failed: error=%v url=%s", err, r.URL)
 		resp.Status = -1
 		resp.Msg = fmt.Sprint(err)
 	}
-	bytes, _ := json.Marshal(resp)
-	fmt.Fprintf(w, "%s", bytes)
+	responseJson(&w, resp)
 }
 
 // 其他相关控制
@@ -315,12 +469,11 @@ func callDriverSetMail(w http.ResponseWriter, r *http.Request) {
 			break
 		}
 		switch req.Key {
-		case "sendMail": // 控制是否发送邮件
+		case "sendMail": // 控制是否发送邮件, 即开关所有email类型的通知渠道
 			var sendOrNot bool
 			sendOrNot, err = strconv.ParseBool(req.Value)
 			if err == nil {
-				logs.Info("Email config change: sendCallDriverEmail=%v", sendOrNot)
-				sendCallDriverEmail = sendOrNot
+				err = setNotifyTypeEnable("email", sendOrNot)
 			}
 
 		default:
@@ -0,0 +1,363 @@
+package handler
+
+// callDriver的聊天附件: 访客和Boss先上传文件得到附件信息, 发送消息时带上附件的文件名
+// 附件保存在StaticPath的callDriver目录下, 只能由会话双方通过callDriver/file和callDriver/thumb访问
+// 上传后一段时间内没有被消息引用的附件会被定期清理
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"../config"
+	"../model"
+	tb "../toolbox"
+	"github.com/astaxie/beego/logs"
+)
+
+const (
+	chatAttachDir     = "callDriver" // 附件在StaticPath下的目录
+	chatAttachPending = time.Hour    // 上传后等待发送的时间, 超时仍未被消息引用的附件会被清理
+	chatAttachNameLen = 100          // 保存的原文件名的最大长度
+)
+
+// 支持的附件类型及其保存时使用的后缀, 类型按文件内容识别, 不信任上传时的文件名
+var chatAttachTypes = map[string]string{
+	"image/jpeg":      ".jpg",
+	"image/png":       ".png",
+	"image/gif":       ".gif",
+	"image/webp":      ".webp",
+	"application/pdf": ".pdf",
+	"application/zip": ".zip",
+	"text/plain":      ".txt",
+}
+
+// 已上传但还未发送的附件
+type chatPendingAttachment struct {
+	owner      string // 上传者, 访客id或Boss的名字
+	attachment model.CallDriverAttachment
+	uploadTime time.Time
+}
+
+var chatPending = struct {
+	mux sync.Mutex
+	m   map[string]chatPendingAttachment // 附件文件名 -> 附件
+}{m: make(map[string]chatPendingAttachment)}
+
+// 访客上传附件
+func callDriverUpload(w http.ResponseWriter, r *http.Request) {
+	saveChatAttachmentHandler(w, r, getOrCreateVisitorID(w, r))
+}
+
+// Boss上传附件
+func callDriverBossUpload(w http.ResponseWriter, r *http.Request) {
+	if !config.ServerConfig.IsTest && !IpMonitor.IsInWhiteList(r) {
+		w.WriteHeader(http.StatusNotAcceptable)
+		return
+	}
+	saveChatAttachmentHandler(w, r, myName)
+}
+
+// 接收POST表单中的file文件, 保存为owner待发送的附件并返回附件信息
+func saveChatAttachmentHandler(w http.ResponseWriter, r *http.Request, owner string) {
+	var resp respStruct
+	var err error
+	ip, _ := tb.GetIpAndPort(r)
+	for loop := true; loop; loop = false {
+		if r.Method != http.MethodPost {
+			err = fmt.Errorf("unexpect method: %s", r.Method)
+			break
+		}
+		// 上传也计入ip的发送次数限制
+		limit := config.AntiSpamConfig.IPLimit
+		if limit > 0 && chatIPLimiter.Count("upload|"+ip) >= limit {
+			err = errChatTooFrequent
+			break
+		}
+		maxSize := config.CallDriverConfig.AttachMaxSize << 10
+		r.Body = http.MaxBytesReader(w, r.Body, maxSize+64<<10)
+		var attachment model.CallDriverAttachment
+		if attachment, err = saveChatAttachment(r, ip, maxSize); err != nil {
+			break
+		}
+		chatIPLimiter.Hit("upload|" + ip)
+		chatPending.mux.Lock()
+		chatPending.m[attachment.File] = chatPendingAttachment{owner: owner, attachment: attachment, uploadTime: time.Now()}
+		chatPending.mux.Unlock()
+		resp.PayLoad = attachment
+	}
+	logs.Info("upload chat attachment: owner=%s ip=%s payload=%+v error=%v", owner, ip, resp.PayLoad, err)
+	if err != nil {
+		resp.Status = -1
+		resp.Msg = fmt.Sprint(err)
+	}
+	responseJson(&w, resp)
+}
+
+// 检查大小和类型后保存上传的文件
+func saveChatAttachment(r *http.Request, ip string, maxSize int64) (attachment model.CallDriverAttachment, err error) {
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		return attachment, fmt.Errorf("read upload file failed: %v", err)
+	}
+	defer file.Close()
+	if header.Size > maxSize {
+		return attachment, fmt.Errorf("file too large: size=%d max=%d", header.Size, maxSize)
+	}
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(file, head)
+	mimeType := strings.Split(http.DetectContentType(head[:n]), ";")[0]
+	ext, ok := chatAttachTypes[mimeType]
+	if !ok || !isChatAttachTypeAllowed(mimeType) {
+		return attachment, fmt.Errorf("unsupported file type: %s", mimeType)
+	}
+	if _, err = file.Seek(0, io.SeekStart); err != nil {
+		return attachment, err
+	}
+	release, err := reserveSpace(areaChat, header.Size, ip)
+	if err != nil {
+		return attachment, err
+	}
+	defer release()
+
+	id := make([]byte, 12)
+	rand.Read(id)
+	attachment = model.CallDriverAttachment{
+		ID:   hex.EncodeToString(id),
+		Name: chatAttachName(header.Filename, ext),
+		Mime: mimeType,
+	}
+	attachment.File = attachment.ID + ext
+	fileName := chatAttachDir + "/" + attachment.File
+	if _, attachment.Size, err = saveStoredFile(fileName, areaChat, file, false); err != nil {
+		return attachment, err
+	}
+	if err = scanChatAttachment(fileName); err != nil {
+		removeStoredFile(fileName)
+		return attachment, err
+	}
+	if strings.HasPrefix(mimeType, "image/") {
+		attachment.Width, attachment.Height = getImageSize(fileName)
+	}
+	return attachment, nil
+}
+
+// 附件类型是否在配置允许的范围内
+func isChatAttachTypeAllowed(mimeType string) bool {
+	if len(config.CallDriverConfig.AttachTypes) == 0 {
+		return true
+	}
+	for _, t := range config.CallDriverConfig.AttachTypes {
+		if strings.TrimSpace(t) == mimeType {
+			return true
+		}
+	}
+	return false
+}
+
+// 整理上传时的文件名, 为空时使用按类型确定的默认文件名
+func chatAttachName(name string, ext string) string {
+	name = strings.TrimSpace(path.Base(strings.Replace(name, "\\", "/", -1)))
+	if name == "" || name == "." || name == "/" {
+		return "attachment" + ext
+	}
+	for utf8.RuneCountInString(name) > chatAttachNameLen {
+		_, size := utf8.DecodeLastRuneInString(name)
+		name = name[:len(name)-size]
+	}
+	return name
+}
+
+// 开启了病毒扫描时扫描附件, 需要隔离的附件直接拒绝
+func scanChatAttachment(fileName string) error {
+	if uploadScanner == nil {
+		return nil
+	}
+	reader, err := openStoredFile(fileName)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	status, result := model.ScanStatusClean, ""
+	res, err := tb.ScanWithTimeout(uploadScanner, reader, time.Duration(config.ScanConfig.Timeout)*time.Second)
+	if err != nil {
+		logs.Error("scan chat attachment failed: fileName=%s error=%v", fileName, err)
+		status, result = model.ScanStatusError, fmt.Sprint(err)
+	} else if res.Infected {
+		logs.Warn("virus found in chat attachment: fileName=%s signature=%s", fileName, res.Signature)
+		sendAlert("callDriver的附件中发现病毒", "文件: %s\n病毒: %s\n附件已被拒绝", fileName, res.Signature)
+		status, result = model.ScanStatusInfected, res.Signature
+	}
+	if isScanBlocked(status) {
+		return scanBlockedError(status, result)
+	}
+	return nil
+}
+
+// 取出owner上传的待发送附件, files为逗号分隔的附件文件名
+// 附件在消息保存后才通过doneChatAttachments移出待发送列表, 发送失败时可以重新发送
+func getChatAttachments(owner string, files string) ([]model.CallDriverAttachment, error) {
+	attachments := make([]model.CallDriverAttachment, 0)
+	if strings.TrimSpace(files) == "" {
+		return attachments, nil
+	}
+	chatPending.mux.Lock()
+	defer chatPending.mux.Unlock()
+	seen := make(map[string]bool)
+	for _, file := range strings.Split(files, ",") {
+		file = strings.TrimSpace(file)
+		if file == "" || seen[file] {
+			continue
+		}
+		seen[file] = true
+		pending, ok := chatPending.m[file]
+		if !ok || pending.owner != owner {
+			return nil, fmt.Errorf("attachment not found or expired: %s", file)
+		}
+		attachments = append(attachments, pending.attachment)
+	}
+	if len(attachments) > config.CallDriverConfig.AttachMaxCount {
+		return nil, fmt.Errorf("too many attachments: max=%d", config.CallDriverConfig.AttachMaxCount)
+	}
+	return attachments, nil
+}
+
+// 附件已被消息引用, 移出待发送列表
+func doneChatAttachments(attachments []model.CallDriverAttachment) {
+	chatPending.mux.Lock()
+	defer chatPending.mux.Unlock()
+	for _, a := range attachments {
+		delete(chatPending.m, a.File)
+	}
+}
+
+// 消息的文字内容, 带上附件的文件名, 用于通知和邮件
+func chatMessageText(msg string, attachments []model.CallDriverAttachment) string {
+	for _, a := range attachments {
+		if msg != "" {
+			msg += " "
+		}
+		msg += "[附件: " + a.Name + "]"
+	}
+	return msg
+}
+
+// 返回附件或其缩略图, 只有Boss和附件所在会话的访客可以访问
+// url format: /callDriver/file/${file} 或 /callDriver/thumb/${file}?size=256
+func callDriverFile(w http.ResponseWriter, r *http.Request, prefix string, thumb bool) {
+	file := strings.TrimPrefix(strings.Trim(r.URL.Path, "/"), prefix)
+	fileName := chatAttachDir + "/" + file
+	if !chatFileReg.MatchString(fileName) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	attachment, visitor, err := findChatAttachment(file)
+	isBoss := config.ServerConfig.IsTest || IpMonitor.IsInWhiteList(r)
+	if err == model.ErrorNoRecord && isBoss { // 等待审核的消息中的附件只有Boss可以查看
+		attachment, err = model.CallDriverAttachment{File: file, Name: file}, nil
+	}
+	if err == model.ErrorNoRecord {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if !isBoss {
+		if id, idErr := getVisitorID(r); idErr != nil || id != visitor {
+			logs.Warn("reject chat attachment request: file=%s visitor=%s", file, id)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+	}
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if thumb {
+		size := 256
+		if s := r.URL.Query().Get("size"); s != "" {
+			if size, err = strconv.Atoi(s); err != nil || size <= 0 {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+		serveThumbnail(w, r, fileName, size)
+		return
+	}
+	inline := strings.HasPrefix(detectMime(fileName), "image/")
+	err = serveStoredFile(w, r, fileName, attachment.Name, inline)
+	if os.IsNotExist(err) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logs.Error("serve chat attachment failed: file=%s error=%v", file, err)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+// 查找附件以及可以访问它的访客id, 未发送的附件为上传者
+func findChatAttachment(file string) (model.CallDriverAttachment, string, error) {
+	chatPending.mux.Lock()
+	pending, ok := chatPending.m[file]
+	chatPending.mux.Unlock()
+	if ok {
+		return pending.attachment, pending.owner, nil
+	}
+	record, err := model.FindCallDriverMessageByAttachment(file)
+	if err != nil {
+		return model.CallDriverAttachment{}, "", err
+	}
+	for _, a := range record.Attachments {
+		if a.File == file {
+			return a, chatRecordVisitor(record), nil
+		}
+	}
+	return model.CallDriverAttachment{}, "", model.ErrorNoRecord
+}
+
+// 清理上传后超时仍未被消息引用的附件
+func cleanChatAttachments() {
+	deadline := time.Now().Add(-chatAttachPending)
+	chatPending.mux.Lock()
+	for file, pending := range chatPending.m {
+		if pending.uploadTime.Before(deadline) {
+			delete(chatPending.m, file)
+		}
+	}
+	chatPending.mux.Unlock()
+
+	files, err := findStoredFiles(areaChat, "", "timeStamp", 0)
+	if err != nil {
+		return
+	}
+	for _, f := range files {
+		if f.Timestamp > deadline.Unix() {
+			break
+		}
+		file := strings.TrimPrefix(f.Name, chatAttachDir+"/")
+		chatPending.mux.Lock()
+		_, isPending := chatPending.m[file]
+		chatPending.mux.Unlock()
+		if isPending {
+			continue
+		}
+		used, err := model.IsCallDriverAttachmentUsed(file)
+		if err != nil || used {
+			continue
+		}
+		if err = removeStoredFile(f.Name); err != nil {
+			logs.Error("remove unused chat attachment failed: file=%s error=%v", f.Name, err)
+			continue
+		}
+		logs.Info("remove unused chat attachment: file=%s", f.Name)
+	}
+}
@@ -0,0 +1,183 @@
+package handler
+
+// callDriver的会话: 每个访客一个会话, 会话id即访客id, 记录最后一条消息、双方未读数以及归档/关闭/静音状态
+// Boss通过收件箱按最后活跃时间查看所有会话, 会话有变化时通过事件流推送conversation事件
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"../config"
+	"../model"
+	tb "../toolbox"
+	"github.com/astaxie/beego/logs"
+)
+
+// 推送会话的变化给Boss
+func publishChatConversation(conv model.CallDriverConversation) {
+	chatHub.publish(chatEvent{Type: "conversation", Data: conv}, "", true)
+}
+
+// 保存新消息后更新所在的会话并推送给双方, 返回更新后的会话
+func recordChatMessage(record model.CallDriverChat, fromVisitor bool) (model.CallDriverConversation, error) {
+	visitor := record.From
+	if !fromVisitor {
+		visitor = record.To
+	}
+	publishChatMessage(record)
+	conv, err := model.TouchCallDriverConversation(visitor, record.Nick, record, fromVisitor)
+	if err != nil {
+		return conv, err
+	}
+	publishChatConversation(conv)
+	return conv, nil
+}
+
+// 以Boss的身份回复会话, 保存消息后推送给双方, 并按配置将回复发送到访客留下的邮箱
+func bossReplyConversation(conv model.CallDriverConversation, msg string, ip string, attachments []model.CallDriverAttachment) error {
+	record, err := model.InsertCallDriverMessage(myName, conv.ID, "", msg, ip, attachments)
+	if err != nil {
+		logs.Error("save boss reply failed: conv=%s error=%v", conv.ID, err)
+		return err
+	}
+	doneChatAttachments(attachments)
+	if _, err = recordChatMessage(record, false); err != nil {
+		logs.Error("update conversation failed: conv=%s error=%v", conv.ID, err)
+		return err
+	}
+	if conv.Email != "" && config.CallDriverConfig.MailVisitor && !config.ServerConfig.IsTest {
+		go tb.SendReplyToVisitor(conv.Email, conv.Visitor, chatMessageText(msg, attachments), config.ServerConfig.ServerURL+"/callDriver")
+	}
+	return nil
+}
+
+// 消息被确认后重新统计会话的未读数
+func refreshChatUnread(convID string) {
+	conv, err := model.RefreshCallDriverConversationUnread(convID)
+	if err != nil {
+		logs.Warn("refresh conversation unread failed: conv=%s error=%v", convID, err)
+		return
+	}
+	publishChatConversation(conv)
+}
+
+// Boss的收件箱, 按最后活跃时间倒序分页查看会话
+// 参数: status为open|archived|closed|all, 默认为open; before为上一页返回的游标; limit可选
+func callDriverBossInbox(w http.ResponseWriter, r *http.Request) {
+	if !config.ServerConfig.IsTest && !IpMonitor.IsInWhiteList(r) {
+		w.WriteHeader(http.StatusNotAcceptable)
+		return
+	}
+	var req struct {
+		Status string `json:"status"`
+		Before string `json:"before"`
+		Limit  string `json:"limit"`
+	}
+	var resp respStruct
+	var err error
+	for loop := true; loop; loop = false {
+		if err = tb.MustQueryFromRequest(r, &req); err != nil {
+			break
+		}
+		switch req.Status {
+		case "":
+			req.Status = model.CallDriverConvOpen
+		case "all":
+			req.Status = ""
+		case model.CallDriverConvOpen, model.CallDriverConvArchived, model.CallDriverConvClosed:
+		default:
+			err = fmt.Errorf("unexpect status: %q", req.Status)
+		}
+		if err != nil {
+			break
+		}
+		var before *model.ChatCursor
+		if before, err = parseChatCursor(req.Before); err != nil {
+			break
+		}
+		limit := chatPageSize
+		if req.Limit != "" {
+			if limit, err = strconv.Atoi(req.Limit); err != nil || limit <= 0 {
+				err = fmt.Errorf("unexpect limit: %q", req.Limit)
+				break
+			}
+			if limit > chatPageMaxSize {
+				limit = chatPageMaxSize
+			}
+		}
+		var convs []model.CallDriverConversation
+		var hasMore bool
+		if convs, hasMore, err = model.FindCallDriverConversations(req.Status, before, limit); err != nil {
+			break
+		}
+		var unread int
+		if unread, err = model.CountCallDriverBossUnread(); err != nil {
+			break
+		}
+		payLoad := map[string]interface{}{"conversations": convs, "hasMore": hasMore, "unread": unread, "before": ""}
+		if len(convs) > 0 {
+			last := convs[len(convs)-1]
+			payLoad["before"] = fmt.Sprintf("%d_%s", last.LastTime, last.ID)
+		}
+		resp.PayLoad = payLoad
+	}
+	if err != nil {
+		logs.Warn("get inbox failed: error=%v url=%s", err, r.URL)
+		resp.Status = -1
+		resp.Msg = fmt.Sprint(err)
+	}
+	responseJson(&w, resp)
+}
+
+// Boss管理会话, 参数: conv为会话id, ope为archive|close|reopen|mute|unmute
+func callDriverBossConversation(w http.ResponseWriter, r *http.Request) {
+	if !config.ServerConfig.IsTest && !IpMonitor.IsInWhiteList(r) {
+		w.WriteHeader(http.StatusNotAcceptable)
+		return
+	}
+	var req struct {
+		Conv string `json:"conv"`
+		Ope  string `json:"ope"`
+	}
+	var resp respStruct
+	var err error
+	for loop := true; loop; loop = false {
+		if err = tb.MustQueryFromRequest(r, &req); err != nil {
+			break
+		}
+		var conv model.CallDriverConversation
+		if conv, err = model.FindCallDriverConversation(strings.TrimSpace(req.Conv)); err != nil {
+			break
+		}
+		switch req.Ope {
+		case "archive":
+			conv.Status = model.CallDriverConvArchived
+		case "close":
+			conv.Status = model.CallDriverConvClosed
+		case "reopen":
+			conv.Status = model.CallDriverConvOpen
+		case "mute":
+			conv.Muted = true
+		case "unmute":
+			conv.Muted = false
+		default:
+			err = fmt.Errorf("unexpect ope: %q", req.Ope)
+		}
+		if err != nil {
+			break
+		}
+		if conv, err = model.UpdateCallDriverConversation(conv.ID, conv.Status, conv.Muted); err != nil {
+			break
+		}
+		publishChatConversation(conv)
+		resp.PayLoad = conv
+		logs.Info("update conversation success: conv=%s ope=%s", conv.ID, req.Ope)
+	}
+	if err != nil {
+		logs.Warn("update conversation failed: error=%v url=%s", err, r.URL)
+		resp.Status = -1
+		resp.Msg = fmt.Sprint(err)
+	}
+	responseJson(&w, resp)
+}
@@ -0,0 +1,363 @@
+package handler
+
+// callDriver聊天记录的搜索、导出和保留期限
+// 搜索和导出使用相同的查询条件, 导出支持json、csv和markdown格式, 以流的方式逐条写出
+// 配置了保留天数时, 后台任务定期将超过期限的记录移到归档集合或直接删除
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"../config"
+	"../model"
+	tb "../toolbox"
+	"github.com/astaxie/beego/logs"
+)
+
+const chatDateLayout = "2006-01-02"
+
+// 搜索结果中的一条消息, 比推送给页面的消息多了ip
+type chatSearchResult struct {
+	chatMessage
+	IP string `json:"ip"`
+}
+
+// 导出的一条消息
+type chatExportRecord struct {
+	ID          string                 `json:"id"`
+	Conv        string                 `json:"conv"`
+	From        string                 `json:"from"`
+	To          string                 `json:"to"`
+	Nick        string                 `json:"nick"`
+	Message     string                 `json:"message"`
+	Time        string                 `json:"time"`
+	TimeStamp   int64                  `json:"timeStamp"`
+	IP          string                 `json:"ip"`
+	Status      int                    `json:"status"`
+	Attachments []chatExportAttachment `json:"attachments"`
+}
+
+type chatExportAttachment struct {
+	Name string `json:"name"`
+	URL  string `json:"url"` // 下载地址, 需要Boss的权限
+}
+
+// 消息所在会话的访客id
+func chatRecordVisitor(record model.CallDriverChat) string {
+	if record.From == myName {
+		return record.To
+	}
+	return record.From
+}
+
+func newChatExportRecord(record model.CallDriverChat) chatExportRecord {
+	res := chatExportRecord{
+		ID:          record.ID,
+		Conv:        chatRecordVisitor(record),
+		From:        record.From,
+		To:          record.To,
+		Nick:        record.Nick,
+		Message:     record.Message,
+		Time:        time.Unix(record.TimeStamp, 0).Format("2006-01-02 15:04:05"),
+		TimeStamp:   record.TimeStamp,
+		IP:          record.IP,
+		Status:      record.Status,
+		Attachments: make([]chatExportAttachment, 0, len(record.Attachments)),
+	}
+	for _, a := range record.Attachments {
+		res.Attachments = append(res.Attachments, chatExportAttachment{
+			Name: a.Name,
+			URL:  config.ServerConfig.ServerURL + "/callDriver/file/" + a.File,
+		})
+	}
+	return res
+}
+
+// 解析搜索和导出的查询条件
+// 参数: conv为会话的访客id, nick, keyword, ip, since和until为日期(2006-01-02, 包含until当天), archived为1时查询已归档的记录
+func parseChatFilter(r *http.Request) (*model.ChatFilter, error) {
+	var req struct {
+		Conv     string `json:"conv"`
+		Nick     string `json:"nick"`
+		Keyword  string `json:"keyword"`
+		IP       string `json:"ip"`
+		Since    string `json:"since"`
+		Until    string `json:"until"`
+		Archived string `json:"archived"`
+	}
+	if err := tb.MustQueryFromRequest(r, &req); err != nil {
+		return nil, err
+	}
+	filter := &model.ChatFilter{
+		Visitor:  strings.TrimSpace(req.Conv),
+		Nick:     strings.TrimSpace(req.Nick),
+		Keyword:  strings.TrimSpace(req.Keyword),
+		IP:       strings.TrimSpace(req.IP),
+		Archived: req.Archived == "1",
+	}
+	if req.Since != "" {
+		since, err := time.ParseInLocation(chatDateLayout, req.Since, time.Local)
+		if err != nil {
+			return nil, fmt.Errorf("unexpect since: %q", req.Since)
+		}
+		filter.Since = since.Unix()
+	}
+	if req.Until != "" {
+		until, err := time.ParseInLocation(chatDateLayout, req.Until, time.Local)
+		if err != nil {
+			return nil, fmt.Errorf("unexpect until: %q", req.Until)
+		}
+		filter.Until = until.AddDate(0, 0, 1).Unix()
+	}
+	if filter.Since > 0 && filter.Until > 0 && filter.Since >= filter.Until {
+		return nil, fmt.Errorf("since must be earlier than until")
+	}
+	return filter, nil
+}
+
+// Boss搜索聊天记录, 按时间倒序分页, 查询条件见parseChatFilter
+// 参数: before为上一页返回的before, limit可选
+func callDriverBossSearch(w http.ResponseWriter, r *http.Request) {
+	if !config.ServerConfig.IsTest && !IpMonitor.IsInWhiteList(r) {
+		w.WriteHeader(http.StatusNotAcceptable)
+		return
+	}
+	var req struct {
+		Before string `json:"before"`
+		Limit  string `json:"limit"`
+	}
+	var resp respStruct
+	var err error
+	for loop := true; loop; loop = false {
+		if err = tb.MustQueryFromRequest(r, &req); err != nil {
+			break
+		}
+		var filter *model.ChatFilter
+		if filter, err = parseChatFilter(r); err != nil {
+			break
+		}
+		var before *model.ChatCursor
+		if before, err = parseChatCursor(req.Before); err != nil {
+			break
+		}
+		limit := chatPageSize
+		if req.Limit != "" {
+			if limit, err = strconv.Atoi(req.Limit); err != nil || limit <= 0 {
+				err = fmt.Errorf("unexpect limit: %q", req.Limit)
+				break
+			}
+			if limit > chatPageMaxSize {
+				limit = chatPageMaxSize
+			}
+		}
+		var history []model.CallDriverChat
+		var hasMore bool
+		if history, hasMore, err = model.SearchCallDriverMessage(filter, before, limit); err != nil {
+			break
+		}
+		results := make([]chatSearchResult, 0, len(history))
+		for _, record := range history {
+			results = append(results, chatSearchResult{chatMessage: newChatMessage(record), IP: record.IP})
+		}
+		payLoad := map[string]interface{}{"messages": results, "hasMore": hasMore, "before": ""}
+		if len(history) > 0 {
+			payLoad["before"] = formatChatCursor(history[len(history)-1])
+		}
+		resp.PayLoad = payLoad
+	}
+	if err != nil {
+		logs.Warn("search chat failed: error=%v url=%s", err, r.URL)
+		resp.Status = -1
+		resp.Msg = fmt.Sprint(err)
+	}
+	responseJson(&w, resp)
+}
+
+// Boss导出聊天记录, 查询条件见parseChatFilter, 不传conv时导出所有会话
+// 参数: format为json|csv|markdown, 默认为json
+func callDriverBossExport(w http.ResponseWriter, r *http.Request) {
+	if !config.ServerConfig.IsTest && !IpMonitor.IsInWhiteList(r) {
+		w.WriteHeader(http.StatusNotAcceptable)
+		return
+	}
+	filter, err := parseChatFilter(r)
+	if err != nil {
+		logs.Warn("export chat failed: error=%v url=%s", err, r.URL)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "json"
+	}
+	var exporter chatExporter
+	switch format {
+	case "json":
+		exporter = &chatJSONExporter{w: w}
+	case "csv":
+		exporter = &chatCSVExporter{w: csv.NewWriter(w)}
+	case "markdown":
+		exporter = &chatMarkdownExporter{w: w}
+	default:
+		http.Error(w, fmt.Sprintf("unexpect format: %q", format), http.StatusBadRequest)
+		return
+	}
+
+	name := "all"
+	if filter.Visitor != "" {
+		name = filter.Visitor
+	}
+	fileName := fmt.Sprintf("callDriver-%s-%s.%s", name, time.Now().Format("20060102"), exporter.ext())
+	w.Header().Set("Content-Type", exporter.contentType())
+	w.Header().Set("Content-Disposition", tb.ContentDisposition("attachment", fileName))
+
+	count := 0
+	if err = exporter.begin(filter); err == nil {
+		err = model.IterCallDriverMessage(filter, func(record model.CallDriverChat) error {
+			count++
+			return exporter.write(newChatExportRecord(record))
+		})
+	}
+	if err == nil {
+		err = exporter.end()
+	}
+	// 响应头已经写出, 出错时只能记录日志
+	logs.Info("export chat: filter=%+v format=%s count=%d error=%v", filter, format, count, err)
+}
+
+// 导出格式
+type chatExporter interface {
+	ext() string
+	contentType() string
+	begin(filter *model.ChatFilter) error
+	write(record chatExportRecord) error
+	end() error
+}
+
+// json格式, 所有消息组成一个数组
+type chatJSONExporter struct {
+	w     io.Writer
+	count int
+}
+
+func (e *chatJSONExporter) ext() string         { return "json" }
+func (e *chatJSONExporter) contentType() string { return "application/json; charset=utf-8" }
+
+func (e *chatJSONExporter) begin(filter *model.ChatFilter) error {
+	_, err := io.WriteString(e.w, "[")
+	return err
+}
+
+func (e *chatJSONExporter) write(record chatExportRecord) error {
+	b, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if e.count > 0 {
+		b = append([]byte(",\n"), b...)
+	}
+	e.count++
+	_, err = e.w.Write(b)
+	return err
+}
+
+func (e *chatJSONExporter) end() error {
+	_, err := io.WriteString(e.w, "]\n")
+	return err
+}
+
+// csv格式, 带BOM以便Excel识别为utf-8, 附件只导出下载地址, 多个附件以空格分隔
+type chatCSVExporter struct {
+	w *csv.Writer
+}
+
+func (e *chatCSVExporter) ext() string         { return "csv" }
+func (e *chatCSVExporter) contentType() string { return "text/csv; charset=utf-8" }
+
+func (e *chatCSVExporter) begin(filter *model.ChatFilter) error {
+	e.w.Write([]string{"\ufeffid", "conv", "from", "to", "nick", "time", "ip", "status", "message", "attachments"})
+	return e.w.Error()
+}
+
+func (e *chatCSVExporter) write(r chatExportRecord) error {
+	urls := make([]string, 0, len(r.Attachments))
+	for _, a := range r.Attachments {
+		urls = append(urls, a.URL)
+	}
+	row := []string{r.ID, r.Conv, r.From, r.To, r.Nick, r.Time, r.IP, strconv.Itoa(r.Status), r.Message, strings.Join(urls, " ")}
+	for i := range row {
+		row[i] = tb.CSVSafeCell(row[i])
+	}
+	e.w.Write(row)
+	return e.w.Error()
+}
+
+func (e *chatCSVExporter) end() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+// markdown格式, 按日期分节, 消息内容作为引用块
+type chatMarkdownExporter struct {
+	w    io.Writer
+	date string
+}
+
+func (e *chatMarkdownExporter) ext() string         { return "md" }
+func (e *chatMarkdownExporter) contentType() string { return "text/markdown; charset=utf-8" }
+
+func (e *chatMarkdownExporter) begin(filter *model.ChatFilter) error {
+	title := "# CallDriver chat history"
+	if filter.Visitor != "" {
+		title += ": " + filter.Visitor
+	}
+	_, err := fmt.Fprintf(e.w, "%s\n\nExported at %s\n", title, time.Now().Format("2006-01-02 15:04:05"))
+	return err
+}
+
+func (e *chatMarkdownExporter) write(r chatExportRecord) error {
+	var b strings.Builder
+	if date := r.Time[:len(chatDateLayout)]; date != e.date {
+		e.date = date
+		fmt.Fprintf(&b, "\n## %s\n", date)
+	}
+	sender := r.Nick
+	if r.From == myName {
+		sender = myName
+	}
+	fmt.Fprintf(&b, "\n**%s** `%s` %s\n\n", sender, r.Conv, r.Time[len(chatDateLayout)+1:])
+	if r.Message != "" {
+		b.WriteString("> " + strings.Replace(r.Message, "\n", "\n> ", -1) + "\n")
+		if len(r.Attachments) > 0 {
+			b.WriteString("\n")
+		}
+	}
+	for _, a := range r.Attachments {
+		fmt.Fprintf(&b, "- [%s](%s)\n", a.Name, a.URL)
+	}
+	_, err := io.WriteString(e.w, b.String())
+	return err
+}
+
+func (e *chatMarkdownExporter) end() error {
+	return nil
+}
+
+// 处理超过保留期限的聊天记录, 删除的记录中的附件由cleanChatAttachments清理
+func cleanChatRetention() {
+	days := config.CallDriverConfig.RetentionDays
+	if days <= 0 {
+		return
+	}
+	before := time.Now().AddDate(0, 0, -int(days)).Unix()
+	archive := config.CallDriverConfig.RetentionMode == "archive"
+	total, err := model.ExpireCallDriverMessage(before, archive)
+	if total > 0 || err != nil {
+		logs.Info("expire chat messages: before=%d archive=%v total=%d error=%v", before, archive, total, err)
+	}
+}
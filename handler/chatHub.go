@@ -0,0 +1,322 @@
+package handler
+
+// callDriver的实时消息推送, 使用Server-Sent Events
+// 访客和Boss页面各自保持一个事件流连接, 服务端推送三种事件:
+//   message: 新消息, 事件id为消息的时间戳, 断线重连时浏览器通过Last-Event-ID带回, 服务端从数据库补发此后的消息
+//   typing:  对方正在输入
+//   receipt: 消息已送达或已读的回执, 由接收方页面显式确认(ack)后产生
+//   conversation: 会话的最后消息、未读数或状态有变化, 只推送给Boss
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"../model"
+	tb "../toolbox"
+	"github.com/astaxie/beego/logs"
+)
+
+const (
+	chatKeepAlive    = 25 * time.Second // 心跳间隔, 防止连接被代理断开
+	chatCatchUpLimit = 200              // 重连时最多补发的消息数
+	chatBufferSize   = 64               // 每个连接的待发送事件数, 超过时断开该连接, 由客户端重连后补发
+	chatPageSize     = 20               // 分页查询默认每页的消息数
+	chatPageMaxSize  = 100              // 分页查询每页最多的消息数
+)
+
+// 推送给页面的一条消息
+type chatMessage struct {
+	ID        string `json:"id"`
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Nick      string `json:"nick"` // 访客的昵称, Boss发出的消息为空
+	Message   string `json:"message"`
+	TimeStamp int64  `json:"timeStamp"`
+	Status    int    `json:"status"`
+
+	Attachments []model.CallDriverAttachment `json:"attachments,omitempty"`
+}
+
+func newChatMessage(record model.CallDriverChat) chatMessage {
+	return chatMessage{
+		ID:        record.ID,
+		From:      record.From,
+		To:        record.To,
+		Nick:      record.Nick,
+		Message:   record.Message,
+		TimeStamp: record.TimeStamp,
+		Status:    record.Status,
+
+		Attachments: record.Attachments,
+	}
+}
+
+// 推送的事件
+type chatEvent struct {
+	Type string      // message|typing|receipt
+	ID   string      // 事件id, 为空时不设置
+	Data interface{} // 以json格式发送
+}
+
+// 一个事件流连接
+type chatSubscriber struct {
+	visitor string // 访客id, Boss连接为空
+	events  chan chatEvent
+}
+
+// 管理所有事件流连接
+type chatHubType struct {
+	mux  sync.Mutex
+	subs map[*chatSubscriber]bool
+}
+
+var chatHub = &chatHubType{subs: make(map[*chatSubscriber]bool)}
+
+func (h *chatHubType) subscribe(visitor string) *chatSubscriber {
+	sub := &chatSubscriber{visitor: visitor, events: make(chan chatEvent, chatBufferSize)}
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	h.subs[sub] = true
+	return sub
+}
+
+func (h *chatHubType) unsubscribe(sub *chatSubscriber) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	if h.subs[sub] {
+		delete(h.subs, sub)
+		close(sub.events)
+	}
+}
+
+// 推送事件, toVisitor为接收事件的访客id(为空时不推送给访客), toBoss控制是否推送给Boss
+func (h *chatHubType) publish(event chatEvent, toVisitor string, toBoss bool) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	for sub := range h.subs {
+		if (sub.visitor == "" && !toBoss) || (sub.visitor != "" && sub.visitor != toVisitor) {
+			continue
+		}
+		select {
+		case sub.events <- event:
+		default: // 处理不过来的连接直接断开
+			logs.Warn("chat subscriber too slow, disconnect: visitor=%s", sub.visitor)
+			delete(h.subs, sub)
+			close(sub.events)
+		}
+	}
+}
+
+// 推送新消息给双方
+func publishChatMessage(record model.CallDriverChat) {
+	visitor := record.From
+	if visitor == myName {
+		visitor = record.To
+	}
+	event := chatEvent{Type: "message", ID: fmt.Sprint(record.TimeStamp), Data: newChatMessage(record)}
+	chatHub.publish(event, visitor, true)
+}
+
+// 处理事件流连接, visitor为空时为Boss的连接
+// 重连时通过Last-Event-ID请求头或since参数指定已收到的最后一条消息的时间戳
+func serveChatEvents(w http.ResponseWriter, r *http.Request, visitor string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	since, _ := strconv.ParseInt(r.Header.Get("Last-Event-ID"), 10, 64)
+	if since == 0 {
+		since, _ = strconv.ParseInt(r.URL.Query().Get("since"), 10, 64)
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+
+	// 先订阅再补发, 避免遗漏补发期间产生的消息; 同一条消息可能重复, 由页面按id去重
+	sub := chatHub.subscribe(visitor)
+	defer chatHub.unsubscribe(sub)
+	fmt.Fprint(w, "retry: 3000\n\n")
+	history, err := findChatCatchUp(visitor, since)
+	if err != nil {
+		logs.Error("catch up chat message failed: visitor=%s since=%d error=%v", visitor, since, err)
+	}
+	for _, record := range history {
+		writeChatEvent(w, chatEvent{Type: "message", ID: fmt.Sprint(record.TimeStamp), Data: newChatMessage(record)})
+	}
+	flusher.Flush()
+	logs.Info("chat event stream connected: visitor=%q since=%d", visitor, since)
+
+	ticker := time.NewTicker(chatKeepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			logs.Info("chat event stream closed: visitor=%q", visitor)
+			return
+		case event, ok := <-sub.events:
+			if !ok {
+				return
+			}
+			writeChatEvent(w, event)
+		case <-ticker.C:
+			fmt.Fprint(w, ": ping\n\n")
+		}
+		flusher.Flush()
+	}
+}
+
+// 获取连接建立时需要补发的消息, 按时间正序; 首次连接(since为0)时返回最近的消息
+func findChatCatchUp(visitor string, since int64) ([]model.CallDriverChat, error) {
+	if since > 0 {
+		return model.FindCallDriverMessageSince(visitor, since, chatCatchUpLimit)
+	}
+	history, _, err := model.FindCallDriverMessagePage(visitor, nil, nil, chatPageSize)
+	return history, err
+}
+
+// 分页查询的一页结果, 消息按时间正序
+type chatPage struct {
+	Messages []chatMessage `json:"messages"`
+	HasMore  bool          `json:"hasMore"` // 查询方向上是否还有更多消息
+	Before   string        `json:"before"`  // 第一条消息的游标, 用于继续查询更早的消息
+	After    string        `json:"after"`   // 最后一条消息的游标, 用于继续查询更新的消息
+}
+
+// 游标格式为"时间戳_消息id", 也可以只传时间戳
+func formatChatCursor(record model.CallDriverChat) string {
+	return fmt.Sprintf("%d_%s", record.TimeStamp, record.ID)
+}
+
+func parseChatCursor(cursor string) (*model.ChatCursor, error) {
+	if cursor == "" {
+		return nil, nil
+	}
+	parts := strings.SplitN(cursor, "_", 2)
+	ts, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("unexpect cursor: %q", cursor)
+	}
+	res := &model.ChatCursor{TimeStamp: ts}
+	if len(parts) == 2 {
+		res.ID = parts[1]
+	}
+	return res, nil
+}
+
+// 根据请求参数分页查询聊天记录, visitor为空时查询所有人的记录
+// 参数: before和after为游标, 二者都为空时返回最新的一页; limit为每页数量, 可选
+func findChatPage(r *http.Request, visitor string) (*chatPage, error) {
+	var req struct {
+		Before string `json:"before"`
+		After  string `json:"after"`
+		Limit  string `json:"limit"`
+	}
+	if err := tb.MustQueryFromRequest(r, &req); err != nil {
+		return nil, err
+	}
+	if req.Before != "" && req.After != "" {
+		return nil, fmt.Errorf("before and after can't be used together")
+	}
+	before, err := parseChatCursor(req.Before)
+	if err != nil {
+		return nil, err
+	}
+	after, err := parseChatCursor(req.After)
+	if err != nil {
+		return nil, err
+	}
+	limit := chatPageSize
+	if req.Limit != "" {
+		if limit, err = strconv.Atoi(req.Limit); err != nil || limit <= 0 {
+			return nil, fmt.Errorf("unexpect limit: %q", req.Limit)
+		}
+		if limit > chatPageMaxSize {
+			limit = chatPageMaxSize
+		}
+	}
+	history, hasMore, err := model.FindCallDriverMessagePage(visitor, before, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	page := &chatPage{Messages: make([]chatMessage, 0, len(history)), HasMore: hasMore}
+	for _, record := range history {
+		page.Messages = append(page.Messages, newChatMessage(record))
+	}
+	if len(history) > 0 {
+		page.Before = formatChatCursor(history[0])
+		page.After = formatChatCursor(history[len(history)-1])
+	}
+	return page, nil
+}
+
+func writeChatEvent(w http.ResponseWriter, event chatEvent) {
+	data, err := json.Marshal(event.Data)
+	if err != nil {
+		logs.Error("marshal chat event failed: error=%v", err)
+		return
+	}
+	if event.ID != "" {
+		fmt.Fprintf(w, "id: %s\n", event.ID)
+	}
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+}
+
+// 转发正在输入的状态, visitor为访客id, fromBoss表示由Boss发出
+func publishChatTyping(visitor string, fromBoss bool) {
+	data := map[string]interface{}{"visitor": visitor, "fromBoss": fromBoss}
+	if fromBoss {
+		chatHub.publish(chatEvent{Type: "typing", Data: data}, visitor, false)
+	} else {
+		chatHub.publish(chatEvent{Type: "typing", Data: data}, "", true)
+	}
+}
+
+// 接收方确认消息, 更新状态并将回执推送给发送方
+// to为确认方(访客id或myName), status为delivered|read
+func ackChatMessage(r *http.Request, to string) (interface{}, error) {
+	var req struct {
+		IDs    string `json:"ids"` // 以逗号分隔的消息id
+		Status string `json:"status"`
+	}
+	if err := tb.MustQueryFromRequest(r, &req); err != nil {
+		return nil, err
+	}
+	var status int
+	switch req.Status {
+	case "delivered":
+		status = model.CallDriverStatusDelivered
+	case "read":
+		status = model.CallDriverStatusRead
+	default:
+		return nil, fmt.Errorf("unexpect status: %q", req.Status)
+	}
+	ids := strings.Split(req.IDs, ",")
+	updated, err := model.AckCallDriverMessage(ids, to, status)
+	if err != nil || len(updated) == 0 {
+		return updated, err
+	}
+	data := map[string]interface{}{"ids": updated, "status": status}
+	if to == myName { // Boss确认的是访客发来的消息, 回执推送给所有访客连接中对应的发送方
+		records, err := model.FindCallDriverMessageByIDs(updated)
+		if err != nil {
+			return updated, err
+		}
+		senders := make(map[string][]string)
+		for _, record := range records {
+			senders[record.From] = append(senders[record.From], record.ID)
+		}
+		for sender, senderIDs := range senders {
+			chatHub.publish(chatEvent{Type: "receipt", Data: map[string]interface{}{"ids": senderIDs, "status": status}}, sender, true)
+			refreshChatUnread(sender)
+		}
+	} else {
+		chatHub.publish(chatEvent{Type: "receipt", Data: data}, to, true)
+		refreshChatUnread(to)
+	}
+	return updated, nil
+}
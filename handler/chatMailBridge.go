@@ -0,0 +1,104 @@
+package handler
+
+// callDriver的邮件回复: 新消息的通知邮件带有会话的回复token(在标题和回复地址中), Boss直接回复该邮件即可回复访客
+// 邮件服务器将发往回复地址的邮件转发到本地的SMTP监听地址, 解析出token和去掉引用后的正文, 作为Boss的回复保存
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"../config"
+	"../model"
+	tb "../toolbox"
+	"github.com/astaxie/beego/logs"
+)
+
+// 邮件回复的ip字段
+const mailReplyIP = "mail"
+
+var replyMailServer *tb.SMTPServer
+
+// 标题中的回复token, 形如 [#token]
+var replyTokenRegexp = regexp.MustCompile(`\[#([^\]\s]+)\]`)
+
+// 会话的回复token, 由会话id和签名组成
+func chatReplyToken(convID string) string {
+	mac := hmac.New(sha256.New, visitorSecret)
+	mac.Write([]byte("reply:" + convID))
+	return convID + "." + hex.EncodeToString(mac.Sum(nil))[:16]
+}
+
+// 校验回复token, 返回对应的会话id
+func parseChatReplyToken(token string) (string, bool) {
+	idx := strings.LastIndex(token, ".")
+	if idx <= 0 {
+		return "", false
+	}
+	convID := token[:idx]
+	return convID, hmac.Equal([]byte(token), []byte(chatReplyToken(convID)))
+}
+
+// 按配置开启接收邮件回复的SMTP服务
+func initChatMailBridge() error {
+	if config.CallDriverConfig.ReplyListen == "" {
+		logs.Info("callDriver mail reply disabled")
+		return nil
+	}
+	if len(config.MailConfig.Recipients) == 0 {
+		return errors.New("mail_recipient or mail_to is required to receive mail reply")
+	}
+	replyMailServer = &tb.SMTPServer{
+		Addr:    config.CallDriverConfig.ReplyListen,
+		MaxSize: 5 << 20,
+		Handler: handleReplyMail,
+	}
+	go func() {
+		err := replyMailServer.ListenAndServe()
+		logs.Error("callDriver mail reply server stopped: addr=%s error=%v", config.CallDriverConfig.ReplyListen, err)
+	}()
+	logs.Info("callDriver mail reply listen on %s", config.CallDriverConfig.ReplyListen)
+	return nil
+}
+
+// 处理收到的回复邮件, 只接受邮件接收人发出的邮件
+func handleReplyMail(from string, to []string, data []byte) error {
+	reply, err := tb.ParseReplyMail(data)
+	if err != nil {
+		return err
+	}
+	if !mailRouter.IsRecipient(reply.From) {
+		return fmt.Errorf("sender not allowed: %s", reply.From)
+	}
+	// 优先使用回复地址中的token, 其次是标题中的token
+	token := ""
+	for _, addr := range to {
+		if token = tb.MailSubAddress(addr); token != "" {
+			break
+		}
+	}
+	if token == "" {
+		if match := replyTokenRegexp.FindStringSubmatch(reply.Subject); match != nil {
+			token = match[1]
+		}
+	}
+	convID, ok := parseChatReplyToken(token)
+	if !ok {
+		return fmt.Errorf("reply token not found or invalid: token=%q", token)
+	}
+	if reply.Text == "" {
+		return errors.New("reply is empty")
+	}
+	conv, err := model.FindCallDriverConversation(convID)
+	if err != nil {
+		return fmt.Errorf("conversation not found: conv=%s error=%v", convID, err)
+	}
+	if err = bossReplyConversation(conv, reply.Text, mailReplyIP, nil); err != nil {
+		return err
+	}
+	logs.Info("mail reply success: conv=%s from=%s", convID, from)
+	return nil
+}
@@ -0,0 +1,161 @@
+package handler
+
+// callDriver新消息的通知: 访客发送消息后异步通知到所有开启的渠道(邮件、webhook、telegram、钉钉、企业微信)
+// 配置了合并通知的间隔时, 间隔内的消息合并为一条通知定期发送
+// 渠道在配置文件中定义, 开关可以在后台修改并持久化到mongo
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"../config"
+	"../model"
+	tb "../toolbox"
+	"github.com/astaxie/beego/logs"
+)
+
+var chatNotifier *tb.Notifier
+
+// 配置了合并通知的间隔时, 间隔内的消息先保存在这里
+var chatDigest struct {
+	mux     sync.Mutex
+	pending []*tb.Notification
+}
+
+func initChatNotify() (err error) {
+	timeout := time.Duration(config.NotifyConfig.Timeout) * time.Second
+	channels := make([]tb.NotifyChannelOptions, 0, len(config.NotifyConfig.Channels))
+	for _, c := range config.NotifyConfig.Channels {
+		channels = append(channels, tb.NotifyChannelOptions(c))
+	}
+	chatNotifier, err = tb.NewNotifier(channels, config.NotifyConfig.Retry, timeout)
+	if err != nil {
+		return err
+	}
+	if config.NotifyConfig.Digest > 0 {
+		go func() {
+			for range time.NewTicker(time.Duration(config.NotifyConfig.Digest) * time.Minute).C {
+				flushChatDigest()
+			}
+		}()
+	}
+	return nil
+}
+
+// 还原上次保存的渠道开关, 配置文件中已不存在的渠道忽略
+func restoreNotifySwitch(switches map[string]bool) {
+	for name, enable := range switches {
+		if err := chatNotifier.SetEnable(name, enable); err != nil {
+			logs.Warn("restore notify switch failed: error=%v", err)
+		}
+	}
+}
+
+// 开启或关闭渠道并保存
+func setNotifyEnable(name string, enable bool) error {
+	if err := chatNotifier.SetEnable(name, enable); err != nil {
+		return err
+	}
+	logs.Info("notify channel switch change: name=%s enable=%v", name, enable)
+	if config.ServerConfig.IsTest {
+		return nil
+	}
+	switches := make(map[string]bool)
+	for _, c := range chatNotifier.Channels() {
+		switches[c.Name] = c.Enable
+	}
+	return model.UpdateUtilData("notifySwitch", switches)
+}
+
+// 开启或关闭某种类型的全部渠道, 兼容原来只有邮件通知时的开关
+func setNotifyTypeEnable(channelType string, enable bool) error {
+	found := false
+	for _, c := range chatNotifier.Channels() {
+		if c.Type != channelType {
+			continue
+		}
+		found = true
+		if err := setNotifyEnable(c.Name, enable); err != nil {
+			return err
+		}
+	}
+	if !found {
+		return fmt.Errorf("no %s notify channel", channelType)
+	}
+	return nil
+}
+
+// 是否有开启的某种类型的渠道
+func notifyTypeEnabled(channelType string) bool {
+	for _, c := range chatNotifier.Channels() {
+		if c.Type == channelType && c.Enable {
+			return true
+		}
+	}
+	return false
+}
+
+// 访客发送了新消息, 静音的会话不通知
+func notifyChatMessage(record model.CallDriverChat, conv model.CallDriverConversation) {
+	if config.ServerConfig.IsTest || conv.Muted {
+		logs.Info("skip notify message: isTest=%v muted=%v conv=%s", config.ServerConfig.IsTest, conv.Muted, conv.ID)
+		return
+	}
+	notify := &tb.Notification{
+		Event:      "callDriver.message",
+		Title:      fmt.Sprintf("来自 %s 的消息", record.Nick),
+		Nick:       record.Nick,
+		Message:    chatMessageText(record.Message, record.Attachments),
+		Conv:       conv.ID,
+		Time:       time.Unix(record.TimeStamp, 0),
+		Link:       config.ServerConfig.ServerURL + "/callDriver/boss",
+		ReplyToken: chatReplyToken(conv.ID),
+	}
+	if config.NotifyConfig.Digest <= 0 {
+		chatNotifier.Notify(notify)
+		return
+	}
+	chatDigest.mux.Lock()
+	chatDigest.pending = append(chatDigest.pending, notify)
+	chatDigest.mux.Unlock()
+}
+
+// 将间隔内的消息合并为一条通知发送, 只有一条消息时原样发送
+func flushChatDigest() {
+	chatDigest.mux.Lock()
+	pending := chatDigest.pending
+	chatDigest.pending = nil
+	chatDigest.mux.Unlock()
+	if len(pending) == 0 {
+		return
+	}
+	if len(pending) == 1 {
+		chatNotifier.Notify(pending[0])
+		return
+	}
+	digest := &tb.Notification{
+		Event:  "callDriver.digest",
+		Title:  fmt.Sprintf("%d 条新消息", len(pending)),
+		Time:   time.Now(),
+		Link:   pending[0].Link,
+		Digest: true,
+	}
+	nicks := make([]string, 0)
+	lines := make([]string, 0, len(pending))
+	convs := make(map[string]bool)
+	for _, n := range pending {
+		if !convs[n.Conv] {
+			convs[n.Conv] = true
+			nicks = append(nicks, n.Nick)
+		}
+		lines = append(lines, fmt.Sprintf("[%s] %s: %s", n.Time.Format("15:04"), n.Nick, n.Message))
+	}
+	digest.Nick = strings.Join(nicks, ", ")
+	digest.Message = strings.Join(lines, "\n")
+	// 都来自同一个会话时可以直接回复
+	if len(convs) == 1 {
+		digest.Conv, digest.ReplyToken = pending[0].Conv, pending[0].ReplyToken
+	}
+	chatNotifier.Notify(digest)
+}
@@ -0,0 +1,223 @@
+package handler
+
+// callDriver的反垃圾: 按ip和访客限制发送频率, 频率较高时要求先完成工作量证明, 拒绝重复的消息
+// 命中关键词或链接规则的消息不直接发送, 而是进入审核队列, 由Boss在后台通过或拒绝
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"../config"
+	"../model"
+	tb "../toolbox"
+	"github.com/astaxie/beego/logs"
+)
+
+// 发送消息接口除0和-1外的返回状态
+const (
+	chatStatusHeld      = 1 // 消息进入了审核队列
+	chatStatusChallenge = 2 // 需要先完成工作量证明, payLoad为chatChallenge
+)
+
+const chatPowTTL = 10 * time.Minute
+
+var (
+	errChatTooFrequent = errors.New("you are sending messages too frequently, please try again later")
+	errChatDuplicate   = errors.New("duplicate message")
+	errChatChallenge   = errors.New("please complete the challenge before sending")
+)
+
+var (
+	chatIPLimiter      *tb.RateLimiter
+	chatVisitorLimiter *tb.RateLimiter
+	chatDupLimiter     *tb.RateLimiter
+	chatPow            *tb.PowChallenger
+)
+
+// 消息中的链接, 取出其域名
+var chatURLRegexp = regexp.MustCompile(`(?i)(?:https?://|www\.)([a-z0-9-]+(?:\.[a-z0-9-]+)+)`)
+
+// 需要访客完成的工作量证明: 找到nonce使 sha256(challenge + nonce) 的前bits个比特都为0
+type chatChallenge struct {
+	Challenge string `json:"challenge"`
+	Bits      int    `json:"bits"`
+}
+
+func initChatSpam() {
+	window := time.Duration(config.AntiSpamConfig.Window) * time.Second
+	chatIPLimiter = tb.NewRateLimiter(window)
+	chatVisitorLimiter = tb.NewRateLimiter(window)
+	chatDupLimiter = tb.NewRateLimiter(time.Duration(config.AntiSpamConfig.DupWindow) * time.Second)
+	chatPow = tb.NewPowChallenger(visitorSecret, config.AntiSpamConfig.PowBits, chatPowTTL)
+}
+
+// 检查发送频率和重复消息, 需要工作量证明时同时返回新的challenge
+// 通过检查后计入发送次数, 消息内容在保存成功后才由recordChatDup记录
+func checkChatSpam(ip, visitor, msg, pow, nonce string) (*chatChallenge, error) {
+	conf := config.AntiSpamConfig
+	ipCount, visitorCount := chatIPLimiter.Count(ip), chatVisitorLimiter.Count(visitor)
+	if (conf.IPLimit > 0 && ipCount >= conf.IPLimit) || (conf.VisitorLimit > 0 && visitorCount >= conf.VisitorLimit) {
+		logs.Warn("callDriver message rate limited: ip=%s visitor=%s ipCount=%d visitorCount=%d", ip, visitor, ipCount, visitorCount)
+		return nil, errChatTooFrequent
+	}
+	if conf.ChallengeAfter > 0 && (ipCount >= conf.ChallengeAfter || visitorCount >= conf.ChallengeAfter) {
+		challenge := &chatChallenge{Challenge: chatPow.Issue(), Bits: chatPow.Bits()}
+		if pow == "" {
+			return challenge, errChatChallenge
+		}
+		if err := chatPow.Verify(pow, nonce); err != nil {
+			logs.Warn("callDriver proof of work failed: ip=%s visitor=%s error=%v", ip, visitor, err)
+			return challenge, err
+		}
+	}
+	hash := chatMessageHash(msg)
+	if chatDupLimiter.Count(visitor+"|"+hash) > 0 || chatDupLimiter.Count(ip+"|"+hash) > 0 {
+		return nil, errChatDuplicate
+	}
+	chatIPLimiter.Hit(ip)
+	chatVisitorLimiter.Hit(visitor)
+	return nil, nil
+}
+
+// 记录已保存或进入审核队列的消息, 窗口内再次发送相同内容会被拒绝
+// 保存失败的消息不记录, 访客可以直接重发
+func recordChatDup(ip, visitor, msg string) {
+	hash := chatMessageHash(msg)
+	chatDupLimiter.Hit(visitor + "|" + hash)
+	chatDupLimiter.Hit(ip + "|" + hash)
+}
+
+// 忽略大小写和空白后消息内容的哈希, 用于检测重复消息
+func chatMessageHash(msg string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(strings.Join(strings.Fields(msg), " "))))
+	return hex.EncodeToString(sum[:16])
+}
+
+// 消息需要进入审核队列的原因, 不需要时返回空字符串
+func chatHoldReason(msg string) string {
+	conf := config.AntiSpamConfig
+	lower := strings.ToLower(msg)
+	for _, keyword := range conf.Keywords {
+		if keyword = strings.ToLower(strings.TrimSpace(keyword)); keyword != "" && strings.Contains(lower, keyword) {
+			return "keyword: " + keyword
+		}
+	}
+	for _, match := range chatURLRegexp.FindAllStringSubmatch(lower, -1) {
+		host := match[1]
+		for _, domain := range conf.BlockDomains {
+			domain = strings.ToLower(strings.TrimSpace(domain))
+			if domain != "" && (host == domain || strings.HasSuffix(host, "."+domain)) {
+				return "blocked domain: " + host
+			}
+		}
+		if conf.HoldURL {
+			return "link: " + host
+		}
+	}
+	return ""
+}
+
+// 保存进入审核队列的消息并推送给Boss
+func holdChatMessage(visitor, nick, msg, ip, reason string, attachments []model.CallDriverAttachment) error {
+	held, err := model.InsertCallDriverHeld(visitor, nick, msg, ip, reason, attachments)
+	if err != nil {
+		return err
+	}
+	doneChatAttachments(attachments)
+	logs.Info("callDriver message held: id=%s visitor=%s reason=%s", held.ID, visitor, reason)
+	chatHub.publish(chatEvent{Type: "held", Data: held}, "", true)
+	return nil
+}
+
+// Boss查看审核队列, 参数: limit可选
+func callDriverBossHeld(w http.ResponseWriter, r *http.Request) {
+	if !config.ServerConfig.IsTest && !IpMonitor.IsInWhiteList(r) {
+		w.WriteHeader(http.StatusNotAcceptable)
+		return
+	}
+	var req struct {
+		Limit string `json:"limit"`
+	}
+	var resp respStruct
+	var err error
+	for loop := true; loop; loop = false {
+		if err = tb.MustQueryFromRequest(r, &req); err != nil {
+			break
+		}
+		limit := chatPageMaxSize
+		if req.Limit != "" {
+			if limit, err = strconv.Atoi(req.Limit); err != nil || limit <= 0 {
+				err = fmt.Errorf("unexpect limit: %q", req.Limit)
+				break
+			}
+			if limit > chatPageMaxSize {
+				limit = chatPageMaxSize
+			}
+		}
+		var helds []model.CallDriverHeld
+		var total int
+		if helds, total, err = model.FindCallDriverHeld(limit); err != nil {
+			break
+		}
+		resp.PayLoad = map[string]interface{}{"messages": helds, "total": total}
+	}
+	if err != nil {
+		logs.Warn("find held messages failed: error=%v url=%s", err, r.URL)
+		resp.Status = -1
+		resp.Msg = fmt.Sprint(err)
+	}
+	responseJson(&w, resp)
+}
+
+// Boss审核消息, 参数: id, ope为approve|reject
+// 通过的消息作为访客的新消息发送到会话并通知, 拒绝的消息直接删除
+func callDriverBossModerate(w http.ResponseWriter, r *http.Request) {
+	if !config.ServerConfig.IsTest && !IpMonitor.IsInWhiteList(r) {
+		w.WriteHeader(http.StatusNotAcceptable)
+		return
+	}
+	var req struct {
+		ID  string `json:"id"`
+		Ope string `json:"ope"`
+	}
+	var resp respStruct
+	var err error
+	for loop := true; loop; loop = false {
+		if err = tb.MustQueryFromRequest(r, &req); err != nil {
+			break
+		}
+		if req.Ope != "approve" && req.Ope != "reject" {
+			err = fmt.Errorf("unexpect ope: %q", req.Ope)
+			break
+		}
+		var held model.CallDriverHeld
+		if held, err = model.RemoveCallDriverHeld(req.ID); err != nil {
+			break
+		}
+		if req.Ope == "reject" {
+			break
+		}
+		var record model.CallDriverChat
+		record, err = model.InsertCallDriverMessage(held.Visitor, myName, held.Nick, held.Message, held.IP, held.Attachments)
+		if err != nil {
+			break
+		}
+		var conv model.CallDriverConversation
+		if conv, err = recordChatMessage(record, true); err != nil {
+			break
+		}
+		notifyChatMessage(record, conv)
+	}
+	logs.Info("moderate held message: req=%+v error=%v", req, err)
+	if err != nil {
+		resp.Status = -1
+		resp.Msg = fmt.Sprint(err)
+	}
+	responseJson(&w, resp)
+}
@@ -0,0 +1,90 @@
+package handler
+
+// callDriver访客的身份: 访客第一次发送消息时由服务端生成随机的访客id, 以签名cookie的形式保存在浏览器中
+// 访客的聊天记录和会话都以访客id关联, 昵称只用于显示; 没有cookie的请求无法读取任何人的聊天记录
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"../config"
+	"github.com/astaxie/beego/logs"
+)
+
+const (
+	visitorCookieName = "cd_visitor"
+	visitorCookieAge  = 365 * 24 * time.Hour
+)
+
+// 没有访客身份, 即访客还没有发送过消息
+var errNoVisitor = errors.New("no visitor identity, please send a message first")
+
+var visitorSecret []byte
+
+// 读取签名密钥, 未配置时随机生成
+func initChatVisitor() {
+	if config.CallDriverConfig.VisitorSecret != "" {
+		visitorSecret = []byte(config.CallDriverConfig.VisitorSecret)
+		return
+	}
+	visitorSecret = make([]byte, 32)
+	rand.Read(visitorSecret)
+	logs.Warn("visitor_secret not set, visitor identities will be invalid after restart")
+}
+
+// 生成新的访客id
+func newVisitorID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return "v" + hex.EncodeToString(b)
+}
+
+// 计算访客id的签名
+func signVisitorID(id string) string {
+	mac := hmac.New(sha256.New, visitorSecret)
+	mac.Write([]byte(id))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// 从请求的cookie中读取并校验访客id
+func getVisitorID(r *http.Request) (string, error) {
+	cookie, err := r.Cookie(visitorCookieName)
+	if err != nil {
+		return "", errNoVisitor
+	}
+	idx := strings.LastIndex(cookie.Value, ".")
+	if idx <= 0 {
+		return "", errNoVisitor
+	}
+	id, sign := cookie.Value[:idx], cookie.Value[idx+1:]
+	if !hmac.Equal([]byte(sign), []byte(signVisitorID(id))) {
+		logs.Warn("bad visitor cookie: value=%s", cookie.Value)
+		return "", errNoVisitor
+	}
+	return id, nil
+}
+
+// 获取访客id, 没有时生成新的身份并写入cookie
+func getOrCreateVisitorID(w http.ResponseWriter, r *http.Request) string {
+	if id, err := getVisitorID(r); err == nil {
+		return id
+	}
+	id := newVisitorID()
+	http.SetCookie(w, &http.Cookie{
+		Name:     visitorCookieName,
+		Value:    id + "." + signVisitorID(id),
+		Path:     "/callDriver",
+		MaxAge:   int(visitorCookieAge / time.Second),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	logs.Info("new visitor identity: id=%s", id)
+	return id
+}
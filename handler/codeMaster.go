@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
@@ -27,6 +28,8 @@ func CodeMasterAPIHandler(w http.ResponseWriter, r *http.Request) {
 		codeSubmitHandler(w, r)
 	case "cmapi/home/getAllWorks":
 		getAllWorksHandler(w, r)
+	case "cmapi/home/search":
+		searchWorksHandler(w, r)
 	case "cmapi/codeDetail/getDetailByID":
 		getCodeDetail(w, r)
 	case "cmapi/codeDetail/getCommentList":
@@ -37,6 +40,26 @@ func CodeMasterAPIHandler(w http.ResponseWriter, r *http.Request) {
 		updateWork(w, r)
 	case "cmapi/codeDetail/runWork":
 		runWork(w, r)
+	case "cmapi/user/register":
+		codeMasterRegister(w, r)
+	case "cmapi/user/login":
+		codeMasterLogin(w, r)
+	case "cmapi/user/logout":
+		codeMasterLogout(w, r)
+	case "cmapi/user/me":
+		codeMasterMe(w, r)
+	case "cmapi/user/profile":
+		codeMasterProfile(w, r)
+	case "cmapi/user/updateProfile":
+		codeMasterUpdateProfile(w, r)
+	case "cmapi/user/password":
+		codeMasterChangePassword(w, r)
+	case "cmapi/user/uploadAvatar":
+		codeMasterUploadAvatar(w, r)
+	case "cmapi/user/avatar":
+		codeMasterAvatar(w, r)
+	case "cmapi/user/works":
+		codeMasterUserWorks(w, r)
 	default:
 		logs.Warn("unexpect uri: uri=%s", uri)
 	}
@@ -112,12 +135,16 @@ func codeDebug(w http.ResponseWriter, r *http.Request) {
 	responseJson(&w, resp)
 }
 
-// 处理作品提交post请求
+// 处理作品提交post请求, 需要登录, 作者为当前用户
 func codeSubmitHandler(w http.ResponseWriter, r *http.Request) {
 	var work model.CodeMasterWork
 	var err error
 	var resp respStruct
 	for loop := true; loop; loop = false {
+		var user *model.CodeMasterUser
+		if user, err = getCodeMasterUser(r); err != nil {
+			break
+		}
 		decoder := json.NewDecoder(r.Body)
 		err = decoder.Decode(&work)
 		if err != nil {
@@ -125,53 +152,10 @@ func codeSubmitHandler(w http.ResponseWriter, r *http.Request) {
 			break
 		}
 		logs.Debug("work=%+v", work)
+		work.UserID = user.ID
+		work.Author = user.Nick
 		// 检查提交字段是否完整和有误
-		if work.Language != "CPP" && work.Language != "C" && work.Language != "GO" {
-			err = fmt.Errorf("unexpect params: language=%q", work.Language)
-			break
-		}
-		if work.Title == "" || len(work.Title) > 80 {
-			err = fmt.Errorf("unexpect params: title=%q", work.Title)
-			break
-		}
-		if work.Author == "" || len(work.Author) > 80 {
-			err = fmt.Errorf("unexpect params: author=%q", work.Author)
-			break
-		}
-		if work.CType < 0 || work.CType > 4 {
-			err = fmt.Errorf("unexpect params: ctype=%d", work.CType)
-			break
-		}
-		if len(work.TagStr) > 120 {
-			err = fmt.Errorf("unexpect params: tagStr=%q", work.TagStr)
-			break
-		}
-		if len(work.InputDesc) > 1200 {
-			err = fmt.Errorf("unexpect params: inputDesc=%q", work.InputDesc)
-			break
-		}
-		if len(work.DemoInput) > 16000 {
-			err = fmt.Errorf("unexpect params: DemoInput=%q", work.DemoInput)
-			break
-		}
-		if len(work.DemoOutput) > 16000 {
-			err = fmt.Errorf("unexpect params: demoOuput=%q", work.DemoOutput)
-			break
-		}
-		if len(work.Code) > 50000 {
-			err = fmt.Errorf("unexpect params: code=%q", work.Code)
-			break
-		}
-		if len(work.Desc) > 800 || work.Desc == "" {
-			err = fmt.Errorf("unexpect params: code=%q", work.Code)
-			break
-		}
-		if len(work.Detail) > 80000 {
-			err = fmt.Errorf("unexpect params: Detail=%q", work.Detail)
-			break
-		}
-		if len(work.CoverURL) > 800 || work.CoverURL == "" {
-			err = fmt.Errorf("unexpect params: coverUrl=%q", work.CoverURL)
+		if err = checkCodeMasterWork(&work); err != nil {
 			break
 		}
 
@@ -179,6 +163,7 @@ func codeSubmitHandler(w http.ResponseWriter, r *http.Request) {
 		work.IsRecommend = false
 		work.Timestamp = time.Now().Unix()
 		work.Score = 30
+		work.Status = 0
 		work.ID = fmt.Sprintf("%d_%s", time.Now().Unix(), toolbox.GetRandomString(2))
 
 		// 保存到数据库
@@ -189,6 +174,13 @@ func codeSubmitHandler(w http.ResponseWriter, r *http.Request) {
 		}
 		resp.PayLoad = work.ID
 		logs.Info("save work success")
+		indexWork(&work)
+		sendMailEvent(&toolbox.MailEvent{
+			Type:    toolbox.MailEventCodeMaster,
+			Title:   "codeMaster新作品: " + work.Title,
+			Message: fmt.Sprintf("作者: %s\n语言: %s\n%s", work.Author, work.Language, work.Desc),
+			Link:    config.ServerConfig.ServerURL + "/codeMaster/",
+		})
 	}
 	if err != nil {
 		logs.Warn("upload codeMaster work failed: error=%v work=%+v", err, work)
@@ -198,47 +190,175 @@ func codeSubmitHandler(w http.ResponseWriter, r *http.Request) {
 	responseJson(&w, resp)
 }
 
-// 查询作品列表
+// 检查作品的字段是否完整和有误, 提交和修改作品时使用
+func checkCodeMasterWork(work *model.CodeMasterWork) error {
+	if work.Language != "CPP" && work.Language != "C" && work.Language != "GO" {
+		return fmt.Errorf("unexpect params: language=%q", work.Language)
+	}
+	if work.Title == "" || len(work.Title) > 80 {
+		return fmt.Errorf("unexpect params: title=%q", work.Title)
+	}
+	if work.Author == "" || len(work.Author) > 80 {
+		return fmt.Errorf("unexpect params: author=%q", work.Author)
+	}
+	if work.CType < 0 || work.CType > 4 {
+		return fmt.Errorf("unexpect params: ctype=%d", work.CType)
+	}
+	if len(work.TagStr) > 120 {
+		return fmt.Errorf("unexpect params: tagStr=%q", work.TagStr)
+	}
+	if len(work.InputDesc) > 1200 {
+		return fmt.Errorf("unexpect params: inputDesc=%q", work.InputDesc)
+	}
+	if len(work.DemoInput) > 16000 {
+		return fmt.Errorf("unexpect params: DemoInput=%q", work.DemoInput)
+	}
+	if len(work.DemoOutput) > 16000 {
+		return fmt.Errorf("unexpect params: demoOuput=%q", work.DemoOutput)
+	}
+	if len(work.Code) > 50000 {
+		return fmt.Errorf("unexpect params: code=%q", work.Code)
+	}
+	if len(work.Desc) > 800 || work.Desc == "" {
+		return fmt.Errorf("unexpect params: code=%q", work.Code)
+	}
+	if len(work.Detail) > 80000 {
+		return fmt.Errorf("unexpect params: Detail=%q", work.Detail)
+	}
+	if len(work.CoverURL) > 800 || work.CoverURL == "" {
+		return fmt.Errorf("unexpect params: coverUrl=%q", work.CoverURL)
+	}
+	return nil
+}
+
+// 作品列表中一个作品的简单信息
+type codeWorkSummary struct {
+	ID          string `json:"id"`
+	Title       string `json:"title"`
+	CType       int    `json:"ctype"`
+	Author      string `json:"author"`
+	UserID      string `json:"userId"`
+	TagStr      string `json:"tagStr"`
+	Desc        string `json:"desc"`
+	CoverURL    string `json:"coverUrl"`
+	Timestamp   int64  `json:"timestamp"`
+	Score       int    `json:"score"`
+	IsRecommend bool   `json:"isRecommend"`
+	Views       int    `json:"views"`
+	Hot         int    `json:"hot"`
+}
+
+// 生成作品列表, 作者使用用户当前的昵称
+func newCodeWorkSummaries(works []*model.CodeMasterWork) []codeWorkSummary {
+	fillWorkAuthors(works)
+	payload := make([]codeWorkSummary, 0, len(works))
+	for _, v := range works {
+		payload = append(payload, codeWorkSummary{
+			ID:          v.ID,
+			Title:       v.Title,
+			CType:       v.CType,
+			Author:      v.Author,
+			UserID:      v.UserID,
+			TagStr:      v.TagStr,
+			Desc:        v.Desc,
+			CoverURL:    v.CoverURL,
+			Timestamp:   v.Timestamp,
+			Score:       v.Score,
+			IsRecommend: v.IsRecommend,
+			Views:       v.Views,
+			Hot:         v.Hot,
+		})
+	}
+	return payload
+}
+
+const (
+	workPageSize    = 20
+	workPageMaxSize = 100
+)
+
+// 解析作品列表的分页、筛选和排序参数
+// 参数: page从1开始, pageSize默认20; ctype, language, tag, recommend为1|0; sort为time(默认)|score|popularity
+func parseWorkQuery(r *http.Request) (filter *model.WorkFilter, sort string, page int, pageSize int, err error) {
+	query := r.URL.Query()
+	filter = &model.WorkFilter{
+		CType:    -1,
+		Language: query.Get("language"),
+		Tag:      strings.TrimSpace(query.Get("tag")),
+	}
+	page, pageSize = 1, workPageSize
+	if s := query.Get("page"); s != "" {
+		if page, err = strconv.Atoi(s); err != nil || page <= 0 {
+			return nil, "", 0, 0, fmt.Errorf("unexpect page: %q", s)
+		}
+	}
+	if s := query.Get("pageSize"); s != "" {
+		if pageSize, err = strconv.Atoi(s); err != nil || pageSize <= 0 {
+			return nil, "", 0, 0, fmt.Errorf("unexpect pageSize: %q", s)
+		}
+		if pageSize > workPageMaxSize {
+			pageSize = workPageMaxSize
+		}
+	}
+	if s := query.Get("ctype"); s != "" {
+		if filter.CType, err = strconv.Atoi(s); err != nil || filter.CType < 0 || filter.CType > 4 {
+			return nil, "", 0, 0, fmt.Errorf("unexpect ctype: %q", s)
+		}
+	}
+	if filter.Language != "" && filter.Language != "CPP" && filter.Language != "C" && filter.Language != "GO" {
+		return nil, "", 0, 0, fmt.Errorf("unexpect language: %q", filter.Language)
+	}
+	switch query.Get("recommend") {
+	case "":
+	case "1":
+		filter.Recommend = 1
+	case "0":
+		filter.Recommend = -1
+	default:
+		return nil, "", 0, 0, fmt.Errorf("unexpect recommend: %q", query.Get("recommend"))
+	}
+	sort = query.Get("sort")
+	if sort == "" {
+		sort = model.WorkSortTime
+	}
+	if sort != model.WorkSortTime && sort != model.WorkSortScore && sort != model.WorkSortHot {
+		return nil, "", 0, 0, fmt.Errorf("unexpect sort: %q", sort)
+	}
+	return filter, sort, page, pageSize, nil
+}
+
+// 按条件分页查询作品, 返回作品列表和总数
+func queryWorks(filter *model.WorkFilter, sort string, page int, pageSize int) (interface{}, error) {
+	works, total, err := model.FindCodeMasterWorks(filter, sort, (page-1)*pageSize, pageSize)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"works":    newCodeWorkSummaries(works),
+		"total":    total,
+		"page":     page,
+		"pageSize": pageSize,
+	}, nil
+}
+
+// 分页查询作品列表, 参数见parseWorkQuery
 func getAllWorksHandler(w http.ResponseWriter, r *http.Request) {
 	var resp respStruct
-	type payloadStruct struct {
-		ID          string `json:"id"`
-		Title       string `json:"title"`
-		CType       int    `json:"ctype"`
-		Author      string `json:"author"`
-		TagStr      string `json:"tagStr"`
-		Desc        string `json:"desc"`
-		CoverURL    string `json:"coverUrl"`
-		Timestamp   int64  `json:"timestamp"`
-		Score       int    `json:"score"`
-		IsRecommend bool   `json:"isRecommend"`
-	}
-	payload := make([]payloadStruct, 0)
-	var allWorks []*model.CodeMasterWork
 	var err error
 	for loop := true; loop; loop = false {
-		allWorks, err = model.GetAllCodeMasterWork()
-		if err != nil {
+		var filter *model.WorkFilter
+		var sort string
+		var page, pageSize int
+		if filter, sort, page, pageSize, err = parseWorkQuery(r); err != nil {
 			break
 		}
-		for _, v := range allWorks {
-			payload = append(payload, payloadStruct{
-				ID:          v.ID,
-				Title:       v.Title,
-				CType:       v.CType,
-				Author:      v.Author,
-				TagStr:      v.TagStr,
-				Desc:        v.Desc,
-				CoverURL:    v.CoverURL,
-				Timestamp:   v.Timestamp,
-				Score:       v.Score,
-				IsRecommend: v.IsRecommend,
-			})
-		}
-		logs.Info("query all works success, len=%d", len(payload))
-		resp.PayLoad = payload
+		if resp.PayLoad, err = queryWorks(filter, sort, page, pageSize); err != nil {
+			break
+		}
+		logs.Info("query works success: filter=%+v sort=%s page=%d", filter, sort, page)
 	}
 	if err != nil {
+		logs.Warn("query works failed: error=%v url=%s", err, r.URL)
 		resp.Status = -1
 		resp.Msg = fmt.Sprint(err)
 	}
@@ -271,6 +391,8 @@ func getCodeDetail(w http.ResponseWriter, r *http.Request) {
 			logs.Warn("get detail failed: error=%v params=%+v", err, params)
 			break
 		}
+		fillWorkAuthors([]*model.CodeMasterWork{detail})
+		model.IncWorkPopularity(detail.ID, 1, model.HotOfView)
 		resp.PayLoad = detail
 		logs.Info("get detail success: params=%+v", params)
 	}
@@ -281,17 +403,19 @@ func getCodeDetail(w http.ResponseWriter, r *http.Request) {
 	responseJson(&w, resp)
 }
 
-// 提交评论
+// 提交评论, 需要登录, 评论者为当前用户
 func submitRecommend(w http.ResponseWriter, r *http.Request) {
 	var params struct {
 		WorkID  string `json:"workId"`
-		Author  string `json:"author"`
 		Comment string `json:"comment"`
-		ImgSrc  string `json:"imgSrc"`
 	}
 	var resp respStruct
 	var err error
 	for loop := true; loop; loop = false {
+		var user *model.CodeMasterUser
+		if user, err = getCodeMasterUser(r); err != nil {
+			break
+		}
 		decoder := json.NewDecoder(r.Body)
 		err = decoder.Decode(&params)
 		if err != nil {
@@ -300,7 +424,7 @@ func submitRecommend(w http.ResponseWriter, r *http.Request) {
 		}
 
 		// 检查参数
-		if params.WorkID == "" || params.Author == "" || params.Comment == "" {
+		if params.WorkID == "" || params.Comment == "" || len(params.Comment) > 2000 {
 			logs.Warning("unexpect params: params=%+v", params)
 			err = fmt.Errorf("unexpect params: %+v", params)
 			break
@@ -325,9 +449,10 @@ func submitRecommend(w http.ResponseWriter, r *http.Request) {
 		}
 		commentData.Comments = append(commentData.Comments, &model.Comment{
 			Timestamp: time.Now().Unix(),
-			ImgSrc:    params.ImgSrc,
+			ImgSrc:    codeMasterAvatarURL(user),
+			UserID:    user.ID,
 			Desc:      params.Comment,
-			Author:    params.Author,
+			Author:    user.Nick,
 		})
 		// 更新数据库
 		err = model.UpdateCommentList(commentData)
@@ -335,6 +460,7 @@ func submitRecommend(w http.ResponseWriter, r *http.Request) {
 			logs.Error("add comment failed: eror=%v params=%+v", err, params)
 			break
 		}
+		model.IncWorkPopularity(params.WorkID, 0, model.HotOfComment)
 		logs.Info("add new comment success: params=%+v", params)
 	}
 	if err != nil {
@@ -370,6 +496,7 @@ func getRecommend(w http.ResponseWriter, r *http.Request) {
 			logs.Warn("get commemtList failed: error=%v params=%+v", err, params)
 			break
 		}
+		fillCommentAuthors(commemtList.Comments)
 		resp.PayLoad = commemtList.Comments
 		logs.Info("get commemtList success: params=%+v", params)
 	}
@@ -381,19 +508,27 @@ func getRecommend(w http.ResponseWriter, r *http.Request) {
 }
 
 // 更新作品信息或删除算法作品
+// 带上正确的key时为管理员操作, 可以修改任何作品以及评分和推荐; 否则需要登录, 且只能修改和删除自己的作品
 func updateWork(w http.ResponseWriter, r *http.Request) {
 	var params struct {
-		Key         string `json:"key"`    // 认真密钥
+		Key         string `json:"key"`    // 认真密钥, 作者修改自己的作品时为空
 		OpType      string `json:"opType"` // [UPDATE|DELETE]
 		WorkID      string `json:"workId"`
 		Title       string `json:"title"`       // 为空不更新
-		IsRecommend int    `json:"isRecommend"` // 0时不更新，大于0推荐，小于0不推荐
-		Score       int    `json:"score"`       // 评分，满分为50分,0分时不更新
+		IsRecommend int    `json:"isRecommend"` // 0时不更新，大于0推荐，小于0不推荐, 只有管理员可以修改
+		Score       int    `json:"score"`       // 评分，满分为50分,0分时不更新, 只有管理员可以修改
 		CoverURL    string `json:"coverUrl"`    // 封面图片，为空时不更新
 		TagStr      string `json:"tagStr"`      // 标签，为空时不更新
+		Desc        string `json:"desc"`        // 简介, 为空时不更新
+		InputDesc   string `json:"inputDesc"`   // 输入数据格式描述, 为空时不更新
+		Detail      string `json:"detail"`      // 为空时不更新
+		DemoInput   string `json:"demoInput"`   // 为空时不更新
+		DemoOutput  string `json:"demoOuput"`   // 为空时不更新
 	}
 	var resp respStruct
 	var err error
+	operator := "admin"
+	written := false // 是否已写入了修改
 	for loop := true; loop; loop = false {
 		if r.Method != http.MethodPost {
 			w.WriteHeader(http.StatusMethodNotAllowed)
@@ -417,11 +552,34 @@ func updateWork(w http.ResponseWriter, r *http.Request) {
 			err = fmt.Errorf("unexpect params: optype=%s", params.OpType)
 			break
 		}
-		if params.Key != config.ServerConfig.AuthorityKey {
-			logs.Warning("unexpect key: %s", params.Key)
-			err = errors.New("not Authority")
+		var work *model.CodeMasterWork
+		work, err = model.GetCodeDetailByID(params.WorkID)
+		if err != nil {
+			logs.Warn("get work failed: error=%v id=%s", err, params.WorkID)
 			break
 		}
+		isAdmin := params.Key != "" && params.Key == config.ServerConfig.AuthorityKey
+		if !isAdmin {
+			if params.Key != "" {
+				logs.Warning("unexpect key: %s", params.Key)
+				err = errors.New("not Authority")
+				break
+			}
+			var user *model.CodeMasterUser
+			if user, err = getCodeMasterUser(r); err != nil {
+				break
+			}
+			operator = user.ID
+			if work.UserID == "" || work.UserID != user.ID {
+				logs.Warning("not the author: user=%s work=%s author=%s", user.ID, work.ID, work.UserID)
+				err = errors.New("not Authority")
+				break
+			}
+			if params.Score != 0 || params.IsRecommend != 0 {
+				err = errors.New("score and isRecommend can only be changed by admin")
+				break
+			}
+		}
 
 		// 数据操作
 		if params.OpType == "DELETE" {
@@ -430,19 +588,59 @@ func updateWork(w http.ResponseWriter, r *http.Request) {
 				logs.Error("delete work failed: params=%+v error=%v", params, err)
 				break
 			}
-			logs.Info("delete work success: params=%+v", params)
+			written = true
+			logs.Info("delete work success: id=%s operator=%s", params.WorkID, operator)
 			break
 		}
 		if params.OpType == "UPDATE" {
-			err = model.UpdateWorksInfo(params.WorkID, params.Score, params.IsRecommend, params.Title, params.CoverURL, params.TagStr)
-			if err != nil {
-				logs.Error("update work failed: params=%+v error=%v", params, err)
-				break
+			// 先检查修改后的内容, 通过后再写入, 避免只写入了一部分
+			changed := false
+			for _, f := range []struct {
+				value string
+				field *string
+			}{
+				{params.Title, &work.Title},
+				{params.CoverURL, &work.CoverURL},
+				{params.TagStr, &work.TagStr},
+				{params.Desc, &work.Desc},
+				{params.InputDesc, &work.InputDesc},
+				{params.Detail, &work.Detail},
+				{params.DemoInput, &work.DemoInput},
+				{params.DemoOutput, &work.DemoOutput},
+			} {
+				if f.value != "" {
+					*f.field = f.value
+					changed = true
+				}
+			}
+			if changed {
+				if err = checkCodeMasterWork(work); err != nil {
+					break
+				}
+			}
+			if params.Score != 0 || params.IsRecommend != 0 {
+				err = model.UpdateWorksInfo(params.WorkID, params.Score, params.IsRecommend, "", "", "")
+				if err != nil {
+					logs.Error("update work failed: params=%+v error=%v", params, err)
+					break
+				}
+				written = true
 			}
-			logs.Info("update work success: params=%+v", params)
+			if changed {
+				if err = model.UpdateWorkContent(work); err != nil {
+					logs.Error("update work failed: params=%+v error=%v", params, err)
+					break
+				}
+				written = true
+			}
+			logs.Info("update work success: id=%s operator=%s", params.WorkID, operator)
 			break
 		}
 	}
+	// 有任何修改写入成功时都需要更新搜索索引
+	if written {
+		reindexWork(params.WorkID)
+	}
 	if err != nil {
 		resp.Status = -1
 		resp.Msg = fmt.Sprint(err)
@@ -518,6 +716,7 @@ func runWork(w http.ResponseWriter, r *http.Request) {
 			logs.Error("unmarshal failed: err=%v", err)
 			break
 		}
+		model.IncWorkPopularity(work.ID, 0, model.HotOfRun)
 		resp.PayLoad = payload
 		logs.Info("run work success, resp=%+v", rpcResp)
 	}
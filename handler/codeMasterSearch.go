@@ -0,0 +1,146 @@
+package handler
+
+// codeMaster作品的全文搜索
+// 索引保存在内存中, 启动时从mongo重建, 提交、修改和删除作品时同步更新
+// 没有使用mongo的文本索引: 它不支持中文分词, 而且每个集合只能有一个文本索引, 无法按需搜索代码
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"../model"
+	"../toolbox"
+	"github.com/astaxie/beego/logs"
+)
+
+const workSearchMaxLen = 100 // 搜索词的最大字数
+
+// 参与搜索的字段及权重, 代码只在请求时指定code=1才搜索
+var workIndex = toolbox.NewTextIndex(map[string]float64{
+	"title":  3,
+	"tags":   2,
+	"desc":   1.5,
+	"detail": 1,
+	"code":   0.5,
+})
+
+var (
+	workSearchFields     = []string{"title", "tags", "desc", "detail"}
+	workSearchCodeFields = []string{"title", "tags", "desc", "detail", "code"}
+)
+
+// 启动时在后台建立索引
+func initWorkIndex() {
+	go func() {
+		err := model.IterCodeMasterWorks(func(work *model.CodeMasterWork) error {
+			indexWork(work)
+			return nil
+		})
+		logs.Info("build codeMaster search index result: works=%d error=%v", workIndex.Len(), err)
+	}()
+}
+
+// 更新作品的索引, 已删除的作品从索引中移除
+// 索引中保存不含大字段的作品副本, 用于按条件过滤
+func indexWork(work *model.CodeMasterWork) {
+	if work.Status != 0 {
+		workIndex.Remove(work.ID)
+		return
+	}
+	meta := *work
+	meta.Code, meta.Detail, meta.InputDesc, meta.DemoInput, meta.DemoOutput = "", "", "", "", ""
+	workIndex.Put(work.ID, map[string]string{
+		"title":  work.Title,
+		"tags":   work.TagStr,
+		"desc":   work.Desc,
+		"detail": work.Detail,
+		"code":   work.Code,
+	}, &meta)
+}
+
+// 从mongo重新读取作品并更新索引
+func reindexWork(id string) {
+	work, err := model.GetCodeDetailByID(id)
+	if err != nil || work == nil {
+		workIndex.Remove(id)
+		return
+	}
+	indexWork(work)
+}
+
+// 搜索结果中的一个作品
+type codeWorkHit struct {
+	codeWorkSummary
+	Score      float64           `json:"relevance"`  // 相关度
+	Highlights map[string]string `json:"highlights"` // 字段 -> 摘要, 匹配的文字以<em>标记, 已转义为HTML
+}
+
+// 搜索作品, 按相关度排序
+// 参数: q为搜索词, code=1时同时搜索代码; 其它筛选和分页参数同getAllWorks, sort参数无效
+func searchWorksHandler(w http.ResponseWriter, r *http.Request) {
+	var resp respStruct
+	var err error
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	for loop := true; loop; loop = false {
+		if query == "" || utf8.RuneCountInString(query) > workSearchMaxLen {
+			err = fmt.Errorf("unexpect q: %q", query)
+			break
+		}
+		var filter *model.WorkFilter
+		var page, pageSize int
+		if filter, _, page, pageSize, err = parseWorkQuery(r); err != nil {
+			break
+		}
+		fields := workSearchFields
+		if r.URL.Query().Get("code") == "1" {
+			fields = workSearchCodeFields
+		}
+
+		hits := workIndex.Search(query, fields, func(meta interface{}) bool {
+			return filter.Match(meta.(*model.CodeMasterWork))
+		})
+		total := len(hits)
+		start, end := (page-1)*pageSize, page*pageSize
+		if start > total {
+			start = total
+		}
+		if end > total {
+			end = total
+		}
+		hits = hits[start:end]
+
+		// 当前页的作品从mongo读取, 保证浏览次数等信息是最新的
+		ids := make([]string, 0, len(hits))
+		scores := make(map[string]float64, len(hits))
+		for _, hit := range hits {
+			ids = append(ids, hit.ID)
+			scores[hit.ID] = hit.Score
+		}
+		var works []*model.CodeMasterWork
+		if works, err = model.FindCodeMasterWorksByIDs(ids); err != nil {
+			break
+		}
+		results := make([]codeWorkHit, 0, len(works))
+		for _, summary := range newCodeWorkSummaries(works) {
+			results = append(results, codeWorkHit{
+				codeWorkSummary: summary,
+				Score:           scores[summary.ID],
+				Highlights:      workIndex.Highlight(summary.ID, query, fields),
+			})
+		}
+		resp.PayLoad = map[string]interface{}{
+			"works":    results,
+			"total":    total,
+			"page":     page,
+			"pageSize": pageSize,
+		}
+		logs.Info("search works success: q=%q filter=%+v page=%d total=%d", query, filter, page, total)
+	}
+	if err != nil {
+		logs.Warn("search works failed: error=%v url=%s", err, r.URL)
+		resp.Status = -1
+		resp.Msg = fmt.Sprint(err)
+	}
+	responseJson(&w, resp)
+}
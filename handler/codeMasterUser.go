@@ -0,0 +1,576 @@
+package handler
+
+// codeMaster的用户账号: 注册或登录后以签名cookie保存登录状态, 修改密码后之前的登录全部失效
+// 作品和评论关联用户id, 显示时使用用户当前的昵称和头像; 作者可以修改和删除自己的作品
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"../config"
+	"../model"
+	tb "../toolbox"
+	"github.com/astaxie/beego/logs"
+)
+
+const (
+	cmSessionCookie = "cm_session"
+	cmAvatarSize    = 256 // 头像缩放后的最大边长
+	cmNickMaxLen    = 20
+	cmBioMaxLen     = 200
+)
+
+var (
+	cmNameReg       = regexp.MustCompile(`^[a-z0-9_]{3,20}$`)
+	errNotLogin     = errors.New("please login first")
+	errWrongAccount = errors.New("wrong name or password")
+)
+
+var (
+	cmSessionSecret []byte
+	cmLoginLimiter  *tb.RateLimiter // 每个ip登录失败的次数
+)
+
+// 读取签名密钥, 未配置时随机生成
+func initCodeMasterUser() {
+	cmLoginLimiter = tb.NewRateLimiter(10 * time.Minute)
+	if config.CodeMasterConfig.SessionSecret != "" {
+		cmSessionSecret = []byte(config.CodeMasterConfig.SessionSecret)
+		return
+	}
+	cmSessionSecret = make([]byte, 32)
+	rand.Read(cmSessionSecret)
+	logs.Warn("cm_session_secret not set, codeMaster users need to login again after restart")
+}
+
+// 返回给前端的用户信息
+type codeMasterUserView struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	Nick       string `json:"nick"`
+	Bio        string `json:"bio"`
+	Avatar     string `json:"avatar"` // 头像地址, 没有头像时为空
+	CreateTime int64  `json:"createTime"`
+}
+
+func newCodeMasterUserView(user *model.CodeMasterUser) codeMasterUserView {
+	return codeMasterUserView{
+		ID:         user.ID,
+		Name:       user.Name,
+		Nick:       user.Nick,
+		Bio:        user.Bio,
+		Avatar:     codeMasterAvatarURL(user),
+		CreateTime: user.CreateTime,
+	}
+}
+
+// 头像地址, 带上更新时间避免浏览器使用旧的缓存
+func codeMasterAvatarURL(user *model.CodeMasterUser) string {
+	if user.AvatarTime == 0 {
+		return ""
+	}
+	return fmt.Sprintf("/cmapi/user/avatar?id=%s&v=%d", user.ID, user.AvatarTime)
+}
+
+// ======================== 登录状态 ========================
+
+// 计算登录cookie的签名
+func signCodeMasterSession(payload string) string {
+	mac := hmac.New(sha256.New, cmSessionSecret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// 写入登录cookie, 格式为 用户id.密码版本.过期时间.签名
+func setCodeMasterSession(w http.ResponseWriter, r *http.Request, user *model.CodeMasterUser) {
+	age := time.Duration(config.CodeMasterConfig.SessionDays) * 24 * time.Hour
+	payload := fmt.Sprintf("%s.%d.%d", user.ID, user.TokenVersion, time.Now().Add(age).Unix())
+	http.SetCookie(w, &http.Cookie{
+		Name:     cmSessionCookie,
+		Value:    payload + "." + signCodeMasterSession(payload),
+		Path:     "/cmapi",
+		MaxAge:   int(age / time.Second),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func clearCodeMasterSession(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     cmSessionCookie,
+		Value:    "",
+		Path:     "/cmapi",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// 从登录cookie中读取当前用户, 未登录或登录已失效时返回errNotLogin
+func getCodeMasterUser(r *http.Request) (*model.CodeMasterUser, error) {
+	cookie, err := r.Cookie(cmSessionCookie)
+	if err != nil {
+		return nil, errNotLogin
+	}
+	idx := strings.LastIndex(cookie.Value, ".")
+	if idx <= 0 {
+		return nil, errNotLogin
+	}
+	payload, sign := cookie.Value[:idx], cookie.Value[idx+1:]
+	if !hmac.Equal([]byte(sign), []byte(signCodeMasterSession(payload))) {
+		logs.Warn("bad codeMaster session: value=%s", cookie.Value)
+		return nil, errNotLogin
+	}
+	parts := strings.Split(payload, ".")
+	if len(parts) != 3 {
+		return nil, errNotLogin
+	}
+	version, _ := strconv.Atoi(parts[1])
+	expire, _ := strconv.ParseInt(parts[2], 10, 64)
+	if expire < time.Now().Unix() {
+		return nil, errNotLogin
+	}
+	user, err := model.GetCodeMasterUser(parts[0])
+	if err == model.ErrorNoRecord {
+		return nil, errNotLogin
+	}
+	if err != nil {
+		return nil, err
+	}
+	if user.TokenVersion != version {
+		return nil, errNotLogin
+	}
+	return user, nil
+}
+
+// ======================== 账号 ========================
+
+// 整理并检查昵称
+func checkCodeMasterNick(nick string) (string, error) {
+	nick = strings.TrimSpace(nick)
+	if nick == "" || utf8.RuneCountInString(nick) > cmNickMaxLen {
+		return "", fmt.Errorf("nick should be 1-%d characters", cmNickMaxLen)
+	}
+	return nick, nil
+}
+
+func checkCodeMasterPassword(password string) error {
+	if len(password) < 6 || len(password) > 64 {
+		return errors.New("password should be 6-64 characters")
+	}
+	return nil
+}
+
+// 注册并登录
+// 参数(json): name为登录名(3-20位小写字母、数字或下划线), password, nick为空时使用登录名
+func codeMasterRegister(w http.ResponseWriter, r *http.Request) {
+	var params struct {
+		Name     string `json:"name"`
+		Password string `json:"password"`
+		Nick     string `json:"nick"`
+	}
+	var resp respStruct
+	var err error
+	ip, _ := tb.GetIpAndPort(r)
+	for loop := true; loop; loop = false {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if config.CodeMasterConfig.Register != "open" {
+			err = errors.New("register is closed")
+			break
+		}
+		if err = json.NewDecoder(r.Body).Decode(&params); err != nil {
+			logs.Error("parse params failed: error=%v", err)
+			break
+		}
+		name := strings.ToLower(strings.TrimSpace(params.Name))
+		if !cmNameReg.MatchString(name) {
+			err = fmt.Errorf("unexpect name: %q", params.Name)
+			break
+		}
+		if err = checkCodeMasterPassword(params.Password); err != nil {
+			break
+		}
+		if params.Nick == "" {
+			params.Nick = name
+		}
+		var nick string
+		if nick, err = checkCodeMasterNick(params.Nick); err != nil {
+			break
+		}
+		id := make([]byte, 12)
+		rand.Read(id)
+		now := time.Now().Unix()
+		user := &model.CodeMasterUser{
+			ID:         "u" + hex.EncodeToString(id),
+			Name:       name,
+			Nick:       nick,
+			PassHash:   tb.HashPassword(params.Password),
+			CreateTime: now,
+			LastLogin:  now,
+		}
+		if err = model.InsertCodeMasterUser(user); err == model.ErrorDupRecord {
+			err = fmt.Errorf("name already exist: %s", name)
+		}
+		if err != nil {
+			break
+		}
+		setCodeMasterSession(w, r, user)
+		resp.PayLoad = newCodeMasterUserView(user)
+	}
+	logs.Info("codeMaster register: name=%s ip=%s error=%v", params.Name, ip, err)
+	if err != nil {
+		resp.Status = -1
+		resp.Msg = fmt.Sprint(err)
+	}
+	responseJson(&w, resp)
+}
+
+// 登录, 每个ip在10分钟内失败的次数有限制
+// 参数(json): name, password
+func codeMasterLogin(w http.ResponseWriter, r *http.Request) {
+	var params struct {
+		Name     string `json:"name"`
+		Password string `json:"password"`
+	}
+	var resp respStruct
+	var err error
+	ip, _ := tb.GetIpAndPort(r)
+	for loop := true; loop; loop = false {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if cmLoginLimiter.Count(ip) >= config.CodeMasterConfig.LoginLimit {
+			err = errors.New("too many failed attempts, please try again later")
+			break
+		}
+		if err = json.NewDecoder(r.Body).Decode(&params); err != nil {
+			logs.Error("parse params failed: error=%v", err)
+			break
+		}
+		var user *model.CodeMasterUser
+		user, err = model.GetCodeMasterUserByName(strings.ToLower(strings.TrimSpace(params.Name)))
+		if err == model.ErrorNoRecord || (err == nil && !tb.CheckPassword(params.Password, user.PassHash)) {
+			cmLoginLimiter.Hit(ip)
+			err = errWrongAccount
+		}
+		if err != nil {
+			break
+		}
+		user.LastLogin = time.Now().Unix()
+		model.UpdateCodeMasterLogin(user.ID, user.LastLogin)
+		setCodeMasterSession(w, r, user)
+		resp.PayLoad = newCodeMasterUserView(user)
+	}
+	logs.Info("codeMaster login: name=%s ip=%s error=%v", params.Name, ip, err)
+	if err != nil {
+		resp.Status = -1
+		resp.Msg = fmt.Sprint(err)
+	}
+	responseJson(&w, resp)
+}
+
+// 退出登录
+func codeMasterLogout(w http.ResponseWriter, r *http.Request) {
+	clearCodeMasterSession(w, r)
+	responseJson(&w, respStruct{})
+}
+
+// 查询当前登录的用户, 未登录时返回错误
+func codeMasterMe(w http.ResponseWriter, r *http.Request) {
+	var resp respStruct
+	user, err := getCodeMasterUser(r)
+	if err != nil {
+		resp.Status = -1
+		resp.Msg = fmt.Sprint(err)
+	} else {
+		resp.PayLoad = newCodeMasterUserView(user)
+	}
+	responseJson(&w, resp)
+}
+
+// 查询用户的公开信息
+// 参数: id为用户id
+func codeMasterProfile(w http.ResponseWriter, r *http.Request) {
+	var params struct {
+		ID string `json:"id"`
+	}
+	var resp respStruct
+	var err error
+	for loop := true; loop; loop = false {
+		if err = tb.MustQueryFromRequest(r, &params); err != nil {
+			logs.Error("parse params failed: error=%v", err)
+			break
+		}
+		var user *model.CodeMasterUser
+		if user, err = model.GetCodeMasterUser(params.ID); err != nil {
+			break
+		}
+		resp.PayLoad = newCodeMasterUserView(user)
+	}
+	if err != nil {
+		resp.Status = -1
+		resp.Msg = fmt.Sprint(err)
+	}
+	responseJson(&w, resp)
+}
+
+// 修改当前用户的昵称和简介
+// 参数(json): nick, bio
+func codeMasterUpdateProfile(w http.ResponseWriter, r *http.Request) {
+	var params struct {
+		Nick string `json:"nick"`
+		Bio  string `json:"bio"`
+	}
+	var resp respStruct
+	var err error
+	for loop := true; loop; loop = false {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		var user *model.CodeMasterUser
+		if user, err = getCodeMasterUser(r); err != nil {
+			break
+		}
+		if err = json.NewDecoder(r.Body).Decode(&params); err != nil {
+			logs.Error("parse params failed: error=%v", err)
+			break
+		}
+		if user.Nick, err = checkCodeMasterNick(params.Nick); err != nil {
+			break
+		}
+		user.Bio = strings.TrimSpace(params.Bio)
+		if utf8.RuneCountInString(user.Bio) > cmBioMaxLen {
+			err = fmt.Errorf("bio should be at most %d characters", cmBioMaxLen)
+			break
+		}
+		if err = model.UpdateCodeMasterProfile(user.ID, user.Nick, user.Bio); err != nil {
+			break
+		}
+		resp.PayLoad = newCodeMasterUserView(user)
+		logs.Info("update codeMaster profile: id=%s nick=%s", user.ID, user.Nick)
+	}
+	if err != nil {
+		resp.Status = -1
+		resp.Msg = fmt.Sprint(err)
+	}
+	responseJson(&w, resp)
+}
+
+// 修改当前用户的密码, 其他设备上的登录失效, 当前请求重新写入登录cookie
+// 参数(json): oldPassword, newPassword
+func codeMasterChangePassword(w http.ResponseWriter, r *http.Request) {
+	var params struct {
+		OldPassword string `json:"oldPassword"`
+		NewPassword string `json:"newPassword"`
+	}
+	var resp respStruct
+	var err error
+	ip, _ := tb.GetIpAndPort(r)
+	for loop := true; loop; loop = false {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if cmLoginLimiter.Count(ip) >= config.CodeMasterConfig.LoginLimit {
+			err = errors.New("too many failed attempts, please try again later")
+			break
+		}
+		var user *model.CodeMasterUser
+		if user, err = getCodeMasterUser(r); err != nil {
+			break
+		}
+		if err = json.NewDecoder(r.Body).Decode(&params); err != nil {
+			logs.Error("parse params failed: error=%v", err)
+			break
+		}
+		if !tb.CheckPassword(params.OldPassword, user.PassHash) {
+			cmLoginLimiter.Hit(ip)
+			err = errWrongAccount
+			break
+		}
+		if err = checkCodeMasterPassword(params.NewPassword); err != nil {
+			break
+		}
+		if err = model.UpdateCodeMasterPassword(user.ID, tb.HashPassword(params.NewPassword)); err != nil {
+			break
+		}
+		user.TokenVersion++
+		setCodeMasterSession(w, r, user)
+		logs.Info("change codeMaster password: id=%s ip=%s", user.ID, ip)
+	}
+	if err != nil {
+		resp.Status = -1
+		resp.Msg = fmt.Sprint(err)
+	}
+	responseJson(&w, resp)
+}
+
+// 上传当前用户的头像, 图片缩放后以jpeg格式保存
+// 参数: POST表单中的file文件, 支持jpeg、png和gif
+func codeMasterUploadAvatar(w http.ResponseWriter, r *http.Request) {
+	var resp respStruct
+	var err error
+	for loop := true; loop; loop = false {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		var user *model.CodeMasterUser
+		if user, err = getCodeMasterUser(r); err != nil {
+			break
+		}
+		maxSize := config.CodeMasterConfig.AvatarMaxSize << 10
+		r.Body = http.MaxBytesReader(w, r.Body, maxSize+64<<10)
+		file, header, ferr := r.FormFile("file")
+		if ferr != nil {
+			err = fmt.Errorf("read upload file failed: %v", ferr)
+			break
+		}
+		defer file.Close()
+		if header.Size > maxSize {
+			err = fmt.Errorf("file too large: size=%d max=%d", header.Size, maxSize)
+			break
+		}
+		conf, _, cerr := image.DecodeConfig(file)
+		if cerr != nil {
+			err = fmt.Errorf("unsupported image: %v", cerr)
+			break
+		}
+		if conf.Width*conf.Height > 4096*4096 {
+			err = fmt.Errorf("image too large: width=%d height=%d", conf.Width, conf.Height)
+			break
+		}
+		file.Seek(0, 0)
+		src, _, derr := image.Decode(file)
+		if derr != nil {
+			err = fmt.Errorf("unsupported image: %v", derr)
+			break
+		}
+		var buf bytes.Buffer
+		if err = jpeg.Encode(&buf, tb.ResizeImage(src, cmAvatarSize), &jpeg.Options{Quality: 85}); err != nil {
+			break
+		}
+		user.AvatarTime = time.Now().Unix()
+		if err = model.UpdateCodeMasterAvatar(user.ID, buf.Bytes(), user.AvatarTime); err != nil {
+			break
+		}
+		resp.PayLoad = codeMasterAvatarURL(user)
+		logs.Info("update codeMaster avatar: id=%s size=%d", user.ID, buf.Len())
+	}
+	if err != nil {
+		logs.Warn("upload codeMaster avatar failed: error=%v", err)
+		resp.Status = -1
+		resp.Msg = fmt.Sprint(err)
+	}
+	responseJson(&w, resp)
+}
+
+// 返回用户的头像
+// url format: /cmapi/user/avatar?id=${userID}&v=${avatarTime}
+func codeMasterAvatar(w http.ResponseWriter, r *http.Request) {
+	avatar, err := model.GetCodeMasterAvatar(r.URL.Query().Get("id"))
+	if err == model.ErrorNoRecord {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	w.Write(avatar)
+}
+
+// 查询用户的作品, 分页、筛选和排序的参数见parseWorkQuery
+// 参数: id为用户id, 为空时查询当前登录用户的作品
+func codeMasterUserWorks(w http.ResponseWriter, r *http.Request) {
+	var resp respStruct
+	var err error
+	for loop := true; loop; loop = false {
+		var filter *model.WorkFilter
+		var sort string
+		var page, pageSize int
+		if filter, sort, page, pageSize, err = parseWorkQuery(r); err != nil {
+			break
+		}
+		if filter.UserID = r.URL.Query().Get("id"); filter.UserID == "" {
+			var user *model.CodeMasterUser
+			if user, err = getCodeMasterUser(r); err != nil {
+				break
+			}
+			filter.UserID = user.ID
+		}
+		resp.PayLoad, err = queryWorks(filter, sort, page, pageSize)
+	}
+	if err != nil {
+		resp.Status = -1
+		resp.Msg = fmt.Sprint(err)
+	}
+	responseJson(&w, resp)
+}
+
+// ======================== 作者信息 ========================
+
+// 查询作品和评论关联的用户, 查询失败时返回空的结果, 显示保存时的作者信息
+func getCodeMasterAuthors(ids []string) map[string]*model.CodeMasterUser {
+	users, err := model.GetCodeMasterUsers(ids)
+	if err != nil {
+		logs.Warn("get codeMaster authors failed: error=%v", err)
+	}
+	return users
+}
+
+// 使用作者当前的昵称
+func fillWorkAuthors(works []*model.CodeMasterWork) {
+	ids := make([]string, 0)
+	for _, work := range works {
+		if work.UserID != "" {
+			ids = append(ids, work.UserID)
+		}
+	}
+	users := getCodeMasterAuthors(ids)
+	for _, work := range works {
+		if user, ok := users[work.UserID]; ok {
+			work.Author = user.Nick
+		}
+	}
+}
+
+// 使用评论者当前的昵称和头像
+func fillCommentAuthors(comments []*model.Comment) {
+	ids := make([]string, 0)
+	for _, comment := range comments {
+		if comment.UserID != "" {
+			ids = append(ids, comment.UserID)
+		}
+	}
+	users := getCodeMasterAuthors(ids)
+	for _, comment := range comments {
+		if user, ok := users[comment.UserID]; ok {
+			comment.Author = user.Nick
+			comment.ImgSrc = codeMasterAvatarURL(user)
+		}
+	}
+}
@@ -2,14 +2,19 @@ package handler
 
 // 提供文件上传和下载功能，可通过curl和wget命令实现文件传送
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"mime/multipart"
 	"net/http"
-	"net/url"
 	"os"
 	"regexp"
 	"strings"
+	"time"
 
 	"../config"
 	"../model"
@@ -23,10 +28,27 @@ func StaticHandler(w http.ResponseWriter, r *http.Request) {
 	url := strings.Trim(fmt.Sprintf("%s", r.URL.Path), "/")
 	if url == "static/upload" {
 		staticUploadHandler(w, r)
+	} else if url == "static/upload/session" {
+		createUploadSessionHandler(w, r)
+	} else if strings.HasPrefix(url, "static/upload/session/") {
+		uploadSessionHandler(w, r)
+	} else if url == "static/mine" {
+		staticMineHandler(w, r)
+	} else if strings.HasPrefix(url, "static/delete/") {
+		staticDeleteHandler(w, r)
 	} else if strings.HasPrefix(url, "static/download/") {
 		staticDownloadHandler(w, r)
 	} else if strings.HasPrefix(url, "static/preview/") {
 		staticPreViewHandler(w, r)
+	} else if strings.HasPrefix(url, "static/thumb/") {
+		staticThumbHandler(w, r)
+	} else if strings.HasPrefix(url, "static/render/") {
+		staticRenderHandler(w, r)
+	} else if strings.HasPrefix(url, "static/meta/") {
+		staticMetaHandler(w, r)
+	} else if url == "static/e2e" {
+		// 浏览器端加密上传和解密下载的页面, 密钥在链接的#之后, 服务端只保存密文
+		assetsHandler(w, "res/html/e2eShare.html")
 	} else {
 		logs.Warn("skip unexpect static request: url=%s", url)
 		w.WriteHeader(http.StatusForbidden)
@@ -34,7 +56,22 @@ func StaticHandler(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
+// 匿名上传的结果, json模式下返回给客户端
+type shareUploadResult struct {
+	Code        string `json:"code"` // 取件码
+	FileName    string `json:"fileName"`
+	Size        int64  `json:"size"`
+	Hash        string `json:"hash"`
+	DownloadURL string `json:"downloadUrl"`
+	PreviewURL  string `json:"previewUrl"`
+	ExpireAt    int64  `json:"expireAt"`    // 过期时间, 0代表不过期
+	DeleteToken string `json:"deleteToken"` // 删除口令, 仅在上传时返回一次
+	DeleteURL   string `json:"deleteUrl"`   // 使用POST或DELETE方法请求该地址可删除文件
+}
+
 // 接受一个post请求，将主体中的文件保存下来，返回一个下载链接,每次仅支持上传单个文件
+// 带上format=json参数或Accept: application/json请求头时以json格式返回结果
+// 带上X-Manage-Token请求头时可以之后通过同样的口令查看和删除自己上传的文件
 // Example：curl -F 'file=@default.conf' http://localhost:80/static/upload
 func staticUploadHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
@@ -44,7 +81,18 @@ func staticUploadHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var err error
+	var result *shareUploadResult
+	jsonMode := isJsonMode(r)
 	defer func() {
+		if jsonMode {
+			resp := respStruct{PayLoad: result}
+			if err != nil {
+				resp.Status = -1
+				resp.Msg = fmt.Sprint(err)
+			}
+			responseJson(&w, resp)
+			return
+		}
 		if err != nil {
 			fmt.Fprintf(w, "Error happen: %v", err)
 		}
@@ -64,6 +112,11 @@ func staticUploadHandler(w http.ResponseWriter, r *http.Request) {
 		logs.Warn(err)
 		return
 	}
+	var ownerHash string
+	ownerHash, err = getOwnerHash(r, false)
+	if err != nil {
+		return
+	}
 
 	for _, files := range r.MultipartForm.File {
 		// 解析表单
@@ -73,44 +126,130 @@ func staticUploadHandler(w http.ResponseWriter, r *http.Request) {
 		}
 		header := files[0]
 		logs.Info("name=%s  size=%d", header.Filename, header.Size)
+		ip, _ := tb.GetIpAndPort(r)
+		var release func()
+		release, err = reserveSpace(areaShare, header.Size, ip)
+		if err != nil {
+			return
+		}
 		var file multipart.File
 		file, err = header.Open()
 		if err != nil {
+			release()
 			logs.Error("open upload file fail: %v", err)
 			return
 		}
 		defer file.Close()
 
-		// 保存文件到本地，名字名字为随机，长度为8
-		var cur *os.File
-		randName := tb.GetRandomString(8)
-		filePath := fmt.Sprintf("%s%s.tmp", config.ServerConfig.StaticPath, randName)
-		cur, err = os.Create(filePath)
+		result, err = saveShareUpload(header.Filename, file, ip, ownerHash)
+		release()
 		if err != nil {
-			logs.Error("create file fail: %v", err)
 			return
 		}
-		defer cur.Close()
-		var size int64
-		size, err = io.Copy(cur, file)
-		if err != nil {
-			return
+		if !jsonMode {
+			fmt.Fprintf(w,
+				"\n Save file success: size=%d name=%s\n browser_download_url:  %s\n browser_preview_url: %s\n command_download_url:  wget --no-check-certificate --content-disposition %s \n command_delete: curl -X DELETE '%s' \n",
+				result.Size, result.FileName, result.DownloadURL, result.PreviewURL, result.DownloadURL, result.DeleteURL)
 		}
-		// 记录上传记录到mongo
-		err = model.InsertUploadRecord(header.Filename, randName, size)
-		if err != nil {
-			logs.Error("save upload file record fail: err=%v", err)
-			break
-		}
-		downloadUrl := fmt.Sprintf("%s/static/download/%s", config.ServerConfig.ServerURL, randName)
-		previewUrl := fmt.Sprintf("%s/static/preview/%s.tmp", config.ServerConfig.ServerURL, randName)
-		fmt.Fprintf(w,
-			"\n Save file success: size=%d name=%s\n browser_download_url:  %s\n browser_preview_url: %s\n command_download_url:  wget --no-check-certificate --content-disposition %s \n",
-			size, header.Filename, downloadUrl, previewUrl, downloadUrl)
 	}
 	return
 }
 
+// 保存一个匿名上传的文件并记录上传信息, 文件名为随机的8位取件码
+func saveShareUpload(fileName string, src io.Reader, ip string, ownerHash string) (*shareUploadResult, error) {
+	// 保存时会读取src, 之后无法重试, 因此先选定未被使用的取件码
+	randName, err := newShareCode()
+	if err != nil {
+		logs.Error("generate share code failed: error=%v", err)
+		return nil, err
+	}
+	// 删除口令是删除文件的唯一凭据, 使用不可预测的随机数
+	tokenBytes := make([]byte, 16)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		logs.Error("generate delete token failed: error=%v", err)
+		return nil, err
+	}
+	deleteToken := hex.EncodeToString(tokenBytes)
+	hash, size, err := saveStoredFile(randName+".tmp", areaShare, src, false)
+	if err != nil {
+		logs.Error("save file fail: %v", err)
+		return nil, err
+	}
+	// 返回取件码之前扫描病毒, 需要隔离的文件只保留上传记录
+	scanStatus, scanResult := scanShareUpload(randName)
+	if isScanBlocked(scanStatus) {
+		if err = quarantineShareUpload(randName); err != nil {
+			logs.Error("quarantine upload failed: code=%s error=%v", randName, err)
+		}
+	}
+	var expireAt int64
+	if config.QuotaConfig.ShareExpire > 0 {
+		expireAt = time.Now().Add(time.Duration(config.QuotaConfig.ShareExpire) * time.Hour).Unix()
+	}
+	// 记录上传记录到mongo
+	record := model.FileUpload{
+		FileName:   fileName,
+		Code:       randName,
+		Size:       size,
+		IP:         ip,
+		Hash:       hash,
+		ExpireAt:   expireAt,
+		OwnerHash:  ownerHash,
+		DeleteHash: sha256Hex(deleteToken),
+		ScanStatus: scanStatus,
+		ScanResult: scanResult,
+	}
+	if scanStatus != "" {
+		record.ScanTime = time.Now().Unix()
+	}
+	err = model.InsertUploadRecord(record)
+	if err != nil {
+		logs.Error("save upload file record fail: err=%v", err)
+		return nil, err
+	}
+	if isScanBlocked(scanStatus) {
+		return nil, scanBlockedError(scanStatus, scanResult)
+	}
+	sendMailEvent(&tb.MailEvent{
+		Type:    tb.MailEventUpload,
+		Title:   "新的上传文件: " + fileName,
+		Message: fmt.Sprintf("取件码: %s\n大小: %d bytes\nip: %s", randName, size, ip),
+		Link:    fmt.Sprintf("%s/static/download/%s", config.ServerConfig.ServerURL, randName),
+	})
+	return &shareUploadResult{
+		Code:        randName,
+		FileName:    fileName,
+		Size:        size,
+		Hash:        hash,
+		DownloadURL: fmt.Sprintf("%s/static/download/%s", config.ServerConfig.ServerURL, randName),
+		PreviewURL:  fmt.Sprintf("%s/static/preview/%s.tmp", config.ServerConfig.ServerURL, randName),
+		ExpireAt:    expireAt,
+		DeleteToken: deleteToken,
+		DeleteURL:   fmt.Sprintf("%s/static/delete/%s?token=%s", config.ServerConfig.ServerURL, randName, deleteToken),
+	}, nil
+}
+
+// 生成一个未被使用的取件码, 文件和上传记录都不存在时才可以使用
+func newShareCode() (string, error) {
+	for retry := 0; retry < 5; retry++ {
+		code := tb.GetRandomString(8)
+		if _, err := statStoredFile(code + ".tmp"); !os.IsNotExist(err) {
+			if err != nil {
+				return "", err
+			}
+			continue
+		}
+		if _, err := model.GetUploadRecord(code); err != model.ErrorNoRecord {
+			if err != nil {
+				return "", err
+			}
+			continue
+		}
+		return code, nil
+	}
+	return "", errors.New("no available share code, please try again")
+}
+
 // 以弹窗下载方式返回staticUploadHandler上传的文件
 // Example: wget --no-check-certificate http://localhost:80/download/abcdefgddd
 func staticDownloadHandler(w http.ResponseWriter, r *http.Request) {
@@ -127,54 +266,195 @@ func staticDownloadHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	code := url[16:] // 取件码
-	filePath := fmt.Sprintf("%s%s.tmp", config.ServerConfig.StaticPath, code)
-	if !tb.CheckFileExist(filePath) {
-		logs.Info("file not exist: path=%s", filePath)
+	fileName := code + ".tmp"
+	// 上传记录保存了过期时间和扫描结果, 查询失败时不返回文件
+	var record model.FileUpload
+	record, err = model.GetUploadRecord(code)
+	if err == model.ErrorNoRecord {
+		logs.Info("record not found: code=%s", code)
+		w.WriteHeader(http.StatusNotFound)
 		fmt.Fprintf(w, "file not exist")
 		return
 	}
-
-	var record model.FileUpload
-	record, err = model.GetUploadRecord(code)
 	if err != nil {
-		logs.Info("record not found: path=%s  err=%v", filePath, err)
-		fmt.Fprintf(w, "file record not found: %v", err)
+		logs.Error("get upload record failed: code=%s error=%v", code, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "get file record failed")
+		return
+	}
+	if isShareBlocked(&record) {
+		logs.Warn("download blocked file: code=%s status=%s", code, record.ScanStatus)
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, scanBlockedError(record.ScanStatus, record.ScanResult))
+		return
+	}
+	if record.ExpireAt > 0 && record.ExpireAt < time.Now().Unix() {
+		logs.Info("file expired: code=%s expireAt=%d", code, record.ExpireAt)
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "file not exist")
+		return
+	}
+	if _, statErr := statStoredFile(fileName); statErr != nil {
+		logs.Info("file not exist: code=%s error=%v", code, statErr)
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "file not exist")
+		return
 	}
 
-	err = tb.ServerFile(w, filePath, record.FileName, record.Size)
+	err = serveStoredFile(w, r, fileName, record.FileName, false)
 	if err != nil {
 		logs.Error("ServerFile fail: %v", err)
 		fmt.Fprintf(w, "Error happen: %v", err)
 		return
 	}
+	model.IncUploadDownload(code)
 	logs.Info("Server file success: %+v", record)
 }
 
-// 以预览方式返回StaticPath目录下的图片等资源
-// url format: /static/preview/${fileName}
-func staticPreViewHandler(w http.ResponseWriter, r *http.Request) {
+// 列出某个管理口令名下的上传文件
+// Example: curl -H 'X-Manage-Token: ${token}' http://localhost:80/static/mine
+func staticMineHandler(w http.ResponseWriter, r *http.Request) {
+	type fileInfo struct {
+		Code        string `json:"code"`
+		FileName    string `json:"fileName"`
+		Size        int64  `json:"size"`
+		Timestamp   int64  `json:"timestamp"`
+		ExpireAt    int64  `json:"expireAt"`
+		ScanStatus  string `json:"scanStatus"`
+		DownloadURL string `json:"downloadUrl"`
+	}
+	var resp respStruct
 	var err error
-	if r.Method != http.MethodGet {
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		logs.Warn("DownloadFile reeceive a bad request: %v", r)
-		return
+	for loop := true; loop; loop = false {
+		var ownerHash string
+		ownerHash, err = getOwnerHash(r, true)
+		if err != nil {
+			break
+		}
+		var records []model.FileUpload
+		records, err = model.GetUploadRecordsByOwner(ownerHash)
+		if err != nil {
+			break
+		}
+		payload := make([]fileInfo, 0, len(records))
+		for _, record := range records {
+			payload = append(payload, fileInfo{
+				Code:        record.Code,
+				FileName:    record.FileName,
+				Size:        record.Size,
+				Timestamp:   record.TimeStamp,
+				ExpireAt:    record.ExpireAt,
+				ScanStatus:  record.ScanStatus,
+				DownloadURL: fmt.Sprintf("%s/static/download/%s", config.ServerConfig.ServerURL, record.Code),
+			})
+		}
+		resp.PayLoad = payload
 	}
-	uri := strings.Trim(fmt.Sprint(r.URL), "/")
-	uri, _ = url.QueryUnescape(uri)
-	fileName := strings.TrimPrefix(uri, "static/preview/")
-	filePath := config.ServerConfig.StaticPath + fileName
-	logs.Info("get static path: %s", filePath)
-	fileInfo, err := os.Stat(filePath)
 	if err != nil {
-		logs.Info("stat file fail: error=%v filePath=%s", err, filePath)
-		w.WriteHeader(http.StatusNotFound)
-		return
+		logs.Warn("list own uploads failed: error=%v", err)
+		resp.Status = -1
+		resp.Msg = fmt.Sprint(err)
 	}
-	if fileInfo.IsDir() {
-		logs.Warn("filePath is a floder: path=%s", filePath)
-		w.WriteHeader(http.StatusNotFound)
+	responseJson(&w, resp)
+}
+
+// 使用上传时返回的删除口令或管理口令删除自己上传的文件
+// Example: curl -X DELETE 'http://localhost:80/static/delete/abcdefgh?token=${deleteToken}'
+// Example: curl -X DELETE -H 'X-Manage-Token: ${token}' http://localhost:80/static/delete/abcdefgh
+func staticDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	var resp respStruct
+	var err error
+	for loop := true; loop; loop = false {
+		if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+			err = fmt.Errorf("unexpect method: %s", r.Method)
+			break
+		}
+		code := strings.TrimPrefix(strings.Trim(r.URL.Path, "/"), "static/delete/")
+		if !regexp.MustCompile("^[a-z]{8}$").MatchString(code) {
+			err = fmt.Errorf("unexpect code: %q", code)
+			break
+		}
+		var record model.FileUpload
+		record, err = model.GetUploadRecord(code)
+		if err != nil {
+			err = fmt.Errorf("file not found: code=%s", code)
+			break
+		}
+		// 使用上传时返回的删除口令, 或上传时使用的管理口令
+		if token := r.URL.Query().Get("token"); token != "" {
+			if record.DeleteHash == "" || subtle.ConstantTimeCompare([]byte(sha256Hex(token)), []byte(record.DeleteHash)) != 1 {
+				err = fmt.Errorf("file not found: code=%s", code)
+				break
+			}
+		} else {
+			var ownerHash string
+			ownerHash, err = getOwnerHash(r, true)
+			if err != nil {
+				break
+			}
+			if record.OwnerHash != ownerHash {
+				err = fmt.Errorf("file not found: code=%s", code)
+				break
+			}
+		}
+		err = removeShareUpload(code)
+		logs.Info("delete own upload: code=%s error=%v", code, err)
+	}
+	if err != nil {
+		resp.Status = -1
+		resp.Msg = fmt.Sprint(err)
+	}
+	responseJson(&w, resp)
+}
+
+// 删除匿名上传的文件及其上传记录
+func removeShareUpload(code string) error {
+	err := removeStoredFile(code + ".tmp")
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	removeQuarantine(code)
+	err = model.RemoveUploadRecord(code)
+	if err == model.ErrorNoRecord {
+		return nil
+	}
+	return err
+}
+
+// 删除已过期的匿名上传文件
+func cleanExpiredShareUpload() {
+	records, err := model.GetExpiredUploadRecords(time.Now().Unix())
+	if err != nil {
 		return
 	}
-	http.ServeFile(w, r, filePath)
-	return
+	for _, record := range records {
+		err = removeShareUpload(record.Code)
+		logs.Info("remove expired upload: code=%s fileName=%s error=%v", record.Code, record.FileName, err)
+	}
+}
+
+// 判断是否以json格式返回结果
+func isJsonMode(r *http.Request) bool {
+	return r.URL.Query().Get("format") == "json" || strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// 获取请求中的管理口令的sha256, 口令通过X-Manage-Token请求头传递, 长度至少为16
+// required为false时请求中没有口令返回空字符串
+func getOwnerHash(r *http.Request, required bool) (string, error) {
+	token := r.Header.Get("X-Manage-Token")
+	if token == "" {
+		if required {
+			return "", errors.New("manage token is required")
+		}
+		return "", nil
+	}
+	if len(token) < 16 {
+		return "", errors.New("manage token should be at least 16 characters")
+	}
+	return sha256Hex(token), nil
+}
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
 }
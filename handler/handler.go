@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"os"
 	"strings"
 	"time"
 
@@ -18,10 +19,12 @@ import (
 
 var IpMonitor *tb.IPMonitor
 
+// StaticPath目录的受限访问入口，所有文件相关的处理器都应通过它读写文件
+var staticFS *tb.SandboxFS
+
 // 一些影响系统行为的配置变量
 var (
-	sendCallDriverEmail = true  // 是否接收callDriver应用的邮件
-	sendAlertEmail      = false // 是否发送告警通知 (暂时未用)
+	sendAlertEmail = false // 是否发送告警通知, 如上传的文件中发现病毒
 )
 
 // 一些信息
@@ -35,16 +38,76 @@ func init() {
 	// 初始化ip监控
 	IpMonitor = tb.NewIpMonitor()
 
+	// 初始化静态文件目录
+	var err error
+	staticFS, err = tb.NewSandboxFS(config.ServerConfig.StaticPath)
+	if err != nil {
+		logs.Critical("init static file sandbox failed: path=%s error=%v", config.ServerConfig.StaticPath, err)
+		os.Exit(1)
+	}
+	staticFS.Reserve(blobDirName)
+	blobStore, err = newBlobStore()
+	if err != nil {
+		logs.Critical("init blob store failed: driver=%s error=%v", config.StorageConfig.Driver, err)
+		os.Exit(1)
+	}
+	if err = initPreview(); err != nil {
+		logs.Critical("init preview failed: error=%v", err)
+		os.Exit(1)
+	}
+	if err = initUploadSession(); err != nil {
+		logs.Critical("init upload session failed: error=%v", err)
+		os.Exit(1)
+	}
+	if err = initVirusScan(); err != nil {
+		logs.Critical("init virus scan failed: error=%v", err)
+		os.Exit(1)
+	}
+	if err = initMail(); err != nil {
+		logs.Critical("init mail failed: error=%v", err)
+		os.Exit(1)
+	}
+	initChatVisitor()
+	initChatSpam()
+	if err = initChatNotify(); err != nil {
+		logs.Critical("init callDriver notify failed: error=%v", err)
+		os.Exit(1)
+	}
+	if err = initChatMailBridge(); err != nil {
+		logs.Critical("init callDriver mail reply failed: error=%v", err)
+		os.Exit(1)
+	}
+	if err = initWebDAV(); err != nil {
+		logs.Critical("init webdav failed: error=%v", err)
+		os.Exit(1)
+	}
+	initCodeMasterUser()
+
 	if !config.ServerConfig.IsTest {
 		// 从mongo中读取旧的标记记录，同时开启协程来定期持久化ip标记数据
 		oldTags := make(map[string]string)
-		err := model.GetUtilData("ipTag", &oldTags)
+		err = model.GetUtilData("ipTag", &oldTags)
 		if err != nil {
 			logs.Error("init ipTag failed: error=%v", err)
 		} else {
 			IpMonitor.UpdateAllIpTag(oldTags)
 		}
 
+		// 从mongo读取文件区域记录
+		oldAreas := make(map[string]string)
+		err = model.GetUtilData("fileArea", &oldAreas)
+		if err != nil {
+			logs.Error("init fileArea failed: error=%v", err)
+		} else {
+			restoreFileArea(oldAreas)
+		}
+
+		// 配额统计和文件列表依赖文件索引, 为旧文件补建索引
+		if err = model.EnsureStoredFileIndex(); err != nil {
+			logs.Error("ensure stored file index failed: error=%v", err)
+		}
+		go syncStoredFileIndex()
+
 		// 从mongo读取RPC服务节点记录，还原上次记录的状态
 		rpcNodes := make([]rpc.RegisterPackage, 0)
 		err = model.GetUtilData("rpcNodes", &rpcNodes)
@@ -54,13 +117,41 @@ func init() {
 			go rpc.RestoreAllNode(rpcNodes)
 		}
 
-		// 定期更新ip标记数据和RPC服务状态
+		// 还原后台修改过的通知渠道开关
+		notifySwitch := make(map[string]bool)
+		err = model.GetUtilData("notifySwitch", &notifySwitch)
+		if err != nil {
+			logs.Error("init notifySwitch failed: error=%v", err)
+		} else {
+			restoreNotifySwitch(notifySwitch)
+		}
+
+		// 为codeMaster作品列表和用户建立索引
+		if err = model.EnsureCodeMasterIndex(); err != nil {
+			logs.Error("ensure codeMaster index failed: error=%v", err)
+		}
+		initWorkIndex()
+
+		// 为旧的callDriver聊天记录补建会话
+		go func() {
+			created, err := model.RebuildCallDriverConversations(myName)
+			logs.Info("rebuild callDriver conversations result: created=%d error=%v", created, err)
+		}()
+
+		// 定期更新ip标记数据、RPC服务状态和文件区域记录, 清理过期的上传、聊天记录、邮件发送记录和未使用的聊天附件
 		go func() {
 			for range time.NewTicker(10 * time.Minute).C {
+				cleanExpiredShareUpload()
+				cleanExpiredUploadSession()
+				cleanChatRetention()
+				cleanMailLog()
+				cleanChatAttachments()
 				err := model.UpdateUtilData("ipTag", IpMonitor.GetIpTag())
 				logs.Debug("update ipTag result: error=%v", err)
 				err = model.UpdateUtilData("rpcNodes", rpc.GetAllNodeMsg())
 				logs.Debug("update rpcNodes result: error=%v", err)
+				err = model.UpdateUtilData("fileArea", getAllFileArea())
+				logs.Debug("update fileArea result: error=%v", err)
 			}
 		}()
 	}
@@ -179,6 +270,11 @@ func RecordRequest(req *http.Request, preFix string) {
 }
 
 func responseJson(w *http.ResponseWriter, payload interface{}) {
+	responseJsonStatus(w, http.StatusOK, payload)
+}
+
+// 以指定的状态码返回json
+func responseJsonStatus(w *http.ResponseWriter, status int, payload interface{}) {
 	bytes, err := json.Marshal(payload)
 	if err != nil {
 		logs.Error("json marshal error: payload=%+v error=%v", payload, err)
@@ -187,5 +283,15 @@ func responseJson(w *http.ResponseWriter, payload interface{}) {
 		return
 	}
 	(*w).Header().Add("content-type", "application/json")
+	if status != http.StatusOK { // 200在写入内容时自动返回
+		(*w).WriteHeader(status)
+	}
 	fmt.Fprintf(*w, "%s", bytes)
 }
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
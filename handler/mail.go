@@ -0,0 +1,98 @@
+package handler
+
+// 邮件发送服务: 待发送的邮件和发送记录保存在mongo中, 测试环境保存在内存中
+// 事件通知按邮件路由规则发送给配置的接收人, 见toolbox/mailRouter.go
+import (
+	"fmt"
+	"time"
+
+	"../config"
+	"../model"
+	tb "../toolbox"
+	"github.com/astaxie/beego/logs"
+)
+
+var (
+	mailer     *tb.Mailer
+	mailRouter *tb.MailRouter
+)
+
+// 使用mongo保存邮件
+type mongoMailStore struct{}
+
+func (mongoMailStore) SaveMail(mail *tb.Mail) error {
+	return model.SaveMail(mail)
+}
+
+func (mongoMailStore) GetMail(id string) (*tb.Mail, error) {
+	return model.GetMail(id)
+}
+
+func (mongoMailStore) PendingMails(now int64, limit int) ([]*tb.Mail, error) {
+	return model.FindPendingMail(now, limit)
+}
+
+func (mongoMailStore) ListMails(status string, limit int) ([]*tb.Mail, int, error) {
+	return model.FindMailLog(status, limit)
+}
+
+func initMail() (err error) {
+	var store tb.MailStore = mongoMailStore{}
+	if config.ServerConfig.IsTest {
+		store = tb.NewMemoryMailStore()
+	}
+	conf := config.MailConfig
+	mailer, err = tb.InitMailer(tb.MailerOptions{
+		Host:        conf.MailHost,
+		Port:        conf.MailPort,
+		User:        conf.MailUser,
+		Pass:        conf.MailPass,
+		FromName:    conf.FromName,
+		Workers:     conf.Workers,
+		Retry:       conf.Retry,
+		RetryDelay:  time.Duration(conf.RetryDelay) * time.Second,
+		IdleTimeout: time.Duration(conf.IdleTimeout) * time.Second,
+		TemplateDir: conf.TemplateDir,
+		ReplyAddr:   config.CallDriverConfig.ReplyAddress,
+	}, store)
+	if err != nil {
+		return err
+	}
+	recipients := make([]tb.MailRecipientOptions, 0, len(conf.Recipients))
+	for _, r := range conf.Recipients {
+		recipients = append(recipients, tb.MailRecipientOptions(r))
+	}
+	routes := make([]tb.MailRouteOptions, 0, len(conf.Routes))
+	for _, r := range conf.Routes {
+		routes = append(routes, tb.MailRouteOptions(r))
+	}
+	mailRouter, err = tb.InitMailRouter(mailer, recipients, routes, time.Duration(conf.Digest)*time.Minute)
+	return err
+}
+
+// 按邮件路由规则发送事件通知, 测试环境不发送
+func sendMailEvent(e *tb.MailEvent) {
+	if config.ServerConfig.IsTest {
+		return
+	}
+	if err := tb.SendMailEvent(e); err != nil {
+		logs.Error("send mail event failed: type=%s title=%s error=%v", e.Type, e.Title, err)
+	}
+}
+
+// 发送告警通知, 可以在后台关闭
+func sendAlert(title, format string, args ...interface{}) {
+	if !sendAlertEmail {
+		return
+	}
+	sendMailEvent(&tb.MailEvent{Type: tb.MailEventAlert, Title: title, Message: fmt.Sprintf(format, args...)})
+}
+
+// 删除超过保留天数的发送记录
+func cleanMailLog() {
+	before := time.Now().AddDate(0, 0, -int(config.MailConfig.LogDays)).Unix()
+	removed, err := model.RemoveMailBefore(before)
+	if removed > 0 || err != nil {
+		logs.Info("clean mail log: before=%d removed=%d error=%v", before, removed, err)
+	}
+}
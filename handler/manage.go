@@ -2,10 +2,8 @@ package handler
 
 import (
 	"fmt"
-	"io"
 	"net"
 	"net/http"
-	"os"
 	"strings"
 
 	"../config"
@@ -65,15 +63,16 @@ func uploadFile(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 			defer file.Close()
-			filePath := config.ServerConfig.StaticPath + v.Filename
-			cur, err := os.Create(filePath)
+			filePath := v.Filename
+			release, err := reserveSpace(areaManage, v.Size, "")
 			if err != nil {
-				logs.Error("create file fial:　err=%v path=%s", err, filePath)
-				w.WriteHeader(http.StatusInternalServerError)
+				logs.Warn("reject upload: err=%v name=%s", err, filePath)
+				w.WriteHeader(http.StatusInsufficientStorage)
+				fmt.Fprint(w, err)
 				return
 			}
-			defer cur.Close()
-			size, err := io.Copy(cur, file)
+			_, size, err := saveStoredFile(filePath, areaManage, file, true)
+			release()
 			if err != nil {
 				logs.Error("save file fail: err=%v path=%s size=%d", err, filePath, size)
 				w.WriteHeader(http.StatusInternalServerError)
@@ -0,0 +1,672 @@
+package handler
+
+// StaticPath下文件的预览: 图片缩略图、代码高亮、Markdown渲染、PDF首页和视频封面以及文件元数据
+// 缩略图按文件内容的sha256缓存在StaticPath/.thumbs目录下, PDF和视频依赖系统中的pdftoppm和ffmpeg命令
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"../config"
+	"../model"
+	tb "../toolbox"
+	"github.com/astaxie/beego/logs"
+	"github.com/russross/blackfriday/v2"
+)
+
+// 保存缩略图的目录, 位于StaticPath下且对外不可见
+const thumbDirName = ".thumbs"
+
+// 加密保存的缩略图的扩展名
+const thumbEncryptedExt = ".enc.jpg"
+
+// 可以生成封面的视频类型及对应的ffmpeg输入格式
+var videoDemuxers = map[string]string{
+	"video/mp4":        "mov",
+	"video/quicktime":  "mov",
+	"video/webm":       "matroska",
+	"video/x-matroska": "matroska",
+	"video/avi":        "avi",
+	"video/x-msvideo":  "avi",
+}
+
+// ffmpeg允许使用的输入格式, mov和matroska的解复用器同时以这些名字注册
+const ffmpegFormatWhitelist = "mov,mp4,m4a,3gp,3g2,mj2,matroska,webm,avi"
+
+const (
+	maxRenderSize    = 1 << 20          // 文本渲染的最大长度, 超出部分截断
+	maxImagePixels   = 50 * 1000 * 1000 // 生成缩略图时允许解码的最大像素数
+	posterTimeout    = 30 * time.Second // 调用外部命令生成封面的超时时间
+	thumbJpegQuality = 85
+)
+
+// 可选的缩略图尺寸, 请求的尺寸向上取整到其中之一以限制缓存数量
+var thumbSizes = []int{64, 128, 256, 512, 1024}
+
+var errPreviewNotSupport = errors.New("preview is not supported for this file")
+
+var (
+	thumbFS    *tb.SandboxFS
+	thumbSem   = make(chan struct{}, runtime.NumCPU()) // 限制同时生成的缩略图数, 避免大量请求同时解码图片或运行ffmpeg
+	thumbMux   = new(sync.Mutex)                       // 保护thumbCalls
+	thumbCalls = make(map[string]*thumbCall)           // 正在生成的缩略图, key为缩略图的文件名
+)
+
+// 一次缩略图的生成, 同一个缩略图的并发请求等待同一次生成的结果
+type thumbCall struct {
+	done chan struct{}
+	err  error
+}
+
+// 代码文件后缀与highlight.js语言的对应关系
+var codeLangs = map[string]string{
+	".go": "go", ".py": "python", ".js": "javascript", ".ts": "typescript", ".java": "java",
+	".c": "c", ".h": "c", ".cpp": "cpp", ".cc": "cpp", ".hpp": "cpp", ".cs": "csharp",
+	".rs": "rust", ".php": "php", ".rb": "ruby", ".lua": "lua", ".kt": "kotlin", ".swift": "swift",
+	".sh": "bash", ".sql": "sql", ".json": "json", ".xml": "xml", ".html": "xml", ".css": "css",
+	".yaml": "yaml", ".yml": "yaml", ".ini": "ini", ".conf": "ini", ".thrift": "thrift",
+	".txt": "plaintext", ".log": "plaintext",
+}
+
+// 文件元数据
+type fileMeta struct {
+	FileName   string `json:"fileName"`
+	Mime       string `json:"mime"`
+	Size       int64  `json:"size"`
+	Hash       string `json:"hash"`
+	Timestamp  int64  `json:"timestamp"`
+	Width      int    `json:"width,omitempty"` // 仅图片有效
+	Height     int    `json:"height,omitempty"`
+	PreviewURL string `json:"previewUrl"`
+	ThumbURL   string `json:"thumbUrl,omitempty"`  // 可生成缩略图时有效
+	RenderURL  string `json:"renderUrl,omitempty"` // 可渲染为网页时有效
+}
+
+// 渲染文本和Markdown的页面, 高亮由highlight.js完成
+var renderTemplate = template.Must(template.New("render").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}</title>
+<link rel="stylesheet" href="https://cdnjs.cloudflare.com/ajax/libs/highlight.js/11.9.0/styles/github.min.css">
+<style nonce="{{.Nonce}}">
+body { max-width: 960px; margin: 0 auto; padding: 16px; font-family: -apple-system, "Segoe UI", Helvetica, Arial, sans-serif; line-height: 1.6; }
+pre { background: #f6f8fa; padding: 12px; overflow: auto; }
+pre code.hljs { padding: 0; }
+img { max-width: 100%; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ddd; padding: 4px 8px; }
+.tips { color: #999; }
+</style>
+</head>
+<body>
+{{if .Markdown}}{{.Markdown}}{{else}}<pre><code{{if .Lang}} class="language-{{.Lang}}"{{end}}>{{.Code}}</code></pre>{{end}}
+{{if .Truncated}}<p class="tips">文件过大, 仅显示前 {{.Limit}} 字节</p>{{end}}
+<script src="https://cdnjs.cloudflare.com/ajax/libs/highlight.js/11.9.0/highlight.min.js"></script>
+<script nonce="{{.Nonce}}">hljs.highlightAll();</script>
+</body>
+</html>`))
+
+// 初始化缩略图目录
+func initPreview() error {
+	var err error
+	staticFS.Reserve(thumbDirName)
+	thumbFS, err = tb.NewSandboxFS(config.ServerConfig.StaticPath + thumbDirName)
+	return err
+}
+
+// 以预览方式返回StaticPath目录下的图片等资源, jpeg图片会去除EXIF信息后返回
+// url format: /static/preview/${fileName}
+func staticPreViewHandler(w http.ResponseWriter, r *http.Request) {
+	var err error
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		logs.Warn("DownloadFile reeceive a bad request: %v", r)
+		return
+	}
+	fileName, ok := parsePreviewFileName(w, r, "static/preview/")
+	if !ok {
+		return
+	}
+	logs.Info("get static file: %s", fileName)
+	// 禁止上传的html等文件在本站域名下执行脚本
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if detectMime(fileName) == "image/jpeg" {
+		err = serveJpegWithoutExif(w, fileName)
+	} else {
+		err = serveStoredFile(w, r, fileName, path.Base(fileName), true)
+	}
+	if err != nil {
+		logs.Error("serve preview file failed: fileName=%s error=%v", fileName, err)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	return
+}
+
+// 返回图片、PDF或视频的缩略图, size为缩略图最长边的像素数
+// url format: /static/thumb/${fileName}?size=256
+func staticThumbHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	fileName, ok := parsePreviewFileName(w, r, "static/thumb/")
+	if !ok {
+		return
+	}
+	size := 256
+	if s := r.URL.Query().Get("size"); s != "" {
+		var err error
+		if size, err = strconv.Atoi(s); err != nil || size <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	serveThumbnail(w, r, fileName, size)
+}
+
+// 返回文件的缩略图, 缓存不存在时生成
+func serveThumbnail(w http.ResponseWriter, r *http.Request, fileName string, size int) {
+	thumbPath, err := getThumbnail(fileName, size)
+	if err == errPreviewNotSupport {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		fmt.Fprint(w, err)
+		return
+	}
+	if err != nil {
+		logs.Error("get thumbnail failed: fileName=%s size=%d error=%v", fileName, size, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	// 开启静态加密时缩略图也是加密保存的, 由文件名区分
+	file, err := os.Open(thumbPath)
+	if err == nil {
+		var thumb *tb.PlainFile
+		if thumb, err = tb.OpenPlainFile(file, blobStore.MasterKey(), strings.HasSuffix(thumbPath, thumbEncryptedExt)); err == nil {
+			defer thumb.Close()
+			info, _ := thumb.Stat()
+			w.Header().Set("Content-Type", "image/jpeg")
+			http.ServeContent(w, r, path.Base(thumbPath), info.ModTime(), thumb)
+			return
+		}
+	}
+	logs.Error("open thumbnail failed: path=%s error=%v", thumbPath, err)
+	w.WriteHeader(http.StatusInternalServerError)
+}
+
+// 将代码、文本文件渲染为高亮后的网页, Markdown文件渲染为HTML
+// url format: /static/render/${fileName}
+func staticRenderHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	fileName, ok := parsePreviewFileName(w, r, "static/render/")
+	if !ok {
+		return
+	}
+	var err error
+	for loop := true; loop; loop = false {
+		var reader io.ReadCloser
+		reader, err = openStoredFile(fileName)
+		if err != nil {
+			break
+		}
+		var content []byte
+		content, err = ioutil.ReadAll(io.LimitReader(reader, maxRenderSize+1))
+		reader.Close()
+		if err != nil {
+			break
+		}
+		truncated := len(content) > maxRenderSize
+		if truncated {
+			content = content[:maxRenderSize]
+		}
+		ext := strings.ToLower(filepath.Ext(fileName))
+		lang, isCode := codeLangs[ext]
+		isMarkdown := ext == ".md" || ext == ".markdown"
+		if !isCode && !isMarkdown && !isTextContent(content) {
+			err = errPreviewNotSupport
+			break
+		}
+		nonceBytes := make([]byte, 16)
+		rand.Read(nonceBytes)
+		nonce := hex.EncodeToString(nonceBytes)
+		data := map[string]interface{}{
+			"Title":     path.Base(fileName),
+			"Nonce":     nonce,
+			"Lang":      lang,
+			"Code":      string(content),
+			"Truncated": truncated,
+			"Limit":     maxRenderSize,
+		}
+		if isMarkdown {
+			data["Markdown"] = template.HTML(renderMarkdown(content))
+		}
+		var buf bytes.Buffer
+		if err = renderTemplate.Execute(&buf, data); err != nil {
+			break
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Content-Security-Policy", fmt.Sprintf("default-src 'none'; img-src * data:; "+
+			"style-src https://cdnjs.cloudflare.com 'nonce-%s'; script-src https://cdnjs.cloudflare.com 'nonce-%s'", nonce, nonce))
+		w.Write(buf.Bytes())
+	}
+	if err == errPreviewNotSupport {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		fmt.Fprint(w, err)
+		return
+	}
+	if err != nil {
+		logs.Error("render file failed: fileName=%s error=%v", fileName, err)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+// 返回文件的元数据, 包括类型、大小、sha256、图片尺寸以及可用的预览地址
+// url format: /static/meta/${fileName}
+func staticMetaHandler(w http.ResponseWriter, r *http.Request) {
+	var resp respStruct
+	var err error
+	fileName, ok := parsePreviewFileName(w, r, "static/meta/")
+	if !ok {
+		return
+	}
+	for loop := true; loop; loop = false {
+		var info *storedFile
+		info, err = statStoredFile(fileName)
+		if err != nil {
+			break
+		}
+		meta := fileMeta{
+			FileName:   fileName,
+			Mime:       detectMime(fileName),
+			Size:       info.Size,
+			Timestamp:  info.Timestamp,
+			PreviewURL: previewURL("preview", fileName),
+		}
+		meta.Hash, err = getStoredFileHash(fileName)
+		if err != nil {
+			break
+		}
+		if strings.HasPrefix(meta.Mime, "image/") {
+			meta.Width, meta.Height = getImageSize(fileName)
+		}
+		if canThumbnail(meta.Mime) {
+			meta.ThumbURL = previewURL("thumb", fileName)
+		}
+		ext := strings.ToLower(filepath.Ext(fileName))
+		if _, isCode := codeLangs[ext]; isCode || ext == ".md" || ext == ".markdown" || strings.HasPrefix(meta.Mime, "text/") {
+			meta.RenderURL = previewURL("render", fileName)
+		}
+		resp.PayLoad = meta
+	}
+	if err != nil {
+		logs.Warn("get file meta failed: fileName=%s error=%v", fileName, err)
+		resp.Status = -1
+		resp.Msg = fmt.Sprint(err)
+	}
+	responseJson(&w, resp)
+}
+
+// 从请求地址中解析出文件名并检查文件是否存在, 失败时已写入响应
+func parsePreviewFileName(w http.ResponseWriter, r *http.Request, prefix string) (string, bool) {
+	fileName := strings.TrimPrefix(strings.Trim(r.URL.Path, "/"), prefix)
+	if _, err := staticFS.Resolve(fileName); err != nil || fileName == "" {
+		logs.Warn("reject preview request: fileName=%q error=%v", fileName, err)
+		w.WriteHeader(http.StatusBadRequest)
+		return "", false
+	}
+	// 聊天附件只能通过callDriver的接口访问
+	if chatFileReg.MatchString(fileName) {
+		logs.Warn("reject preview chat attachment: fileName=%s", fileName)
+		w.WriteHeader(http.StatusForbidden)
+		return "", false
+	}
+	// 匿名上传的文件需检查病毒扫描结果, 上传记录写入之前文件还未扫描, 不允许访问
+	if shareFileReg.MatchString(fileName) {
+		record, err := model.GetUploadRecord(strings.TrimSuffix(fileName, ".tmp"))
+		if err == model.ErrorNoRecord {
+			logs.Info("preview file without record: fileName=%s", fileName)
+			w.WriteHeader(http.StatusNotFound)
+			return "", false
+		}
+		if err != nil {
+			logs.Error("get upload record failed: fileName=%s error=%v", fileName, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return "", false
+		}
+		if isShareBlocked(&record) {
+			logs.Warn("preview blocked file: fileName=%s status=%s", fileName, record.ScanStatus)
+			w.WriteHeader(http.StatusForbidden)
+			return "", false
+		}
+		if record.ExpireAt > 0 && record.ExpireAt < time.Now().Unix() {
+			logs.Info("preview expired file: fileName=%s expireAt=%d", fileName, record.ExpireAt)
+			w.WriteHeader(http.StatusNotFound)
+			return "", false
+		}
+	}
+	if _, err := statStoredFile(fileName); err != nil {
+		logs.Info("stat file fail: error=%v fileName=%s", err, fileName)
+		w.WriteHeader(http.StatusNotFound)
+		return "", false
+	}
+	return fileName, true
+}
+
+// 生成预览相关的地址
+func previewURL(kind string, fileName string) string {
+	segments := strings.Split(fileName, "/")
+	for i := range segments {
+		segments[i] = url.PathEscape(segments[i])
+	}
+	return fmt.Sprintf("%s/static/%s/%s", config.ServerConfig.ServerURL, kind, strings.Join(segments, "/"))
+}
+
+// 判断文件类型, 无法通过后缀判断时读取文件头部识别
+func detectMime(fileName string) string {
+	if mimeType := mime.TypeByExtension(filepath.Ext(fileName)); mimeType != "" {
+		return strings.Split(mimeType, ";")[0]
+	}
+	reader, err := openStoredFile(fileName)
+	if err != nil {
+		return "application/octet-stream"
+	}
+	defer reader.Close()
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(reader, head)
+	return strings.Split(http.DetectContentType(head[:n]), ";")[0]
+}
+
+// 判断内容是否为文本
+func isTextContent(content []byte) bool {
+	if len(content) == 0 {
+		return true
+	}
+	if !strings.HasPrefix(http.DetectContentType(content), "text/") {
+		return false
+	}
+	// 截断时末尾可能是不完整的字符
+	for i := 0; i < utf8.UTFMax && len(content) > 0 && !utf8.Valid(content); i++ {
+		content = content[:len(content)-1]
+	}
+	return utf8.Valid(content)
+}
+
+// 判断该类型的文件能否生成缩略图
+func canThumbnail(mimeType string) bool {
+	switch mimeType {
+	case "image/jpeg", "image/png", "image/gif":
+		return true
+	case "application/pdf":
+		_, err := exec.LookPath("pdftoppm")
+		return err == nil
+	}
+	if _, ok := videoDemuxers[mimeType]; ok {
+		_, err := exec.LookPath("ffmpeg")
+		return err == nil
+	}
+	return false
+}
+
+// 获取图片的宽高, 失败时返回0
+func getImageSize(fileName string) (int, int) {
+	reader, err := openStoredFile(fileName)
+	if err != nil {
+		return 0, 0
+	}
+	defer reader.Close()
+	conf, _, err := image.DecodeConfig(reader)
+	if err != nil {
+		return 0, 0
+	}
+	return conf.Width, conf.Height
+}
+
+// 将Markdown转换为HTML, 忽略其中的原始HTML并过滤危险链接
+func renderMarkdown(content []byte) []byte {
+	renderer := blackfriday.NewHTMLRenderer(blackfriday.HTMLRendererParameters{
+		Flags: blackfriday.CommonHTMLFlags | blackfriday.SkipHTML | blackfriday.Safelink | blackfriday.NofollowLinks,
+	})
+	return blackfriday.Run(content, blackfriday.WithRenderer(renderer), blackfriday.WithExtensions(blackfriday.CommonExtensions))
+}
+
+// 返回去除EXIF信息后的jpeg图片
+func serveJpegWithoutExif(w http.ResponseWriter, fileName string) error {
+	reader, err := openStoredFile(fileName)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	w.Header().Set("Content-Type", "image/jpeg")
+	return tb.StripJpegExif(reader, w)
+}
+
+// 获取缩略图在本地的路径, 缓存不存在时生成
+func getThumbnail(fileName string, size int) (string, error) {
+	for _, s := range thumbSizes {
+		if s >= size {
+			size = s
+			break
+		}
+	}
+	size = minInt(size, thumbSizes[len(thumbSizes)-1])
+	mimeType := detectMime(fileName)
+	if !canThumbnail(mimeType) {
+		return "", errPreviewNotSupport
+	}
+	hash, err := getStoredFileHash(fileName)
+	if err != nil {
+		return "", err
+	}
+	thumbName := thumbFileName(hash, size, blobStore.EncryptEnabled())
+	thumbPath, err := thumbFS.Resolve(thumbName)
+	if err != nil {
+		return "", err
+	}
+	if _, err = os.Stat(thumbPath); err == nil {
+		return thumbPath, nil
+	}
+
+	thumbMux.Lock()
+	if call, ok := thumbCalls[thumbName]; ok { // 其他请求正在生成
+		thumbMux.Unlock()
+		<-call.done
+		if call.err != nil {
+			return "", call.err
+		}
+		return thumbPath, nil
+	}
+	call := &thumbCall{done: make(chan struct{}), err: errors.New("create thumbnail failed")}
+	thumbCalls[thumbName] = call
+	thumbMux.Unlock()
+	defer func() {
+		thumbMux.Lock()
+		delete(thumbCalls, thumbName)
+		thumbMux.Unlock()
+		close(call.done)
+	}()
+
+	if _, err = os.Stat(thumbPath); err == nil { // 登记之前刚被其他请求生成
+		call.err = nil
+		return thumbPath, nil
+	}
+	if call.err = makeThumbnail(fileName, mimeType, thumbName, size); call.err != nil {
+		return "", call.err
+	}
+	logs.Info("create thumbnail: fileName=%s hash=%s size=%d", fileName, hash, size)
+	return thumbPath, nil
+}
+
+// 生成缩略图并保存为thumbFS中的thumbName, 同时生成的数量受thumbSem限制
+func makeThumbnail(fileName string, mimeType string, thumbName string, size int) error {
+	thumbSem <- struct{}{}
+	defer func() { <-thumbSem }()
+	var img image.Image
+	var err error
+	switch {
+	case strings.HasPrefix(mimeType, "image/"):
+		img, err = decodeStoredImage(fileName)
+	case mimeType == "application/pdf":
+		img, err = makePoster(fileName, func(ctx context.Context, src, dst string) *exec.Cmd {
+			return exec.CommandContext(ctx, "pdftoppm", "-f", "1", "-l", "1", "-png", "-singlefile", "-scale-to", "1024", src, strings.TrimSuffix(dst, ".png"))
+		})
+	default:
+		// 按识别出的类型指定输入格式, 并只允许读取本地文件和常见的视频格式
+		// 避免ffmpeg把上传的播放列表(hls、concat等)当作输入, 读取服务器上的其他文件生成封面
+		img, err = makePoster(fileName, func(ctx context.Context, src, dst string) *exec.Cmd {
+			return exec.CommandContext(ctx, "ffmpeg", "-y", "-loglevel", "error",
+				"-protocol_whitelist", "file", "-format_whitelist", ffmpegFormatWhitelist, "-f", videoDemuxers[mimeType],
+				"-i", src, "-vf", "thumbnail", "-frames:v", "1", dst)
+		})
+	}
+	if err != nil {
+		return err
+	}
+	if err = thumbFS.MkdirAll(path.Dir(thumbName)); err != nil {
+		return err
+	}
+	// 先写入临时文件再重命名, 避免返回写了一半的缩略图
+	tmpName := thumbName + "." + tb.GetRandomString(8)
+	file, err := thumbFS.CreateNew(tmpName)
+	if err != nil {
+		return err
+	}
+	err = writeThumbnail(file, tb.ResizeImage(img, size))
+	file.Close()
+	if err == nil {
+		err = thumbFS.Rename(tmpName, thumbName)
+	}
+	if err != nil {
+		thumbFS.Remove(tmpName)
+	}
+	return err
+}
+
+// 缩略图在thumbFS中的文件名, 加密保存的缩略图使用不同的扩展名
+func thumbFileName(hash string, size int, encrypted bool) string {
+	ext := ".jpg"
+	if encrypted {
+		ext = thumbEncryptedExt
+	}
+	return fmt.Sprintf("%s/%s_%d%s", hash[:2], hash, size, ext)
+}
+
+// 将缩略图编码为jpeg写入file, 开启静态加密时加密保存
+func writeThumbnail(file io.Writer, img image.Image) error {
+	if !blobStore.EncryptEnabled() {
+		return jpeg.Encode(file, img, &jpeg.Options{Quality: thumbJpegQuality})
+	}
+	writer, err := tb.NewEncryptWriter(file, blobStore.MasterKey())
+	if err != nil {
+		return err
+	}
+	if err = jpeg.Encode(writer, img, &jpeg.Options{Quality: thumbJpegQuality}); err != nil {
+		return err
+	}
+	return writer.Close()
+}
+
+// 解码图片, 拒绝像素数过大的图片
+func decodeStoredImage(fileName string) (image.Image, error) {
+	width, height := getImageSize(fileName)
+	if width*height > maxImagePixels {
+		return nil, fmt.Errorf("image too large: width=%d height=%d", width, height)
+	}
+	reader, err := openStoredFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	img, _, err := image.Decode(reader)
+	return img, err
+}
+
+// 调用外部命令生成PDF或视频的封面图片
+// newCmd根据源文件路径和输出的png文件路径创建命令
+func makePoster(fileName string, newCmd func(ctx context.Context, src, dst string) *exec.Cmd) (image.Image, error) {
+	tmpDir, err := ioutil.TempDir("", "poster")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpDir)
+	src, err := getLocalFilePath(fileName, tmpDir)
+	if err != nil {
+		return nil, err
+	}
+	dst := filepath.Join(tmpDir, "poster.png")
+	ctx, cancel := context.WithTimeout(context.Background(), posterTimeout)
+	defer cancel()
+	cmd := newCmd(ctx, src, dst)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("create poster failed: cmd=%s error=%v output=%s", cmd.Path, err, output)
+	}
+	file, err := os.Open(dst)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	img, _, err := image.Decode(file)
+	return img, err
+}
+
+// 获取文件在本地的路径, 文件保存在对象存储或已加密时将明文写入tmpDir中
+func getLocalFilePath(fileName string, tmpDir string) (string, error) {
+	if blobStore.IsLocal() {
+		encrypted, err := isStoredFileEncrypted(fileName)
+		if err != nil {
+			return "", err
+		}
+		if !encrypted {
+			return staticFS.Resolve(fileName)
+		}
+	}
+	reader, err := openStoredFile(fileName)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+	localPath := filepath.Join(tmpDir, "src"+filepath.Ext(fileName))
+	file, err := os.Create(localPath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	_, err = io.Copy(file, reader)
+	return localPath, err
+}
+
+// 删除某个文件块对应的全部缩略图
+func removeThumbnails(hash string) {
+	for _, size := range thumbSizes {
+		thumbFS.Remove(thumbFileName(hash, size, false))
+		thumbFS.Remove(thumbFileName(hash, size, true))
+	}
+}
@@ -0,0 +1,913 @@
+package handler
+
+// StaticPath目录的容量配额、占用统计以及去重存储
+// 目录下的文件按用途划分为四个区域: 匿名上传(share)、个人网盘(netdish)、manage页面上传(manage)、callDriver聊天附件(chat)
+// 上传的文件内容统一保存在blobStore中, 相同内容只保存一份:
+// 使用本地存储时StaticPath下的文件是指向文件块的硬链接; 使用对象存储时文件只存在于stored_file索引中
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"../config"
+	"../model"
+	tb "../toolbox"
+	"github.com/astaxie/beego/logs"
+)
+
+// 存储区域
+const (
+	areaShare   = "share"   // static服务的匿名上传
+	areaNetdish = "netdish" // 个人网盘, 无法识别归属的文件默认属于这里
+	areaManage  = "manage"  // manage页面上传
+	areaChat    = "chat"    // callDriver的聊天附件
+)
+
+// 保存文件块的目录, 位于StaticPath下且对外不可见
+const blobDirName = ".blobs"
+
+// static服务保存的文件名格式
+var shareFileReg = regexp.MustCompile(`^[a-z]{8}\.tmp$`)
+
+// callDriver聊天附件保存的文件名格式
+var chatFileReg = regexp.MustCompile(`^callDriver/[0-9a-f]{24}\.[a-z0-9]+$`)
+
+var errFileExist = errors.New("file already exist")
+
+const evictBatch = 20 // 淘汰文件时每次查询的文件数
+
+var (
+	blobStore    *tb.BlobStore
+	fileAreas    = make(map[string]string) // 无法从文件名判断归属的文件的区域记录, key为相对StaticPath的路径
+	fileAreasMux = new(sync.Mutex)
+	quotaMux     = new(sync.Mutex)      // 保证配额检查和淘汰过程串行执行
+	blobMux      = new(sync.Mutex)      // 保证文件块引用的增减串行执行
+	pendingBlobs = make(map[string]int) // 正在保存的文件块及保存的请求数, 由blobMux保护
+
+	// 已通过配额检查但还未保存完成的大小, 检查配额时计为已占用, 由quotaMux保护
+	reservedSpace   = make(map[string]int64) // 区域 -> 字节数
+	reservedIPSpace = make(map[string]int64) // 匿名上传的ip -> 字节数
+)
+
+// StaticPath下的一个文件
+type storedFile struct {
+	Name      string `json:"fileName"` // 相对StaticPath的路径
+	Area      string `json:"area"`
+	Size      int64  `json:"size"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// 目录列表中的一项
+type storedEntry struct {
+	storedFile
+	IsDir bool `json:"isDir"`
+}
+
+// 单个区域的占用情况
+type areaUsage struct {
+	Area  string `json:"area"`
+	Quota int64  `json:"quota"` // 单位为byte, 0代表不限制
+	Bytes int64  `json:"bytes"` // 同一区域中内容相同的文件只计算一次
+	Files int    `json:"files"`
+}
+
+// 根据配置创建文件块存储
+func newBlobStore() (*tb.BlobStore, error) {
+	blobRoot := config.ServerConfig.StaticPath + blobDirName
+	var driver tb.StorageDriver
+	var err error
+	switch config.StorageConfig.Driver {
+	case "local":
+		driver, err = tb.NewLocalDriver(blobRoot)
+	case "s3":
+		driver, err = tb.NewS3Driver(tb.S3Options{
+			Endpoint:  config.StorageConfig.S3Endpoint,
+			Region:    config.StorageConfig.S3Region,
+			Bucket:    config.StorageConfig.S3Bucket,
+			AccessKey: config.StorageConfig.S3AccessKey,
+			SecretKey: config.StorageConfig.S3SecretKey,
+			Prefix:    config.StorageConfig.S3Prefix,
+			PathStyle: config.StorageConfig.S3PathStyle,
+		})
+	default:
+		err = fmt.Errorf("unexpect storage driver: driver=%q", config.StorageConfig.Driver)
+	}
+	if err != nil {
+		return nil, err
+	}
+	store, err := tb.NewBlobStore(driver, blobRoot+"/tmp")
+	if err != nil {
+		return nil, err
+	}
+	// 未开启加密时也可以配置主密钥, 用于读取之前加密保存的文件
+	if config.StorageConfig.MasterKey != "" {
+		key, err := tb.ParseMasterKey(config.StorageConfig.MasterKey)
+		if err != nil {
+			return nil, err
+		}
+		store.SetMasterKey(key, config.StorageConfig.EncryptAtRest)
+	} else if config.StorageConfig.EncryptAtRest {
+		return nil, errors.New("encrypt_at_rest is enabled but master key is not set")
+	}
+	return store, nil
+}
+
+// 记录文件所属区域
+func setFileArea(name, area string) {
+	fileAreasMux.Lock()
+	defer fileAreasMux.Unlock()
+	fileAreas[name] = area
+}
+
+// 删除文件的区域记录
+func removeFileArea(name string) {
+	fileAreasMux.Lock()
+	defer fileAreasMux.Unlock()
+	delete(fileAreas, name)
+}
+
+// 获取全部区域记录的副本，用于持久化
+func getAllFileArea() map[string]string {
+	fileAreasMux.Lock()
+	defer fileAreasMux.Unlock()
+	res := make(map[string]string, len(fileAreas))
+	for k, v := range fileAreas {
+		res[k] = v
+	}
+	return res
+}
+
+// 还原区域记录
+func restoreFileArea(old map[string]string) {
+	fileAreasMux.Lock()
+	defer fileAreasMux.Unlock()
+	for k, v := range old {
+		fileAreas[k] = v
+	}
+}
+
+// 判断文件所属区域
+func getFileArea(name string) string {
+	if shareFileReg.MatchString(name) {
+		return areaShare
+	}
+	if chatFileReg.MatchString(name) {
+		return areaChat
+	}
+	fileAreasMux.Lock()
+	defer fileAreasMux.Unlock()
+	if area, isExist := fileAreas[name]; isExist {
+		return area
+	}
+	return areaNetdish
+}
+
+// 获取某个区域的配额(byte)以及超额时是否淘汰旧文件
+func getAreaQuota(area string) (quota int64, evict bool) {
+	switch area {
+	case areaShare:
+		return config.QuotaConfig.ShareQuota << 20, config.QuotaConfig.ShareEvict
+	case areaNetdish:
+		return config.QuotaConfig.NetdishQuota << 20, config.QuotaConfig.NetdishEvict
+	case areaManage:
+		return config.QuotaConfig.ManageQuota << 20, config.QuotaConfig.ManageEvict
+	case areaChat:
+		return config.QuotaConfig.ChatQuota << 20, config.QuotaConfig.ChatEvict
+	}
+	return 0, false
+}
+
+// 按条件查询stored_file中的文件索引, 参数见model.FindStoredFiles
+func findStoredFiles(area string, prefix string, sort string, limit int) ([]storedFile, error) {
+	files := make([]storedFile, 0)
+	indexes, err := model.FindStoredFiles(area, prefix, sort, limit)
+	if err != nil {
+		return files, err
+	}
+	for _, f := range indexes {
+		files = append(files, storedFile{Name: f.Name, Area: f.Area, Size: f.Size, Timestamp: f.TimeStamp})
+	}
+	return files, nil
+}
+
+// 使用本地存储时, 为没有索引的旧文件补建索引, 并删除文件已不存在的索引, 启动时在后台执行
+// 之后配额检查和文件列表都只依赖索引, 不再遍历StaticPath
+func syncStoredFileIndex() {
+	if !blobStore.IsLocal() {
+		return
+	}
+	indexes, err := model.GetAllStoredFile()
+	if err != nil {
+		return
+	}
+	stale := make(map[string]bool, len(indexes))
+	for _, f := range indexes {
+		stale[f.Name] = true
+	}
+	created := 0
+	root := staticFS.Root()
+	err = filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if info.IsDir() {
+			if staticFS.IsReserved(rel) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if stale[rel] {
+			delete(stale, rel)
+			return nil
+		}
+		if _, err := model.GetStoredFile(rel); err != model.ErrorNoRecord { // 遍历期间新保存的文件已有索引
+			return nil
+		}
+		// 加密保存的文件在写入索引失败时会被删除, 没有索引的文件都是明文
+		index := model.StoredFile{Name: rel, Area: getFileArea(rel), Size: info.Size(), TimeStamp: info.ModTime().Unix()}
+		if model.UpsertStoredFile(&index) == nil {
+			created++
+		}
+		return nil
+	})
+	if err != nil {
+		logs.Error("sync stored file index failed: error=%v", err)
+		return
+	}
+	removed := 0
+	for name := range stale {
+		if _, err := staticFS.Stat(name); os.IsNotExist(err) && model.RemoveStoredFile(name) == nil {
+			removed++
+		}
+	}
+	logs.Info("sync stored file index success: created=%d removed=%d", created, removed)
+}
+
+// 列出StaticPath下某个目录中的文件和子目录
+func listStoredDir(dir string) ([]storedEntry, error) {
+	entries := make([]storedEntry, 0)
+	if blobStore.IsLocal() {
+		infos, err := staticFS.ReadDir(dir)
+		if err != nil {
+			return entries, err
+		}
+		for _, info := range infos {
+			name := path.Join(dir, info.Name())
+			entries = append(entries, storedEntry{
+				storedFile: storedFile{Name: name, Area: getFileArea(name), Size: localFileSize(name, info), Timestamp: info.ModTime().Unix()},
+				IsDir:      info.IsDir(),
+			})
+		}
+		return entries, nil
+	}
+	// 对象存储中没有目录, 由文件路径得到子目录
+	prefix := ""
+	if dir != "" && dir != "." {
+		prefix = strings.TrimSuffix(dir, "/") + "/"
+	}
+	files, err := findStoredFiles("", prefix, "", 0)
+	if err != nil {
+		return entries, err
+	}
+	dirs := make(map[string]int) // 子目录 -> 在entries中的位置
+	for _, f := range files {
+		rest := strings.TrimPrefix(f.Name, prefix)
+		i := strings.Index(rest, "/")
+		if i < 0 {
+			entries = append(entries, storedEntry{storedFile: f})
+			continue
+		}
+		name := prefix + rest[:i]
+		if pos, ok := dirs[name]; ok {
+			if f.Timestamp > entries[pos].Timestamp {
+				entries[pos].Timestamp = f.Timestamp
+			}
+			continue
+		}
+		dirs[name] = len(entries)
+		entries = append(entries, storedEntry{storedFile: storedFile{Name: name, Area: getFileArea(name), Timestamp: f.Timestamp}, IsDir: true})
+	}
+	return entries, nil
+}
+
+// 查询StaticPath下某个文件的信息, 文件不存在或是一个目录时返回错误
+func statStoredFile(name string) (*storedFile, error) {
+	if !blobStore.IsLocal() {
+		index, err := model.GetStoredFile(name)
+		if err == model.ErrorNoRecord {
+			return nil, os.ErrNotExist
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &storedFile{Name: index.Name, Area: index.Area, Size: index.Size, Timestamp: index.TimeStamp}, nil
+	}
+	info, err := staticFS.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, fmt.Errorf("it is a floder: name=%s", name)
+	}
+	return &storedFile{Name: name, Area: getFileArea(name), Size: localFileSize(name, info), Timestamp: info.ModTime().Unix()}, nil
+}
+
+// 本地文件的明文大小, 只有设置了主密钥时才可能存在加密的文件
+func localFileSize(name string, info os.FileInfo) int64 {
+	if blobStore.MasterKey() == nil || info.IsDir() {
+		return info.Size()
+	}
+	if encrypted, err := isStoredFileEncrypted(name); err == nil && encrypted {
+		if size, err := tb.EncryptedPlainSize(info.Size()); err == nil {
+			return size
+		}
+	}
+	return info.Size()
+}
+
+// 根据文件索引判断文件是否加密保存, 没有索引的旧文件都是明文
+func isStoredFileEncrypted(name string) (bool, error) {
+	index, err := model.GetStoredFile(name)
+	if err == model.ErrorNoRecord {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return index.Encrypted, nil
+}
+
+// 统计各区域的占用情况
+func getAreaUsage() ([]areaUsage, error) {
+	usage := make([]areaUsage, 0)
+	sums, err := model.SumStoredFileByArea()
+	if err != nil {
+		return usage, err
+	}
+	for _, area := range []string{areaShare, areaNetdish, areaManage, areaChat} {
+		quota, _ := getAreaQuota(area)
+		tmp := areaUsage{Area: area, Quota: quota}
+		for _, sum := range sums {
+			if sum.Area == area {
+				tmp.Bytes, tmp.Files = sum.Bytes, sum.Files
+			}
+		}
+		usage = append(usage, tmp)
+	}
+	return usage, nil
+}
+
+// 查询某个区域已使用的容量
+func getAreaUsed(area string) (int64, error) {
+	usage, err := getAreaUsage()
+	if err != nil {
+		return 0, err
+	}
+	for _, u := range usage {
+		if u.Area == area {
+			return u.Bytes, nil
+		}
+	}
+	return 0, nil
+}
+
+// 在写入新文件之前检查配额，区域配置为淘汰模式时会删除该区域最旧的文件以腾出空间
+// ip仅对匿名上传有效，用于检查单个IP每天的上传量
+// 通过检查后预留size直到调用返回的release, 文件保存完成或失败后都需要调用
+func reserveSpace(area string, size int64, ip string) (release func(), err error) {
+	quotaMux.Lock()
+	defer quotaMux.Unlock()
+	if err = reserveSpaceLocked(area, size, ip, ""); err != nil {
+		return nil, err
+	}
+	reservedSpace[area] += size
+	if area == areaShare {
+		reservedIPSpace[ip] += size
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			quotaMux.Lock()
+			defer quotaMux.Unlock()
+			if reservedSpace[area] -= size; reservedSpace[area] <= 0 {
+				delete(reservedSpace, area)
+			}
+			if area == areaShare {
+				if reservedIPSpace[ip] -= size; reservedIPSpace[ip] <= 0 {
+					delete(reservedIPSpace, ip)
+				}
+			}
+		})
+	}, nil
+}
+
+// 区域当前还可以写入的大小, 淘汰模式下为淘汰全部旧文件后可用的大小, 未限制配额时返回-1
+func getAreaAvailable(area string) (int64, error) {
+	quota, evict := getAreaQuota(area)
+	if quota <= 0 {
+		return -1, nil
+	}
+	quotaMux.Lock()
+	defer quotaMux.Unlock()
+	pending := reservedSpace[area]
+	if area == areaShare {
+		sessions, _, _, err := sumOpenSessions("", "")
+		if err != nil {
+			return 0, err
+		}
+		pending += sessions
+	}
+	var used int64
+	if !evict {
+		var err error
+		if used, err = getAreaUsed(area); err != nil {
+			return 0, err
+		}
+	}
+	if available := quota - used - pending; available > 0 {
+		return available, nil
+	}
+	return 0, nil
+}
+
+// 调用者需持有quotaMux
+// 已预留的大小以及匿名上传时未完成的断点续传会话声明的大小也计为已占用, exceptSession为不计入的会话id
+func reserveSpaceLocked(area string, size int64, ip string, exceptSession string) error {
+	pending, ipPending := reservedSpace[area], int64(0)
+	if area == areaShare {
+		sessions, ipSessions, _, err := sumOpenSessions(ip, exceptSession)
+		if err != nil {
+			return err
+		}
+		pending += sessions
+		ipPending = reservedIPSpace[ip] + ipSessions
+	}
+
+	if area == areaShare && config.QuotaConfig.ShareIPQuota > 0 {
+		used, err := model.SumUploadSizeByIP(ip, time.Now().Add(-24*time.Hour).Unix())
+		if err != nil {
+			return err
+		}
+		used += ipPending
+		if used+size > config.QuotaConfig.ShareIPQuota<<20 {
+			logs.Warn("reject upload by ip quota: ip=%s used=%d size=%d", ip, used, size)
+			return fmt.Errorf("upload quota of your ip is used up: used=%d size=%d", used, size)
+		}
+	}
+
+	quota, evict := getAreaQuota(area)
+	if quota <= 0 {
+		return nil
+	}
+	if size > quota {
+		return fmt.Errorf("file too large: area=%s quota=%d size=%d", area, quota, size)
+	}
+	used, err := getAreaUsed(area)
+	if err != nil {
+		return err
+	}
+	used += pending
+	if used+size <= quota {
+		return nil
+	}
+	if pending+size > quota { // 淘汰全部文件也无法容纳, 不删除文件
+		logs.Warn("reject upload by pending sessions: area=%s quota=%d pending=%d size=%d", area, quota, pending, size)
+		return fmt.Errorf("storage quota is used up: area=%s quota=%d used=%d", area, quota, used)
+	}
+	if !evict {
+		logs.Warn("reject upload by area quota: area=%s quota=%d used=%d size=%d", area, quota, used, size)
+		return fmt.Errorf("storage quota is used up: area=%s quota=%d used=%d", area, quota, used)
+	}
+	// 从最旧的文件开始淘汰, 每删除一个文件后重新统计
+	for used+size > quota {
+		var files []storedFile
+		if files, err = findStoredFiles(area, "", "timeStamp", evictBatch); err != nil {
+			return err
+		}
+		if len(files) == 0 {
+			return fmt.Errorf("storage quota is used up: area=%s quota=%d used=%d", area, quota, used)
+		}
+		for _, f := range files {
+			err = removeStoredFile(f.Name)
+			if os.IsNotExist(err) { // 文件已不存在, 删除过期的索引
+				err = model.RemoveStoredFile(f.Name)
+			}
+			if err != nil {
+				logs.Error("evict file failed: file=%+v error=%v", f, err)
+				return err
+			}
+			logs.Info("evict file by quota: file=%+v", f)
+			if used, err = getAreaUsed(area); err != nil {
+				return err
+			}
+			used += pending
+			if used+size <= quota {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// 将数据保存为StaticPath下的name文件, 返回内容的sha256和大小
+// overwrite为false时若name已存在则返回errFileExist
+func saveStoredFile(name string, area string, src io.Reader, overwrite bool) (hash string, size int64, err error) {
+	if _, err = statStoredFile(name); err == nil && !overwrite {
+		return "", 0, errFileExist
+	}
+	if _, err = staticFS.Resolve(name); err != nil { // 使用对象存储时同样要求文件名合法
+		return "", 0, err
+	}
+	staged, err := blobStore.Stage(src)
+	if err != nil {
+		logs.Error("save blob failed: name=%s error=%v", name, err)
+		return "", 0, err
+	}
+	defer blobStore.Discard(staged)
+	hash, size = staged.Hash, staged.Size
+	blobHash := hash // 出错返回时hash会被置空
+
+	// 提交之前登记正在保存的文件块, 之后文件块在被引用或本次保存失败之前不会被其他请求删除
+	blobMux.Lock()
+	pendingBlobs[blobHash]++
+	blobMux.Unlock()
+	created, err := blobStore.Commit(staged)
+
+	blobMux.Lock()
+	defer blobMux.Unlock()
+	defer func() {
+		if pendingBlobs[blobHash]--; pendingBlobs[blobHash] <= 0 {
+			delete(pendingBlobs, blobHash)
+		}
+		if err != nil { // 保存失败时释放文件块, 仍被其他文件引用或正在保存时不会删除
+			releaseBlob(blobHash)
+		}
+	}()
+	if err != nil {
+		logs.Error("save blob failed: name=%s hash=%s error=%v", name, hash, err)
+		return "", 0, err
+	}
+	// 文件块已存在时沿用它的加密状态, 开关加密之前保存的数据不会被重新加密
+	encrypted := staged.Encrypted
+	if !created {
+		var blob *model.FileBlob
+		if blob, err = model.GetBlob(hash); err == nil {
+			encrypted = blob.Encrypted
+		} else if err != model.ErrorNoRecord { // 没有记录时是其他请求刚刚保存的, 加密状态与本次相同
+			return "", 0, err
+		}
+	}
+	if _, err = statStoredFile(name); err == nil {
+		if !overwrite {
+			return "", 0, errFileExist
+		}
+		if err = removeStoredFileLocked(name); err != nil {
+			return "", 0, err
+		}
+	}
+	if blobStore.IsLocal() {
+		var blobPath string
+		blobPath, err = blobStore.Path(hash)
+		if err != nil {
+			return "", 0, err
+		}
+		if err = staticFS.MkdirAll(filepath.Dir(name)); err != nil {
+			return "", 0, err
+		}
+		err = staticFS.Link(blobPath, name)
+		if err != nil { // 无法创建硬链接时退化为复制
+			logs.Warn("link blob failed, copy instead: name=%s hash=%s error=%v", name, hash, err)
+			err = copyBlob(hash, name)
+		}
+		if err != nil {
+			logs.Error("save stored file failed: name=%s hash=%s error=%v", name, hash, err)
+			return "", 0, err
+		}
+	}
+	index := model.StoredFile{
+		Name:      name,
+		Area:      area,
+		Hash:      hash,
+		Size:      size,
+		Encrypted: encrypted,
+		TimeStamp: time.Now().Unix(),
+	}
+	if err = model.UpsertStoredFile(&index); err != nil {
+		// 对象存储模式下索引是找到文件的唯一途径, 加密的文件也只能通过索引识别
+		if !blobStore.IsLocal() {
+			return "", 0, err
+		}
+		if encrypted {
+			staticFS.Remove(name)
+			return "", 0, err
+		}
+		logs.Error("save file index failed: name=%s error=%v", name, err)
+	}
+	if err = model.AddBlobRef(hash, size, encrypted, name); err != nil {
+		logs.Error("add blob ref failed, file saved without ref: name=%s hash=%s error=%v", name, hash, err)
+	}
+	if area != getFileArea(name) {
+		setFileArea(name, area)
+	}
+	logs.Info("save stored file success: name=%s hash=%s size=%d newBlob=%v encrypted=%v", name, hash, size, created, encrypted)
+	return hash, size, nil
+}
+
+// 删除StaticPath下的文件, 同时释放它对文件块的引用
+func removeStoredFile(name string) error {
+	blobMux.Lock()
+	defer blobMux.Unlock()
+	return removeStoredFileLocked(name)
+}
+
+func removeStoredFileLocked(name string) error {
+	if blobStore.IsLocal() {
+		err := staticFS.Remove(name)
+		if err != nil {
+			return err
+		}
+		model.RemoveStoredFile(name)
+	} else {
+		err := model.RemoveStoredFile(name)
+		if err == model.ErrorNoRecord {
+			return os.ErrNotExist
+		}
+		if err != nil {
+			return err
+		}
+	}
+	removeFileArea(name)
+	blob, err := model.RemoveBlobRef(name)
+	if err == model.ErrorNoRecord { // 去重存储之前保存的文件
+		return nil
+	}
+	if err != nil {
+		logs.Error("release blob ref failed: name=%s error=%v", name, err)
+		return nil
+	}
+	if len(blob.Refs) == 0 {
+		releaseBlob(blob.Hash)
+	}
+	return nil
+}
+
+// 删除StaticPath下的目录及其中的全部文件, 仅支持本地存储
+func removeStoredDir(name string) error {
+	if !blobStore.IsLocal() {
+		return tb.ErrNotLocalStorage
+	}
+	dirPath, err := staticFS.Resolve(name)
+	if err != nil {
+		return err
+	}
+	if dirPath == staticFS.Root() {
+		return tb.ErrBadFileName
+	}
+	files, err := listLocalFiles(dirPath)
+	if err != nil {
+		return err
+	}
+	for _, rel := range files {
+		if err = removeStoredFile(path.Join(name, rel)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.RemoveAll(dirPath)
+}
+
+// 移动StaticPath下的文件或目录, 同时更新索引、文件块引用以及区域记录, 仅支持本地存储
+func moveStoredFile(oldName, newName string) error {
+	if !blobStore.IsLocal() {
+		return tb.ErrNotLocalStorage
+	}
+	blobMux.Lock()
+	defer blobMux.Unlock()
+	oldPath, err := staticFS.Resolve(oldName)
+	if err != nil {
+		return err
+	}
+	files, err := listLocalFiles(oldPath)
+	if err != nil {
+		return err
+	}
+	if err = staticFS.Rename(oldName, newName); err != nil {
+		return err
+	}
+	for _, rel := range files {
+		from, to := path.Join(oldName, rel), path.Join(newName, rel)
+		area := getFileArea(from)
+		removeFileArea(from)
+		if area != getFileArea(to) {
+			setFileArea(to, area)
+		}
+		index, err := model.GetStoredFile(from)
+		if err != nil { // 去重存储之前保存的文件没有索引
+			continue
+		}
+		model.RemoveStoredFile(from)
+		index.Name = to
+		if err = model.UpsertStoredFile(index); err != nil {
+			logs.Error("update file index failed: from=%s to=%s error=%v", from, to, err)
+		}
+		model.RemoveBlobRef(from)
+		if err = model.AddBlobRef(index.Hash, index.Size, index.Encrypted, to); err != nil {
+			logs.Error("update blob ref failed: from=%s to=%s error=%v", from, to, err)
+		}
+	}
+	logs.Info("move stored file: from=%s to=%s files=%d", oldName, newName, len(files))
+	return nil
+}
+
+// 列出本地路径下的全部文件, 返回相对该路径的名字; 路径本身是文件时返回"."
+func listLocalFiles(root string) ([]string, error) {
+	files := make([]string, 0)
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			rel, err := filepath.Rel(root, p)
+			if err != nil {
+				return err
+			}
+			files = append(files, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	return files, err
+}
+
+// 返回StaticPath下的文件, downloadName为下载时使用的文件名, inline为true时以预览方式返回
+// 文件保存在对象存储时重定向到临时下载链接
+func serveStoredFile(w http.ResponseWriter, r *http.Request, name string, downloadName string, inline bool) error {
+	if blobStore.IsLocal() {
+		info, err := statStoredFile(name)
+		if err != nil {
+			return err
+		}
+		filePath, err := staticFS.Resolve(name)
+		if err != nil {
+			return err
+		}
+		file, err := openLocalPlainFile(name)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		if !file.Encrypted() {
+			if inline {
+				http.ServeFile(w, r, filePath)
+				return nil
+			}
+			return tb.ServerFile(w, filePath, downloadName, info.Size)
+		}
+		// 加密的文件解密后返回, 仍支持Range请求
+		if !inline {
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Header().Set("content-disposition", tb.ContentDisposition("attachment", downloadName))
+		}
+		http.ServeContent(w, r, name, time.Unix(info.Timestamp, 0), file)
+		return nil
+	}
+
+	index, err := model.GetStoredFile(name)
+	if err == model.ErrorNoRecord {
+		return os.ErrNotExist
+	}
+	if err != nil {
+		return err
+	}
+	expire := time.Duration(config.StorageConfig.PresignExpire) * time.Second
+	url, err := blobStore.PresignURL(index.Hash, downloadName, inline, expire)
+	if err == nil {
+		logs.Info("redirect to presigned url: name=%s hash=%s", name, index.Hash)
+		http.Redirect(w, r, url, http.StatusFound)
+		return nil
+	}
+	if err != tb.ErrPresignNotSupport {
+		return err
+	}
+	// 不支持临时链接时由本服务转发数据
+	reader, err := blobStore.Open(index.Hash, index.Encrypted)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	if inline {
+		w.Header().Set("Content-Type", mime.TypeByExtension(filepath.Ext(name)))
+	} else {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("content-disposition", tb.ContentDisposition("attachment", downloadName))
+	}
+	w.Header().Set("Content-Length", fmt.Sprint(index.Size))
+	_, err = io.Copy(w, reader)
+	return err
+}
+
+// 打开StaticPath下的文件用于读取, 加密的文件返回解密后的内容
+func openStoredFile(name string) (io.ReadCloser, error) {
+	if blobStore.IsLocal() {
+		return openLocalPlainFile(name)
+	}
+	index, err := model.GetStoredFile(name)
+	if err == model.ErrorNoRecord {
+		return nil, os.ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	return blobStore.Open(index.Hash, index.Encrypted)
+}
+
+// 打开本地的文件, 加密的文件支持随机读取解密后的内容
+func openLocalPlainFile(name string) (*tb.PlainFile, error) {
+	encrypted, err := isStoredFileEncrypted(name)
+	if err != nil {
+		return nil, err
+	}
+	file, err := staticFS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return tb.OpenPlainFile(file, blobStore.MasterKey(), encrypted)
+}
+
+// 获取文件内容的sha256, 去重存储之前保存的文件没有索引, 需要读取文件计算
+func getStoredFileHash(name string) (string, error) {
+	index, err := model.GetStoredFile(name)
+	if err == nil && index.Hash != "" {
+		return index.Hash, nil
+	}
+	if !blobStore.IsLocal() {
+		if err == model.ErrorNoRecord {
+			return "", os.ErrNotExist
+		}
+		return "", err
+	}
+	file, err := openLocalPlainFile(name)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hasher := sha256.New()
+	if _, err = io.Copy(hasher, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// 文件块不再被引用时删除它, 调用方需持有blobMux
+// 有请求正在保存同样内容的文件块时不删除, 由最后一个保存失败的请求释放
+func releaseBlob(hash string) {
+	if pendingBlobs[hash] > 0 {
+		return
+	}
+	blob, err := model.GetBlob(hash)
+	if err == model.ErrorNoRecord { // 从未被引用过的文件块
+		err = blobStore.Remove(hash)
+		logs.Info("remove unreferenced blob: hash=%s error=%v", hash, err)
+		return
+	}
+	if err != nil || len(blob.Refs) > 0 {
+		return
+	}
+	removed, err := model.RemoveUnusedBlob(hash)
+	if err != nil || !removed {
+		return
+	}
+	err = blobStore.Remove(hash)
+	removeThumbnails(hash)
+	logs.Info("remove unused blob: hash=%s error=%v", hash, err)
+}
+
+// 将文件块的内容复制到name, 加密的文件块原样复制
+func copyBlob(hash string, name string) error {
+	src, err := blobStore.OpenRaw(hash)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := staticFS.CreateNew(name)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	_, err = io.Copy(dst, src)
+	return err
+}
@@ -0,0 +1,315 @@
+package handler
+
+// 支持断点续传的匿名上传, 供命令行客户端上传大文件使用
+// 1. POST  /static/upload/session?fileName=${name}&size=${size}  创建上传会话, 返回会话id
+// 2. HEAD  /static/upload/session/${id}  通过Upload-Offset响应头返回已接收的字节数
+// 3. PATCH /static/upload/session/${id}  携带Upload-Offset请求头上传从该位置开始的数据, 全部接收后返回上传结果
+// 未完成的数据保存在StaticPath/.partial目录下, 超过一天没有更新的会话会被清理
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"../config"
+	tb "../toolbox"
+	"github.com/astaxie/beego/logs"
+)
+
+// 保存未完成上传的目录, 位于StaticPath下且对外不可见
+const partialDirName = ".partial"
+
+const uploadSessionExpire = 24 * time.Hour
+
+var sessionIDReg = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+var (
+	partialFS    *tb.SandboxFS
+	sessionLocks = new(sync.Map) // 会话id -> *sync.Mutex, 同一个会话的数据串行写入
+)
+
+// 上传会话, 以json格式保存在${id}.json中
+type uploadSession struct {
+	ID        string `json:"id"`
+	FileName  string `json:"fileName"`
+	Size      int64  `json:"size"`
+	IP        string `json:"ip"`
+	OwnerHash string `json:"ownerHash"`
+	CreateAt  int64  `json:"createAt"`
+}
+
+// 初始化未完成上传的保存目录
+func initUploadSession() error {
+	var err error
+	staticFS.Reserve(partialDirName)
+	partialFS, err = tb.NewSandboxFS(config.ServerConfig.StaticPath + partialDirName)
+	return err
+}
+
+// 创建上传会话, 此时即检查配额
+// 会话声明的大小在完成或过期之前计为已占用的空间, 每个IP同时打开的会话数有上限
+func createUploadSessionHandler(w http.ResponseWriter, r *http.Request) {
+	var resp respStruct
+	var err error
+	for loop := true; loop; loop = false {
+		if r.Method != http.MethodPost {
+			err = fmt.Errorf("unexpect method: %s", r.Method)
+			break
+		}
+		r.ParseForm()
+		session := uploadSession{
+			FileName: r.Form.Get("fileName"),
+			CreateAt: time.Now().Unix(),
+		}
+		if session.ID, err = newUploadSessionID(); err != nil {
+			break
+		}
+		session.Size, err = strconv.ParseInt(r.Form.Get("size"), 10, 64)
+		if err != nil || session.Size < 0 || session.FileName == "" {
+			err = fmt.Errorf("unexpect params: fileName=%q size=%q", session.FileName, r.Form.Get("size"))
+			break
+		}
+		session.OwnerHash, err = getOwnerHash(r, false)
+		if err != nil {
+			break
+		}
+		session.IP, _ = tb.GetIpAndPort(r)
+		if err = openUploadSession(&session); err != nil {
+			break
+		}
+		logs.Info("create upload session: session=%+v", session)
+		resp.PayLoad = map[string]interface{}{
+			"id":        session.ID,
+			"offset":    0,
+			"uploadUrl": fmt.Sprintf("%s/static/upload/session/%s", config.ServerConfig.ServerURL, session.ID),
+		}
+	}
+	if err != nil {
+		logs.Warn("create upload session failed: error=%v", err)
+		resp.Status = -1
+		resp.Msg = fmt.Sprint(err)
+	}
+	responseJson(&w, resp)
+}
+
+// 查询进度或上传数据
+func uploadSessionHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(strings.Trim(r.URL.Path, "/"), "static/upload/session/")
+	if !sessionIDReg.MatchString(id) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	lock, _ := sessionLocks.LoadOrStore(id, new(sync.Mutex))
+	lock.(*sync.Mutex).Lock()
+	defer lock.(*sync.Mutex).Unlock()
+
+	session, err := loadUploadSession(id)
+	if err != nil {
+		logs.Info("upload session not found: id=%s error=%v", id, err)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	info, err := partialFS.Stat(id + ".part")
+	if err != nil {
+		logs.Error("stat upload session failed: id=%s error=%v", id, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	offset := info.Size()
+	w.Header().Set("Upload-Length", fmt.Sprint(session.Size))
+	w.Header().Set("Upload-Offset", fmt.Sprint(offset))
+	switch r.Method {
+	case http.MethodHead:
+		return
+	case http.MethodPatch, http.MethodPut:
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var resp respStruct
+	status := http.StatusOK
+	for loop := true; loop; loop = false {
+		var reqOffset int64
+		reqOffset, err = strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+		if err != nil || reqOffset != offset {
+			status = http.StatusConflict
+			err = fmt.Errorf("offset mismatch: expect=%d got=%q", offset, r.Header.Get("Upload-Offset"))
+			break
+		}
+		var file *os.File
+		file, err = partialFS.OpenFile(id+".part", os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			break
+		}
+		var n int64
+		n, err = io.Copy(file, io.LimitReader(r.Body, session.Size-offset))
+		file.Close()
+		offset += n
+		w.Header().Set("Upload-Offset", fmt.Sprint(offset))
+		if err != nil { // 已写入的部分保留, 客户端可从新的位置继续
+			break
+		}
+		if offset < session.Size {
+			resp.PayLoad = map[string]interface{}{"id": id, "offset": offset}
+			break
+		}
+		resp.PayLoad, err = finishUploadSession(session)
+	}
+	if err != nil {
+		logs.Warn("handle upload session failed: id=%s error=%v", id, err)
+		resp.Status = -1
+		resp.Msg = fmt.Sprint(err)
+	}
+	responseJsonStatus(&w, status, resp)
+}
+
+// 检查配额和会话数并保存新的会话, 检查与保存在quotaMux内完成, 避免并发创建的会话超出配额
+func openUploadSession(session *uploadSession) error {
+	quotaMux.Lock()
+	defer quotaMux.Unlock()
+	_, _, count, err := sumOpenSessions(session.IP, "")
+	if err != nil {
+		return err
+	}
+	if count >= config.QuotaConfig.ShareIPSessions {
+		logs.Warn("reject upload session by count: ip=%s count=%d", session.IP, count)
+		return fmt.Errorf("too many unfinished upload sessions: count=%d", count)
+	}
+	if err = reserveSpaceLocked(areaShare, session.Size, session.IP, ""); err != nil {
+		return err
+	}
+	file, err := partialFS.CreateNew(session.ID + ".part")
+	if err != nil {
+		return err
+	}
+	file.Close()
+	if err = saveUploadSession(session); err != nil {
+		partialFS.Remove(session.ID + ".part")
+		return err
+	}
+	return nil
+}
+
+// 数据接收完毕, 将其保存为匿名上传文件并删除会话
+func finishUploadSession(session *uploadSession) (*shareUploadResult, error) {
+	// 会话创建之后其他上传可能已占用了空间, 需要再次检查, 会话自身声明的大小不重复计算
+	quotaMux.Lock()
+	err := reserveSpaceLocked(areaShare, session.Size, session.IP, session.ID)
+	quotaMux.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	file, err := partialFS.Open(session.ID + ".part")
+	if err != nil {
+		return nil, err
+	}
+	result, err := saveShareUpload(session.FileName, file, session.IP, session.OwnerHash)
+	file.Close()
+	if _, ok := err.(*scanBlockError); ok { // 文件和上传记录已保存, 关闭会话以免重试时重复保存
+		removeUploadSession(session.ID)
+		logs.Info("close blocked upload session: id=%s error=%v", session.ID, err)
+		return nil, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	removeUploadSession(session.ID)
+	logs.Info("finish upload session: id=%s code=%s", session.ID, result.Code)
+	return result, nil
+}
+
+// 会话id同时是上传地址中的凭据, 使用不可预测的随机数
+func newUploadSessionID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// 统计未完成的会话声明的大小, 返回全部会话的总大小、该ip的会话总大小和会话数, except为不统计的会话id
+func sumOpenSessions(ip string, except string) (total int64, ipTotal int64, ipCount int, err error) {
+	infos, err := partialFS.ReadDir("")
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	for _, info := range infos {
+		id := strings.TrimSuffix(info.Name(), ".json")
+		if id == info.Name() || id == except {
+			continue
+		}
+		session, err := loadUploadSession(id)
+		if err != nil { // 会话可能刚被删除
+			logs.Debug("load upload session failed: id=%s error=%v", id, err)
+			continue
+		}
+		total += session.Size
+		if session.IP == ip {
+			ipTotal += session.Size
+			ipCount++
+		}
+	}
+	return total, ipTotal, ipCount, nil
+}
+
+func saveUploadSession(session *uploadSession) error {
+	bytes, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	file, err := partialFS.CreateNew(session.ID + ".json")
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.Write(bytes)
+	return err
+}
+
+func loadUploadSession(id string) (*uploadSession, error) {
+	file, err := partialFS.Open(id + ".json")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	bytes, err := ioutil.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+	var session uploadSession
+	err = json.Unmarshal(bytes, &session)
+	return &session, err
+}
+
+func removeUploadSession(id string) {
+	partialFS.Remove(id + ".part")
+	partialFS.Remove(id + ".json")
+	sessionLocks.Delete(id)
+}
+
+// 清理超过一天没有更新的上传会话
+func cleanExpiredUploadSession() {
+	infos, err := partialFS.ReadDir("")
+	if err != nil {
+		logs.Error("read partial dir failed: error=%v", err)
+		return
+	}
+	for _, info := range infos {
+		id := strings.TrimSuffix(info.Name(), ".part")
+		if id == info.Name() || time.Since(info.ModTime()) < uploadSessionExpire {
+			continue
+		}
+		removeUploadSession(id)
+		logs.Info("remove expired upload session: id=%s size=%d", id, info.Size())
+	}
+}
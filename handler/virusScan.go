@@ -0,0 +1,197 @@
+package handler
+
+// 匿名上传文件的病毒扫描: 文件保存后、返回取件码之前进行扫描, 结果记录在上传记录中
+// 发现病毒的文件从StaticPath移入隔离目录, 不再能被下载或预览, 管理员可以在后台放行或删除
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"../config"
+	"../model"
+	tb "../toolbox"
+	"github.com/astaxie/beego/logs"
+)
+
+// 隔离文件的目录, 位于StaticPath下且对外不可见, 文件以取件码命名
+const quarantineDirName = ".quarantine"
+
+var (
+	quarantineFS  *tb.SandboxFS
+	uploadScanner tb.VirusScanner // 为nil时不扫描
+)
+
+// 根据配置创建扫描器和隔离目录
+func initVirusScan() error {
+	var err error
+	staticFS.Reserve(quarantineDirName)
+	quarantineFS, err = tb.NewSandboxFS(config.ServerConfig.StaticPath + quarantineDirName)
+	if err != nil {
+		return err
+	}
+	switch config.ScanConfig.Driver {
+	case "":
+		logs.Info("virus scan disabled")
+	case "eicar":
+		uploadScanner = tb.EicarScanner{}
+		logs.Warn("virus scan uses eicar test scanner, only EICAR test file will be detected")
+	case "clamd":
+		var scanner *tb.ClamdScanner
+		scanner, err = tb.NewClamdScanner(config.ScanConfig.ClamdAddr)
+		if err != nil {
+			return err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		// clamd暂时不可用时不影响启动, 扫描时会按scan_fail_close处理
+		if pingErr := scanner.Ping(ctx); pingErr != nil {
+			logs.Warn("clamd not available now: addr=%s error=%v", config.ScanConfig.ClamdAddr, pingErr)
+		}
+		uploadScanner = scanner
+	default:
+		return fmt.Errorf("unexpect scan driver: driver=%q", config.ScanConfig.Driver)
+	}
+	return nil
+}
+
+// 扫描匿名上传的文件, 返回扫描状态和结果, 未开启扫描时返回空字符串
+func scanShareUpload(code string) (status string, result string) {
+	if uploadScanner == nil {
+		return "", ""
+	}
+	reader, err := openStoredFile(code + ".tmp")
+	if err != nil {
+		return model.ScanStatusError, fmt.Sprint(err)
+	}
+	defer reader.Close()
+	res, err := tb.ScanWithTimeout(uploadScanner, reader, time.Duration(config.ScanConfig.Timeout)*time.Second)
+	if err != nil {
+		logs.Error("scan upload failed: code=%s error=%v", code, err)
+		return model.ScanStatusError, fmt.Sprint(err)
+	}
+	if res.Infected {
+		logs.Warn("virus found in upload: code=%s signature=%s", code, res.Signature)
+		sendAlert("上传的文件中发现病毒", "取件码: %s\n病毒: %s\n文件已被隔离, 可以在后台查看和放行", code, res.Signature)
+		return model.ScanStatusInfected, res.Signature
+	}
+	return model.ScanStatusClean, ""
+}
+
+// 扫描结果是否需要隔离
+func isScanBlocked(status string) bool {
+	return status == model.ScanStatusInfected || (status == model.ScanStatusError && config.ScanConfig.FailClose)
+}
+
+// 上传记录对应的文件是否因扫描结果而禁止访问
+func isShareBlocked(record *model.FileUpload) bool {
+	return isScanBlocked(record.ScanStatus)
+}
+
+// 隔离副本的文件名, 加密保存的副本带有.enc后缀
+func quarantineName(code string, encrypted bool) string {
+	if encrypted {
+		return code + ".enc"
+	}
+	return code
+}
+
+// 将匿名上传的文件移入隔离目录; 即使保存隔离副本失败也会删除原文件, 保证其不能再被访问
+func quarantineShareUpload(code string) error {
+	fileName := code + ".tmp"
+	copyName := quarantineName(code, blobStore.EncryptEnabled())
+	copyErr := func() error {
+		reader, err := openStoredFile(fileName)
+		if err != nil {
+			return err
+		}
+		defer reader.Close()
+		file, err := quarantineFS.OpenFile(copyName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		if !blobStore.EncryptEnabled() {
+			_, err = io.Copy(file, reader)
+			return err
+		}
+		writer, err := tb.NewEncryptWriter(file, blobStore.MasterKey())
+		if err != nil {
+			return err
+		}
+		if _, err = io.Copy(writer, reader); err != nil {
+			return err
+		}
+		return writer.Close()
+	}()
+	if copyErr != nil {
+		logs.Error("save quarantine copy failed: code=%s error=%v", code, copyErr)
+		quarantineFS.Remove(copyName)
+	}
+	if err := removeStoredFile(fileName); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	logs.Warn("upload quarantined: code=%s", code)
+	return nil
+}
+
+// 放行被隔离的文件, 将其恢复到StaticPath
+func releaseShareUpload(record *model.FileUpload) error {
+	if !isShareBlocked(record) {
+		return fmt.Errorf("upload is not quarantined: code=%s status=%s", record.Code, record.ScanStatus)
+	}
+	encrypted := true
+	file, err := quarantineFS.Open(quarantineName(record.Code, encrypted))
+	if os.IsNotExist(err) {
+		encrypted = false
+		file, err = quarantineFS.Open(quarantineName(record.Code, encrypted))
+	}
+	if err != nil {
+		return fmt.Errorf("quarantine copy not found: code=%s error=%v", record.Code, err)
+	}
+	reader, err := tb.NewPlainReader(file, blobStore.MasterKey(), encrypted)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	release, err := reserveSpace(areaShare, record.Size, "")
+	if err != nil {
+		return err
+	}
+	_, _, err = saveStoredFile(record.Code+".tmp", areaShare, reader, false)
+	release()
+	if err != nil {
+		return err
+	}
+	removeQuarantine(record.Code)
+	return model.UpdateUploadScan(record.Code, model.ScanStatusReleased, record.ScanResult)
+}
+
+// 删除隔离目录中的文件
+func removeQuarantine(code string) {
+	for _, encrypted := range []bool{false, true} {
+		name := quarantineName(code, encrypted)
+		if err := quarantineFS.Remove(name); err != nil && !os.IsNotExist(err) {
+			logs.Error("remove quarantine copy failed: name=%s error=%v", name, err)
+		}
+	}
+}
+
+// 文件已保存但因扫描结果被禁止访问, 重新上传相同的内容没有意义
+type scanBlockError struct {
+	msg string
+}
+
+func (e *scanBlockError) Error() string {
+	return e.msg
+}
+
+// 扫描结果对应的提示
+func scanBlockedError(status string, result string) error {
+	if status == model.ScanStatusInfected {
+		return &scanBlockError{"file blocked by virus scan: " + result}
+	}
+	return &scanBlockError{"file blocked: virus scan failed, " + strings.TrimSpace(result)}
+}
@@ -0,0 +1,330 @@
+package handler
+
+// 个人网盘的WebDAV服务, 可将StaticPath挂载为网络磁盘
+// 所有路径都经过staticFS沙盒检查; 写入的数据先保存在StaticPath/.webdav下的临时文件中, 关闭时通过saveStoredFile写入去重存储,
+// 因此不会直接修改指向文件块的硬链接. 对象存储模式下StaticPath中没有实际的目录结构, 不提供该服务
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"../config"
+	tb "../toolbox"
+	"github.com/astaxie/beego/logs"
+	"golang.org/x/net/webdav"
+)
+
+const (
+	webdavPrefix  = "/webdav"
+	davTmpDirName = ".webdav" // 写入中的文件的临时目录
+)
+
+var errDavQuota = errors.New("storage quota is used up")
+
+var (
+	davHandler     *webdav.Handler
+	davAuthLimiter *tb.RateLimiter // 每个ip认证失败的次数
+	davTmpFS       *tb.SandboxFS
+)
+
+// 请求的context中记录已经检查过配额的上传大小
+type davReservedKey struct{}
+
+// 根据配置创建WebDAV服务, 并清理上次退出时残留的临时文件
+func initWebDAV() error {
+	if config.WebdavConfig.User == "" || config.WebdavConfig.Password == "" {
+		logs.Info("webdav disabled: user or password not set")
+		return nil
+	}
+	if !blobStore.IsLocal() {
+		logs.Warn("webdav disabled: only local storage driver is supported")
+		return nil
+	}
+	var err error
+	staticFS.Reserve(davTmpDirName)
+	if davTmpFS, err = tb.NewSandboxFS(config.ServerConfig.StaticPath + davTmpDirName); err != nil {
+		return err
+	}
+	infos, err := davTmpFS.ReadDir("")
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		davTmpFS.Remove(info.Name())
+	}
+	davAuthLimiter = tb.NewRateLimiter(10 * time.Minute)
+	davHandler = &webdav.Handler{
+		Prefix:     webdavPrefix,
+		FileSystem: davFS{},
+		LockSystem: webdav.NewMemLS(),
+		Logger: func(r *http.Request, err error) {
+			if err != nil {
+				logs.Warn("webdav request failed: method=%s path=%s error=%v", r.Method, r.URL.Path, err)
+			}
+		},
+	}
+	return nil
+}
+
+// WebDAV服务入口, 使用Basic认证
+// Example: rclone/Finder/Windows资源管理器中挂载 http://localhost:80/webdav/
+func WebDAVHandler(w http.ResponseWriter, r *http.Request) {
+	if davHandler == nil {
+		NotFoundHandler(w, r)
+		return
+	}
+	ip, _ := tb.GetIpAndPort(r)
+	if davAuthLimiter.Count(ip) >= config.WebdavConfig.AuthLimit {
+		logs.Warn("webdav auth limited: ip=%s", ip)
+		w.WriteHeader(http.StatusTooManyRequests)
+		return
+	}
+	user, password, ok := r.BasicAuth()
+	if !ok || subtle.ConstantTimeCompare([]byte(user), []byte(config.WebdavConfig.User)) != 1 ||
+		subtle.ConstantTimeCompare([]byte(password), []byte(config.WebdavConfig.Password)) != 1 {
+		if ok { // 客户端第一次请求时不带认证信息, 不计入失败次数
+			davAuthLimiter.Hit(ip)
+			logs.Warn("webdav auth failed: user=%s ip=%s", user, ip)
+		}
+		w.Header().Set("WWW-Authenticate", `Basic realm="netdish", charset="UTF-8"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	// 已知大小的上传提前检查配额, 避免传输完成后才失败; 关闭文件时不再重复检查
+	if r.Method == http.MethodPut && r.ContentLength > 0 {
+		name := davName(strings.TrimPrefix(r.URL.Path, webdavPrefix))
+		release, err := reserveDavSpace(name, r.ContentLength)
+		if err != nil {
+			w.WriteHeader(http.StatusInsufficientStorage)
+			fmt.Fprint(w, err)
+			return
+		}
+		defer release()
+		r = r.WithContext(context.WithValue(r.Context(), davReservedKey{}, r.ContentLength))
+	}
+	davHandler.ServeHTTP(w, r)
+}
+
+// 写入name之前检查配额, 覆盖已有文件时只需要新旧文件的大小之差, release同reserveSpace
+func reserveDavSpace(name string, size int64) (release func(), err error) {
+	area := getFileArea(name)
+	if old, err := statStoredFile(name); err == nil && old.Area == area {
+		size -= old.Size
+	}
+	if size <= 0 {
+		return func() {}, nil
+	}
+	return reserveSpace(area, size, "")
+}
+
+// 以StaticPath为根目录的webdav.FileSystem
+type davFS struct{}
+
+// 将WebDAV中以'/'开头的路径转换为相对StaticPath的路径
+func davName(name string) string {
+	return strings.Trim(path.Clean("/"+name), "/")
+}
+
+func (davFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	fullPath, err := staticFS.Resolve(davName(name))
+	if err != nil {
+		return err
+	}
+	return os.Mkdir(fullPath, perm)
+}
+
+func (davFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	name = davName(name)
+	fullPath, err := staticFS.Resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	info, statErr := os.Stat(fullPath)
+	if statErr != nil && !os.IsNotExist(statErr) {
+		return nil, statErr
+	}
+	isExist := statErr == nil
+	if isExist && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0 {
+		return nil, os.ErrExist
+	}
+	// 只读打开, 或不截断地打开已有文件(如PROPPATCH)时返回只读文件, 对其写入会失败
+	writable := flag&(os.O_WRONLY|os.O_RDWR) != 0
+	if !writable || (isExist && (info.IsDir() || flag&os.O_TRUNC == 0)) {
+		encrypted := false
+		if isExist && !info.IsDir() {
+			if encrypted, err = isStoredFileEncrypted(name); err != nil {
+				return nil, err
+			}
+		}
+		file, err := os.Open(fullPath)
+		if err != nil {
+			return nil, err
+		}
+		plain, err := tb.OpenPlainFile(file, blobStore.MasterKey(), encrypted)
+		if err != nil {
+			return nil, err
+		}
+		return &davReadFile{PlainFile: plain, name: name}, nil
+	}
+	if !isExist {
+		if flag&os.O_CREATE == 0 {
+			return nil, os.ErrNotExist
+		}
+		if _, err = os.Stat(filepath.Dir(fullPath)); err != nil { // 父目录必须存在
+			return nil, err
+		}
+	}
+	// 未知大小的上传最多写入区域剩余的容量, 覆盖已有文件时加上旧文件的大小
+	reserved, _ := ctx.Value(davReservedKey{}).(int64)
+	limit := reserved
+	if reserved <= 0 {
+		area := getFileArea(name)
+		if limit, err = getAreaAvailable(area); err != nil {
+			return nil, err
+		}
+		if old, err := statStoredFile(name); limit >= 0 && err == nil && old.Area == area {
+			limit += old.Size
+		}
+	}
+	tmpFile, err := davTmpFS.CreateNew(tb.GetRandomString(16))
+	if err != nil {
+		return nil, err
+	}
+	return &davWriteFile{file: tmpFile, name: name, reserved: reserved, limit: limit}, nil
+}
+
+func (davFS) RemoveAll(ctx context.Context, name string) error {
+	name = davName(name)
+	info, err := staticFS.Stat(name)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return removeStoredDir(name)
+	}
+	return removeStoredFile(name)
+}
+
+func (davFS) Rename(ctx context.Context, oldName, newName string) error {
+	return moveStoredFile(davName(oldName), davName(newName))
+}
+
+func (davFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	name = davName(name)
+	info, err := staticFS.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	return davFileInfo{FileInfo: info, size: localFileSize(name, info)}, nil
+}
+
+// 文件大小为明文大小的FileInfo
+type davFileInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (i davFileInfo) Size() int64 {
+	return i.size
+}
+
+// 只读打开的文件或目录, 加密的文件返回解密后的内容, 列出根目录时隐藏保留的目录
+type davReadFile struct {
+	*tb.PlainFile
+	name string // 相对StaticPath的路径
+}
+
+func (f *davReadFile) Stat() (os.FileInfo, error) {
+	info, err := f.PlainFile.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return davFileInfo{FileInfo: info, size: f.PlainFile.Size()}, nil
+}
+
+func (f *davReadFile) Readdir(count int) ([]os.FileInfo, error) {
+	infos, err := f.PlainFile.Readdir(count)
+	res := make([]os.FileInfo, 0, len(infos))
+	for _, info := range infos {
+		if f.name == "" && staticFS.IsReserved(info.Name()) {
+			continue
+		}
+		res = append(res, davFileInfo{FileInfo: info, size: localFileSize(path.Join(f.name, info.Name()), info)})
+	}
+	return res, err
+}
+
+// 写入中的文件, 数据保存在临时文件中, 关闭时才保存到StaticPath
+// 不嵌入*os.File, 避免WriteString、ReadFrom等方法绕过Write中的大小检查
+type davWriteFile struct {
+	file     *os.File
+	name     string // 相对StaticPath的路径
+	reserved int64  // 请求开始时已经检查过配额的大小
+	limit    int64  // 最多写入的大小, 小于0时不限制
+	written  int64
+	err      error // 写入失败的原因, 失败后关闭时不保存
+}
+
+func (f *davWriteFile) Write(p []byte) (int, error) {
+	if f.err != nil {
+		return 0, f.err
+	}
+	if f.limit >= 0 && f.written+int64(len(p)) > f.limit {
+		f.err = errDavQuota
+		return 0, f.err
+	}
+	n, err := f.file.Write(p)
+	f.written += int64(n)
+	if err != nil {
+		f.err = err
+	}
+	return n, err
+}
+
+func (f *davWriteFile) Read(p []byte) (int, error) {
+	return f.file.Read(p)
+}
+
+func (f *davWriteFile) Seek(offset int64, whence int) (int64, error) {
+	return f.file.Seek(offset, whence)
+}
+
+func (f *davWriteFile) Readdir(count int) ([]os.FileInfo, error) {
+	return f.file.Readdir(count)
+}
+
+func (f *davWriteFile) Stat() (os.FileInfo, error) {
+	return f.file.Stat()
+}
+
+func (f *davWriteFile) Close() error {
+	defer os.Remove(f.file.Name())
+	defer f.file.Close()
+	if f.err != nil {
+		return f.err
+	}
+	info, err := f.file.Stat()
+	if err != nil {
+		return err
+	}
+	if _, err = f.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if info.Size() > f.reserved { // 未知大小或实际写入超出声明的大小时在这里检查
+		var release func()
+		if release, err = reserveDavSpace(f.name, info.Size()); err != nil {
+			return err
+		}
+		defer release()
+	}
+	_, _, err = saveStoredFile(f.name, getFileArea(f.name), f.file, true)
+	return err
+}
@@ -48,6 +48,7 @@ func main() {
 	muxer.Handle("/callDriver/", MakeSafeHandler(handler.CallDriverHandler)) // callDriver应用
 	muxer.Handle("/static/", MakeSafeHandler(handler.StaticHandler))         // 静态文件存储服务
 	muxer.Handle("/manage/", MakeSafeHandler(handler.ManageHandler))
+	muxer.Handle("/webdav/", MakeDefaultHandler(handler.WebDAVHandler)) // 个人网盘WebDAV服务, 使用Basic认证
 
 	err := http.ListenAndServe(":80", muxer)
 	if err != nil {
@@ -11,13 +11,21 @@ import (
 const (
 	CollectUploadFile      = "upload_file"         // 文件暂存服务记录的文件信息
 	CollectCallDriverMsg   = "call_driver_msg"     //callDriver应用的聊条记录
+	CollectCallDriverConv  = "call_driver_conv"    // callDriver应用的会话, 每个访客一个
+	CollectCallDriverHeld  = "call_driver_held"    // callDriver应用被拦截等待审核的消息
+	CollectCallDriverArch  = "call_driver_archive" // callDriver应用超过保留期限后归档的聊天记录
 	CollectUtil            = "util"                // 杂项信息,约定使用UtilStruct作为数据项结构
 	CollectCodeMasterWorks = "code_master_work"    // codeMaster应用程序作品
 	CollectCodeComment     = "code_master_comment" // codeMaster作品评论
+	CollectCodeMasterUser  = "code_master_user"    // codeMaster用户
+	CollectFileBlob        = "file_blob"           // 按内容寻址保存的文件块及其引用
+	CollectStoredFile      = "stored_file"         // StaticPath下的文件索引
+	CollectMail            = "mail"                // 待发送的邮件及发送记录
 )
 
 var (
-	ErrorNoRecord error = errors.New("No record")
+	ErrorNoRecord  error = errors.New("No record")
+	ErrorDupRecord error = errors.New("Record already exist")
 )
 
 //全局对象
@@ -47,17 +55,137 @@ type FileUpload struct {
 	Code      string `bson:"code"`
 	TimeStamp int64  `bson:"timeStamp"`
 	Size      int64  `bson:"size"`
+	IP        string `bson:"ip"`        // 上传者的IP
+	Hash      string `bson:"hash"`      // 文件内容的sha256, 对应FileBlob
+	ExpireAt  int64  `bson:"expireAt"`  // 过期时间, 0代表不过期
+	OwnerHash string `bson:"ownerHash"` // 上传者管理口令的sha256, 用于查看和删除自己的上传
+
+	DeleteHash    string `bson:"deleteHash"`    // 上传时返回的删除口令的sha256
+	DownloadCount int64  `bson:"downloadCount"` // 下载次数
+	LastAccess    int64  `bson:"lastAccess"`    // 最后一次下载的时间
+
+	ScanStatus string `bson:"scanStatus"` // 病毒扫描结果, 见ScanStatus*, 为空代表未扫描
+	ScanResult string `bson:"scanResult"` // 发现的病毒名称或扫描出错的原因
+	ScanTime   int64  `bson:"scanTime"`
+}
+
+// 上传文件的病毒扫描结果
+const (
+	ScanStatusClean    = "clean"    // 未发现病毒
+	ScanStatusInfected = "infected" // 发现病毒, 文件已被隔离
+	ScanStatusError    = "error"    // 扫描出错
+	ScanStatusReleased = "released" // 被隔离后由管理员放行
+)
+
+// 按内容寻址保存的文件块, 以内容的sha256作为id
+type FileBlob struct {
+	Hash      string   `bson:"_id"`
+	Size      int64    `bson:"size"`
+	Encrypted bool     `bson:"encrypted"` // 数据是否加密保存
+	Refs      []string `bson:"refs"`      // 引用该文件块的文件, 为相对StaticPath的路径
+	TimeStamp int64    `bson:"timeStamp"`
+}
+
+// StaticPath下的文件索引, 文件数据保存在对象存储时通过索引来列出和查找文件
+type StoredFile struct {
+	Name      string `bson:"_id"` // 相对StaticPath的路径
+	Area      string `bson:"area"`
+	Hash      string `bson:"hash"`      // 对应FileBlob
+	Size      int64  `bson:"size"`      // 明文大小
+	Encrypted bool   `bson:"encrypted"` // 与FileBlob相同, 读取文件时据此决定是否解密
+	TimeStamp int64  `bson:"timeStamp"`
+}
+
+// 某个区域的文件占用统计
+type StoredAreaUsage struct {
+	Area  string `bson:"_id"`
+	Bytes int64  `bson:"bytes"`
+	Files int    `bson:"files"`
 }
 
 // callDriver 应用聊天记录结构
 type CallDriverChat = struct {
 	ID        string `bson:"_id"`
-	From      string `bson:"from"`
+	From      string `bson:"from"` // 发送方, 访客为访客id, Boss为其名字
 	To        string `bson:"to"`
+	Nick      string `bson:"nick"` // 访客发送消息时显示的昵称
 	Message   string `bson:"message"`
 	TimeStamp int64  `bson:"timeStamp"`
 	IP        string `bson:"ip"`
-	Status    int    `bson:"status"`
+	Status    int    `bson:"status"` // 见CallDriverStatus*, 由接收方显式确认后更新
+
+	Attachments []CallDriverAttachment `bson:"attachments,omitempty"`
+}
+
+// callDriver 消息的附件, 文件保存在StaticPath的callDriver目录下
+type CallDriverAttachment struct {
+	ID     string `json:"id" bson:"id"`
+	File   string `json:"file" bson:"file"` // callDriver目录下的文件名, 即id加上按文件类型确定的后缀
+	Name   string `json:"name" bson:"name"` // 上传时的文件名
+	Size   int64  `json:"size" bson:"size"`
+	Mime   string `json:"mime" bson:"mime"`
+	Width  int    `json:"width,omitempty" bson:"width,omitempty"` // 图片的宽高
+	Height int    `json:"height,omitempty" bson:"height,omitempty"`
+}
+
+// callDriver 消息状态
+const (
+	CallDriverStatusSent      = 0 // 已发送
+	CallDriverStatusDelivered = 1 // 已送达接收方的页面
+	CallDriverStatusRead      = 2 // 已读
+)
+
+// callDriver 会话, 每个访客一个, 记录最后一条消息和双方的未读数
+type CallDriverConversation = struct {
+	ID            string `json:"id" bson:"_id"`          // 访客id, 旧的会话为访客昵称
+	Visitor       string `json:"visitor" bson:"visitor"` // 访客显示的昵称
+	Email         string `json:"email" bson:"email"`     // 访客留下的邮箱, 不为空时Boss的回复会发送到该邮箱
+	Status        string `json:"status" bson:"status"`   // 见CallDriverConv*
+	Muted         bool   `json:"muted" bson:"muted"`     // 静音的会话不发送新消息通知
+	LastMessage   string `json:"lastMessage" bson:"lastMessage"`
+	LastFrom      string `json:"lastFrom" bson:"lastFrom"`
+	LastTime      int64  `json:"lastTime" bson:"lastTime"`
+	BossUnread    int    `json:"bossUnread" bson:"bossUnread"`       // Boss未读的消息数
+	VisitorUnread int    `json:"visitorUnread" bson:"visitorUnread"` // 访客未读的消息数
+	CreateTime    int64  `json:"createTime" bson:"createTime"`
+}
+
+// callDriver 会话状态
+const (
+	CallDriverConvOpen     = "open"     // 进行中
+	CallDriverConvArchived = "archived" // 已归档, 访客发来新消息时重新打开
+	CallDriverConvClosed   = "closed"   // 已关闭, 访客不能再发送消息
+)
+
+// callDriver 被反垃圾规则拦截, 等待Boss审核的消息
+type CallDriverHeld = struct {
+	ID        string `json:"id" bson:"_id"`
+	Visitor   string `json:"visitor" bson:"visitor"` // 访客id
+	Nick      string `json:"nick" bson:"nick"`
+	Message   string `json:"message" bson:"message"`
+	IP        string `json:"ip" bson:"ip"`
+	Reason    string `json:"reason" bson:"reason"` // 被拦截的原因
+	TimeStamp int64  `json:"timeStamp" bson:"timeStamp"`
+
+	Attachments []CallDriverAttachment `json:"attachments" bson:"attachments,omitempty"`
+}
+
+// callDriver 聊天记录的分页游标, 同一秒内的消息按id排序
+// ID为空时只按时间戳比较
+type ChatCursor struct {
+	TimeStamp int64
+	ID        string
+}
+
+// callDriver 聊天记录的查询条件, 为空的条件不作限制
+type ChatFilter struct {
+	Visitor  string // 会话的访客id
+	Nick     string // 访客昵称, 不区分大小写的部分匹配
+	Keyword  string // 消息内容或附件的文件名, 不区分大小写的部分匹配
+	IP       string // ip前缀
+	Since    int64  // 时间范围为[Since, Until), 为0时不限制
+	Until    int64
+	Archived bool // 查询已归档的记录
 }
 
 // codeMaster 程序作品
@@ -66,7 +194,8 @@ type CodeMasterWork struct {
 	Title       string `json:"title"`
 	CType       int    `json:"ctype"`    // 作品类型 [0-其他,1-生活问题,2-数据结构,3-程序开发,4-趣味恶搞]
 	Language    string `json:"language"` // 编程语言 [C++\C\GO]
-	Author      string `json:"author"`
+	Author      string `json:"author"`   // 作者的昵称, 关联了用户时以用户当前的昵称为准
+	UserID      string `json:"userId"`   // 作者的用户id, 旧的作品为空
 	TagStr      string `json:"tagStr"`
 	Desc        string `json:"desc"`      // 简介
 	InputDesc   string `json:"inputDesc"` // 输入数据格式描述
@@ -79,16 +208,56 @@ type CodeMasterWork struct {
 	Score       int    `json:"score"` // 评分，满分为50分
 	Status      int    `json:"status"`
 	IsRecommend bool   `json:"isRecommend"` // 是否推荐
+	Views       int    `json:"views"`       // 浏览次数
+	Hot         int    `json:"hot"`         // 热度, 浏览、运行和评论时增加, 见HotOf*
+}
+
+// 各种操作增加的作品热度
+const (
+	HotOfView    = 1
+	HotOfRun     = 2
+	HotOfComment = 5
+)
+
+// 作品列表的排序方式
+const (
+	WorkSortTime  = "time"       // 提交时间倒序
+	WorkSortScore = "score"      // 评分倒序
+	WorkSortHot   = "popularity" // 热度倒序
+)
+
+// 作品列表的查询条件
+type WorkFilter struct {
+	CType     int    // 作品类型, 小于0时不限制
+	Language  string // 编程语言
+	Tag       string // 标签包含的文字, 不区分大小写
+	Recommend int    // 大于0只查询推荐的作品, 小于0只查询未推荐的作品, 0不限制
+	UserID    string // 作者的用户id
 }
 
 // codeMaster 单条评论
 type Comment struct {
 	Author    string `json:"author"`
-	ImgSrc    string `json:"imgSrc"`
-	Desc      string `json:"desc"` // 评论内容
+	ImgSrc    string `json:"imgSrc"` // 头像, 关联了用户时为用户的头像地址
+	UserID    string `json:"userId"` // 评论者的用户id, 旧的评论为空
+	Desc      string `json:"desc"`   // 评论内容
 	Timestamp int64  `json:"timestamp"`
 }
 
+// codeMaster 用户
+type CodeMasterUser struct {
+	ID           string `json:"id" bson:"_id"`
+	Name         string `json:"name" bson:"name"` // 登录名, 小写, 唯一
+	Nick         string `json:"nick" bson:"nick"`
+	Bio          string `json:"bio" bson:"bio"`
+	PassHash     string `json:"-" bson:"passHash"`
+	TokenVersion int    `json:"-" bson:"tokenVersion"`        // 修改密码时增加, 使之前的登录失效
+	Avatar       []byte `json:"-" bson:"avatar"`              // 头像, 缩放后的jpeg, 查询用户时不返回
+	AvatarTime   int64  `json:"avatarTime" bson:"avatarTime"` // 头像的更新时间, 0代表没有头像
+	CreateTime   int64  `json:"createTime" bson:"createTime"`
+	LastLogin    int64  `json:"lastLogin" bson:"lastLogin"`
+}
+
 // codeMaster作品评论列表
 type CommendList struct {
 	WorkID   string     `json:"workId"` // 作品的id
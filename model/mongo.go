@@ -4,6 +4,8 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"regexp"
+	"strings"
 	"time"
 
 	"../config"
@@ -124,7 +126,7 @@ func GetUtilData(key string, value interface{}) error {
 // ================ StaticHandler ====================
 
 // 记录文件上传信息
-func InsertUploadRecord(fileName string, code string, size int64) error {
+func InsertUploadRecord(record FileUpload) error {
 	var err error
 	if err = mongoBlocker(); err != nil {
 		logs.Error("%v", err)
@@ -132,8 +134,8 @@ func InsertUploadRecord(fileName string, code string, size int64) error {
 	}
 
 	for loop := true; loop; loop = false {
-		if fileName == "" || code == "" {
-			err = fmt.Errorf("unexpcet params: fileName=%s code=%s", fileName, code)
+		if record.FileName == "" || record.Code == "" {
+			err = fmt.Errorf("unexpcet params: fileName=%s code=%s", record.FileName, record.Code)
 			break
 		}
 		collection := database.C(CollectUploadFile)
@@ -141,171 +143,1136 @@ func InsertUploadRecord(fileName string, code string, size int64) error {
 			err = fmt.Errorf("connect to collection fail: collection=%s", CollectUploadFile)
 			break
 		}
-		data := FileUpload{
-			FileName:  fileName,
-			Code:      code,
-			TimeStamp: time.Now().Unix(),
-			Size:      size,
+		if record.TimeStamp == 0 {
+			record.TimeStamp = time.Now().Unix()
+		}
+		err = collection.Insert(record)
+		if err != nil {
+			break
+		}
+	}
+	if err != nil {
+		logs.Error("mongoDB insert Error: %v", err)
+	}
+	return err
+}
+
+// 获取文件保存信息
+func GetUploadRecord(code string) (FileUpload, error) {
+	var record FileUpload
+	var err error
+	var query *mgo.Query
+
+	if err = mongoBlocker(); err != nil {
+		logs.Error("%v", err)
+		return record, err
+	}
+
+	collection := database.C(CollectUploadFile)
+	query = collection.Find(bson.M{"code": code})
+	if query == nil {
+		logs.Warning("find result is null: code=%s", code)
+		return record, ErrorNoRecord
+	}
+	err = query.One(&record)
+	if err == mgo.ErrNotFound {
+		return record, ErrorNoRecord
+	}
+	if err != nil {
+		logs.Error(err)
+	}
+	return record, err
+}
+
+// 统计某个IP自since以来上传文件的总大小
+func SumUploadSizeByIP(ip string, since int64) (total int64, err error) {
+	if err = mongoBlocker(); err != nil {
+		logs.Error("%v", err)
+		return 0, err
+	}
+	for loop := true; loop; loop = false {
+		collection := database.C(CollectUploadFile)
+		if collection == nil {
+			err = fmt.Errorf("connect to collection fail: collection=%s", CollectUploadFile)
+			break
+		}
+		var result struct {
+			Total int64 `bson:"total"`
+		}
+		err = collection.Pipe([]bson.M{
+			{"$match": bson.M{"ip": ip, "timeStamp": bson.M{"$gte": since}}},
+			{"$group": bson.M{"_id": nil, "total": bson.M{"$sum": "$size"}}},
+		}).One(&result)
+		if err == mgo.ErrNotFound {
+			err = nil
+			break
+		}
+		if err != nil {
+			break
+		}
+		total = result.Total
+	}
+	if err != nil {
+		logs.Error("sum upload size failed: error=%v ip=%s", err, ip)
+	}
+	return total, err
+}
+
+// 获取某个管理口令名下的全部上传记录, 按上传时间倒序
+func GetUploadRecordsByOwner(ownerHash string) (records []FileUpload, err error) {
+	records = make([]FileUpload, 0)
+	if err = mongoBlocker(); err != nil {
+		logs.Error("%v", err)
+		return records, err
+	}
+	if ownerHash == "" {
+		return records, fmt.Errorf("owner can't be null")
+	}
+	collection := database.C(CollectUploadFile)
+	err = collection.Find(bson.M{"ownerHash": ownerHash}).Sort("-timeStamp").All(&records)
+	if err != nil {
+		logs.Error("get upload records failed: error=%v", err)
+	}
+	return records, err
+}
+
+// 获取全部上传记录, 按上传时间倒序
+func GetAllUploadRecords() (records []FileUpload, err error) {
+	records = make([]FileUpload, 0)
+	if err = mongoBlocker(); err != nil {
+		logs.Error("%v", err)
+		return records, err
+	}
+	collection := database.C(CollectUploadFile)
+	err = collection.Find(nil).Sort("-timeStamp").All(&records)
+	if err != nil {
+		logs.Error("get all upload records failed: error=%v", err)
+	}
+	return records, err
+}
+
+// 记录一次下载
+func IncUploadDownload(code string) (err error) {
+	if err = mongoBlocker(); err != nil {
+		logs.Error("%v", err)
+		return err
+	}
+	collection := database.C(CollectUploadFile)
+	err = collection.Update(bson.M{"code": code}, bson.M{
+		"$inc": bson.M{"downloadCount": 1},
+		"$set": bson.M{"lastAccess": time.Now().Unix()},
+	})
+	if err == mgo.ErrNotFound {
+		return ErrorNoRecord
+	}
+	if err != nil {
+		logs.Error("update download count failed: error=%v code=%s", err, code)
+	}
+	return err
+}
+
+// 修改上传文件的过期时间, 0代表不过期
+func UpdateUploadExpire(code string, expireAt int64) (err error) {
+	if err = mongoBlocker(); err != nil {
+		logs.Error("%v", err)
+		return err
+	}
+	collection := database.C(CollectUploadFile)
+	err = collection.Update(bson.M{"code": code}, bson.M{"$set": bson.M{"expireAt": expireAt}})
+	if err == mgo.ErrNotFound {
+		return ErrorNoRecord
+	}
+	if err != nil {
+		logs.Error("update upload expire failed: error=%v code=%s", err, code)
+	}
+	return err
+}
+
+// 记录上传文件的病毒扫描结果
+func UpdateUploadScan(code string, status string, result string) (err error) {
+	if err = mongoBlocker(); err != nil {
+		logs.Error("%v", err)
+		return err
+	}
+	collection := database.C(CollectUploadFile)
+	update := bson.M{"scanStatus": status, "scanResult": result, "scanTime": time.Now().Unix()}
+	err = collection.Update(bson.M{"code": code}, bson.M{"$set": update})
+	if err == mgo.ErrNotFound {
+		return ErrorNoRecord
+	}
+	if err != nil {
+		logs.Error("update upload scan failed: error=%v code=%s", err, code)
+	}
+	return err
+}
+
+// 获取过期时间早于now的上传记录
+func GetExpiredUploadRecords(now int64) (records []FileUpload, err error) {
+	records = make([]FileUpload, 0)
+	if err = mongoBlocker(); err != nil {
+		logs.Error("%v", err)
+		return records, err
+	}
+	collection := database.C(CollectUploadFile)
+	err = collection.Find(bson.M{"expireAt": bson.M{"$gt": 0, "$lt": now}}).All(&records)
+	if err != nil {
+		logs.Error("get expired upload records failed: error=%v", err)
+	}
+	return records, err
+}
+
+// 删除上传记录
+func RemoveUploadRecord(code string) (err error) {
+	if err = mongoBlocker(); err != nil {
+		logs.Error("%v", err)
+		return err
+	}
+	collection := database.C(CollectUploadFile)
+	err = collection.Remove(bson.M{"code": code})
+	if err == mgo.ErrNotFound {
+		return ErrorNoRecord
+	}
+	if err != nil {
+		logs.Error("remove upload record failed: error=%v code=%s", err, code)
+	}
+	return err
+}
+
+// ================ FileBlob ====================
+
+// 增加文件块的一个引用, 文件块记录不存在时自动创建
+func AddBlobRef(hash string, size int64, encrypted bool, ref string) (err error) {
+	if err = mongoBlocker(); err != nil {
+		logs.Error("%v", err)
+		return err
+	}
+	for loop := true; loop; loop = false {
+		if hash == "" || ref == "" {
+			err = fmt.Errorf("unexpect params: hash=%s ref=%s", hash, ref)
+			break
+		}
+		collection := database.C(CollectFileBlob)
+		if collection == nil {
+			err = fmt.Errorf("connect to collection fail: collection=%s", CollectFileBlob)
+			break
+		}
+		_, err = collection.UpsertId(hash, bson.M{
+			"$setOnInsert": bson.M{"size": size, "encrypted": encrypted, "timeStamp": time.Now().Unix()},
+			"$addToSet":    bson.M{"refs": ref},
+		})
+	}
+	if err != nil {
+		logs.Error("add blob ref failed: error=%v hash=%s ref=%s", err, hash, ref)
+	}
+	return err
+}
+
+// 移除某个文件对文件块的引用, 返回更新后的文件块记录, 文件没有引用任何文件块时返回ErrorNoRecord
+func RemoveBlobRef(ref string) (blob *FileBlob, err error) {
+	if err = mongoBlocker(); err != nil {
+		logs.Error("%v", err)
+		return nil, err
+	}
+	for loop := true; loop; loop = false {
+		collection := database.C(CollectFileBlob)
+		if collection == nil {
+			err = fmt.Errorf("connect to collection fail: collection=%s", CollectFileBlob)
+			break
+		}
+		var result FileBlob
+		change := mgo.Change{
+			Update:    bson.M{"$pull": bson.M{"refs": ref}},
+			ReturnNew: true,
+		}
+		_, err = collection.Find(bson.M{"refs": ref}).Apply(change, &result)
+		if err == mgo.ErrNotFound {
+			return nil, ErrorNoRecord
+		}
+		if err != nil {
+			break
+		}
+		blob = &result
+	}
+	if err != nil {
+		logs.Error("remove blob ref failed: error=%v ref=%s", err, ref)
+	}
+	return blob, err
+}
+
+// 根据sha256查询文件块记录
+func GetBlob(hash string) (blob *FileBlob, err error) {
+	if err = mongoBlocker(); err != nil {
+		logs.Error("%v", err)
+		return nil, err
+	}
+	collection := database.C(CollectFileBlob)
+	err = collection.FindId(hash).One(&blob)
+	if err == mgo.ErrNotFound {
+		return nil, ErrorNoRecord
+	}
+	if err != nil {
+		logs.Error("get blob failed: error=%v hash=%s", err, hash)
+	}
+	return blob, err
+}
+
+// 删除已经没有任何引用的文件块记录, 返回记录是否被删除
+func RemoveUnusedBlob(hash string) (bool, error) {
+	var err error
+	if err = mongoBlocker(); err != nil {
+		logs.Error("%v", err)
+		return false, err
+	}
+	collection := database.C(CollectFileBlob)
+	err = collection.Remove(bson.M{"_id": hash, "refs": bson.M{"$size": 0}})
+	if err == mgo.ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		logs.Error("remove blob failed: error=%v hash=%s", err, hash)
+		return false, err
+	}
+	return true, nil
+}
+
+// ================ StoredFile ==================
+
+// 新增或更新文件索引
+func UpsertStoredFile(file *StoredFile) (err error) {
+	if err = mongoBlocker(); err != nil {
+		logs.Error("%v", err)
+		return err
+	}
+	for loop := true; loop; loop = false {
+		if file == nil || file.Name == "" {
+			err = errors.New("unexpect params")
+			break
+		}
+		collection := database.C(CollectStoredFile)
+		if collection == nil {
+			err = fmt.Errorf("connect to collection fail: collection=%s", CollectStoredFile)
+			break
+		}
+		_, err = collection.UpsertId(file.Name, *file)
+	}
+	if err != nil {
+		logs.Error("upsert stored file failed: error=%v file=%+v", err, file)
+	}
+	return err
+}
+
+// 根据路径查询文件索引
+func GetStoredFile(name string) (file *StoredFile, err error) {
+	if err = mongoBlocker(); err != nil {
+		logs.Error("%v", err)
+		return nil, err
+	}
+	collection := database.C(CollectStoredFile)
+	err = collection.FindId(name).One(&file)
+	if err == mgo.ErrNotFound {
+		return nil, ErrorNoRecord
+	}
+	if err != nil {
+		logs.Error("get stored file failed: error=%v name=%s", err, name)
+	}
+	return file, err
+}
+
+// 查询全部文件索引
+func GetAllStoredFile() (files []*StoredFile, err error) {
+	files = make([]*StoredFile, 0)
+	if err = mongoBlocker(); err != nil {
+		logs.Error("%v", err)
+		return files, err
+	}
+	collection := database.C(CollectStoredFile)
+	err = collection.Find(nil).All(&files)
+	if err != nil {
+		logs.Error("get all stored file failed: error=%v", err)
+	}
+	return files, err
+}
+
+// 删除文件索引
+func RemoveStoredFile(name string) (err error) {
+	if err = mongoBlocker(); err != nil {
+		logs.Error("%v", err)
+		return err
+	}
+	collection := database.C(CollectStoredFile)
+	err = collection.RemoveId(name)
+	if err == mgo.ErrNotFound {
+		return ErrorNoRecord
+	}
+	if err != nil {
+		logs.Error("remove stored file failed: error=%v name=%s", err, name)
+	}
+	return err
+}
+
+// 为文件索引的统计和查询建立索引, 启动时调用
+func EnsureStoredFileIndex() (err error) {
+	if err = mongoBlocker(); err != nil {
+		logs.Error("%v", err)
+		return err
+	}
+	collection := database.C(CollectStoredFile)
+	for _, key := range [][]string{{"area", "timeStamp"}, {"-size"}, {"timeStamp"}} {
+		if err = collection.EnsureIndex(mgo.Index{Key: key, Background: true}); err != nil {
+			logs.Error("ensure stored file index failed: key=%v error=%v", key, err)
+			return err
+		}
+	}
+	return nil
+}
+
+// 按区域统计文件索引的总大小和文件数
+// 同一区域中内容相同的文件共用一个文件块, 只计算一次大小; 没有hash的旧文件各自计算
+func SumStoredFileByArea() (usage []StoredAreaUsage, err error) {
+	usage = make([]StoredAreaUsage, 0)
+	if err = mongoBlocker(); err != nil {
+		logs.Error("%v", err)
+		return usage, err
+	}
+	blobKey := bson.M{"$cond": []interface{}{bson.M{"$eq": []interface{}{bson.M{"$ifNull": []interface{}{"$hash", ""}}, ""}}, "$_id", "$hash"}}
+	err = database.C(CollectStoredFile).Pipe([]bson.M{
+		{"$group": bson.M{"_id": bson.M{"area": "$area", "blob": blobKey}, "size": bson.M{"$max": "$size"}, "files": bson.M{"$sum": 1}}},
+		{"$group": bson.M{"_id": "$_id.area", "bytes": bson.M{"$sum": "$size"}, "files": bson.M{"$sum": "$files"}}},
+	}).All(&usage)
+	if err != nil {
+		logs.Error("sum stored file failed: error=%v", err)
+	}
+	return usage, err
+}
+
+// 查询文件索引, area为空时不限制区域, prefix不为空时只查询该目录下的文件
+// sort为排序字段, limit为0时不限制数量
+func FindStoredFiles(area string, prefix string, sort string, limit int) (files []*StoredFile, err error) {
+	files = make([]*StoredFile, 0)
+	if err = mongoBlocker(); err != nil {
+		logs.Error("%v", err)
+		return files, err
+	}
+	selector := bson.M{}
+	if area != "" {
+		selector["area"] = area
+	}
+	if prefix != "" {
+		selector["_id"] = bson.RegEx{Pattern: "^" + regexp.QuoteMeta(prefix)}
+	}
+	query := database.C(CollectStoredFile).Find(selector)
+	if sort != "" {
+		query = query.Sort(sort, "_id")
+	}
+	err = query.Limit(limit).All(&files)
+	if err != nil {
+		logs.Error("find stored files failed: error=%v area=%s prefix=%s", err, area, prefix)
+	}
+	return files, err
+}
+
+// =============== CallDriver ==================
+// 保存callDriver应用中收到的来自其他用户的消息, 返回保存的记录
+func InsertCallDriverMessage(from, to, nick, msg, ip string, attachments []CallDriverAttachment) (CallDriverChat, error) {
+	var err error
+	if err = mongoBlocker(); err != nil {
+		logs.Error("%v", err)
+		return CallDriverChat{}, err
+	}
+
+	ts := time.Now().Unix()
+	record := CallDriverChat{
+		ID:        fmt.Sprintf("%d%s", ts, tb.GetRandomString(3)),
+		From:      from,
+		To:        to,
+		Nick:      nick,
+		Message:   msg,
+		TimeStamp: ts,
+		IP:        ip,
+		Status:    CallDriverStatusSent,
+
+		Attachments: attachments,
+	}
+	for loop := true; loop; loop = false {
+		if from == "" || to == "" || (msg == "" && len(attachments) == 0) {
+			err = fmt.Errorf("unexpect params: from=%s to=%s msg=%s", from, to, msg)
+			break
+		}
+		collection := database.C(CollectCallDriverMsg)
+		if collection == nil {
+			err = fmt.Errorf("connect to collection fail: collection=%s", CollectCallDriverMsg)
+			break
+		}
+		err = collection.Insert(record)
+		if err != nil {
+			break
+		}
+	}
+	logs.Debug("insert result: collection=%s err=%v record=%v", CollectCallDriverMsg, err, msg)
+	return record, err
+}
+
+// 位于游标之前($lt)或之后($gt)的查询条件, field为游标时间戳对应的字段
+func (c *ChatCursor) selector(field string, op string) bson.M {
+	if c.ID == "" {
+		return bson.M{field: bson.M{op: c.TimeStamp}}
+	}
+	return bson.M{"$or": []bson.M{
+		{field: bson.M{op: c.TimeStamp}},
+		{field: c.TimeStamp, "_id": bson.M{op: c.ID}},
+	}}
+}
+
+// 分页查询聊天记录, 按(timeStamp, _id)排序, 返回的记录按时间正序
+// visitor为访客id, 为空时查询所有人的记录; after不为空时返回其后的limit条, 否则返回before之前(before为空时为最新)的limit条
+// hasMore表示查询方向上是否还有更多记录
+func FindCallDriverMessagePage(visitor string, before, after *ChatCursor, limit int) (history []CallDriverChat, hasMore bool, err error) {
+	history = make([]CallDriverChat, 0)
+	if err = mongoBlocker(); err != nil {
+		logs.Error("%v", err)
+		return history, false, err
+	}
+	conds := []bson.M{}
+	if visitor != "" {
+		conds = append(conds, bson.M{"$or": []bson.M{{"from": visitor}, {"to": visitor}}})
+	}
+	sort := []string{"-timeStamp", "-_id"}
+	if after != nil {
+		conds = append(conds, after.selector("timeStamp", "$gt"))
+		sort = []string{"timeStamp", "_id"}
+	} else if before != nil {
+		conds = append(conds, before.selector("timeStamp", "$lt"))
+	}
+	selector := bson.M{}
+	if len(conds) > 0 {
+		selector["$and"] = conds
+	}
+	collection := database.C(CollectCallDriverMsg)
+	err = collection.Find(selector).Sort(sort...).Limit(limit + 1).All(&history)
+	if err != nil {
+		logs.Error("find callDriver chat fail: err=%v visitor=%s", err, visitor)
+		return history, false, err
+	}
+	if len(history) > limit {
+		history, hasMore = history[:limit], true
+	}
+	if after == nil {
+		for i, j := 0, len(history)-1; i < j; i, j = i+1, j-1 {
+			history[i], history[j] = history[j], history[i]
+		}
+	}
+	return history, hasMore, nil
+}
+
+// 接收方确认消息已送达或已读, 只更新发给to且状态低于status的消息, 返回实际更新的消息id
+func AckCallDriverMessage(ids []string, to string, status int) (updated []string, err error) {
+	updated = make([]string, 0)
+	if err = mongoBlocker(); err != nil {
+		logs.Error("%v", err)
+		return updated, err
+	}
+	if len(ids) == 0 || to == "" {
+		return updated, fmt.Errorf("unexpect params: ids=%v to=%s", ids, to)
+	}
+	collection := database.C(CollectCallDriverMsg)
+	selector := bson.M{"_id": bson.M{"$in": ids}, "to": to, "status": bson.M{"$lt": status}}
+	var records []CallDriverChat
+	if err = collection.Find(selector).Select(bson.M{"_id": 1}).All(&records); err != nil {
+		logs.Error("find callDriver chat fail: err=%v ids=%v", err, ids)
+		return updated, err
+	}
+	for _, r := range records {
+		updated = append(updated, r.ID)
+	}
+	if len(updated) == 0 {
+		return updated, nil
+	}
+	selector["_id"] = bson.M{"$in": updated}
+	if _, err = collection.UpdateAll(selector, bson.M{"$set": bson.M{"status": status}}); err != nil {
+		logs.Error("update callDriver chat fail: err=%v ids=%v", err, updated)
+		return nil, err
+	}
+	logs.Debug("ack message success: to=%s status=%d updated=%d", to, status, len(updated))
+	return updated, nil
+}
+
+// 查询时间戳不早于since的聊天记录, 按时间正序, 用于断线重连后补发消息; visitor为访客id, 为空时查询所有人的记录
+func FindCallDriverMessageSince(visitor string, since int64, num int) (history []CallDriverChat, err error) {
+	history = make([]CallDriverChat, 0)
+	if err = mongoBlocker(); err != nil {
+		logs.Error("%v", err)
+		return history, err
+	}
+	selector := bson.M{"timeStamp": bson.M{"$gte": since}}
+	if visitor != "" {
+		selector["$or"] = []bson.M{{"from": visitor}, {"to": visitor}}
+	}
+	collection := database.C(CollectCallDriverMsg)
+	err = collection.Find(selector).Sort("timeStamp").Limit(num).All(&history)
+	if err != nil {
+		logs.Error("find callDriver chat fail: err=%v visitor=%s since=%d", err, visitor, since)
+	}
+	return history, err
+}
+
+// 按id查询聊天记录
+func FindCallDriverMessageByIDs(ids []string) (history []CallDriverChat, err error) {
+	history = make([]CallDriverChat, 0)
+	if err = mongoBlocker(); err != nil {
+		logs.Error("%v", err)
+		return history, err
+	}
+	collection := database.C(CollectCallDriverMsg)
+	err = collection.Find(bson.M{"_id": bson.M{"$in": ids}}).All(&history)
+	if err != nil {
+		logs.Error("find callDriver chat fail: err=%v ids=%v", err, ids)
+	}
+	return history, err
+}
+
+// 查询包含某个附件的消息, 不存在时返回ErrorNoRecord
+func FindCallDriverMessageByAttachment(file string) (record CallDriverChat, err error) {
+	if err = mongoBlocker(); err != nil {
+		logs.Error("%v", err)
+		return record, err
+	}
+	err = database.C(CollectCallDriverMsg).Find(bson.M{"attachments.file": file}).One(&record)
+	if err == mgo.ErrNotFound {
+		return record, ErrorNoRecord
+	}
+	if err != nil {
+		logs.Error("find callDriver chat by attachment failed: error=%v file=%s", err, file)
+	}
+	return record, err
+}
+
+// 附件是否被消息、已归档的消息或等待审核的消息引用
+func IsCallDriverAttachmentUsed(file string) (bool, error) {
+	if err := mongoBlocker(); err != nil {
+		logs.Error("%v", err)
+		return false, err
+	}
+	for _, name := range []string{CollectCallDriverMsg, CollectCallDriverHeld, CollectCallDriverArch} {
+		n, err := database.C(name).Find(bson.M{"attachments.file": file}).Count()
+		if err != nil {
+			logs.Error("count callDriver attachment failed: error=%v collection=%s file=%s", err, name, file)
+			return false, err
+		}
+		if n > 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// 新消息产生后更新会话, 会话不存在时创建; fromVisitor表示消息由访客发出
+// 访客发来新消息时, 已归档的会话会重新打开
+func TouchCallDriverConversation(id, visitor string, record CallDriverChat, fromVisitor bool) (conv CallDriverConversation, err error) {
+	if err = mongoBlocker(); err != nil {
+		logs.Error("%v", err)
+		return conv, err
+	}
+	for loop := true; loop; loop = false {
+		collection := database.C(CollectCallDriverConv)
+		lastMessage := record.Message
+		if lastMessage == "" && len(record.Attachments) > 0 {
+			lastMessage = "[" + record.Attachments[0].Name + "]"
+		}
+		set := bson.M{"lastMessage": lastMessage, "lastFrom": record.From, "lastTime": record.TimeStamp}
+		inc := bson.M{"visitorUnread": 1}
+		if fromVisitor {
+			set["visitor"] = visitor
+			inc = bson.M{"bossUnread": 1}
+			err = collection.Update(bson.M{"_id": id, "status": CallDriverConvArchived}, bson.M{"$set": bson.M{"status": CallDriverConvOpen}})
+			if err != nil && err != mgo.ErrNotFound {
+				break
+			}
+		}
+		change := mgo.Change{
+			Update: bson.M{
+				"$set":         set,
+				"$inc":         inc,
+				"$setOnInsert": bson.M{"status": CallDriverConvOpen, "createTime": record.TimeStamp},
+			},
+			Upsert:    true,
+			ReturnNew: true,
+		}
+		_, err = collection.Find(bson.M{"_id": id}).Apply(change, &conv)
+	}
+	if err != nil {
+		logs.Error("touch callDriver conversation failed: error=%v id=%s", err, id)
+	}
+	return conv, err
+}
+
+// 为没有会话的历史聊天记录补建会话, bossName为Boss的名字, 返回新建的会话数
+func RebuildCallDriverConversations(bossName string) (created int, err error) {
+	if err = mongoBlocker(); err != nil {
+		logs.Error("%v", err)
+		return 0, err
+	}
+	for loop := true; loop; loop = false {
+		var groups []struct {
+			ID            string         `bson:"_id"`
+			Last          CallDriverChat `bson:"last"`
+			First         int64          `bson:"first"`
+			BossUnread    int            `bson:"bossUnread"`
+			VisitorUnread int            `bson:"visitorUnread"`
+		}
+		fromBoss := bson.M{"$eq": []interface{}{"$from", bossName}}
+		unread := bson.M{"$lt": []interface{}{"$status", CallDriverStatusRead}}
+		err = database.C(CollectCallDriverMsg).Pipe([]bson.M{
+			{"$sort": bson.M{"timeStamp": 1}},
+			{"$group": bson.M{
+				"_id":           bson.M{"$cond": []interface{}{fromBoss, "$to", "$from"}},
+				"last":          bson.M{"$last": "$$ROOT"},
+				"first":         bson.M{"$first": "$timeStamp"},
+				"bossUnread":    bson.M{"$sum": bson.M{"$cond": []interface{}{bson.M{"$and": []interface{}{bson.M{"$not": []interface{}{fromBoss}}, unread}}, 1, 0}}},
+				"visitorUnread": bson.M{"$sum": bson.M{"$cond": []interface{}{bson.M{"$and": []interface{}{fromBoss, unread}}, 1, 0}}},
+			}},
+		}).All(&groups)
+		if err != nil {
+			break
+		}
+		collection := database.C(CollectCallDriverConv)
+		for _, g := range groups {
+			var n int
+			if n, err = collection.FindId(g.ID).Count(); err != nil {
+				break
+			}
+			if n > 0 {
+				continue
+			}
+			visitor := g.Last.Nick
+			if visitor == "" {
+				visitor = g.ID
+			}
+			err = collection.Insert(CallDriverConversation{
+				ID:            g.ID,
+				Visitor:       visitor,
+				Status:        CallDriverConvOpen,
+				LastMessage:   g.Last.Message,
+				LastFrom:      g.Last.From,
+				LastTime:      g.Last.TimeStamp,
+				BossUnread:    g.BossUnread,
+				VisitorUnread: g.VisitorUnread,
+				CreateTime:    g.First,
+			})
+			if err != nil && !mgo.IsDup(err) {
+				break
+			}
+			err = nil
+			created++
+		}
+	}
+	if err != nil {
+		logs.Error("rebuild callDriver conversations failed: error=%v", err)
+	}
+	return created, err
+}
+
+// 查询会话, 不存在时返回ErrorNoRecord
+func FindCallDriverConversation(id string) (conv CallDriverConversation, err error) {
+	if err = mongoBlocker(); err != nil {
+		logs.Error("%v", err)
+		return conv, err
+	}
+	err = database.C(CollectCallDriverConv).FindId(id).One(&conv)
+	if err == mgo.ErrNotFound {
+		return conv, ErrorNoRecord
+	}
+	if err != nil {
+		logs.Error("find callDriver conversation failed: error=%v id=%s", err, id)
+	}
+	return conv, err
+}
+
+// 按最后活跃时间倒序分页查询会话, status为空时查询所有状态的会话
+func FindCallDriverConversations(status string, before *ChatCursor, limit int) (convs []CallDriverConversation, hasMore bool, err error) {
+	convs = make([]CallDriverConversation, 0)
+	if err = mongoBlocker(); err != nil {
+		logs.Error("%v", err)
+		return convs, false, err
+	}
+	conds := []bson.M{}
+	if status != "" {
+		conds = append(conds, bson.M{"status": status})
+	}
+	if before != nil {
+		conds = append(conds, before.selector("lastTime", "$lt"))
+	}
+	selector := bson.M{}
+	if len(conds) > 0 {
+		selector["$and"] = conds
+	}
+	collection := database.C(CollectCallDriverConv)
+	err = collection.Find(selector).Sort("-lastTime", "-_id").Limit(limit + 1).All(&convs)
+	if err != nil {
+		logs.Error("find callDriver conversations failed: error=%v status=%s", err, status)
+		return convs, false, err
+	}
+	if len(convs) > limit {
+		convs, hasMore = convs[:limit], true
+	}
+	return convs, hasMore, nil
+}
+
+// 更新访客的昵称和邮箱, 会话不存在时返回ErrorNoRecord
+func UpdateCallDriverVisitor(id, nick, email string) (conv CallDriverConversation, err error) {
+	if err = mongoBlocker(); err != nil {
+		logs.Error("%v", err)
+		return conv, err
+	}
+	change := mgo.Change{
+		Update:    bson.M{"$set": bson.M{"visitor": nick, "email": email}},
+		ReturnNew: true,
+	}
+	_, err = database.C(CollectCallDriverConv).FindId(id).Apply(change, &conv)
+	if err == mgo.ErrNotFound {
+		return conv, ErrorNoRecord
+	}
+	if err != nil {
+		logs.Error("update callDriver visitor failed: error=%v id=%s", err, id)
+	}
+	return conv, err
+}
+
+// 统计未静音的会话中Boss未读的消息总数
+func CountCallDriverBossUnread() (total int, err error) {
+	if err = mongoBlocker(); err != nil {
+		logs.Error("%v", err)
+		return 0, err
+	}
+	var result struct {
+		Total int `bson:"total"`
+	}
+	err = database.C(CollectCallDriverConv).Pipe([]bson.M{
+		{"$match": bson.M{"muted": bson.M{"$ne": true}, "bossUnread": bson.M{"$gt": 0}}},
+		{"$group": bson.M{"_id": nil, "total": bson.M{"$sum": "$bossUnread"}}},
+	}).One(&result)
+	if err == mgo.ErrNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		logs.Error("count callDriver unread failed: error=%v", err)
+	}
+	return result.Total, err
+}
+
+// 更新会话的状态或静音设置, 会话不存在时返回ErrorNoRecord
+func UpdateCallDriverConversation(id string, status string, muted bool) (conv CallDriverConversation, err error) {
+	if err = mongoBlocker(); err != nil {
+		logs.Error("%v", err)
+		return conv, err
+	}
+	change := mgo.Change{
+		Update:    bson.M{"$set": bson.M{"status": status, "muted": muted}},
+		ReturnNew: true,
+	}
+	_, err = database.C(CollectCallDriverConv).FindId(id).Apply(change, &conv)
+	if err == mgo.ErrNotFound {
+		return conv, ErrorNoRecord
+	}
+	if err != nil {
+		logs.Error("update callDriver conversation failed: error=%v id=%s", err, id)
+	}
+	return conv, err
+}
+
+// 根据消息的状态重新统计会话双方的未读数, 消息被确认已读后调用
+func RefreshCallDriverConversationUnread(id string) (conv CallDriverConversation, err error) {
+	if err = mongoBlocker(); err != nil {
+		logs.Error("%v", err)
+		return conv, err
+	}
+	for loop := true; loop; loop = false {
+		msgs := database.C(CollectCallDriverMsg)
+		var bossUnread, visitorUnread int
+		bossUnread, err = msgs.Find(bson.M{"from": id, "status": bson.M{"$lt": CallDriverStatusRead}}).Count()
+		if err != nil {
+			break
+		}
+		visitorUnread, err = msgs.Find(bson.M{"to": id, "status": bson.M{"$lt": CallDriverStatusRead}}).Count()
+		if err != nil {
+			break
+		}
+		change := mgo.Change{
+			Update:    bson.M{"$set": bson.M{"bossUnread": bossUnread, "visitorUnread": visitorUnread}},
+			ReturnNew: true,
+		}
+		_, err = database.C(CollectCallDriverConv).FindId(id).Apply(change, &conv)
+		if err == mgo.ErrNotFound {
+			return conv, ErrorNoRecord
+		}
+	}
+	if err != nil {
+		logs.Error("refresh callDriver conversation unread failed: error=%v id=%s", err, id)
+	}
+	return conv, err
+}
+
+// 查询条件对应的mongo查询
+func (f *ChatFilter) selector() bson.M {
+	conds := []bson.M{}
+	if f.Visitor != "" {
+		conds = append(conds, bson.M{"$or": []bson.M{{"from": f.Visitor}, {"to": f.Visitor}}})
+	}
+	if f.Nick != "" {
+		conds = append(conds, bson.M{"nick": bson.RegEx{Pattern: regexp.QuoteMeta(f.Nick), Options: "i"}})
+	}
+	if f.Keyword != "" {
+		keyword := bson.RegEx{Pattern: regexp.QuoteMeta(f.Keyword), Options: "i"}
+		conds = append(conds, bson.M{"$or": []bson.M{{"message": keyword}, {"attachments.name": keyword}}})
+	}
+	if f.IP != "" {
+		conds = append(conds, bson.M{"ip": bson.RegEx{Pattern: "^" + regexp.QuoteMeta(f.IP)}})
+	}
+	if f.Since > 0 {
+		conds = append(conds, bson.M{"timeStamp": bson.M{"$gte": f.Since}})
+	}
+	if f.Until > 0 {
+		conds = append(conds, bson.M{"timeStamp": bson.M{"$lt": f.Until}})
+	}
+	if len(conds) == 0 {
+		return bson.M{}
+	}
+	return bson.M{"$and": conds}
+}
+
+func (f *ChatFilter) collection() string {
+	if f.Archived {
+		return CollectCallDriverArch
+	}
+	return CollectCallDriverMsg
+}
+
+// 按条件搜索聊天记录, 按时间倒序分页, before为上一页最后一条记录的游标
+func SearchCallDriverMessage(filter *ChatFilter, before *ChatCursor, limit int) (history []CallDriverChat, hasMore bool, err error) {
+	history = make([]CallDriverChat, 0)
+	if err = mongoBlocker(); err != nil {
+		logs.Error("%v", err)
+		return history, false, err
+	}
+	selector := filter.selector()
+	if before != nil {
+		selector = bson.M{"$and": []bson.M{selector, before.selector("timeStamp", "$lt")}}
+	}
+	collection := database.C(filter.collection())
+	err = collection.Find(selector).Sort("-timeStamp", "-_id").Limit(limit + 1).All(&history)
+	if err != nil {
+		logs.Error("search callDriver chat failed: error=%v filter=%+v", err, filter)
+		return history, false, err
+	}
+	if len(history) > limit {
+		history, hasMore = history[:limit], true
+	}
+	return history, hasMore, nil
+}
+
+// 按时间正序逐条处理符合条件的聊天记录, 用于导出, fn返回错误时停止
+func IterCallDriverMessage(filter *ChatFilter, fn func(record CallDriverChat) error) (err error) {
+	if err = mongoBlocker(); err != nil {
+		logs.Error("%v", err)
+		return err
+	}
+	iter := database.C(filter.collection()).Find(filter.selector()).Sort("timeStamp", "_id").Iter()
+	var record CallDriverChat
+	for iter.Next(&record) {
+		if err = fn(record); err != nil {
+			iter.Close()
+			return err
+		}
+		record = CallDriverChat{}
+	}
+	if err = iter.Close(); err != nil {
+		logs.Error("iterate callDriver chat failed: error=%v filter=%+v", err, filter)
+	}
+	return err
+}
+
+// 删除时间戳早于before的聊天记录, archive为true时先移到归档集合, 返回处理的记录数
+// 分批处理, 每批先归档再删除, 中途出错时已处理的批次不受影响
+func ExpireCallDriverMessage(before int64, archive bool) (total int, err error) {
+	if err = mongoBlocker(); err != nil {
+		logs.Error("%v", err)
+		return 0, err
+	}
+	const batchSize = 500
+	msgs := database.C(CollectCallDriverMsg)
+	arch := database.C(CollectCallDriverArch)
+	for {
+		var records []CallDriverChat
+		err = msgs.Find(bson.M{"timeStamp": bson.M{"$lt": before}}).Sort("timeStamp").Limit(batchSize).All(&records)
+		if err != nil || len(records) == 0 {
+			break
+		}
+		ids := make([]string, 0, len(records))
+		for _, record := range records {
+			if archive {
+				if _, err = arch.UpsertId(record.ID, record); err != nil {
+					break
+				}
+			}
+			ids = append(ids, record.ID)
 		}
-		err = collection.Insert(data)
 		if err != nil {
 			break
 		}
+		if _, err = msgs.RemoveAll(bson.M{"_id": bson.M{"$in": ids}}); err != nil {
+			break
+		}
+		total += len(ids)
+	}
+	if err != nil {
+		logs.Error("expire callDriver chat failed: error=%v before=%d archive=%v total=%d", err, before, archive, total)
+	}
+	return total, err
+}
+
+// 保存被拦截等待审核的消息
+func InsertCallDriverHeld(visitor, nick, msg, ip, reason string, attachments []CallDriverAttachment) (held CallDriverHeld, err error) {
+	if err = mongoBlocker(); err != nil {
+		logs.Error("%v", err)
+		return held, err
+	}
+	ts := time.Now().Unix()
+	held = CallDriverHeld{
+		ID:        fmt.Sprintf("%d%s", ts, tb.GetRandomString(3)),
+		Visitor:   visitor,
+		Nick:      nick,
+		Message:   msg,
+		IP:        ip,
+		Reason:    reason,
+		TimeStamp: ts,
+
+		Attachments: attachments,
+	}
+	err = database.C(CollectCallDriverHeld).Insert(held)
+	if err != nil {
+		logs.Error("insert callDriver held message failed: error=%v held=%+v", err, held)
+	}
+	return held, err
+}
+
+// 按时间倒序查询等待审核的消息, 同时返回总数
+func FindCallDriverHeld(limit int) (helds []CallDriverHeld, total int, err error) {
+	helds = make([]CallDriverHeld, 0)
+	if err = mongoBlocker(); err != nil {
+		logs.Error("%v", err)
+		return helds, 0, err
+	}
+	for loop := true; loop; loop = false {
+		collection := database.C(CollectCallDriverHeld)
+		if total, err = collection.Count(); err != nil {
+			break
+		}
+		err = collection.Find(nil).Sort("-timeStamp", "-_id").Limit(limit).All(&helds)
 	}
 	if err != nil {
-		logs.Error("mongoDB insert Error: %v", err)
+		logs.Error("find callDriver held messages failed: error=%v", err)
 	}
-	return err
+	return helds, total, err
 }
 
-// 获取文件保存信息
-func GetUploadRecord(code string) (FileUpload, error) {
-	var record FileUpload
-	var err error
-	var query *mgo.Query
-
+// 从审核队列中取出并删除一条消息, 不存在时返回ErrorNoRecord
+func RemoveCallDriverHeld(id string) (held CallDriverHeld, err error) {
 	if err = mongoBlocker(); err != nil {
 		logs.Error("%v", err)
-		return record, err
+		return held, err
 	}
-
-	collection := database.C(CollectUploadFile)
-	query = collection.Find(bson.M{"code": code})
-	if query == nil {
-		logs.Warning("find result is null: code=%s", code)
-		return record, ErrorNoRecord
+	_, err = database.C(CollectCallDriverHeld).FindId(id).Apply(mgo.Change{Remove: true}, &held)
+	if err == mgo.ErrNotFound {
+		return held, ErrorNoRecord
 	}
-	err = query.One(&record)
 	if err != nil {
-		logs.Error(err)
+		logs.Error("remove callDriver held message failed: error=%v id=%s", err, id)
 	}
-	return record, err
+	return held, err
 }
 
-// =============== CallDriver ==================
-// 保存callDriver应用中收到的来自其他用户的消息
-func InsertCallDriverMessage(from, to, msg, ip string) error {
-	var err error
+// =============== Mail ==================
+// 新增或更新一封邮件
+func SaveMail(mail *tb.Mail) (err error) {
 	if err = mongoBlocker(); err != nil {
 		logs.Error("%v", err)
 		return err
 	}
-
-	ts := time.Now().Unix()
-	record := CallDriverChat{
-		ID:        fmt.Sprintf("%d%s", ts, tb.GetRandomString(3)),
-		From:      from,
-		To:        to,
-		Message:   msg,
-		TimeStamp: ts,
-		IP:        ip,
-		Status:    0,
-	}
-	for loop := true; loop; loop = false {
-		if from == "" || to == "" || msg == "" {
-			err = fmt.Errorf("unexpect params: from=%s to=%s msg=%s", from, to, msg)
-			break
-		}
-		collection := database.C(CollectCallDriverMsg)
-		if collection == nil {
-			err = fmt.Errorf("connect to collection fail: collection=%s", CollectCallDriverMsg)
-			break
-		}
-		err = collection.Insert(record)
-		if err != nil {
-			break
-		}
+	if _, err = database.C(CollectMail).UpsertId(mail.ID, mail); err != nil {
+		logs.Error("save mail failed: error=%v id=%s", err, mail.ID)
 	}
-	logs.Debug("insert result: collection=%s err=%v record=%v", CollectCallDriverMsg, err, msg)
 	return err
 }
 
-// 查询callDriver应用的聊天记录
-func FindCallDriverMessage(nick string, num int) (history []CallDriverChat, err error) {
-	history = make([]CallDriverChat, 0)
+// 按id查询邮件, 不存在时返回ErrorNoRecord
+func GetMail(id string) (mail *tb.Mail, err error) {
 	if err = mongoBlocker(); err != nil {
 		logs.Error("%v", err)
-		return history, err
+		return nil, err
 	}
-	for loop := true; loop; loop = false {
-		if nick == "" || num <= 0 {
-			err = fmt.Errorf("unexpect params: nick=%s num=%d", nick, num)
-			break
-		}
-		collection := database.C(CollectCallDriverMsg)
-		if collection == nil {
-			err = fmt.Errorf("connect to collection fail: collection=%s", CollectCallDriverMsg)
-			break
-		}
-		var query *mgo.Query
-		query = collection.Find(bson.M{"$or": []bson.M{bson.M{"from": nick}, bson.M{"to": nick}}}).Sort("-timeStamp").Limit(num)
-		if query == nil {
-			err = fmt.Errorf("query return null")
-			break
-		}
-		query.All(&history)
-		// 更新消息状态
-		if len(history) > 0 {
-			ids := make([]string, 0)
-			for _, t := range history {
-				ids = append(ids, t.ID)
-			}
-			go UpdateCallDriverMessage(ids)
-		}
+	mail = new(tb.Mail)
+	err = database.C(CollectMail).FindId(id).One(mail)
+	if err == mgo.ErrNotFound {
+		return nil, ErrorNoRecord
 	}
-	logs.Debug("find result: collection=%s err=%v nick=%s history.len=%d",
-		CollectCallDriverMsg, err, nick, len(history))
-	return history, err
+	if err != nil {
+		logs.Error("get mail failed: error=%v id=%s", err, id)
+		return nil, err
+	}
+	return mail, nil
 }
 
-// 记录聊天记录已读,status自增1
-func UpdateCallDriverMessage(ids []string) {
-	var err error
+// 按下一次尝试的时间顺序查询到期且等待发送的邮件
+func FindPendingMail(now int64, limit int) (mails []*tb.Mail, err error) {
+	mails = make([]*tb.Mail, 0)
 	if err = mongoBlocker(); err != nil {
 		logs.Error("%v", err)
-		return
-	}
-	if ids == nil || len(ids) == 0 {
-		logs.Warning("unexpect params: ids=%v", ids)
-		return
-	}
-	collection := database.C(CollectCallDriverMsg)
-	if collection == nil {
-		logs.Error("connect to collection fail: collection=%s", CollectCallDriverMsg)
-		return
+		return mails, err
 	}
-	info, err := collection.UpdateAll(bson.M{"_id": bson.M{"$in": ids}}, bson.M{"$inc": bson.M{"status": 1}})
+	selector := bson.M{"status": tb.MailStatusPending, "nextTime": bson.M{"$lte": now}}
+	err = database.C(CollectMail).Find(selector).Sort("nextTime").Limit(limit).All(&mails)
 	if err != nil {
-		logs.Error("update callDriver chat fail: err=%v ids=%v", err, ids)
-		return
+		logs.Error("find pending mail failed: error=%v", err)
 	}
-	logs.Debug("update message status success: total=%d update=%d", len(ids), info.Updated)
+	return mails, err
 }
 
-// 查询所有聊天记录
-func FindAllCallDriverMessage() (history []CallDriverChat, err error) {
-	history = make([]CallDriverChat, 0)
+// 按创建时间倒序查询发送记录, 不返回邮件内容和附件数据; status为空时查询所有状态
+func FindMailLog(status string, limit int) (mails []*tb.Mail, total int, err error) {
+	mails = make([]*tb.Mail, 0)
 	if err = mongoBlocker(); err != nil {
 		logs.Error("%v", err)
-		return history, err
+		return mails, 0, err
+	}
+	selector := bson.M{}
+	if status != "" {
+		selector["status"] = status
 	}
 	for loop := true; loop; loop = false {
-		collection := database.C(CollectCallDriverMsg)
-		if collection == nil {
-			err = fmt.Errorf("connect to collection fail: collection=%s", CollectCallDriverMsg)
-			break
-		}
-		var query *mgo.Query
-		myName := "BlackCarDriver"
-		query = collection.Find(bson.M{"$or": []bson.M{bson.M{"from": myName}, bson.M{"to": myName}}}).Sort("-timeStamp").Limit(50)
-		if query == nil {
-			err = fmt.Errorf("query return null")
+		query := database.C(CollectMail).Find(selector)
+		if total, err = query.Count(); err != nil {
 			break
 		}
-		query.All(&history)
+		err = query.Select(bson.M{"html": 0, "text": 0, "attachments.data": 0}).Sort("-createTime", "-_id").Limit(limit).All(&mails)
 	}
-	logs.Debug("find result: collection=%s err=%v history.len=%d", CollectCallDriverMsg, err, len(history))
-	return history, err
+	if err != nil {
+		logs.Error("find mail log failed: error=%v status=%s", err, status)
+	}
+	return mails, total, err
+}
+
+// 删除创建时间早于before且已发送或已失败的邮件, 返回删除的数量
+func RemoveMailBefore(before int64) (removed int, err error) {
+	if err = mongoBlocker(); err != nil {
+		logs.Error("%v", err)
+		return 0, err
+	}
+	selector := bson.M{"createTime": bson.M{"$lt": before}, "status": bson.M{"$ne": tb.MailStatusPending}}
+	info, err := database.C(CollectMail).RemoveAll(selector)
+	if err != nil {
+		logs.Error("remove mail failed: error=%v before=%d", err, before)
+		return 0, err
+	}
+	return info.Removed, nil
 }
 
 // =============== CodeMaster ==================
@@ -338,35 +1305,6 @@ func InsertCodeMasterWork(work *CodeMasterWork) (err error) {
 	return err
 }
 
-// 查询已有的程序作品的简单信息
-func GetAllCodeMasterWork() (works []*CodeMasterWork, err error) {
-	works = make([]*CodeMasterWork, 0)
-	if err = mongoBlocker(); err != nil {
-		logs.Error("%v", err)
-		return works, err
-	}
-	works = make([]*CodeMasterWork, 0)
-	for loop := true; loop; loop = false {
-		collection := database.C(CollectCodeMasterWorks)
-		query := collection.Find(bson.M{"status": 0})
-		if query == nil {
-			logs.Warning("no works found...")
-			break
-		}
-		err = query.All(&works)
-		if err != nil {
-			logs.Error("query data failed: error=%v", err)
-			break
-		}
-		logs.Info("get all works success: len=%d", len(works))
-	}
-
-	if err != nil {
-		logs.Error("get works failed: error=%+v", err)
-	}
-	return works, err
-}
-
 // 根据ID查询作品的详细信息
 func GetCodeDetailByID(ID string) (works *CodeMasterWork, err error) {
 	if err = mongoBlocker(); err != nil {
@@ -506,3 +1444,318 @@ func UpdateWorksStatus(id string, newStatus int) (err error) {
 	}
 	return err
 }
+
+// 作品列表不返回的大字段
+var workListExclude = bson.M{"code": 0, "detail": 0, "inputdesc": 0, "demoinput": 0, "demooutput": 0}
+
+// 作品列表的排序方式对应的mongo排序, 相同时按提交时间倒序
+var workSortFields = map[string][]string{
+	WorkSortTime:  {"-timestamp", "-_id"},
+	WorkSortScore: {"-score", "-timestamp", "-_id"},
+	WorkSortHot:   {"-hot", "-timestamp", "-_id"},
+}
+
+// 为作品列表的查询和排序以及用户登录名建立索引, 启动时调用
+func EnsureCodeMasterIndex() (err error) {
+	if err = mongoBlocker(); err != nil {
+		logs.Error("%v", err)
+		return err
+	}
+	collection := database.C(CollectCodeMasterWorks)
+	for _, key := range [][]string{
+		{"status", "-timestamp"},
+		{"status", "-score", "-timestamp"},
+		{"status", "-hot", "-timestamp"},
+		{"status", "ctype", "-timestamp"},
+		{"status", "language", "-timestamp"},
+		{"status", "isrecommend", "-timestamp"},
+		{"userid", "status", "-timestamp"},
+	} {
+		if err = collection.EnsureIndex(mgo.Index{Key: key, Background: true}); err != nil {
+			logs.Error("ensure works index failed: key=%v error=%v", key, err)
+			return err
+		}
+	}
+	// 登录名不能重复, 注册时依赖这个索引判断重名
+	if err = database.C(CollectCodeMasterUser).EnsureIndex(mgo.Index{Key: []string{"name"}, Unique: true}); err != nil {
+		logs.Error("ensure user index failed: error=%v", err)
+		return err
+	}
+	return nil
+}
+
+// 查询条件对应的mongo查询, 只查询未删除的作品
+func (f *WorkFilter) selector() bson.M {
+	selector := bson.M{"status": 0}
+	if f.CType >= 0 {
+		selector["ctype"] = f.CType
+	}
+	if f.Language != "" {
+		selector["language"] = f.Language
+	}
+	if f.Tag != "" {
+		selector["tagstr"] = bson.RegEx{Pattern: regexp.QuoteMeta(f.Tag), Options: "i"}
+	}
+	if f.Recommend > 0 {
+		selector["isrecommend"] = true
+	}
+	if f.Recommend < 0 {
+		selector["isrecommend"] = false
+	}
+	if f.UserID != "" {
+		selector["userid"] = f.UserID
+	}
+	return selector
+}
+
+// 作品是否符合查询条件, 与selector的条件一致, 用于在内存中过滤搜索结果
+func (f *WorkFilter) Match(work *CodeMasterWork) bool {
+	switch {
+	case work.Status != 0:
+		return false
+	case f.CType >= 0 && work.CType != f.CType:
+		return false
+	case f.Language != "" && work.Language != f.Language:
+		return false
+	case f.Tag != "" && !strings.Contains(strings.ToLower(work.TagStr), strings.ToLower(f.Tag)):
+		return false
+	case f.Recommend > 0 && !work.IsRecommend, f.Recommend < 0 && work.IsRecommend:
+		return false
+	case f.UserID != "" && work.UserID != f.UserID:
+		return false
+	}
+	return true
+}
+
+// 按条件分页查询作品列表, 不返回代码和详情等大字段, 同时返回符合条件的总数
+func FindCodeMasterWorks(filter *WorkFilter, sort string, skip int, limit int) (works []*CodeMasterWork, total int, err error) {
+	works = make([]*CodeMasterWork, 0)
+	if err = mongoBlocker(); err != nil {
+		logs.Error("%v", err)
+		return works, 0, err
+	}
+	fields, ok := workSortFields[sort]
+	if !ok {
+		return works, 0, fmt.Errorf("unexpect sort: %q", sort)
+	}
+	for loop := true; loop; loop = false {
+		query := database.C(CollectCodeMasterWorks).Find(filter.selector())
+		if total, err = query.Count(); err != nil {
+			break
+		}
+		err = query.Select(workListExclude).Sort(fields...).Skip(skip).Limit(limit).All(&works)
+	}
+	if err != nil {
+		logs.Error("find works failed: error=%v filter=%+v sort=%s", err, filter, sort)
+	}
+	return works, total, err
+}
+
+// 增加作品的浏览次数和热度
+func IncWorkPopularity(id string, views int, hot int) (err error) {
+	if err = mongoBlocker(); err != nil {
+		logs.Error("%v", err)
+		return err
+	}
+	err = database.C(CollectCodeMasterWorks).UpdateId(id, bson.M{"$inc": bson.M{"views": views, "hot": hot}})
+	if err != nil && err != mgo.ErrNotFound {
+		logs.Error("inc work popularity failed: error=%v id=%s", err, id)
+	}
+	return err
+}
+
+// 作者更新作品的内容, 只更新作者可以修改的字段
+func UpdateWorkContent(work *CodeMasterWork) (err error) {
+	if err = mongoBlocker(); err != nil {
+		logs.Error("%v", err)
+		return err
+	}
+	updater := bson.M{
+		"title":      work.Title,
+		"ctype":      work.CType,
+		"tagstr":     work.TagStr,
+		"desc":       work.Desc,
+		"inputdesc":  work.InputDesc,
+		"detail":     work.Detail,
+		"demoinput":  work.DemoInput,
+		"demooutput": work.DemoOutput,
+		"coverurl":   work.CoverURL,
+	}
+	if err = database.C(CollectCodeMasterWorks).UpdateId(work.ID, bson.M{"$set": updater}); err != nil {
+		logs.Error("update work content failed: error=%v id=%s", err, work.ID)
+	}
+	return err
+}
+
+// 遍历所有正常状态的作品, 用于建立搜索索引; fn返回错误时停止遍历
+func IterCodeMasterWorks(fn func(work *CodeMasterWork) error) (err error) {
+	if err = mongoBlocker(); err != nil {
+		logs.Error("%v", err)
+		return err
+	}
+	iter := database.C(CollectCodeMasterWorks).Find(bson.M{"status": 0}).Iter()
+	work := &CodeMasterWork{}
+	for iter.Next(work) {
+		if err = fn(work); err != nil {
+			iter.Close()
+			return err
+		}
+		work = &CodeMasterWork{}
+	}
+	if err = iter.Close(); err != nil {
+		logs.Error("iterate works failed: error=%v", err)
+	}
+	return err
+}
+
+// 按id批量查询作品, 不返回代码和详情等大字段, 结果按ids的顺序排列, 不存在的作品被忽略
+func FindCodeMasterWorksByIDs(ids []string) (works []*CodeMasterWork, err error) {
+	works = make([]*CodeMasterWork, 0, len(ids))
+	if err = mongoBlocker(); err != nil {
+		logs.Error("%v", err)
+		return works, err
+	}
+	if len(ids) == 0 {
+		return works, nil
+	}
+	found := make([]*CodeMasterWork, 0, len(ids))
+	err = database.C(CollectCodeMasterWorks).Find(bson.M{"_id": bson.M{"$in": ids}}).Select(workListExclude).All(&found)
+	if err != nil {
+		logs.Error("find works by ids failed: error=%v ids=%v", err, ids)
+		return works, err
+	}
+	byID := make(map[string]*CodeMasterWork, len(found))
+	for _, work := range found {
+		byID[work.ID] = work
+	}
+	for _, id := range ids {
+		if work, ok := byID[id]; ok {
+			works = append(works, work)
+		}
+	}
+	return works, nil
+}
+
+// =============== CodeMaster 用户 ==================
+
+// 查询用户时不返回头像数据
+var codeMasterUserFields = bson.M{"avatar": 0}
+
+// 新增用户, 登录名已存在时返回ErrorDupRecord
+func InsertCodeMasterUser(user *CodeMasterUser) (err error) {
+	if err = mongoBlocker(); err != nil {
+		logs.Error("%v", err)
+		return err
+	}
+	collection := database.C(CollectCodeMasterUser)
+	err = collection.Insert(user)
+	if mgo.IsDup(err) {
+		return ErrorDupRecord
+	}
+	if err != nil {
+		logs.Error("insert user failed: error=%v name=%s", err, user.Name)
+	}
+	return err
+}
+
+// 按id查询用户, 不存在时返回ErrorNoRecord
+func GetCodeMasterUser(id string) (*CodeMasterUser, error) {
+	return findCodeMasterUser(bson.M{"_id": id})
+}
+
+// 按登录名查询用户, 不存在时返回ErrorNoRecord
+func GetCodeMasterUserByName(name string) (*CodeMasterUser, error) {
+	return findCodeMasterUser(bson.M{"name": name})
+}
+
+func findCodeMasterUser(selector bson.M) (user *CodeMasterUser, err error) {
+	if err = mongoBlocker(); err != nil {
+		logs.Error("%v", err)
+		return nil, err
+	}
+	user = new(CodeMasterUser)
+	err = database.C(CollectCodeMasterUser).Find(selector).Select(codeMasterUserFields).One(user)
+	if err == mgo.ErrNotFound {
+		return nil, ErrorNoRecord
+	}
+	if err != nil {
+		logs.Error("find user failed: error=%v selector=%v", err, selector)
+		return nil, err
+	}
+	return user, nil
+}
+
+// 批量查询用户, 返回id到用户的映射, 不存在的用户不在结果中
+func GetCodeMasterUsers(ids []string) (users map[string]*CodeMasterUser, err error) {
+	users = make(map[string]*CodeMasterUser)
+	if len(ids) == 0 {
+		return users, nil
+	}
+	if err = mongoBlocker(); err != nil {
+		logs.Error("%v", err)
+		return users, err
+	}
+	list := make([]*CodeMasterUser, 0)
+	err = database.C(CollectCodeMasterUser).Find(bson.M{"_id": bson.M{"$in": ids}}).Select(codeMasterUserFields).All(&list)
+	if err != nil {
+		logs.Error("find users failed: error=%v ids=%v", err, ids)
+		return users, err
+	}
+	for _, u := range list {
+		users[u.ID] = u
+	}
+	return users, nil
+}
+
+// 更新用户的昵称和简介
+func UpdateCodeMasterProfile(id string, nick string, bio string) (err error) {
+	return updateCodeMasterUser(id, bson.M{"$set": bson.M{"nick": nick, "bio": bio}})
+}
+
+// 更新用户的密码, 同时使之前的登录失效
+func UpdateCodeMasterPassword(id string, passHash string) (err error) {
+	return updateCodeMasterUser(id, bson.M{"$set": bson.M{"passHash": passHash}, "$inc": bson.M{"tokenVersion": 1}})
+}
+
+// 更新用户的头像
+func UpdateCodeMasterAvatar(id string, avatar []byte, avatarTime int64) (err error) {
+	return updateCodeMasterUser(id, bson.M{"$set": bson.M{"avatar": avatar, "avatarTime": avatarTime}})
+}
+
+// 记录用户的登录时间
+func UpdateCodeMasterLogin(id string, loginTime int64) (err error) {
+	return updateCodeMasterUser(id, bson.M{"$set": bson.M{"lastLogin": loginTime}})
+}
+
+func updateCodeMasterUser(id string, updater bson.M) (err error) {
+	if err = mongoBlocker(); err != nil {
+		logs.Error("%v", err)
+		return err
+	}
+	err = database.C(CollectCodeMasterUser).UpdateId(id, updater)
+	if err == mgo.ErrNotFound {
+		return ErrorNoRecord
+	}
+	if err != nil {
+		logs.Error("update user failed: error=%v id=%s", err, id)
+	}
+	return err
+}
+
+// 查询用户的头像, 没有头像时返回ErrorNoRecord
+func GetCodeMasterAvatar(id string) (avatar []byte, err error) {
+	if err = mongoBlocker(); err != nil {
+		logs.Error("%v", err)
+		return nil, err
+	}
+	var user CodeMasterUser
+	err = database.C(CollectCodeMasterUser).FindId(id).Select(bson.M{"avatar": 1}).One(&user)
+	if err == mgo.ErrNotFound || (err == nil && len(user.Avatar) == 0) {
+		return nil, ErrorNoRecord
+	}
+	if err != nil {
+		logs.Error("get avatar failed: error=%v id=%s", err, id)
+		return nil, err
+	}
+	return user.Avatar, nil
+}
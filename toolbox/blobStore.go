@@ -0,0 +1,189 @@
+package toolbox
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"time"
+
+	"github.com/astaxie/beego/logs"
+)
+
+var blobHashReg = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// BlobStore 按内容寻址的文件存储, 文件以内容的sha256命名, 相同内容只保存一份
+// 数据保存在StorageDriver中, key为${hash[0:2]}/${hash}; 写入时先在本地临时目录计算sha256
+// 设置主密钥并开启加密后, 新写入的数据以加密形式保存, hash仍按明文计算以保证去重有效
+type BlobStore struct {
+	driver    StorageDriver
+	tmpFS     *SandboxFS
+	masterKey []byte
+	encrypt   bool
+}
+
+// 创建一个BlobStore, tmpDir为写入过程中存放临时文件的本地目录
+func NewBlobStore(driver StorageDriver, tmpDir string) (*BlobStore, error) {
+	if driver == nil {
+		return nil, fmt.Errorf("storage driver can't be null")
+	}
+	tmpFS, err := NewSandboxFS(tmpDir)
+	if err != nil {
+		return nil, err
+	}
+	return &BlobStore{driver: driver, tmpFS: tmpFS}, nil
+}
+
+// 设置主密钥, encrypt为true时新写入的数据会被加密; 只设置密钥时仍可读取已加密的数据
+func (b *BlobStore) SetMasterKey(key []byte, encrypt bool) {
+	b.masterKey = key
+	b.encrypt = encrypt && key != nil
+}
+
+// 获取主密钥, 未设置时返回nil
+func (b *BlobStore) MasterKey() []byte {
+	return b.masterKey
+}
+
+// 新写入的数据是否加密
+func (b *BlobStore) EncryptEnabled() bool {
+	return b.encrypt
+}
+
+// 判断数据是否保存在本地磁盘
+func (b *BlobStore) IsLocal() bool {
+	_, ok := b.driver.(*LocalDriver)
+	return ok
+}
+
+// 暂存在本地临时文件中, 等待提交的文件块
+type StagedBlob struct {
+	Hash      string
+	Size      int64 // 明文大小
+	Encrypted bool  // 临时文件是否加密保存, 由调用方记录在索引中
+	tmpPath   string
+}
+
+// 将数据写入本地临时文件并计算sha256, 之后调用Commit保存, 最后调用Discard删除临时文件
+// 写入数据较慢, 分为两步是为了让调用方在提交前记录正在保存的hash, 避免同内容的文件块被并发删除
+func (b *BlobStore) Stage(src io.Reader) (*StagedBlob, error) {
+	tmpName := GetRandomString(16)
+	tmpFile, err := b.tmpFS.CreateNew(tmpName)
+	if err != nil {
+		return nil, err
+	}
+	staged := &StagedBlob{Encrypted: b.encrypt, tmpPath: tmpFile.Name()}
+	hasher := sha256.New()
+	var dst io.WriteCloser = tmpFile
+	if b.encrypt {
+		if dst, err = NewEncryptWriter(tmpFile, b.masterKey); err != nil {
+			tmpFile.Close()
+			b.Discard(staged)
+			return nil, err
+		}
+	}
+	staged.Size, err = io.Copy(io.MultiWriter(dst, hasher), src)
+	if b.encrypt && err == nil {
+		err = dst.Close()
+	}
+	tmpFile.Close()
+	if err != nil {
+		b.Discard(staged)
+		return nil, err
+	}
+	staged.Hash = hex.EncodeToString(hasher.Sum(nil))
+	return staged, nil
+}
+
+// 保存暂存的文件块, created表示是否由本次调用新建; 内容已存在时不会重复保存, 此时已有数据的加密状态可能与暂存的不同
+func (b *BlobStore) Commit(staged *StagedBlob) (created bool, err error) {
+	key := b.blobKey(staged.Hash)
+	isExist, err := b.driver.Exist(key)
+	if err != nil {
+		return false, err
+	}
+	if isExist {
+		logs.Info("blob already exist: hash=%s size=%d", staged.Hash, staged.Size)
+		return false, nil
+	}
+	if local, ok := b.driver.(*LocalDriver); ok {
+		err = local.MoveIn(key, staged.tmpPath)
+	} else {
+		var file *os.File
+		if file, err = os.Open(staged.tmpPath); err != nil {
+			return false, err
+		}
+		var info os.FileInfo
+		if info, err = file.Stat(); err == nil {
+			err = b.driver.Put(key, file, info.Size())
+		}
+		file.Close()
+	}
+	if err != nil {
+		return false, err
+	}
+	logs.Info("save new blob: hash=%s size=%d", staged.Hash, staged.Size)
+	return true, nil
+}
+
+// 删除暂存的临时文件, 提交之后调用也是安全的
+func (b *BlobStore) Discard(staged *StagedBlob) {
+	if staged != nil {
+		os.Remove(staged.tmpPath)
+	}
+}
+
+// 获取文件块在本地磁盘上的路径, 数据不在本地时返回ErrNotLocalStorage
+func (b *BlobStore) Path(hash string) (string, error) {
+	if !blobHashReg.MatchString(hash) {
+		return "", fmt.Errorf("unexpect blob hash: hash=%q", hash)
+	}
+	local, ok := b.driver.(*LocalDriver)
+	if !ok {
+		return "", ErrNotLocalStorage
+	}
+	return local.Path(b.blobKey(hash))
+}
+
+// 打开文件块用于读取, encrypted为文件块保存时是否加密, 加密的数据返回解密后的内容
+func (b *BlobStore) Open(hash string, encrypted bool) (io.ReadCloser, error) {
+	reader, err := b.OpenRaw(hash)
+	if err != nil {
+		return nil, err
+	}
+	return NewPlainReader(reader, b.masterKey, encrypted)
+}
+
+// 打开文件块用于读取, 返回实际保存的数据
+func (b *BlobStore) OpenRaw(hash string) (io.ReadCloser, error) {
+	if !blobHashReg.MatchString(hash) {
+		return nil, fmt.Errorf("unexpect blob hash: hash=%q", hash)
+	}
+	return b.driver.Get(b.blobKey(hash))
+}
+
+// 生成文件块的临时下载链接, 不支持时返回ErrPresignNotSupport
+// 设置了主密钥时数据可能是加密的, 需要由服务端解密后返回, 同样返回ErrPresignNotSupport
+func (b *BlobStore) PresignURL(hash string, fileName string, inline bool, expire time.Duration) (string, error) {
+	if !blobHashReg.MatchString(hash) {
+		return "", fmt.Errorf("unexpect blob hash: hash=%q", hash)
+	}
+	if b.masterKey != nil {
+		return "", ErrPresignNotSupport
+	}
+	return b.driver.PresignGet(b.blobKey(hash), fileName, inline, expire)
+}
+
+// 删除文件块
+func (b *BlobStore) Remove(hash string) error {
+	if !blobHashReg.MatchString(hash) {
+		return fmt.Errorf("unexpect blob hash: hash=%q", hash)
+	}
+	return b.driver.Delete(b.blobKey(hash))
+}
+
+func (b *BlobStore) blobKey(hash string) string {
+	return fmt.Sprintf("%s/%s", hash[:2], hash)
+}
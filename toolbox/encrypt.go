@@ -0,0 +1,362 @@
+package toolbox
+
+// 文件的静态加密(AES-256-GCM)
+// 每个文件使用随机生成的数据密钥, 数据密钥由主密钥加密后保存在文件头部, 文件格式:
+//   magic(8) | version(1) | 加密的数据密钥(nonce 12 + 密钥 32 + tag 16) | 基础nonce(12) | 数据块...
+// 明文按64KB分块加密, 每块的nonce由基础nonce与块序号异或得到, 附加数据中包含块序号和是否为最后一块, 防止数据块被调换或截断
+// 最后一块的明文长度小于64KB(可以为0), 因此可以由密文长度算出明文长度, 并支持随机读取
+// 文件是否加密由调用方记录(如文件索引), 不根据文件头判断: 上传的明文文件也可能以magic开头
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"strings"
+)
+
+const (
+	encryptVersion    = 1
+	encryptChunkSize  = 64 << 10
+	encryptTagSize    = 16
+	encryptNonceSize  = 12
+	encryptKeySize    = 32
+	encryptHeaderSize = 8 + 1 + encryptNonceSize + encryptKeySize + encryptTagSize + encryptNonceSize
+)
+
+var encryptMagic = []byte("\x89SSENC\r\n")
+
+var (
+	ErrBadMasterKey     = errors.New("master key should be 32 bytes in hex or base64")
+	ErrNoMasterKey      = errors.New("file is encrypted but master key is not set")
+	ErrBadEncryptedFile = errors.New("encrypted file is damaged or master key is wrong")
+)
+
+// 解析hex或base64格式的32字节主密钥
+func ParseMasterKey(s string) ([]byte, error) {
+	s = strings.TrimSpace(s)
+	if key, err := hex.DecodeString(s); err == nil && len(key) == encryptKeySize {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(s); err == nil && len(key) == encryptKeySize {
+		return key, nil
+	}
+	return nil, ErrBadMasterKey
+}
+
+// 判断数据是否以加密文件头开始
+func isEncryptedHeader(header []byte) bool {
+	return len(header) >= len(encryptMagic) && bytes.Equal(header[:len(encryptMagic)], encryptMagic)
+}
+
+// 由加密文件的大小计算明文的大小
+func EncryptedPlainSize(cipherSize int64) (int64, error) {
+	body := cipherSize - encryptHeaderSize
+	if body < encryptTagSize {
+		return 0, ErrBadEncryptedFile
+	}
+	full := body / (encryptChunkSize + encryptTagSize)
+	rest := body % (encryptChunkSize + encryptTagSize)
+	if rest < encryptTagSize {
+		return 0, ErrBadEncryptedFile
+	}
+	return full*encryptChunkSize + rest - encryptTagSize, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// 计算第index块的nonce和附加数据
+func chunkNonce(base []byte, index uint64, final bool) (nonce []byte, ad []byte) {
+	nonce = make([]byte, encryptNonceSize)
+	copy(nonce, base)
+	for i := 0; i < 8; i++ {
+		nonce[encryptNonceSize-1-i] ^= byte(index >> (8 * i))
+	}
+	ad = make([]byte, 9)
+	binary.BigEndian.PutUint64(ad, index)
+	if final {
+		ad[8] = 1
+	}
+	return nonce, ad
+}
+
+// ------------------- 加密 ---------------------
+
+type encryptWriter struct {
+	dst   io.Writer
+	aead  cipher.AEAD
+	base  []byte
+	index uint64
+	buf   []byte
+}
+
+// 创建一个加密写入器, 写入的明文加密后写到dst, 必须调用Close写入最后一块
+func NewEncryptWriter(dst io.Writer, masterKey []byte) (io.WriteCloser, error) {
+	masterAEAD, err := newGCM(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	dataKey := make([]byte, encryptKeySize)
+	keyNonce := make([]byte, encryptNonceSize)
+	base := make([]byte, encryptNonceSize)
+	for _, b := range [][]byte{dataKey, keyNonce, base} {
+		if _, err = rand.Read(b); err != nil {
+			return nil, err
+		}
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, 0, encryptHeaderSize)
+	header = append(header, encryptMagic...)
+	header = append(header, encryptVersion)
+	header = append(header, keyNonce...)
+	header = masterAEAD.Seal(header, keyNonce, dataKey, encryptMagic)
+	header = append(header, base...)
+	if _, err = dst.Write(header); err != nil {
+		return nil, err
+	}
+	return &encryptWriter{dst: dst, aead: aead, base: base, buf: make([]byte, 0, encryptChunkSize*2)}, nil
+}
+
+func (w *encryptWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	// 只有确定后面还有数据时才写出完整的块, 保证最后一块小于块大小
+	for len(w.buf) > encryptChunkSize {
+		if err := w.seal(w.buf[:encryptChunkSize], false); err != nil {
+			return 0, err
+		}
+		w.buf = append(w.buf[:0], w.buf[encryptChunkSize:]...)
+	}
+	return len(p), nil
+}
+
+func (w *encryptWriter) Close() error {
+	if len(w.buf) == encryptChunkSize {
+		if err := w.seal(w.buf, false); err != nil {
+			return err
+		}
+		w.buf = w.buf[:0]
+	}
+	return w.seal(w.buf, true)
+}
+
+func (w *encryptWriter) seal(plain []byte, final bool) error {
+	nonce, ad := chunkNonce(w.base, w.index, final)
+	w.index++
+	_, err := w.dst.Write(w.aead.Seal(nil, nonce, plain, ad))
+	return err
+}
+
+// ------------------- 解密 ---------------------
+
+// 读取文件头并解出数据密钥
+func openEncryptHeader(header []byte, masterKey []byte) (cipher.AEAD, []byte, error) {
+	if len(header) < encryptHeaderSize || !isEncryptedHeader(header) || header[len(encryptMagic)] != encryptVersion {
+		return nil, nil, ErrBadEncryptedFile
+	}
+	if masterKey == nil {
+		return nil, nil, ErrNoMasterKey
+	}
+	masterAEAD, err := newGCM(masterKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	offset := len(encryptMagic) + 1
+	keyNonce := header[offset : offset+encryptNonceSize]
+	wrapped := header[offset+encryptNonceSize : offset+encryptNonceSize+encryptKeySize+encryptTagSize]
+	dataKey, err := masterAEAD.Open(nil, keyNonce, wrapped, encryptMagic)
+	if err != nil {
+		return nil, nil, ErrBadEncryptedFile
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	base := header[encryptHeaderSize-encryptNonceSize : encryptHeaderSize]
+	return aead, append([]byte(nil), base...), nil
+}
+
+type decryptReader struct {
+	src   *bufio.Reader
+	aead  cipher.AEAD
+	base  []byte
+	index uint64
+	plain []byte
+	done  bool
+}
+
+func (r *decryptReader) Read(p []byte) (int, error) {
+	for len(r.plain) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		chunk := make([]byte, encryptChunkSize+encryptTagSize)
+		n, err := io.ReadFull(r.src, chunk)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			if err == io.EOF {
+				err = ErrBadEncryptedFile // 缺少最后一块
+			}
+			return 0, err
+		}
+		// 不足一个完整块, 或完整块之后没有数据时为最后一块
+		final := n < len(chunk)
+		if !final {
+			if _, peekErr := r.src.Peek(1); peekErr == io.EOF {
+				final = true
+			}
+		}
+		nonce, ad := chunkNonce(r.base, r.index, final)
+		r.plain, err = r.aead.Open(nil, nonce, chunk[:n], ad)
+		if err != nil {
+			return 0, ErrBadEncryptedFile
+		}
+		r.index++
+		r.done = final
+	}
+	n := copy(p, r.plain)
+	r.plain = r.plain[n:]
+	return n, nil
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// 将数据流转换为明文: encrypted为true时返回解密后的内容, 否则原样返回
+func NewPlainReader(src io.ReadCloser, masterKey []byte, encrypted bool) (io.ReadCloser, error) {
+	if !encrypted {
+		return src, nil
+	}
+	reader := bufio.NewReaderSize(src, encryptChunkSize)
+	header := make([]byte, encryptHeaderSize)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		src.Close()
+		return nil, ErrBadEncryptedFile
+	}
+	aead, base, err := openEncryptHeader(header, masterKey)
+	if err != nil {
+		src.Close()
+		return nil, err
+	}
+	return readCloser{Reader: &decryptReader{src: reader, aead: aead, base: base}, Closer: src}, nil
+}
+
+// PlainFile 以明文方式读取的本地文件, 加密的文件支持随机读取解密后的内容
+type PlainFile struct {
+	*os.File
+	size int64 // 明文大小
+
+	aead  cipher.AEAD // 以下字段仅在文件加密时有效
+	base  []byte
+	pos   int64
+	index int64 // 缓存的数据块序号
+	plain []byte
+}
+
+// 打开本地文件, encrypted为true时按加密文件解密读取, file的所有权转移给PlainFile
+func OpenPlainFile(file *os.File, masterKey []byte, encrypted bool) (*PlainFile, error) {
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	res := &PlainFile{File: file, size: info.Size(), index: -1}
+	if info.IsDir() || !encrypted {
+		return res, nil
+	}
+	header := make([]byte, encryptHeaderSize)
+	n, _ := file.ReadAt(header, 0)
+	if res.aead, res.base, err = openEncryptHeader(header[:n], masterKey); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if res.size, err = EncryptedPlainSize(info.Size()); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return res, nil
+}
+
+// 文件是否加密
+func (f *PlainFile) Encrypted() bool {
+	return f.aead != nil
+}
+
+// 明文大小
+func (f *PlainFile) Size() int64 {
+	return f.size
+}
+
+func (f *PlainFile) Read(p []byte) (int, error) {
+	if !f.Encrypted() {
+		return f.File.Read(p)
+	}
+	if f.pos >= f.size {
+		return 0, io.EOF
+	}
+	index := f.pos / encryptChunkSize
+	if index != f.index {
+		if err := f.loadChunk(index); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, f.plain[f.pos-index*encryptChunkSize:])
+	f.pos += int64(n)
+	return n, nil
+}
+
+func (f *PlainFile) Seek(offset int64, whence int) (int64, error) {
+	if !f.Encrypted() {
+		return f.File.Seek(offset, whence)
+	}
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		offset += f.size
+	default:
+		return 0, os.ErrInvalid
+	}
+	if offset < 0 {
+		return 0, os.ErrInvalid
+	}
+	f.pos = offset
+	return offset, nil
+}
+
+// 读取并解密第index块
+func (f *PlainFile) loadChunk(index int64) error {
+	lastIndex := f.size / encryptChunkSize
+	chunkLen := int64(encryptChunkSize)
+	if index == lastIndex {
+		chunkLen = f.size - lastIndex*encryptChunkSize
+	}
+	chunk := make([]byte, chunkLen+encryptTagSize)
+	offset := encryptHeaderSize + index*(encryptChunkSize+encryptTagSize)
+	if _, err := f.File.ReadAt(chunk, offset); err != nil {
+		return err
+	}
+	nonce, ad := chunkNonce(f.base, uint64(index), index == lastIndex)
+	plain, err := f.aead.Open(nil, nonce, chunk, ad)
+	if err != nil {
+		return ErrBadEncryptedFile
+	}
+	f.index, f.plain = index, plain
+	return nil
+}
@@ -0,0 +1,78 @@
+package toolbox
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPlainFileEncryptedFlag(t *testing.T) {
+	key := make([]byte, encryptKeySize)
+	rand.Read(key)
+	dir := t.TempDir()
+	plain := bytes.Repeat([]byte("0123456789"), encryptChunkSize/5)
+
+	var cipherData bytes.Buffer
+	writer, err := NewEncryptWriter(&cipherData, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer.Write(plain)
+	if err = writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// 以加密文件头开始的明文文件
+	fake := append(append([]byte(nil), encryptMagic...), "not encrypted"...)
+
+	cases := []struct {
+		name      string
+		data      []byte
+		encrypted bool
+		want      []byte
+	}{
+		{"cipher", cipherData.Bytes(), true, plain},
+		{"fake", fake, false, fake},
+	}
+	for _, c := range cases {
+		filePath := filepath.Join(dir, c.name)
+		if err = ioutil.WriteFile(filePath, c.data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		file, err := os.Open(filePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		plainFile, err := OpenPlainFile(file, key, c.encrypted)
+		if err != nil {
+			t.Fatalf("OpenPlainFile(%s) failed: %v", c.name, err)
+		}
+		got, _ := ioutil.ReadAll(plainFile)
+		plainFile.Close()
+		if !bytes.Equal(got, c.want) || plainFile.Size() != int64(len(c.want)) {
+			t.Errorf("OpenPlainFile(%s) = %d bytes, size %d; want %d", c.name, len(got), plainFile.Size(), len(c.want))
+		}
+
+		reader, err := NewPlainReader(ioutil.NopCloser(bytes.NewReader(c.data)), key, c.encrypted)
+		if err != nil {
+			t.Fatalf("NewPlainReader(%s) failed: %v", c.name, err)
+		}
+		if got, _ = ioutil.ReadAll(reader); !bytes.Equal(got, c.want) {
+			t.Errorf("NewPlainReader(%s) = %d bytes; want %d", c.name, len(got), len(c.want))
+		}
+	}
+
+	// 明文文件被当作加密文件打开时报错, 而不是返回错误的内容
+	file, err := os.Open(filepath.Join(dir, "fake"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = OpenPlainFile(file, key, true); err != ErrBadEncryptedFile {
+		t.Errorf("OpenPlainFile(fake, encrypted) error = %v; want %v", err, ErrBadEncryptedFile)
+	}
+	if _, err = NewPlainReader(ioutil.NopCloser(bytes.NewReader(fake)), key, true); err != ErrBadEncryptedFile {
+		t.Errorf("NewPlainReader(fake, encrypted) error = %v; want %v", err, ErrBadEncryptedFile)
+	}
+}
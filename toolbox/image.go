@@ -0,0 +1,137 @@
+package toolbox
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+	"io/ioutil"
+)
+
+// 将图片等比缩小到不超过maxSize*maxSize的范围内, 透明部分以白色填充
+// 使用区域平均的方式采样, 图片本身足够小时只做背景填充
+func ResizeImage(src image.Image, maxSize int) image.Image {
+	bounds := src.Bounds()
+	srcW, srcH := bounds.Dx(), bounds.Dy()
+	dstW, dstH := srcW, srcH
+	if srcW > maxSize || srcH > maxSize {
+		if srcW >= srcH {
+			dstW, dstH = maxSize, srcH*maxSize/srcW
+		} else {
+			dstW, dstH = srcW*maxSize/srcH, maxSize
+		}
+	}
+	if dstW < 1 {
+		dstW = 1
+	}
+	if dstH < 1 {
+		dstH = 1
+	}
+
+	// 先绘制到白色背景上, 统一为RGBA格式
+	canvas := image.NewRGBA(image.Rect(0, 0, srcW, srcH))
+	draw.Draw(canvas, canvas.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.Draw(canvas, canvas.Bounds(), src, bounds.Min, draw.Over)
+	if dstW == srcW && dstH == srcH {
+		return canvas
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dstW, dstH))
+	for y := 0; y < dstH; y++ {
+		y0, y1 := y*srcH/dstH, (y+1)*srcH/dstH
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < dstW; x++ {
+			x0, x1 := x*srcW/dstW, (x+1)*srcW/dstW
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+			var r, g, b, a, n uint32
+			for sy := y0; sy < y1; sy++ {
+				offset := canvas.PixOffset(x0, sy)
+				for sx := x0; sx < x1; sx++ {
+					r += uint32(canvas.Pix[offset])
+					g += uint32(canvas.Pix[offset+1])
+					b += uint32(canvas.Pix[offset+2])
+					a += uint32(canvas.Pix[offset+3])
+					offset += 4
+					n++
+				}
+			}
+			offset := dst.PixOffset(x, y)
+			dst.Pix[offset] = uint8(r / n)
+			dst.Pix[offset+1] = uint8(g / n)
+			dst.Pix[offset+2] = uint8(b / n)
+			dst.Pix[offset+3] = uint8(a / n)
+		}
+	}
+	return dst
+}
+
+// 复制一张jpeg图片并去除其中的EXIF、XMP、IPTC等元数据段(APP1、APP13)
+func StripJpegExif(src io.Reader, dst io.Writer) error {
+	reader := bufio.NewReader(src)
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return err
+	}
+	if header[0] != 0xFF || header[1] != 0xD8 {
+		return errors.New("not a jpeg file")
+	}
+	if _, err := dst.Write(header); err != nil {
+		return err
+	}
+	for {
+		marker := make([]byte, 2)
+		if _, err := io.ReadFull(reader, marker); err != nil {
+			return err
+		}
+		if marker[0] != 0xFF {
+			return errors.New("unexpect jpeg marker")
+		}
+		// 没有长度字段的标记
+		if marker[1] == 0xD8 || marker[1] == 0x01 || (marker[1] >= 0xD0 && marker[1] <= 0xD7) {
+			if _, err := dst.Write(marker); err != nil {
+				return err
+			}
+			continue
+		}
+		if marker[1] == 0xD9 { // EOI
+			_, err := dst.Write(marker)
+			return err
+		}
+		lengthBytes := make([]byte, 2)
+		if _, err := io.ReadFull(reader, lengthBytes); err != nil {
+			return err
+		}
+		length := int64(binary.BigEndian.Uint16(lengthBytes)) - 2
+		if length < 0 {
+			return errors.New("unexpect jpeg segment length")
+		}
+		// 丢弃APP1(EXIF/XMP)和APP13(IPTC)
+		if marker[1] == 0xE1 || marker[1] == 0xED {
+			if _, err := io.CopyN(ioutil.Discard, reader, length); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, err := dst.Write(marker); err != nil {
+			return err
+		}
+		if _, err := dst.Write(lengthBytes); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(dst, reader, length); err != nil {
+			return err
+		}
+		// SOS之后为图像数据, 原样复制剩余内容
+		if marker[1] == 0xDA {
+			_, err := io.Copy(dst, reader)
+			return err
+		}
+	}
+}
@@ -1,58 +1,499 @@
 package toolbox
 
+// 邮件发送服务: 邮件先保存到MailStore再由多个worker异步发送, 失败时按指数退避重试
+// 每个worker复用一个SMTP连接, 空闲一段时间后关闭; 保存的邮件同时作为发送记录在后台查看
 import (
+	"errors"
 	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
-	"../config"
 	"github.com/astaxie/beego/logs"
 	"gopkg.in/gomail.v2"
 )
 
-// 相关配置
-var (
-	agentHost string
-	agentPort int
-	agentUser string
-	agentPass string
+// 邮件的状态
+const (
+	MailStatusPending = "pending" // 等待发送或等待重试
+	MailStatusSent    = "sent"    // 已发送
+	MailStatusFailed  = "failed"  // 重试后仍然失败
 )
 
-func initMailSender() {
-	agentHost = config.MailConfig.MailHost
-	agentPort = config.MailConfig.MailPort
-	agentUser = config.MailConfig.MailUser
-	agentPass = config.MailConfig.MailPass
+const (
+	mailQueueSize    = 256
+	mailPollInterval = 5 * time.Second // 检查到期需要重试的邮件的间隔
+	mailPollLimit    = 100             // 每次最多取出的到期邮件数
+	mailMaxAttach    = 10 << 20        // 单封邮件附件的总大小上限, 保存在mongo中, 不能超过文档大小的限制
+)
+
+var errMailerClosed = errors.New("mailer closed")
+
+// Mail 一封邮件, 同时作为发送记录保存
+type Mail struct {
+	ID          string           `json:"id" bson:"_id"`
+	Template    string           `json:"template" bson:"template"` // 渲染内容使用的模板, 直接指定内容时为空
+	FromName    string           `json:"fromName" bson:"fromName"` // 发件人的显示名称, 为空时使用配置的名称
+	To          []string         `json:"to" bson:"to"`
+	ReplyTo     string           `json:"replyTo" bson:"replyTo"`
+	Subject     string           `json:"subject" bson:"subject"`
+	HTML        string           `json:"html,omitempty" bson:"html"`
+	Text        string           `json:"text,omitempty" bson:"text"` // 纯文本内容, 与HTML同时存在时作为备选内容
+	Attachments []MailAttachment `json:"attachments" bson:"attachments"`
+	Status      string           `json:"status" bson:"status"` // 见MailStatus*
+	Attempts    int              `json:"attempts" bson:"attempts"`
+	LastError   string           `json:"lastError" bson:"lastError"`
+	CreateTime  int64            `json:"createTime" bson:"createTime"`
+	NextTime    int64            `json:"nextTime" bson:"nextTime"` // 下一次尝试发送的时间
+	SendTime    int64            `json:"sendTime" bson:"sendTime"`
+}
+
+// MailAttachment 邮件的附件, 发送成功后清空数据只保留文件名和大小
+type MailAttachment struct {
+	Name string `json:"name" bson:"name"`
+	Mime string `json:"mime" bson:"mime"`
+	Size int    `json:"size" bson:"size"`
+	Data []byte `json:"-" bson:"data"`
+}
+
+// MailStore 保存待发送的邮件和发送记录
+type MailStore interface {
+	// 新增或更新一封邮件
+	SaveMail(mail *Mail) error
+	// 按id查询, 不存在时返回错误
+	GetMail(id string) (*Mail, error)
+	// 按下一次尝试的时间顺序查询到期(NextTime不晚于now)且等待发送的邮件
+	PendingMails(now int64, limit int) ([]*Mail, error)
+	// 按创建时间倒序查询发送记录, status为空时查询所有状态, 同时返回总数
+	ListMails(status string, limit int) ([]*Mail, int, error)
+}
+
+// MailerOptions 邮件发送服务的配置
+type MailerOptions struct {
+	Host        string
+	Port        int
+	User        string // 登录用户, 同时作为发件地址
+	Pass        string
+	FromName    string        // 发件人的显示名称
+	Workers     int           // 同时发送的连接数
+	Retry       int           // 失败后最多重试的次数
+	RetryDelay  time.Duration // 第一次重试的等待时间, 之后每次翻倍
+	IdleTimeout time.Duration // 连接空闲超过这个时间后关闭
+	TemplateDir string        // 自定义模板的目录, 见LoadMailTemplates
+	ReplyAddr   string        // 接收回复的地址, 事件邮件的回复地址为它的子地址, 见replyAddress
+}
+
+// Mailer 邮件发送服务
+type Mailer struct {
+	opts      MailerOptions
+	store     MailStore
+	templates map[string]*mailTemplate
+	dial      func() (gomail.SendCloser, error)
+	queue     chan *Mail
+	done      chan struct{}
+	wg        sync.WaitGroup
+
+	mux      sync.Mutex
+	inflight map[string]bool // 已放入队列还未处理完的邮件, 避免重复发送
+	closed   bool
+}
+
+// 默认的邮件发送服务, 由InitMailer设置
+var defaultMailer *Mailer
+
+// 创建邮件发送服务并启动worker, 启动时会继续发送store中未完成的邮件
+func NewMailer(opts MailerOptions, store MailStore) (*Mailer, error) {
+	if store == nil {
+		return nil, errors.New("mail store is nil")
+	}
+	if opts.Workers <= 0 {
+		opts.Workers = 1
+	}
+	templates, err := LoadMailTemplates(opts.TemplateDir)
+	if err != nil {
+		return nil, err
+	}
+	dialer := gomail.NewDialer(opts.Host, opts.Port, opts.User, opts.Pass)
+	m := &Mailer{
+		opts:      opts,
+		store:     store,
+		templates: templates,
+		dial:      dialer.Dial,
+		queue:     make(chan *Mail, mailQueueSize),
+		done:      make(chan struct{}),
+		inflight:  make(map[string]bool),
+	}
+	for i := 0; i < opts.Workers; i++ {
+		m.wg.Add(1)
+		go m.worker()
+	}
+	m.wg.Add(1)
+	go m.poll()
+	return m, nil
+}
+
+// 创建默认的邮件发送服务, 参数同NewMailer
+func InitMailer(opts MailerOptions, store MailStore) (*Mailer, error) {
+	m, err := NewMailer(opts, store)
+	if err != nil {
+		return nil, err
+	}
+	defaultMailer = m
 	logs.Info("mail init success...")
+	return m, nil
 }
 
-// 发送邮箱接口
-func sendMail(mailTo []string, subject string, body string) error {
-	d := gomail.NewDialer(
-		agentHost,
-		agentPort,
-		agentUser,
-		agentPass,
-	)
-	m := gomail.NewMessage()
-	m.SetHeader("From", m.FormatAddress(agentUser, "CallDriver")) //添加别名
-	m.SetHeader("To", mailTo...)
-	m.SetHeader("Subject", subject)
-	m.SetBody("text/html", body)
-	err := d.DialAndSend(m)
+// 将邮件保存后放入发送队列, 返回时邮件还未发送
+func (m *Mailer) Send(mail *Mail) error {
+	if len(mail.To) == 0 || mail.Subject == "" || (mail.HTML == "" && mail.Text == "") {
+		return fmt.Errorf("unexpect mail: to=%v subject=%q", mail.To, mail.Subject)
+	}
+	m.mux.Lock()
+	closed := m.closed
+	m.mux.Unlock()
+	if closed {
+		return errMailerClosed
+	}
+	size := 0
+	for _, a := range mail.Attachments {
+		size += len(a.Data)
+	}
+	if size > mailMaxAttach {
+		return fmt.Errorf("attachments too large: size=%d max=%d", size, mailMaxAttach)
+	}
+	now := time.Now().Unix()
+	mail.ID = fmt.Sprintf("%d%s", now, GetRandomString(6))
+	mail.Status = MailStatusPending
+	mail.Attempts = 0
+	mail.LastError = ""
+	mail.CreateTime = now
+	mail.NextTime = now
+	for i := range mail.Attachments {
+		mail.Attachments[i].Size = len(mail.Attachments[i].Data)
+	}
+	if err := m.store.SaveMail(mail); err != nil {
+		return err
+	}
+	m.enqueue(mail)
+	return nil
+}
+
+// 使用模板渲染标题和内容后发送, data为模板的数据
+func (m *Mailer) SendTemplate(name string, to []string, replyTo string, data interface{}, attachments ...MailAttachment) (*Mail, error) {
+	t, ok := m.templates[name]
+	if !ok {
+		return nil, fmt.Errorf("mail template not found: name=%s", name)
+	}
+	mail := &Mail{Template: name, To: to, ReplyTo: replyTo, Attachments: attachments}
+	var err error
+	if mail.Subject, mail.HTML, mail.Text, err = t.render(data); err != nil {
+		return nil, err
+	}
+	return mail, m.Send(mail)
+}
+
+// 重新发送一封已失败的邮件, 重试次数重新计算
+func (m *Mailer) Resend(id string) error {
+	mail, err := m.store.GetMail(id)
 	if err != nil {
-		logs.Debug("send mail fial: %+v", d)
+		return err
+	}
+	if mail.Status != MailStatusFailed {
+		return fmt.Errorf("only failed mail can be resent: id=%s status=%s", id, mail.Status)
+	}
+	mail.Status = MailStatusPending
+	mail.Attempts = 0
+	mail.NextTime = time.Now().Unix()
+	if err = m.store.SaveMail(mail); err != nil {
+		return err
+	}
+	m.enqueue(mail)
+	return nil
+}
+
+// 查看发送记录
+func (m *Mailer) List(status string, limit int) ([]*Mail, int, error) {
+	return m.store.ListMails(status, limit)
+}
+
+// 停止发送, 等待正在发送的邮件完成; 队列中的邮件保持等待发送的状态, 下次启动时继续发送
+func (m *Mailer) Close() {
+	m.mux.Lock()
+	if m.closed {
+		m.mux.Unlock()
+		return
 	}
-	return err
+	m.closed = true
+	close(m.done)
+	m.mux.Unlock()
+	m.wg.Wait()
 }
 
-// 发送一条消息到自己的邮箱
-func SendToMySelf(name, body string) error {
-	mailTo := []string{config.MailConfig.MailTo}
-	subject := fmt.Sprintf("来自 %s 的消息", name)
-	err := sendMail(mailTo, subject, body)
+// 放入发送队列, 队列已满时留在store中等待poll取出
+func (m *Mailer) enqueue(mail *Mail) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if m.closed || m.inflight[mail.ID] {
+		return
+	}
+	select {
+	case m.queue <- mail:
+		m.inflight[mail.ID] = true
+	default:
+		logs.Warn("mail queue is full, wait for next poll: id=%s", mail.ID)
+	}
+}
+
+// 定期将到期的邮件放入队列, 包括等待重试的邮件和队列满时未能放入的邮件
+func (m *Mailer) poll() {
+	defer m.wg.Done()
+	ticker := time.NewTicker(mailPollInterval)
+	defer ticker.Stop()
+	for {
+		mails, err := m.store.PendingMails(time.Now().Unix(), mailPollLimit)
+		if err != nil {
+			logs.Error("find pending mails failed: error=%v", err)
+		}
+		for _, mail := range mails {
+			m.enqueue(mail)
+		}
+		select {
+		case <-ticker.C:
+		case <-m.done:
+			return
+		}
+	}
+}
+
+// 从队列中取出邮件发送, 连接在空闲超时或出错后关闭, 下次发送时重新建立
+func (m *Mailer) worker() {
+	defer m.wg.Done()
+	var conn gomail.SendCloser
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+	for {
+		var idle <-chan time.Time
+		if conn != nil && m.opts.IdleTimeout > 0 {
+			idle = time.After(m.opts.IdleTimeout)
+		}
+		select {
+		case mail := <-m.queue:
+			if mail = m.reload(mail); mail == nil {
+				continue
+			}
+			var err error
+			conn, err = m.send(conn, mail)
+			m.finish(mail, err)
+		case <-idle:
+			conn.Close()
+			conn = nil
+		case <-m.done:
+			return
+		}
+	}
+}
+
+// 发送前重新读取邮件, poll可能在邮件刚发送完时取出了旧的记录, 已不需要发送时返回nil
+func (m *Mailer) reload(mail *Mail) *Mail {
+	latest, err := m.store.GetMail(mail.ID)
+	if err != nil {
+		logs.Warn("reload mail failed: id=%s error=%v", mail.ID, err)
+		return mail
+	}
+	if latest.Status == MailStatusPending && latest.NextTime <= time.Now().Unix() {
+		return latest
+	}
+	m.mux.Lock()
+	delete(m.inflight, mail.ID)
+	m.mux.Unlock()
+	return nil
+}
+
+// 发送一封邮件, 返回之后可以继续使用的连接
+// 复用的连接可能已被服务器关闭, 失败时重新建立连接再试一次
+func (m *Mailer) send(conn gomail.SendCloser, mail *Mail) (gomail.SendCloser, error) {
+	msg := m.message(mail)
+	for reused := conn != nil; ; reused = false {
+		var err error
+		if conn == nil {
+			if conn, err = m.dial(); err != nil {
+				return nil, fmt.Errorf("dial smtp server failed: %v", err)
+			}
+		}
+		if err = gomail.Send(conn, msg); err == nil {
+			return conn, nil
+		}
+		conn.Close()
+		conn = nil
+		if !reused {
+			return nil, err
+		}
+		logs.Debug("send mail with reused connection failed, redial: id=%s error=%v", mail.ID, err)
+	}
+}
+
+func (m *Mailer) message(mail *Mail) *gomail.Message {
+	msg := gomail.NewMessage()
+	fromName := mail.FromName
+	if fromName == "" {
+		fromName = m.opts.FromName
+	}
+	msg.SetHeader("From", msg.FormatAddress(m.opts.User, fromName))
+	msg.SetHeader("To", mail.To...)
+	msg.SetHeader("Subject", mail.Subject)
+	if mail.ReplyTo != "" {
+		msg.SetHeader("Reply-To", mail.ReplyTo)
+	}
+	switch {
+	case mail.Text != "" && mail.HTML != "":
+		msg.SetBody("text/plain", mail.Text)
+		msg.AddAlternative("text/html", mail.HTML)
+	case mail.HTML != "":
+		msg.SetBody("text/html", mail.HTML)
+	default:
+		msg.SetBody("text/plain", mail.Text)
+	}
+	for _, a := range mail.Attachments {
+		data := a.Data
+		settings := []gomail.FileSetting{gomail.SetCopyFunc(func(w io.Writer) error {
+			_, err := w.Write(data)
+			return err
+		})}
+		if a.Mime != "" {
+			settings = append(settings, gomail.SetHeader(map[string][]string{"Content-Type": {a.Mime}}))
+		}
+		msg.Attach(a.Name, settings...)
+	}
+	return msg
+}
+
+// 记录发送结果, 失败且未超过重试次数时设置下一次尝试的时间
+func (m *Mailer) finish(mail *Mail, err error) {
+	now := time.Now()
+	mail.Attempts++
+	if err == nil {
+		mail.Status = MailStatusSent
+		mail.SendTime = now.Unix()
+		mail.LastError = ""
+		for i := range mail.Attachments {
+			mail.Attachments[i].Data = nil
+		}
+		logs.Info("send mail success: id=%s to=%v subject=%q attempts=%d", mail.ID, mail.To, mail.Subject, mail.Attempts)
+	} else if mail.Attempts > m.opts.Retry {
+		mail.Status = MailStatusFailed
+		mail.LastError = err.Error()
+		logs.Error("send mail failed: id=%s to=%v attempts=%d error=%v", mail.ID, mail.To, mail.Attempts, err)
+	} else {
+		delay := m.opts.RetryDelay << uint(mail.Attempts-1)
+		mail.NextTime = now.Add(delay).Unix()
+		mail.LastError = err.Error()
+		logs.Warn("send mail failed, retry after %v: id=%s attempt=%d error=%v", delay, mail.ID, mail.Attempts, err)
+	}
+	if err = m.store.SaveMail(mail); err != nil {
+		logs.Error("save mail failed: id=%s error=%v", mail.ID, err)
+	}
+	m.mux.Lock()
+	delete(m.inflight, mail.ID)
+	m.mux.Unlock()
+}
+
+// 可以作为邮箱子地址的回复token
+var addressTokenRegexp = regexp.MustCompile(`^[a-z0-9.]+$`)
+
+// 回复地址, 形如 user+token@domain, 未配置回复地址或token不能作为子地址时返回空字符串
+func (m *Mailer) replyAddress(token string) string {
+	addr := m.opts.ReplyAddr
+	idx := strings.LastIndex(addr, "@")
+	if idx <= 0 || !addressTokenRegexp.MatchString(token) {
+		return ""
+	}
+	return addr[:idx] + "+" + token + addr[idx:]
+}
+
+// 将Boss的回复发送到访客留下的邮箱, link为访客查看会话的地址
+func SendReplyToVisitor(email, nick, body, link string) error {
+	if defaultMailer == nil {
+		return errors.New("mailer not init")
+	}
+	data := map[string]interface{}{"Nick": nick, "Message": body, "Link": link}
+	mail, err := defaultMailer.SendTemplate("reply", []string{email}, "", data)
 	if err != nil {
-		logs.Error("Send email fail: %v", err)
+		logs.Error("Send reply email fail: email=%s error=%v", email, err)
 		return err
 	}
-	logs.Info("send success")
+	logs.Info("reply mail queued: id=%s email=%s", mail.ID, email)
 	return nil
 }
+
+// MemoryMailStore 保存在内存中的MailStore, 重启后丢失, 用于测试环境
+type MemoryMailStore struct {
+	mux   sync.Mutex
+	mails map[string]Mail
+}
+
+func NewMemoryMailStore() *MemoryMailStore {
+	return &MemoryMailStore{mails: make(map[string]Mail)}
+}
+
+func (s *MemoryMailStore) SaveMail(mail *Mail) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.mails[mail.ID] = *mail
+	return nil
+}
+
+func (s *MemoryMailStore) GetMail(id string) (*Mail, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	mail, ok := s.mails[id]
+	if !ok {
+		return nil, fmt.Errorf("mail not found: id=%s", id)
+	}
+	return &mail, nil
+}
+
+func (s *MemoryMailStore) PendingMails(now int64, limit int) ([]*Mail, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	mails := make([]*Mail, 0)
+	for _, mail := range s.mails {
+		if mail.Status == MailStatusPending && mail.NextTime <= now {
+			mail := mail
+			mails = append(mails, &mail)
+		}
+	}
+	sort.Slice(mails, func(i, j int) bool { return mails[i].NextTime < mails[j].NextTime })
+	if len(mails) > limit {
+		mails = mails[:limit]
+	}
+	return mails, nil
+}
+
+func (s *MemoryMailStore) ListMails(status string, limit int) ([]*Mail, int, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	mails := make([]*Mail, 0)
+	for _, mail := range s.mails {
+		if status == "" || mail.Status == status {
+			mail := mail
+			mails = append(mails, &mail)
+		}
+	}
+	sort.Slice(mails, func(i, j int) bool {
+		if mails[i].CreateTime != mails[j].CreateTime {
+			return mails[i].CreateTime > mails[j].CreateTime
+		}
+		return mails[i].ID > mails[j].ID
+	})
+	total := len(mails)
+	if len(mails) > limit {
+		mails = mails[:limit]
+	}
+	return mails, total, nil
+}
@@ -0,0 +1,193 @@
+package toolbox
+
+// 解析收到的回复邮件: 取出纯文本正文并去掉引用的原文和签名
+// 正文和标题按声明的字符集(如gbk、big5、iso-8859-1)转换为utf-8, 无法识别的字符集返回ErrMailCharset
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/html/charset"
+)
+
+var (
+	ErrMailNoText  = errors.New("mail has no text content")
+	ErrMailCharset = errors.New("unsupported mail charset")
+)
+
+// ReplyMail 解析后的回复邮件
+type ReplyMail struct {
+	From    string // 发件人地址
+	Subject string
+	Text    string // 去掉引用和签名后的正文
+}
+
+// 解析回复邮件
+func ParseReplyMail(data []byte) (*ReplyMail, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	res := &ReplyMail{Subject: msg.Header.Get("Subject")}
+	// 标题中的编码字可能使用gbk等字符集, 与正文使用同样的转换
+	decoder := &mime.WordDecoder{CharsetReader: charset.NewReaderLabel}
+	if subject, err := decoder.DecodeHeader(res.Subject); err == nil {
+		res.Subject = subject
+	}
+	if from, err := mail.ParseAddress(msg.Header.Get("From")); err == nil {
+		res.From = from.Address
+	}
+	text, err := readMailText(msg.Header.Get("Content-Type"), msg.Header.Get("Content-Transfer-Encoding"), msg.Body)
+	if err != nil {
+		return nil, err
+	}
+	res.Text = StripMailQuote(text)
+	return res, nil
+}
+
+// 读取邮件正文, 多段邮件优先使用text/plain部分, 没有时使用去掉标签的text/html部分
+func readMailText(contentType, encoding string, body io.Reader) (string, error) {
+	if contentType == "" {
+		contentType = "text/plain; charset=us-ascii"
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", fmt.Errorf("bad content type: %q", contentType)
+	}
+	if strings.HasPrefix(mediaType, "multipart/") {
+		reader := multipart.NewReader(body, params["boundary"])
+		htmlText := ""
+		for {
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return "", err
+			}
+			text, err := readMailText(part.Header.Get("Content-Type"), part.Header.Get("Content-Transfer-Encoding"), part)
+			if err == ErrMailNoText {
+				continue
+			}
+			if err != nil {
+				return "", err
+			}
+			partType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+			if partType == "text/html" {
+				if htmlText == "" {
+					htmlText = text
+				}
+				continue
+			}
+			return text, nil
+		}
+		if htmlText != "" {
+			return htmlText, nil
+		}
+		return "", ErrMailNoText
+	}
+	if mediaType != "text/plain" && mediaType != "text/html" {
+		return "", ErrMailNoText
+	}
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, &mailBase64Reader{r: body})
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(body, 1<<20))
+	if err != nil {
+		return "", err
+	}
+	label := strings.ToLower(strings.TrimSpace(params["charset"]))
+	if label != "" && label != "utf-8" && label != "us-ascii" {
+		reader, err := charset.NewReaderLabel(label, bytes.NewReader(data))
+		if err != nil {
+			return "", ErrMailCharset
+		}
+		if data, err = ioutil.ReadAll(reader); err != nil {
+			return "", err
+		}
+	}
+	if !utf8.Valid(data) {
+		return "", ErrMailCharset
+	}
+	text := strings.Replace(string(data), "\r\n", "\n", -1)
+	if mediaType == "text/html" {
+		text = htmlToText(text)
+	}
+	return text, nil
+}
+
+// 去掉base64内容中的换行
+type mailBase64Reader struct {
+	r io.Reader
+}
+
+func (m *mailBase64Reader) Read(p []byte) (int, error) {
+	n, err := m.r.Read(p)
+	j := 0
+	for _, b := range p[:n] {
+		if b != '\r' && b != '\n' && b != ' ' && b != '\t' {
+			p[j] = b
+			j++
+		}
+	}
+	return j, err
+}
+
+var (
+	htmlBreakRegexp = regexp.MustCompile(`(?i)<br\s*/?>|</p>|</div>|</blockquote>`)
+	htmlQuoteRegexp = regexp.MustCompile(`(?is)<blockquote.*?</blockquote>`)
+	htmlTagRegexp   = regexp.MustCompile(`(?s)<[^>]*>`)
+	htmlDropRegexp  = regexp.MustCompile(`(?is)<(style|script|head)[^>]*>.*?</(style|script|head)>`)
+)
+
+// 将html正文转为纯文本, 引用块直接去掉
+func htmlToText(s string) string {
+	s = htmlDropRegexp.ReplaceAllString(s, "")
+	s = htmlQuoteRegexp.ReplaceAllString(s, "")
+	s = htmlBreakRegexp.ReplaceAllString(s, "\n")
+	s = htmlTagRegexp.ReplaceAllString(s, "")
+	return html.UnescapeString(s)
+}
+
+// 引用原文的开始, 之后的内容都会被去掉
+var mailQuoteStartRegexps = []*regexp.Regexp{
+	regexp.MustCompile(`^>`),
+	regexp.MustCompile(`^On\s.+wrote:$`),
+	regexp.MustCompile(`^在.+写道[:：]$`),
+	regexp.MustCompile(`(?i)^-{2,}\s*(Original Message|原始邮件)\s*-{2,}$`),
+	regexp.MustCompile(`^_{10,}$`),
+	regexp.MustCompile(`^(From|发件人)\s*[:：]`),
+	regexp.MustCompile(`^--$`), // 签名分隔行"-- "
+}
+
+// 去掉回复邮件中引用的原文和签名, 只保留回复的内容
+func StripMailQuote(text string) string {
+	lines := strings.Split(strings.Replace(text, "\r\n", "\n", -1), "\n")
+	for i, line := range lines {
+		line = strings.TrimSpace(line)
+		if i > 0 && strings.HasSuffix(line, "wrote:") && strings.HasPrefix(strings.TrimSpace(lines[i-1]), "On ") {
+			// "On ... wrote:" 被客户端折成了两行
+			return strings.TrimSpace(strings.Join(lines[:i-1], "\n"))
+		}
+		for _, re := range mailQuoteStartRegexps {
+			if re.MatchString(line) {
+				return strings.TrimSpace(strings.Join(lines[:i], "\n"))
+			}
+		}
+	}
+	return strings.TrimSpace(text)
+}
@@ -0,0 +1,92 @@
+package toolbox
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseReplyMailCharset(t *testing.T) {
+	cases := []struct {
+		name    string
+		mail    string
+		subject string
+		text    string
+	}{
+		{
+			name: "gbk base64",
+			mail: "From: =?gb2312?B?1cXI/Q==?= <zhang@example.com>\r\n" +
+				"Subject: =?gb2312?B?u9i4tDogzsrM4g==?=\r\n" +
+				"Content-Type: text/plain; charset=GBK\r\n" +
+				"Content-Transfer-Encoding: base64\r\n\r\n" +
+				"ytW1vaOs0LvQuw0KDQrU2iAyMDI0xOox1MIxyNWjrNXFyP0g0LS1wKO6DQo+INStzsQNCg==\r\n",
+			subject: "回复: 问题",
+			text:    "收到，谢谢",
+		},
+		{
+			name: "big5 in multipart",
+			mail: "From: a@example.com\r\n" +
+				"Subject: Re: hello\r\n" +
+				"Content-Type: multipart/alternative; boundary=b1\r\n\r\n" +
+				"--b1\r\nContent-Type: text/html; charset=big5\r\nContent-Transfer-Encoding: base64\r\n\r\np9qmYrNvuMwNCg==\r\n" +
+				"--b1\r\nContent-Type: text/plain; charset=\"big5\"\r\nContent-Transfer-Encoding: base64\r\n\r\np9qmYrNvuMwNCg==\r\n" +
+				"--b1--\r\n",
+			subject: "Re: hello",
+			text:    "我在這裡",
+		},
+		{
+			name: "latin1 quoted-printable",
+			mail: "From: b@example.com\r\n" +
+				"Subject: =?iso-8859-1?Q?Gr=FC=DFe?=\r\n" +
+				"Content-Type: text/plain; charset=iso-8859-1\r\n" +
+				"Content-Transfer-Encoding: quoted-printable\r\n\r\n" +
+				"Sch=F6ne Gr=FC=DFe\r\n",
+			subject: "Grüße",
+			text:    "Schöne Grüße",
+		},
+		{
+			name:    "utf-8 without charset",
+			mail:    "From: c@example.com\r\nSubject: hi\r\n\r\n你好\r\n",
+			subject: "hi",
+			text:    "你好",
+		},
+	}
+	for _, c := range cases {
+		reply, err := ParseReplyMail([]byte(c.mail))
+		if err != nil {
+			t.Errorf("ParseReplyMail(%s) failed: %v", c.name, err)
+			continue
+		}
+		if reply.Subject != c.subject || reply.Text != c.text {
+			t.Errorf("ParseReplyMail(%s) = %q %q; want %q %q", c.name, reply.Subject, reply.Text, c.subject, c.text)
+		}
+	}
+}
+
+func TestParseReplyMailBadCharset(t *testing.T) {
+	for _, mail := range []string{
+		"From: a@example.com\r\nContent-Type: text/plain; charset=x-unknown\r\n\r\nhello\r\n",
+		"From: a@example.com\r\nContent-Type: text/plain\r\n\r\n\xc4\xe3\xba\xc3\r\n", // 未声明字符集的gbk
+	} {
+		if _, err := ParseReplyMail([]byte(mail)); err != ErrMailCharset {
+			t.Errorf("ParseReplyMail(%q) error = %v; want %v", mail, err, ErrMailCharset)
+		}
+	}
+}
+
+func TestStripMailQuote(t *testing.T) {
+	cases := []struct{ text, want string }{
+		{"ok\n\nOn Mon, Jan 1, 2024 at 10:00 AM Boss <boss@example.com> wrote:\n> hi", "ok"},
+		{"ok\nOn Mon, Jan 1, 2024 at 10:00 AM Boss\n<boss@example.com> wrote:\n> hi", "ok"},
+		{"好的\r\n-- \r\n签名", "好的"},
+		{"好的\n------------------ 原始邮件 ------------------\n发件人: boss", "好的"},
+		{"no quote", "no quote"},
+	}
+	for _, c := range cases {
+		if got := StripMailQuote(c.text); got != c.want {
+			t.Errorf("StripMailQuote(%q) = %q; want %q", c.text, got, c.want)
+		}
+	}
+	if got := htmlToText("<p>a&amp;b</p><blockquote>quoted</blockquote><br>c"); strings.TrimSpace(got) != "a&b\n\nc" {
+		t.Errorf("htmlToText = %q", got)
+	}
+}
@@ -0,0 +1,420 @@
+package toolbox
+
+// 邮件路由: 按事件类型将通知邮件发送给配置的接收人
+// 优先级为low的事件, 以及接收人免打扰时段内的非urgent事件, 先放入接收人的摘要中, 之后合并为一封邮件发送
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/astaxie/beego/logs"
+)
+
+// 事件类型
+const (
+	MailEventChat       = "callDriver.message" // callDriver的新消息
+	MailEventAlert      = "alert"              // 告警, 如上传的文件中发现病毒
+	MailEventUpload     = "upload"             // 分享文件上传
+	MailEventCodeMaster = "codeMaster.submit"  // codeMaster提交了新作品
+)
+
+// 事件的优先级, 数值越大越优先
+const (
+	mailPriorityLow    = iota // 合并到摘要中定期发送
+	mailPriorityNormal        // 立即发送, 免打扰时段内延后
+	mailPriorityUrgent        // 立即发送, 忽略免打扰时段
+)
+
+var mailPriorities = map[string]int{
+	"low":    mailPriorityLow,
+	"normal": mailPriorityNormal,
+	"":       mailPriorityNormal,
+	"urgent": mailPriorityUrgent,
+}
+
+const (
+	mailFlushInterval = time.Minute
+	mailDigestMax     = 200 // 每个接收人的摘要中最多保留的事件数, 超过时丢弃最早的事件
+)
+
+// MailEvent 一个需要通过邮件通知的事件, 同时作为event模板的数据
+type MailEvent struct {
+	Type       string    `json:"type"` // 见MailEvent*
+	Title      string    `json:"title"`
+	Message    string    `json:"message"`
+	Link       string    `json:"link"`
+	ReplyToken string    `json:"-"` // 附在标题中并作为回复地址的子地址, 用于将邮件回复关联到callDriver的会话
+	Time       time.Time `json:"time"`
+}
+
+// MailRecipientOptions 邮件接收人的配置
+type MailRecipientOptions struct {
+	Name    string // 名称, 唯一, 在路由规则中引用
+	Address string // 邮箱地址
+	Quiet   string // 免打扰时段, 如 23:00-08:00, 为空时不限制
+}
+
+// MailRouteOptions 邮件路由规则的配置
+type MailRouteOptions struct {
+	Event      string   // 事件类型, 以.*结尾时匹配前缀, *匹配所有事件
+	Recipients []string // 接收人名称, 为空时发送给所有接收人
+	Priority   string   // urgent | normal | low, 见mailPriorities
+}
+
+// MailRecipientStatus 接收人的状态
+type MailRecipientStatus struct {
+	Name       string `json:"name"`
+	Address    string `json:"address"`
+	Quiet      string `json:"quiet"`
+	InQuiet    bool   `json:"inQuiet"`    // 当前是否在免打扰时段内
+	Pending    int    `json:"pending"`    // 摘要中等待发送的事件数
+	LastDigest int64  `json:"lastDigest"` // 上一次发送摘要的时间
+}
+
+type mailRecipient struct {
+	name       string
+	address    string
+	quiet      string
+	quietFrom  int // 免打扰时段的开始和结束, 一天中的分钟数, 未配置时为-1
+	quietTo    int
+	pending    []*MailEvent
+	deferred   int // 摘要中因免打扰延后的非low事件数, 大于0时免打扰结束后立即发送摘要
+	dropped    int // 超过mailDigestMax丢弃的事件数
+	lastDigest time.Time
+}
+
+type mailRoute struct {
+	event      string
+	recipients []*mailRecipient
+	priority   int
+}
+
+// MailRouter 按路由规则发送事件通知
+type MailRouter struct {
+	mailer     *Mailer
+	recipients []*mailRecipient
+	routes     []mailRoute
+	interval   time.Duration // 发送摘要的间隔
+	now        func() time.Time
+	done       chan struct{}
+	once       sync.Once
+
+	mux sync.Mutex
+}
+
+// 默认的邮件路由, 由InitMailRouter设置
+var defaultMailRouter *MailRouter
+
+// 创建邮件路由并启动定期发送摘要的任务, 接收人名称重复、规则引用了不存在的接收人或配置格式错误时返回错误
+func NewMailRouter(mailer *Mailer, recipients []MailRecipientOptions, routes []MailRouteOptions, interval time.Duration) (*MailRouter, error) {
+	if mailer == nil {
+		return nil, errors.New("mailer is nil")
+	}
+	if interval <= 0 {
+		return nil, fmt.Errorf("unexpect digest interval: %v", interval)
+	}
+	rt := &MailRouter{
+		mailer:   mailer,
+		interval: interval,
+		now:      time.Now,
+		done:     make(chan struct{}),
+	}
+	byName := make(map[string]*mailRecipient)
+	for _, conf := range recipients {
+		if conf.Name == "" || conf.Address == "" {
+			return nil, fmt.Errorf("mail recipient requires name and address: %+v", conf)
+		}
+		if byName[conf.Name] != nil {
+			return nil, fmt.Errorf("duplicate mail recipient: name=%s", conf.Name)
+		}
+		from, to, err := parseQuietHours(conf.Quiet)
+		if err != nil {
+			return nil, fmt.Errorf("mail recipient %s: %v", conf.Name, err)
+		}
+		r := &mailRecipient{
+			name:       conf.Name,
+			address:    conf.Address,
+			quiet:      conf.Quiet,
+			quietFrom:  from,
+			quietTo:    to,
+			lastDigest: rt.now(),
+		}
+		byName[conf.Name] = r
+		rt.recipients = append(rt.recipients, r)
+	}
+	for _, conf := range routes {
+		priority, ok := mailPriorities[conf.Priority]
+		if !ok {
+			return nil, fmt.Errorf("unexpect mail route priority: event=%s priority=%s", conf.Event, conf.Priority)
+		}
+		if conf.Event == "" {
+			return nil, fmt.Errorf("mail route requires event: %+v", conf)
+		}
+		route := mailRoute{event: conf.Event, priority: priority, recipients: rt.recipients}
+		if len(conf.Recipients) > 0 {
+			route.recipients = nil
+			for _, name := range conf.Recipients {
+				r := byName[name]
+				if r == nil {
+					return nil, fmt.Errorf("mail route %s: recipient not found: %s", conf.Event, name)
+				}
+				route.recipients = append(route.recipients, r)
+			}
+		}
+		rt.routes = append(rt.routes, route)
+	}
+	go rt.loop()
+	return rt, nil
+}
+
+// 创建默认的邮件路由, 参数同NewMailRouter
+func InitMailRouter(mailer *Mailer, recipients []MailRecipientOptions, routes []MailRouteOptions, interval time.Duration) (*MailRouter, error) {
+	rt, err := NewMailRouter(mailer, recipients, routes, interval)
+	if err != nil {
+		return nil, err
+	}
+	defaultMailRouter = rt
+	logs.Info("mail router init success: recipients=%d routes=%d", len(rt.recipients), len(rt.routes))
+	return rt, nil
+}
+
+// 解析免打扰时段, 格式为 HH:MM-HH:MM, 结束时间早于开始时间时跨越零点, 为空时返回-1
+func parseQuietHours(s string) (from, to int, err error) {
+	if s == "" {
+		return -1, -1, nil
+	}
+	parts := strings.Split(s, "-")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("unexpect quiet hours: %q", s)
+	}
+	var minutes [2]int
+	for i, part := range parts {
+		t, err := time.Parse("15:04", strings.TrimSpace(part))
+		if err != nil {
+			return 0, 0, fmt.Errorf("unexpect quiet hours: %q", s)
+		}
+		minutes[i] = t.Hour()*60 + t.Minute()
+	}
+	if minutes[0] == minutes[1] {
+		return 0, 0, fmt.Errorf("unexpect quiet hours: %q", s)
+	}
+	return minutes[0], minutes[1], nil
+}
+
+// 是否在免打扰时段内
+func (r *mailRecipient) inQuiet(now time.Time) bool {
+	if r.quietFrom < 0 {
+		return false
+	}
+	m := now.Hour()*60 + now.Minute()
+	if r.quietFrom < r.quietTo {
+		return m >= r.quietFrom && m < r.quietTo
+	}
+	return m >= r.quietFrom || m < r.quietTo
+}
+
+// 事件类型是否匹配规则: * 匹配所有事件, 以.*结尾时匹配前缀
+// 返回匹配的精确程度, 完全相同时最高, 前缀越长越高, 不匹配时返回-1
+func matchMailEvent(pattern, event string) int {
+	switch {
+	case pattern == event:
+		return len(pattern) + 1
+	case pattern == "*":
+		return 0
+	case strings.HasSuffix(pattern, ".*") && strings.HasPrefix(event, pattern[:len(pattern)-1]):
+		return len(pattern) - 1
+	}
+	return -1
+}
+
+// 按路由规则发送事件, 没有匹配的规则时忽略
+// 每个接收人使用匹配最精确的规则的优先级, 精确程度相同时取最高的优先级
+func (rt *MailRouter) Dispatch(e *MailEvent) error {
+	if e.Time.IsZero() {
+		e.Time = rt.now()
+	}
+	type match struct {
+		level    int
+		priority int
+	}
+	matches := make(map[*mailRecipient]match)
+	var matched []*mailRecipient
+	for _, route := range rt.routes {
+		level := matchMailEvent(route.event, e.Type)
+		if level < 0 {
+			continue
+		}
+		for _, r := range route.recipients {
+			m, ok := matches[r]
+			if !ok {
+				matched = append(matched, r)
+			}
+			if !ok || level > m.level || (level == m.level && route.priority > m.priority) {
+				matches[r] = match{level: level, priority: route.priority}
+			}
+		}
+	}
+	if len(matched) == 0 {
+		logs.Debug("no mail route for event: type=%s title=%s", e.Type, e.Title)
+		return nil
+	}
+
+	now := rt.now()
+	var immediate []string
+	rt.mux.Lock()
+	for _, r := range matched {
+		p := matches[r].priority
+		if p == mailPriorityUrgent || (p == mailPriorityNormal && !r.inQuiet(now)) {
+			immediate = append(immediate, r.address)
+			continue
+		}
+		if p != mailPriorityLow {
+			r.deferred++
+		}
+		r.pending = append(r.pending, e)
+		if len(r.pending) > mailDigestMax {
+			r.pending = r.pending[1:]
+			r.dropped++
+		}
+	}
+	rt.mux.Unlock()
+	if len(immediate) == 0 {
+		return nil
+	}
+	return rt.sendEvent(immediate, e)
+}
+
+// 立即发送一个事件, 每个接收人单独一封邮件
+func (rt *MailRouter) sendEvent(to []string, e *MailEvent) error {
+	var lastErr error
+	for _, addr := range to {
+		mail, err := rt.mailer.SendTemplate("event", []string{addr}, rt.mailer.replyAddress(e.ReplyToken), e)
+		if err != nil {
+			logs.Error("send mail event failed: type=%s to=%s error=%v", e.Type, addr, err)
+			lastErr = err
+			continue
+		}
+		logs.Info("mail event queued: id=%s type=%s to=%s", mail.ID, e.Type, addr)
+	}
+	return lastErr
+}
+
+// 定期发送到期的摘要
+func (rt *MailRouter) loop() {
+	ticker := time.NewTicker(mailFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			rt.Flush(false)
+		case <-rt.done:
+			return
+		}
+	}
+}
+
+// 发送接收人的摘要, force为false时只发送到期的摘要:
+// 不在免打扰时段内, 且有因免打扰延后的事件或距离上次发送已超过间隔
+func (rt *MailRouter) Flush(force bool) {
+	type digest struct {
+		r       *mailRecipient
+		events  []*MailEvent
+		dropped int
+	}
+	now := rt.now()
+	var digests []digest
+	rt.mux.Lock()
+	for _, r := range rt.recipients {
+		if len(r.pending) == 0 {
+			continue
+		}
+		if !force && (r.inQuiet(now) || (r.deferred == 0 && now.Sub(r.lastDigest) < rt.interval)) {
+			continue
+		}
+		digests = append(digests, digest{r: r, events: r.pending, dropped: r.dropped})
+		r.pending = nil
+		r.deferred = 0
+		r.dropped = 0
+		r.lastDigest = now
+	}
+	rt.mux.Unlock()
+
+	for _, d := range digests {
+		// 只有一个事件时按单个事件发送, 保留回复token
+		if len(d.events) == 1 && d.dropped == 0 {
+			rt.sendEvent([]string{d.r.address}, d.events[0])
+			continue
+		}
+		data := map[string]interface{}{"Count": len(d.events) + d.dropped, "Events": d.events, "Dropped": d.dropped}
+		mail, err := rt.mailer.SendTemplate("digest", []string{d.r.address}, "", data)
+		if err != nil {
+			logs.Error("send mail digest failed: to=%s count=%d error=%v", d.r.address, len(d.events), err)
+			continue
+		}
+		logs.Info("mail digest queued: id=%s to=%s count=%d dropped=%d", mail.ID, d.r.address, len(d.events), d.dropped)
+	}
+}
+
+// 立即发送一封测试邮件, name为空时发送给所有接收人, 返回邮件id
+func (rt *MailRouter) Test(name string) ([]string, error) {
+	e := &MailEvent{Type: "test", Title: "测试邮件", Message: "这是一封测试邮件, 收到说明邮件配置正确", Time: rt.now()}
+	ids := make([]string, 0)
+	for _, r := range rt.recipients {
+		if name != "" && r.name != name {
+			continue
+		}
+		mail, err := rt.mailer.SendTemplate("event", []string{r.address}, "", e)
+		if err != nil {
+			return ids, err
+		}
+		ids = append(ids, mail.ID)
+	}
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("mail recipient not found: name=%q", name)
+	}
+	return ids, nil
+}
+
+// 查看接收人的状态
+func (rt *MailRouter) Recipients() []MailRecipientStatus {
+	now := rt.now()
+	rt.mux.Lock()
+	defer rt.mux.Unlock()
+	res := make([]MailRecipientStatus, 0, len(rt.recipients))
+	for _, r := range rt.recipients {
+		res = append(res, MailRecipientStatus{
+			Name:       r.name,
+			Address:    r.address,
+			Quiet:      r.quiet,
+			InQuiet:    r.inQuiet(now),
+			Pending:    len(r.pending),
+			LastDigest: r.lastDigest.Unix(),
+		})
+	}
+	return res
+}
+
+// 是否为配置的接收人地址
+func (rt *MailRouter) IsRecipient(address string) bool {
+	for _, r := range rt.recipients {
+		if strings.EqualFold(r.address, address) {
+			return true
+		}
+	}
+	return false
+}
+
+// 停止定期发送摘要, 未发送的摘要会丢失
+func (rt *MailRouter) Close() {
+	rt.once.Do(func() { close(rt.done) })
+}
+
+// 使用默认的邮件路由发送事件
+func SendMailEvent(e *MailEvent) error {
+	if defaultMailRouter == nil {
+		return errors.New("mail router not init")
+	}
+	return defaultMailRouter.Dispatch(e)
+}
@@ -0,0 +1,134 @@
+package toolbox
+
+// 邮件模板: 每个模板包括标题、HTML内容和纯文本内容
+// 纯文本模板中通过 {{define "subject"}} 定义标题, 为空时不发送纯文本内容
+// 配置了模板目录时, 目录下的 ${name}.html 和 ${name}.txt 会覆盖同名的内置模板, 也可以增加新的模板
+import (
+	"bytes"
+	"fmt"
+	htmltemplate "html/template"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	texttemplate "text/template"
+)
+
+type mailTemplate struct {
+	html *htmltemplate.Template
+	text *texttemplate.Template
+}
+
+// 内置模板: 模板名称 -> {html, text}
+var defaultMailTemplates = map[string][2]string{
+	// 按路由规则发送给接收人的事件通知, 数据: MailEvent
+	"event": {
+		`<p>{{range $i, $line := lines .Message}}{{if $i}}<br>{{end}}{{$line}}{{end}}</p>{{if .Link}}<p><a href="{{.Link}}">{{.Link}}</a></p>{{end}}`,
+		`{{define "subject"}}{{.Title}}{{if .ReplyToken}} [#{{.ReplyToken}}]{{end}}{{end}}{{.Message}}{{if .Link}}
+
+{{.Link}}{{end}}`,
+	},
+	// 合并多个事件的摘要, 数据: Count(事件总数), Events([]*MailEvent), Dropped(未列出的较早事件数)
+	"digest": {
+		`<p>共 {{.Count}} 条通知:</p><ul>{{range .Events}}<li><b>{{.Title}}</b> {{.Time.Format "01-02 15:04"}}<br>{{range $i, $line := lines .Message}}{{if $i}}<br>{{end}}{{$line}}{{end}}{{if .Link}}<br><a href="{{.Link}}">{{.Link}}</a>{{end}}</li>{{end}}</ul>{{if .Dropped}}<p>另有 {{.Dropped}} 条较早的通知未列出</p>{{end}}`,
+		`{{define "subject"}}{{.Count}} 条新的通知{{end}}共 {{.Count}} 条通知:{{range .Events}}
+
+[{{.Time.Format "01-02 15:04"}}] {{.Title}}
+{{.Message}}{{if .Link}}
+{{.Link}}{{end}}{{end}}{{if .Dropped}}
+
+另有 {{.Dropped}} 条较早的通知未列出{{end}}`,
+	},
+	// 发送到访客邮箱的Boss回复, 数据: Nick, Message, Link
+	"reply": {
+		`<p>Hi {{.Nick}}:</p><p>{{range $i, $line := lines .Message}}{{if $i}}<br>{{end}}{{$line}}{{end}}</p><p><a href="{{.Link}}">查看完整的对话</a></p>`,
+		`{{define "subject"}}BlackCarDriver 回复了你的消息{{end}}Hi {{.Nick}}:
+
+{{.Message}}
+
+查看完整的对话: {{.Link}}`,
+	},
+}
+
+var mailTemplateFuncs = map[string]interface{}{
+	"lines": func(s string) []string { return strings.Split(s, "\n") },
+}
+
+// 读取内置模板和模板目录下的模板, dir为空时只使用内置模板
+func LoadMailTemplates(dir string) (map[string]*mailTemplate, error) {
+	sources := make(map[string][2]string)
+	for name, src := range defaultMailTemplates {
+		sources[name] = src
+	}
+	if dir != "" {
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			ext := filepath.Ext(f.Name())
+			if f.IsDir() || (ext != ".html" && ext != ".txt") {
+				continue
+			}
+			b, err := ioutil.ReadFile(filepath.Join(dir, f.Name()))
+			if err != nil {
+				return nil, err
+			}
+			name := strings.TrimSuffix(f.Name(), ext)
+			src := sources[name]
+			if ext == ".html" {
+				src[0] = string(b)
+			} else {
+				src[1] = string(b)
+			}
+			sources[name] = src
+		}
+	}
+	templates := make(map[string]*mailTemplate)
+	for name, src := range sources {
+		t, err := parseMailTemplate(name, src[0], src[1])
+		if err != nil {
+			return nil, err
+		}
+		templates[name] = t
+	}
+	return templates, nil
+}
+
+func parseMailTemplate(name, html, text string) (*mailTemplate, error) {
+	t := &mailTemplate{}
+	var err error
+	if t.text, err = texttemplate.New(name).Funcs(mailTemplateFuncs).Parse(text); err != nil {
+		return nil, err
+	}
+	if t.text.Lookup("subject") == nil {
+		return nil, fmt.Errorf("mail template %s: subject is not defined", name)
+	}
+	if html != "" {
+		if t.html, err = htmltemplate.New(name).Funcs(mailTemplateFuncs).Parse(html); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// 渲染标题、HTML内容和纯文本内容
+func (t *mailTemplate) render(data interface{}) (subject, html, text string, err error) {
+	var buf bytes.Buffer
+	if err = t.text.ExecuteTemplate(&buf, "subject", data); err != nil {
+		return
+	}
+	subject = strings.TrimSpace(buf.String())
+	buf.Reset()
+	if err = t.text.Execute(&buf, data); err != nil {
+		return
+	}
+	text = strings.TrimSpace(buf.String())
+	if t.html != nil {
+		buf.Reset()
+		if err = t.html.Execute(&buf, data); err != nil {
+			return
+		}
+		html = buf.String()
+	}
+	return
+}
@@ -0,0 +1,162 @@
+package toolbox
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 创建连接到本地SMTPServer的Mailer
+func newTestMailer(t *testing.T, addr string, opts MailerOptions) (*Mailer, *MemoryMailStore) {
+	t.Helper()
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts.Host = host
+	opts.Port, _ = strconv.Atoi(port)
+	opts.User = "noreply@example.com"
+	store := NewMemoryMailStore()
+	m, err := NewMailer(opts, store)
+	if err != nil {
+		t.Fatalf("NewMailer failed: %v", err)
+	}
+	t.Cleanup(m.Close)
+	return m, store
+}
+
+// 等待邮件变为status状态
+func waitMailStatus(t *testing.T, store *MemoryMailStore, id string, status string) *Mail {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mail, err := store.GetMail(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mail.Status == status {
+			return mail
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("mail %s status = %s attempts=%d lastError=%q; want %s", id, mail.Status, mail.Attempts, mail.LastError, status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMailerSend(t *testing.T) {
+	addr, received := startTestSMTPServer(t, &SMTPServer{})
+	m, store := newTestMailer(t, addr, MailerOptions{FromName: "Boss", Workers: 1})
+
+	mail := &Mail{
+		To:          []string{"a@example.com", "b@example.com"},
+		ReplyTo:     "reply@example.com",
+		Subject:     "hello",
+		Text:        "plain body",
+		HTML:        "<p>html body</p>",
+		Attachments: []MailAttachment{{Name: "a.txt", Mime: "text/plain", Data: []byte("attachment")}},
+	}
+	if err := m.Send(mail); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	sent := waitMailStatus(t, store, mail.ID, MailStatusSent)
+	if sent.Attempts != 1 || sent.LastError != "" || sent.SendTime == 0 {
+		t.Errorf("sent mail = %+v", sent)
+	}
+	if sent.Attachments[0].Data != nil || sent.Attachments[0].Size != len("attachment") {
+		t.Errorf("attachment after sent = %+v; want data cleared and size kept", sent.Attachments[0])
+	}
+
+	mails := received()
+	if len(mails) != 1 {
+		t.Fatalf("received %d mails; want 1", len(mails))
+	}
+	got := mails[0]
+	if got.from != "noreply@example.com" || strings.Join(got.to, ",") != "a@example.com,b@example.com" {
+		t.Errorf("envelope = %s %v", got.from, got.to)
+	}
+	for _, want := range []string{"Subject: hello", "Reply-To: reply@example.com", `"Boss" <noreply@example.com>`, "plain body", "<p>html body</p>", `filename="a.txt"`} {
+		if !strings.Contains(got.data, want) {
+			t.Errorf("mail data does not contain %q:\n%s", want, got.data)
+		}
+	}
+}
+
+// 服务器关闭了空闲的连接后, 之后的邮件仍能发送成功
+func TestMailerRedial(t *testing.T) {
+	addr, received := startTestSMTPServer(t, &SMTPServer{Timeout: 100 * time.Millisecond})
+	m, store := newTestMailer(t, addr, MailerOptions{Workers: 1})
+
+	for i := 0; i < 2; i++ {
+		mail := &Mail{To: []string{"a@example.com"}, Subject: "mail " + strconv.Itoa(i), Text: "body"}
+		if err := m.Send(mail); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+		if sent := waitMailStatus(t, store, mail.ID, MailStatusSent); sent.Attempts != 1 {
+			t.Errorf("mail %d attempts = %d; want 1", i, sent.Attempts)
+		}
+		time.Sleep(300 * time.Millisecond)
+	}
+	if n := len(received()); n != 2 {
+		t.Errorf("received %d mails; want 2", n)
+	}
+}
+
+// 服务器拒绝时超过重试次数后标记为失败, 可以重新发送
+func TestMailerFailAndResend(t *testing.T) {
+	var reject int32 = 1
+	addr, received := startTestSMTPServer(t, &SMTPServer{Handler: func(from string, to []string, data []byte) error {
+		if atomic.LoadInt32(&reject) == 1 {
+			return errors.New("mailbox unavailable")
+		}
+		return nil
+	}})
+	m, store := newTestMailer(t, addr, MailerOptions{Workers: 1, Retry: 0})
+
+	mail := &Mail{To: []string{"a@example.com"}, Subject: "hello", Text: "body"}
+	if err := m.Send(mail); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	failed := waitMailStatus(t, store, mail.ID, MailStatusFailed)
+	if failed.Attempts != 1 || !strings.Contains(failed.LastError, "mailbox unavailable") {
+		t.Errorf("failed mail attempts=%d lastError=%q", failed.Attempts, failed.LastError)
+	}
+	if len(received()) != 0 {
+		t.Errorf("rejected mail was received")
+	}
+
+	atomic.StoreInt32(&reject, 0)
+	if err := m.Resend(mail.ID); err != nil {
+		t.Fatalf("Resend failed: %v", err)
+	}
+	waitMailStatus(t, store, mail.ID, MailStatusSent)
+	if len(received()) != 1 {
+		t.Errorf("resent mail was not received")
+	}
+	if err := m.Resend(mail.ID); err == nil {
+		t.Errorf("Resend of a sent mail succeeded; want error")
+	}
+}
+
+func TestMailerSendRejectsBadMail(t *testing.T) {
+	addr, _ := startTestSMTPServer(t, &SMTPServer{})
+	m, _ := newTestMailer(t, addr, MailerOptions{})
+	for _, mail := range []*Mail{
+		{Subject: "no receiver", Text: "body"},
+		{To: []string{"a@example.com"}, Text: "no subject"},
+		{To: []string{"a@example.com"}, Subject: "no body"},
+		{To: []string{"a@example.com"}, Subject: "too large", Text: "body", Attachments: []MailAttachment{{Name: "a.bin", Data: make([]byte, mailMaxAttach+1)}}},
+	} {
+		if err := m.Send(mail); err == nil {
+			t.Errorf("Send(%q) succeeded; want error", mail.Subject)
+		}
+	}
+	m.Close()
+	if err := m.Send(&Mail{To: []string{"a@example.com"}, Subject: "closed", Text: "body"}); err != errMailerClosed {
+		t.Errorf("Send after Close = %v; want %v", err, errMailerClosed)
+	}
+}
@@ -0,0 +1,381 @@
+package toolbox
+
+// 消息通知: 将一条通知异步发送到所有开启的渠道, 失败时按指数退避重试
+// 渠道类型: email | webhook | telegram | dingtalk | wecom, 每个渠道可以单独开关和设置通知内容的模板
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/astaxie/beego/logs"
+)
+
+const (
+	notifyQueueSize  = 256
+	notifyRetryDelay = 5 * time.Second // 第一次重试的等待时间, 之后每次翻倍
+	defaultTelegram  = "https://api.telegram.org"
+)
+
+// 默认的通知内容模板
+const defaultNotifyTemplate = `{{.Title}}
+{{if .Digest}}{{.Message}}{{else}}{{.Nick}}: {{.Message}}{{end}}{{if .Link}}
+{{.Link}}{{end}}`
+
+// Notification 一条通知, 同时作为模板的数据
+type Notification struct {
+	Event      string    `json:"event"` // 事件类型, 如 callDriver.message
+	Title      string    `json:"title"`
+	Nick       string    `json:"nick"`
+	Message    string    `json:"message"`
+	Conv       string    `json:"conv"`
+	Time       time.Time `json:"time"`
+	Link       string    `json:"link"`
+	ReplyToken string    `json:"-"`      // email渠道在标题和回复地址中带上的回复token
+	Digest     bool      `json:"digest"` // 是否为多条消息合并的通知, Message为每条消息一行
+}
+
+// NotifyChannelStatus 渠道的状态
+type NotifyChannelStatus struct {
+	Name      string `json:"name"`
+	Type      string `json:"type"`
+	Enable    bool   `json:"enable"`
+	Sent      int64  `json:"sent"`      // 发送成功的次数
+	Failed    int64  `json:"failed"`    // 重试后仍然失败的次数
+	LastError string `json:"lastError"` // 最近一次发送失败的原因
+	LastTime  int64  `json:"lastTime"`  // 最近一次发送的时间
+}
+
+// NotifyChannelOptions 通知渠道的配置
+type NotifyChannelOptions struct {
+	Name     string // 渠道名称, 唯一
+	Type     string // 渠道类型, 见notifySenders
+	Enable   bool   // 是否默认开启
+	URL      string // webhook地址; telegram为API地址, 默认 https://api.telegram.org
+	Token    string // telegram的机器人token
+	ChatID   string // telegram的chat_id
+	Secret   string // 钉钉机器人的加签密钥; 通用webhook的签名密钥
+	Template string // 通知内容的模板(text/template), 为空时使用默认模板
+}
+
+// 一个通知渠道
+type notifyChannel struct {
+	conf   NotifyChannelOptions
+	tmpl   *template.Template
+	send   notifySender
+	status NotifyChannelStatus
+}
+
+// 待发送的通知
+type notifyTask struct {
+	channel *notifyChannel
+	n       *Notification
+	attempt int
+}
+
+// Notifier 管理所有通知渠道
+type Notifier struct {
+	mux      sync.Mutex
+	channels []*notifyChannel
+	queue    chan notifyTask
+	client   *http.Client
+	retry    int
+	timeout  time.Duration
+}
+
+// 发送一条渲染后的通知
+type notifySender func(ctx context.Context, client *http.Client, c *notifyChannel, text string, n *Notification) error
+
+var notifySenders = map[string]notifySender{
+	"email":    sendEmailNotify,
+	"webhook":  sendWebhookNotify,
+	"telegram": sendTelegramNotify,
+	"dingtalk": sendRobotNotify,
+	"wecom":    sendRobotNotify,
+}
+
+// 根据配置创建Notifier并启动发送协程, retry为失败后的重试次数, timeout为单次发送的超时
+func NewNotifier(confs []NotifyChannelOptions, retry int, timeout time.Duration) (*Notifier, error) {
+	n := &Notifier{
+		queue:   make(chan notifyTask, notifyQueueSize),
+		client:  &http.Client{Timeout: timeout},
+		retry:   retry,
+		timeout: timeout,
+	}
+	for _, conf := range confs {
+		if conf.Name == "" {
+			return nil, errors.New("notify channel name can't be empty")
+		}
+		if n.find(conf.Name) != nil {
+			return nil, fmt.Errorf("duplicate notify channel: name=%s", conf.Name)
+		}
+		send, ok := notifySenders[conf.Type]
+		if !ok {
+			return nil, fmt.Errorf("unexpect notify channel type: name=%s type=%q", conf.Name, conf.Type)
+		}
+		switch {
+		case conf.Type == "telegram" && (conf.Token == "" || conf.ChatID == ""):
+			return nil, fmt.Errorf("token and chat_id are required: name=%s", conf.Name)
+		case conf.Type != "email" && conf.Type != "telegram" && conf.URL == "":
+			return nil, fmt.Errorf("url is required: name=%s", conf.Name)
+		}
+		text := conf.Template
+		if strings.TrimSpace(text) == "" {
+			text = defaultNotifyTemplate
+		}
+		tmpl, err := template.New(conf.Name).Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("bad notify template: name=%s error=%v", conf.Name, err)
+		}
+		n.channels = append(n.channels, &notifyChannel{
+			conf:   conf,
+			tmpl:   tmpl,
+			send:   send,
+			status: NotifyChannelStatus{Name: conf.Name, Type: conf.Type, Enable: conf.Enable},
+		})
+	}
+	go n.run()
+	return n, nil
+}
+
+func (n *Notifier) find(name string) *notifyChannel {
+	for _, c := range n.channels {
+		if c.conf.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// 异步发送通知到所有开启的渠道
+func (n *Notifier) Notify(notify *Notification) {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	for _, c := range n.channels {
+		if c.status.Enable {
+			n.enqueue(notifyTask{channel: c, n: notify})
+		}
+	}
+}
+
+// 加入发送队列, 队列已满时丢弃
+func (n *Notifier) enqueue(task notifyTask) {
+	select {
+	case n.queue <- task:
+	default:
+		logs.Error("notify queue is full, drop notification: channel=%s event=%s", task.channel.conf.Name, task.n.Event)
+	}
+}
+
+// 同步发送一条通知到指定的渠道(不论是否开启), 不重试, 用于测试渠道的配置
+func (n *Notifier) Test(name string, notify *Notification) error {
+	n.mux.Lock()
+	c := n.find(name)
+	n.mux.Unlock()
+	if c == nil {
+		return fmt.Errorf("notify channel not found: name=%s", name)
+	}
+	err := n.send(c, notify)
+	n.record(c, err, true)
+	return err
+}
+
+// 开启或关闭渠道
+func (n *Notifier) SetEnable(name string, enable bool) error {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	c := n.find(name)
+	if c == nil {
+		return fmt.Errorf("notify channel not found: name=%s", name)
+	}
+	c.status.Enable = enable
+	return nil
+}
+
+// 所有渠道的状态
+func (n *Notifier) Channels() []NotifyChannelStatus {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	res := make([]NotifyChannelStatus, 0, len(n.channels))
+	for _, c := range n.channels {
+		res = append(res, c.status)
+	}
+	return res
+}
+
+// 处理发送队列, 失败的通知延迟后重新加入队列
+func (n *Notifier) run() {
+	for task := range n.queue {
+		err := n.send(task.channel, task.n)
+		if err != nil && task.attempt < n.retry {
+			delay := notifyRetryDelay << uint(task.attempt)
+			logs.Warn("send notify failed, retry after %v: channel=%s attempt=%d error=%v", delay, task.channel.conf.Name, task.attempt+1, err)
+			n.record(task.channel, err, false)
+			retry := notifyTask{channel: task.channel, n: task.n, attempt: task.attempt + 1}
+			time.AfterFunc(delay, func() {
+				n.enqueue(retry)
+			})
+			continue
+		}
+		n.record(task.channel, err, err != nil)
+	}
+}
+
+// 记录发送结果, final表示不会再重试
+func (n *Notifier) record(c *notifyChannel, err error, final bool) {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	c.status.LastTime = time.Now().Unix()
+	if err == nil {
+		c.status.Sent++
+		return
+	}
+	c.status.LastError = err.Error()
+	if final {
+		c.status.Failed++
+		logs.Error("send notify failed: channel=%s error=%v", c.conf.Name, err)
+	}
+}
+
+// 渲染模板并发送一次
+func (n *Notifier) send(c *notifyChannel, notify *Notification) error {
+	var buf bytes.Buffer
+	if err := c.tmpl.Execute(&buf, notify); err != nil {
+		return fmt.Errorf("render template failed: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), n.timeout)
+	defer cancel()
+	return c.send(ctx, n.client, c, buf.String(), notify)
+}
+
+// 以json格式POST请求, result不为nil时解析返回的json
+// target中可能带有密钥(如telegram的bot token、企业微信的key), 返回的错误中只保留协议和域名
+func postNotifyJSON(ctx context.Context, client *http.Client, target string, header http.Header, body interface{}, result interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", target, bytes.NewReader(data))
+	if err != nil {
+		return redactNotifyError(err, target)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return redactNotifyError(err, target)
+	}
+	defer resp.Body.Close()
+	respBody, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpect status: code=%d body=%s", resp.StatusCode, respBody)
+	}
+	if result != nil {
+		if err = json.Unmarshal(respBody, result); err != nil {
+			return fmt.Errorf("unexpect response: body=%s", respBody)
+		}
+	}
+	return nil
+}
+
+// 去掉请求错误中的完整地址, 避免密钥出现在日志和渠道状态中
+func redactNotifyError(err error, target string) error {
+	host := "notify url"
+	if u, parseErr := url.Parse(target); parseErr == nil && u.Host != "" {
+		host = u.Scheme + "://" + u.Host
+	}
+	if urlErr, ok := err.(*url.Error); ok {
+		err = urlErr.Err
+	}
+	msg := strings.Replace(err.Error(), target, host, -1)
+	return fmt.Errorf("post %s failed: %s", host, msg)
+}
+
+// 按邮件路由规则发送给接收人, 邮件放入发送队列后即返回, 由邮件发送服务负责重试
+func sendEmailNotify(ctx context.Context, client *http.Client, c *notifyChannel, text string, n *Notification) error {
+	return SendMailEvent(&MailEvent{Type: n.Event, Title: n.Title, Message: text, ReplyToken: n.ReplyToken, Time: n.Time})
+}
+
+// 通用webhook, 发送通知的全部字段和渲染后的text; 配置了secret时在X-Signature头中带上请求体的HMAC-SHA256签名
+func sendWebhookNotify(ctx context.Context, client *http.Client, c *notifyChannel, text string, n *Notification) error {
+	body := struct {
+		*Notification
+		Time int64  `json:"time"`
+		Text string `json:"text"`
+	}{n, n.Time.Unix(), text}
+	header := http.Header{}
+	if c.conf.Secret != "" {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		mac := hmac.New(sha256.New, []byte(c.conf.Secret))
+		mac.Write(data)
+		header.Set("X-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	return postNotifyJSON(ctx, client, c.conf.URL, header, body, nil)
+}
+
+// Telegram Bot API的sendMessage
+func sendTelegramNotify(ctx context.Context, client *http.Client, c *notifyChannel, text string, n *Notification) error {
+	base := strings.TrimRight(c.conf.URL, "/")
+	if base == "" {
+		base = defaultTelegram
+	}
+	var result struct {
+		OK          bool   `json:"ok"`
+		Description string `json:"description"`
+	}
+	body := map[string]interface{}{"chat_id": c.conf.ChatID, "text": text, "disable_web_page_preview": true}
+	if err := postNotifyJSON(ctx, client, base+"/bot"+c.conf.Token+"/sendMessage", nil, body, &result); err != nil {
+		return errors.New(strings.Replace(err.Error(), c.conf.Token, "<token>", -1))
+	}
+	if !result.OK {
+		return fmt.Errorf("telegram error: %s", result.Description)
+	}
+	return nil
+}
+
+// 钉钉和企业微信的群机器人, 消息格式相同; 钉钉配置了secret时按加签方式在url中带上timestamp和sign
+func sendRobotNotify(ctx context.Context, client *http.Client, c *notifyChannel, text string, n *Notification) error {
+	target := c.conf.URL
+	if c.conf.Type == "dingtalk" && c.conf.Secret != "" {
+		ts := fmt.Sprint(time.Now().UnixNano() / int64(time.Millisecond))
+		mac := hmac.New(sha256.New, []byte(c.conf.Secret))
+		mac.Write([]byte(ts + "\n" + c.conf.Secret))
+		sign := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+		sep := "?"
+		if strings.Contains(target, "?") {
+			sep = "&"
+		}
+		target += sep + "timestamp=" + ts + "&sign=" + url.QueryEscape(sign)
+	}
+	var result struct {
+		ErrCode int    `json:"errcode"`
+		ErrMsg  string `json:"errmsg"`
+	}
+	body := map[string]interface{}{"msgtype": "text", "text": map[string]string{"content": text}}
+	if err := postNotifyJSON(ctx, client, target, nil, body, &result); err != nil {
+		return err
+	}
+	if result.ErrCode != 0 {
+		return fmt.Errorf("%s error: code=%d msg=%s", c.conf.Type, result.ErrCode, result.ErrMsg)
+	}
+	return nil
+}
@@ -0,0 +1,211 @@
+package toolbox
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testTelegramToken = "123456:ABC-secret-token"
+
+// 本地的通知接收端替身, 记录收到的请求
+type fakeNotifyServer struct {
+	*httptest.Server
+	requests chan *fakeNotifyRequest
+}
+
+type fakeNotifyRequest struct {
+	path   string
+	query  string
+	header http.Header
+	body   []byte
+}
+
+func newFakeNotifyServer(t *testing.T, reply func(w http.ResponseWriter, r *fakeNotifyRequest)) *fakeNotifyServer {
+	t.Helper()
+	fake := &fakeNotifyServer{requests: make(chan *fakeNotifyRequest, 16)}
+	fake.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		req := &fakeNotifyRequest{path: r.URL.Path, query: r.URL.RawQuery, header: r.Header, body: body}
+		fake.requests <- req
+		reply(w, req)
+	}))
+	t.Cleanup(fake.Close)
+	return fake
+}
+
+func (f *fakeNotifyServer) next(t *testing.T) *fakeNotifyRequest {
+	t.Helper()
+	select {
+	case req := <-f.requests:
+		return req
+	case <-time.After(5 * time.Second):
+		t.Fatal("no request received")
+	}
+	return nil
+}
+
+func newTestNotifier(t *testing.T, confs ...NotifyChannelOptions) *Notifier {
+	t.Helper()
+	notifier, err := NewNotifier(confs, 0, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return notifier
+}
+
+var testNotification = &Notification{Event: "callDriver.message", Title: "新消息", Nick: "访客", Message: "你好", Time: time.Unix(1700000000, 0)}
+
+func TestNotifierWebhook(t *testing.T) {
+	fake := newFakeNotifyServer(t, func(w http.ResponseWriter, r *fakeNotifyRequest) {})
+	notifier := newTestNotifier(t, NotifyChannelOptions{Name: "hook", Type: "webhook", Enable: true, URL: fake.URL + "/hook", Secret: "s3cret", Template: "{{.Nick}}说{{.Message}}"})
+
+	notifier.Notify(testNotification)
+	req := fake.next(t)
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write(req.body)
+	if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); req.header.Get("X-Signature") != want {
+		t.Errorf("X-Signature = %q; want %q", req.header.Get("X-Signature"), want)
+	}
+	var body map[string]interface{}
+	if err := json.Unmarshal(req.body, &body); err != nil {
+		t.Fatal(err)
+	}
+	if body["text"] != "访客说你好" || body["event"] != "callDriver.message" || body["time"] != float64(1700000000) {
+		t.Errorf("webhook body = %s", req.body)
+	}
+	// 异步发送, 等待结果记录完成
+	for i := 0; i < 100 && notifier.Channels()[0].Sent == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if status := notifier.Channels()[0]; status.Sent != 1 || status.Failed != 0 {
+		t.Errorf("status = %+v; want sent=1", status)
+	}
+
+	// 关闭的渠道不发送
+	notifier.SetEnable("hook", false)
+	notifier.Notify(testNotification)
+	select {
+	case req = <-fake.requests:
+		t.Errorf("disabled channel sent request: %s", req.body)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestNotifierTelegram(t *testing.T) {
+	fake := newFakeNotifyServer(t, func(w http.ResponseWriter, r *fakeNotifyRequest) {
+		if strings.Contains(string(r.body), `"chat_id":"404"`) {
+			fmt.Fprint(w, `{"ok":false,"description":"Bad Request: chat not found"}`)
+			return
+		}
+		fmt.Fprint(w, `{"ok":true}`)
+	})
+	notifier := newTestNotifier(t,
+		NotifyChannelOptions{Name: "tg", Type: "telegram", URL: fake.URL + "/", Token: testTelegramToken, ChatID: "42"},
+		NotifyChannelOptions{Name: "tg404", Type: "telegram", URL: fake.URL, Token: testTelegramToken, ChatID: "404"},
+	)
+	if err := notifier.Test("tg", testNotification); err != nil {
+		t.Fatalf("Test(tg) failed: %v", err)
+	}
+	req := fake.next(t)
+	if req.path != "/bot"+testTelegramToken+"/sendMessage" || !strings.Contains(string(req.body), `"text":"新消息\n访客: 你好"`) {
+		t.Errorf("telegram request = %s %s", req.path, req.body)
+	}
+	err := notifier.Test("tg404", testNotification)
+	if err == nil || !strings.Contains(err.Error(), "chat not found") {
+		t.Errorf("Test(tg404) error = %v; want chat not found", err)
+	}
+	if err = notifier.Test("missing", testNotification); err == nil {
+		t.Errorf("Test(missing) should fail")
+	}
+}
+
+func TestNotifierRedactToken(t *testing.T) {
+	fake := newFakeNotifyServer(t, func(w http.ResponseWriter, r *fakeNotifyRequest) {})
+	addr := fake.URL
+	fake.Close() // 连接失败时net/http返回的*url.Error中带有完整地址
+	notifier := newTestNotifier(t,
+		NotifyChannelOptions{Name: "tg", Type: "telegram", URL: addr, Token: testTelegramToken, ChatID: "42"},
+		NotifyChannelOptions{Name: "bad", Type: "telegram", URL: "http://bad host", Token: testTelegramToken, ChatID: "42"},
+		NotifyChannelOptions{Name: "wecom", Type: "wecom", URL: addr + "/cgi-bin/webhook/send?key=wecom-secret-key"},
+	)
+	for _, name := range []string{"tg", "bad", "wecom"} {
+		err := notifier.Test(name, testNotification)
+		if err == nil {
+			t.Errorf("Test(%s) should fail", name)
+			continue
+		}
+		for _, secret := range []string{testTelegramToken, "ABC-secret", "wecom-secret-key"} {
+			if strings.Contains(err.Error(), secret) {
+				t.Errorf("Test(%s) error leaks secret: %v", name, err)
+			}
+		}
+	}
+	for _, status := range notifier.Channels() {
+		if strings.Contains(status.LastError, "secret") || status.LastError == "" {
+			t.Errorf("status %s lastError = %q", status.Name, status.LastError)
+		}
+	}
+}
+
+func TestNotifierRobot(t *testing.T) {
+	fake := newFakeNotifyServer(t, func(w http.ResponseWriter, r *fakeNotifyRequest) {
+		if strings.Contains(r.query, "key=bad") {
+			fmt.Fprint(w, `{"errcode":93000,"errmsg":"invalid webhook url"}`)
+			return
+		}
+		fmt.Fprint(w, `{"errcode":0,"errmsg":"ok"}`)
+	})
+	notifier := newTestNotifier(t,
+		NotifyChannelOptions{Name: "ding", Type: "dingtalk", URL: fake.URL + "/robot/send?access_token=abc", Secret: "SECxyz"},
+		NotifyChannelOptions{Name: "wecom", Type: "wecom", URL: fake.URL + "/send?key=bad"},
+	)
+	if err := notifier.Test("ding", testNotification); err != nil {
+		t.Fatalf("Test(ding) failed: %v", err)
+	}
+	req := fake.next(t)
+	query, err := url.ParseQuery(req.query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mac := hmac.New(sha256.New, []byte("SECxyz"))
+	mac.Write([]byte(query.Get("timestamp") + "\nSECxyz"))
+	if query.Get("access_token") != "abc" || query.Get("sign") != base64.StdEncoding.EncodeToString(mac.Sum(nil)) {
+		t.Errorf("dingtalk query = %s", req.query)
+	}
+	if !strings.Contains(string(req.body), `"msgtype":"text"`) {
+		t.Errorf("dingtalk body = %s", req.body)
+	}
+	err = notifier.Test("wecom", testNotification)
+	if err == nil || !strings.Contains(err.Error(), "code=93000") {
+		t.Errorf("Test(wecom) error = %v; want code=93000", err)
+	}
+}
+
+func TestNewNotifierConfig(t *testing.T) {
+	for _, conf := range []NotifyChannelOptions{
+		{Name: "", Type: "webhook", URL: "http://a"},
+		{Name: "a", Type: "sms"},
+		{Name: "a", Type: "telegram", Token: "t"},
+		{Name: "a", Type: "webhook"},
+		{Name: "a", Type: "webhook", URL: "http://a", Template: "{{.Title"},
+	} {
+		if _, err := NewNotifier([]NotifyChannelOptions{conf}, 0, time.Second); err == nil {
+			t.Errorf("NewNotifier(%+v) should fail", conf)
+		}
+	}
+	dup := NotifyChannelOptions{Name: "a", Type: "email"}
+	if _, err := NewNotifier([]NotifyChannelOptions{dup, dup}, 0, time.Second); err == nil {
+		t.Errorf("NewNotifier with duplicate names should fail")
+	}
+}
@@ -0,0 +1,80 @@
+package toolbox
+
+// 用户密码的哈希: PBKDF2-HMAC-SHA256, 每个密码使用随机的盐
+// 保存格式: pbkdf2-sha256$迭代次数$盐(base64)$哈希(base64), 迭代次数保存在哈希中, 调整后旧密码仍然可以校验
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	passwordScheme  = "pbkdf2-sha256"
+	passwordIter    = 100000
+	passwordSaltLen = 16
+	passwordKeyLen  = 32
+)
+
+// 计算密码的哈希
+func HashPassword(password string) string {
+	salt := make([]byte, passwordSaltLen)
+	rand.Read(salt)
+	key := pbkdf2SHA256([]byte(password), salt, passwordIter, passwordKeyLen)
+	return fmt.Sprintf("%s$%d$%s$%s", passwordScheme, passwordIter,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+}
+
+// 校验密码与HashPassword得到的哈希是否匹配
+func CheckPassword(password, hash string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != passwordScheme {
+		return false
+	}
+	iter, err := strconv.Atoi(parts[1])
+	if err != nil || iter <= 0 {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil || len(key) == 0 {
+		return false
+	}
+	return hmac.Equal(key, pbkdf2SHA256([]byte(password), salt, iter, len(key)))
+}
+
+// PBKDF2 (RFC 8018), 伪随机函数为HMAC-SHA256
+func pbkdf2SHA256(password, salt []byte, iter, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	hashLen := prf.Size()
+	blocks := (keyLen + hashLen - 1) / hashLen
+	key := make([]byte, 0, blocks*hashLen)
+	buf := make([]byte, 4)
+	u := make([]byte, hashLen)
+	for block := 1; block <= blocks; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.BigEndian.PutUint32(buf, uint32(block))
+		prf.Write(buf)
+		u = prf.Sum(u[:0])
+		t := make([]byte, hashLen)
+		copy(t, u)
+		for i := 1; i < iter; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLen]
+}
@@ -0,0 +1,119 @@
+package toolbox
+
+// 工作量证明: 客户端需要找到一个nonce, 使 sha256(challenge + nonce) 的前bits个比特都为0
+// challenge由服务端签名, 不需要保存, 只记录已使用过的challenge防止重复使用
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrPowExpired = errors.New("challenge expired")
+	ErrPowInvalid = errors.New("invalid challenge")
+	ErrPowUsed    = errors.New("challenge already used")
+	ErrPowWrong   = errors.New("wrong proof of work")
+)
+
+// PowChallenger 签发和校验工作量证明的challenge
+type PowChallenger struct {
+	secret []byte
+	bits   int
+	ttl    time.Duration
+	mux    sync.Mutex
+	used   map[string]int64 // 已使用的challenge -> 过期时间
+}
+
+// 创建PowChallenger, bits为要求的前导零比特数, ttl为challenge的有效期
+func NewPowChallenger(secret []byte, bits int, ttl time.Duration) *PowChallenger {
+	p := &PowChallenger{
+		secret: secret,
+		bits:   bits,
+		ttl:    ttl,
+		used:   make(map[string]int64),
+	}
+	go func() {
+		for range time.NewTicker(ttl).C {
+			p.clean()
+		}
+	}()
+	return p
+}
+
+// 要求的前导零比特数
+func (p *PowChallenger) Bits() int {
+	return p.bits
+}
+
+// 签发一个challenge, 格式为 过期时间.随机串.签名
+func (p *PowChallenger) Issue() string {
+	payload := fmt.Sprintf("%d.%s", time.Now().Add(p.ttl).Unix(), GetRandomString(12))
+	return payload + "." + p.sign(payload)
+}
+
+func (p *PowChallenger) sign(payload string) string {
+	mac := hmac.New(sha256.New, p.secret)
+	mac.Write([]byte(fmt.Sprintf("pow:%d:%s", p.bits, payload)))
+	return hex.EncodeToString(mac.Sum(nil))[:16]
+}
+
+// 校验challenge和nonce, 通过后challenge不能再次使用
+func (p *PowChallenger) Verify(challenge, nonce string) error {
+	idx := strings.LastIndex(challenge, ".")
+	if idx < 0 || !hmac.Equal([]byte(p.sign(challenge[:idx])), []byte(challenge[idx+1:])) {
+		return ErrPowInvalid
+	}
+	expire, err := strconv.ParseInt(strings.SplitN(challenge, ".", 2)[0], 10, 64)
+	if err != nil {
+		return ErrPowInvalid
+	}
+	if time.Now().Unix() > expire {
+		return ErrPowExpired
+	}
+	sum := sha256.Sum256([]byte(challenge + nonce))
+	if len(nonce) > 32 || leadingZeroBits(sum[:]) < p.bits {
+		return ErrPowWrong
+	}
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	if _, ok := p.used[challenge]; ok {
+		return ErrPowUsed
+	}
+	p.used[challenge] = expire
+	return nil
+}
+
+// 清理已过期的challenge
+func (p *PowChallenger) clean() {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	now := time.Now().Unix()
+	for challenge, expire := range p.used {
+		if now > expire {
+			delete(p.used, challenge)
+		}
+	}
+}
+
+// 前导零比特数
+func leadingZeroBits(b []byte) int {
+	n := 0
+	for _, c := range b {
+		if c == 0 {
+			n += 8
+			continue
+		}
+		for c&0x80 == 0 {
+			n++
+			c <<= 1
+		}
+		break
+	}
+	return n
+}
@@ -0,0 +1,70 @@
+package toolbox
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimiter 滑动窗口计数器, 记录每个key在窗口内发生的次数
+type RateLimiter struct {
+	window time.Duration
+	mux    sync.Mutex
+	hits   map[string][]int64
+}
+
+// 创建计数器, 并启动协程定期清理过期的记录
+func NewRateLimiter(window time.Duration) *RateLimiter {
+	l := &RateLimiter{
+		window: window,
+		hits:   make(map[string][]int64),
+	}
+	go func() {
+		for range time.NewTicker(window).C {
+			l.clean()
+		}
+	}()
+	return l
+}
+
+// 窗口内的次数
+func (l *RateLimiter) Count(key string) int {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	return len(l.expire(key, time.Now().UnixNano()))
+}
+
+// 记录一次, 返回包括这次在内窗口内的次数
+func (l *RateLimiter) Hit(key string) int {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	now := time.Now().UnixNano()
+	hits := append(l.expire(key, now), now)
+	l.hits[key] = hits
+	return len(hits)
+}
+
+// 去掉key在窗口外的记录
+func (l *RateLimiter) expire(key string, now int64) []int64 {
+	hits := l.hits[key]
+	i := 0
+	for i < len(hits) && now-hits[i] >= int64(l.window) {
+		i++
+	}
+	if i == len(hits) {
+		delete(l.hits, key)
+		return nil
+	}
+	hits = hits[i:]
+	l.hits[key] = hits
+	return hits
+}
+
+// 清理所有过期的记录
+func (l *RateLimiter) clean() {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	now := time.Now().UnixNano()
+	for key := range l.hits {
+		l.expire(key, now)
+	}
+}
@@ -0,0 +1,284 @@
+package toolbox
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/astaxie/beego/logs"
+)
+
+// S3Options 创建S3Driver所需的参数
+type S3Options struct {
+	Endpoint  string // 服务地址, 如 https://s3.amazonaws.com 或 http://127.0.0.1:9000
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	Prefix    string // 所有key的公共前缀, 可为空
+	PathStyle bool   // 使用 endpoint/bucket/key 形式的地址(MinIO需要), 否则使用 bucket.endpoint/key
+}
+
+// S3Driver 将数据保存在S3兼容的对象存储中的StorageDriver, 请求使用AWS Signature V4签名
+type S3Driver struct {
+	opt      S3Options
+	endpoint *url.URL
+	client   *http.Client
+}
+
+// 创建一个S3Driver
+func NewS3Driver(opt S3Options) (*S3Driver, error) {
+	if opt.Endpoint == "" || opt.Bucket == "" || opt.AccessKey == "" || opt.SecretKey == "" {
+		return nil, fmt.Errorf("unexpect s3 options: endpoint=%q bucket=%q", opt.Endpoint, opt.Bucket)
+	}
+	endpoint, err := url.Parse(strings.TrimRight(opt.Endpoint, "/"))
+	if err != nil {
+		return nil, err
+	}
+	if opt.Region == "" {
+		opt.Region = "us-east-1"
+	}
+	opt.Prefix = strings.Trim(opt.Prefix, "/")
+	logs.Info("s3 driver created: endpoint=%s bucket=%s prefix=%s", endpoint, opt.Bucket, opt.Prefix)
+	return &S3Driver{
+		opt:      opt,
+		endpoint: endpoint,
+		client:   &http.Client{Timeout: 10 * time.Minute},
+	}, nil
+}
+
+func (d *S3Driver) Put(key string, src io.Reader, size int64) error {
+	req, err := http.NewRequest(http.MethodPut, d.objectURL(key).String(), src)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	if size == 0 {
+		req.Body = http.NoBody
+	}
+	resp, err := d.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return d.respError(resp)
+	}
+	return nil
+}
+
+func (d *S3Driver) Get(key string) (io.ReadCloser, error) {
+	req, err := http.NewRequest(http.MethodGet, d.objectURL(key).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := d.do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, os.ErrNotExist
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, d.respError(resp)
+	}
+	return resp.Body, nil
+}
+
+func (d *S3Driver) Exist(key string) (bool, error) {
+	req, err := http.NewRequest(http.MethodHead, d.objectURL(key).String(), nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := d.do(req)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, fmt.Errorf("s3 head object failed: key=%s status=%d", key, resp.StatusCode)
+}
+
+func (d *S3Driver) Delete(key string) error {
+	req, err := http.NewRequest(http.MethodDelete, d.objectURL(key).String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := d.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return d.respError(resp)
+	}
+	return nil
+}
+
+func (d *S3Driver) PresignGet(key string, fileName string, inline bool, expire time.Duration) (string, error) {
+	u := d.objectURL(key)
+	query := url.Values{}
+	if fileName != "" {
+		disposition := "attachment"
+		if inline {
+			disposition = "inline"
+		}
+		query.Set("response-content-disposition", fmt.Sprintf("%s; filename*=UTF-8''%s", disposition, url.PathEscape(fileName)))
+	}
+	return d.presign(http.MethodGet, u, query, expire, time.Now().UTC()), nil
+}
+
+// ------------------- 签名 ---------------------
+
+// 获取key对应的对象地址
+func (d *S3Driver) objectURL(key string) *url.URL {
+	if d.opt.Prefix != "" {
+		key = d.opt.Prefix + "/" + key
+	}
+	u := *d.endpoint
+	if d.opt.PathStyle {
+		u.Path = fmt.Sprintf("%s/%s/%s", strings.TrimRight(u.Path, "/"), d.opt.Bucket, key)
+	} else {
+		u.Host = d.opt.Bucket + "." + u.Host
+		u.Path = fmt.Sprintf("%s/%s", strings.TrimRight(u.Path, "/"), key)
+	}
+	u.RawPath = s3EscapePath(u.Path)
+	return &u
+}
+
+// 签名并发送请求
+func (d *S3Driver) do(req *http.Request) (*http.Response, error) {
+	now := time.Now().UTC()
+	payloadHash := "UNSIGNED-PAYLOAD"
+	req.Header.Set("x-amz-date", now.Format("20060102T150405Z"))
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := fmt.Sprintf("host:%s\nx-amz-content-sha256:%s\nx-amz-date:%s\n",
+		req.URL.Host, payloadHash, now.Format("20060102T150405Z"))
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3EscapePath(req.URL.Path),
+		s3CanonicalQuery(req.URL.Query()),
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := d.scope(now)
+	signature := d.signature(now, canonicalRequest)
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		d.opt.AccessKey, scope, signedHeaders, signature))
+	return d.client.Do(req)
+}
+
+// 生成预签名地址
+func (d *S3Driver) presign(method string, u *url.URL, query url.Values, expire time.Duration, now time.Time) string {
+	query.Set("X-Amz-Algorithm", "AWS4-HMAC-SHA256")
+	query.Set("X-Amz-Credential", d.opt.AccessKey+"/"+d.scope(now))
+	query.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	query.Set("X-Amz-Expires", fmt.Sprint(int64(expire/time.Second)))
+	query.Set("X-Amz-SignedHeaders", "host")
+	canonicalQuery := s3CanonicalQuery(query)
+	canonicalRequest := strings.Join([]string{
+		method,
+		s3EscapePath(u.Path),
+		canonicalQuery,
+		"host:" + u.Host + "\n",
+		"host",
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+	signature := d.signature(now, canonicalRequest)
+	res := *u
+	res.RawQuery = canonicalQuery + "&X-Amz-Signature=" + signature
+	return res.String()
+}
+
+func (d *S3Driver) scope(now time.Time) string {
+	return fmt.Sprintf("%s/%s/s3/aws4_request", now.Format("20060102"), d.opt.Region)
+}
+
+// 计算签名
+func (d *S3Driver) signature(now time.Time, canonicalRequest string) string {
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		now.Format("20060102T150405Z"),
+		d.scope(now),
+		hex.EncodeToString(requestHash[:]),
+	}, "\n")
+	key := hmacSHA256([]byte("AWS4"+d.opt.SecretKey), now.Format("20060102"))
+	key = hmacSHA256(key, d.opt.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+// 将出错的响应转换为error
+func (d *S3Driver) respError(resp *http.Response) error {
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("s3 request failed: method=%s url=%s status=%d body=%s",
+		resp.Request.Method, resp.Request.URL.Path, resp.StatusCode, body)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// 按照签名规范编码路径, 保留'/'
+func s3EscapePath(path string) string {
+	if path == "" {
+		return "/"
+	}
+	segments := strings.Split(path, "/")
+	for i, seg := range segments {
+		segments[i] = s3Escape(seg)
+	}
+	return strings.Join(segments, "/")
+}
+
+// 按照签名规范排序并编码查询参数
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		for _, v := range query[k] {
+			pairs = append(pairs, s3Escape(k)+"="+s3Escape(v))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// RFC3986编码, 仅保留非保留字符
+func s3Escape(s string) string {
+	var buf strings.Builder
+	for _, b := range []byte(s) {
+		if (b >= 'A' && b <= 'Z') || (b >= 'a' && b <= 'z') || (b >= '0' && b <= '9') ||
+			b == '-' || b == '_' || b == '.' || b == '~' {
+			buf.WriteByte(b)
+		} else {
+			fmt.Fprintf(&buf, "%%%02X", b)
+		}
+	}
+	return buf.String()
+}
@@ -0,0 +1,243 @@
+package toolbox
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/astaxie/beego/logs"
+)
+
+// SandboxFS 以某个目录为根的受限文件系统, 所有文件操作都只能落在根目录之内
+// 传入的文件名一律视为相对根目录的路径, 含有'..'、绝对路径、或经符号链接解析后逃出根目录的路径都会被拒绝
+type SandboxFS struct {
+	root     string          // 根目录的绝对路径(已解析符号链接)
+	reserved map[string]bool // 保留给内部使用的顶层文件名, 无法通过SandboxFS访问
+}
+
+var (
+	ErrOutOfSandbox = errors.New("path is out of sandbox")
+	ErrBadFileName  = errors.New("unexpect file name")
+)
+
+// 创建一个以root为根目录的SandboxFS, 根目录不存在时会自动创建
+func NewSandboxFS(root string) (*SandboxFS, error) {
+	if root == "" {
+		return nil, fmt.Errorf("sandbox root can't be null")
+	}
+	err := os.MkdirAll(root, 0755)
+	if err != nil {
+		return nil, err
+	}
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	realRoot, err := filepath.EvalSymlinks(absRoot)
+	if err != nil {
+		return nil, err
+	}
+	logs.Info("sandbox created: root=%s", realRoot)
+	return &SandboxFS{root: realRoot, reserved: make(map[string]bool)}, nil
+}
+
+// 返回根目录
+func (s *SandboxFS) Root() string {
+	return s.root
+}
+
+// 保留根目录下的某个文件名供内部使用, 之后对它及其子路径的访问都会被拒绝
+// 需要在SandboxFS投入使用之前调用
+func (s *SandboxFS) Reserve(name string) {
+	s.reserved[name] = true
+}
+
+// 判断根目录下的某个文件名是否被保留
+func (s *SandboxFS) IsReserved(name string) bool {
+	return s.reserved[name]
+}
+
+// 将相对路径转换为根目录下的真实路径, 路径不合法时返回错误
+// 空字符串或"."代表根目录本身
+func (s *SandboxFS) Resolve(name string) (string, error) {
+	if err := checkSandboxName(name); err != nil {
+		logs.Warn("reject sandbox path: name=%q error=%v", name, err)
+		return "", err
+	}
+	fullPath := filepath.Join(s.root, filepath.FromSlash(name))
+	if !s.contains(fullPath) {
+		return "", ErrOutOfSandbox
+	}
+	if rel, _ := filepath.Rel(s.root, fullPath); s.reserved[strings.Split(filepath.ToSlash(rel), "/")[0]] {
+		logs.Warn("reject reserved sandbox path: name=%q", name)
+		return "", ErrOutOfSandbox
+	}
+	// 解析符号链接: 目标不存在时逐级向上解析已存在的祖先目录
+	existPath, rest := fullPath, ""
+	for {
+		realPath, err := filepath.EvalSymlinks(existPath)
+		if err == nil {
+			realPath = filepath.Join(realPath, rest)
+			if !s.contains(realPath) {
+				logs.Warn("reject sandbox path by symlink: name=%q real=%s", name, realPath)
+				return "", ErrOutOfSandbox
+			}
+			return fullPath, nil
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+		parent := filepath.Dir(existPath)
+		if parent == existPath {
+			return "", ErrOutOfSandbox
+		}
+		rest = filepath.Join(filepath.Base(existPath), rest)
+		existPath = parent
+	}
+}
+
+// 判断一个绝对路径是否位于根目录之内
+func (s *SandboxFS) contains(fullPath string) bool {
+	return fullPath == s.root || strings.HasPrefix(fullPath, s.root+string(filepath.Separator))
+}
+
+// 检查文件名是否合法: 不允许空字节、反斜杠、绝对路径以及'..'
+func checkSandboxName(name string) error {
+	if strings.ContainsRune(name, 0) || strings.Contains(name, `\`) {
+		return ErrBadFileName
+	}
+	if strings.HasPrefix(name, "/") || filepath.IsAbs(name) || filepath.VolumeName(name) != "" {
+		return ErrBadFileName
+	}
+	for _, elem := range strings.Split(name, "/") {
+		if elem == ".." {
+			return ErrOutOfSandbox
+		}
+	}
+	return nil
+}
+
+// 打开文件用于读取
+func (s *SandboxFS) Open(name string) (*os.File, error) {
+	fullPath, err := s.Resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(fullPath)
+}
+
+// 创建文件, 文件已存在时会被清空
+func (s *SandboxFS) Create(name string) (*os.File, error) {
+	fullPath, err := s.Resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	if fullPath == s.root {
+		return nil, ErrBadFileName
+	}
+	return os.Create(fullPath)
+}
+
+// 创建一个新文件, 文件已存在时返回错误
+func (s *SandboxFS) CreateNew(name string) (*os.File, error) {
+	fullPath, err := s.Resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	if fullPath == s.root {
+		return nil, ErrBadFileName
+	}
+	return os.OpenFile(fullPath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+}
+
+// 以指定的flag打开文件, 如追加写入
+func (s *SandboxFS) OpenFile(name string, flag int, perm os.FileMode) (*os.File, error) {
+	fullPath, err := s.Resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	if fullPath == s.root && flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		return nil, ErrBadFileName
+	}
+	return os.OpenFile(fullPath, flag, perm)
+}
+
+// 查询文件信息
+func (s *SandboxFS) Stat(name string) (os.FileInfo, error) {
+	fullPath, err := s.Resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Stat(fullPath)
+}
+
+// 删除文件或空目录, 不允许删除根目录
+func (s *SandboxFS) Remove(name string) error {
+	fullPath, err := s.Resolve(name)
+	if err != nil {
+		return err
+	}
+	if fullPath == s.root {
+		return ErrBadFileName
+	}
+	return os.Remove(fullPath)
+}
+
+// 重命名文件, 新旧路径都必须位于根目录之内
+func (s *SandboxFS) Rename(oldName, newName string) error {
+	oldPath, err := s.Resolve(oldName)
+	if err != nil {
+		return err
+	}
+	newPath, err := s.Resolve(newName)
+	if err != nil {
+		return err
+	}
+	if oldPath == s.root || newPath == s.root {
+		return ErrBadFileName
+	}
+	return os.Rename(oldPath, newPath)
+}
+
+// 以硬链接的方式将已有文件oldPath放到沙盒中的name, oldPath必须是可信的真实路径
+func (s *SandboxFS) Link(oldPath, name string) error {
+	fullPath, err := s.Resolve(name)
+	if err != nil {
+		return err
+	}
+	if fullPath == s.root {
+		return ErrBadFileName
+	}
+	return os.Link(oldPath, fullPath)
+}
+
+// 创建目录
+func (s *SandboxFS) MkdirAll(name string) error {
+	fullPath, err := s.Resolve(name)
+	if err != nil {
+		return err
+	}
+	return os.MkdirAll(fullPath, 0755)
+}
+
+// 列出目录下的文件, 根目录下被保留的文件名不会出现在结果中
+func (s *SandboxFS) ReadDir(name string) ([]os.FileInfo, error) {
+	fullPath, err := s.Resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	infos, err := ioutil.ReadDir(fullPath)
+	if err != nil || fullPath != s.root {
+		return infos, err
+	}
+	res := make([]os.FileInfo, 0, len(infos))
+	for _, info := range infos {
+		if !s.reserved[info.Name()] {
+			res = append(res, info)
+		}
+	}
+	return res, nil
+}
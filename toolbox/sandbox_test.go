@@ -0,0 +1,147 @@
+package toolbox
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// 创建以临时目录为根的沙盒, 并保留handler中使用的内部目录名
+func newTestSandbox(t *testing.T) *SandboxFS {
+	t.Helper()
+	sandbox, err := NewSandboxFS(filepath.Join(t.TempDir(), "root"))
+	if err != nil {
+		t.Fatalf("create sandbox failed: %v", err)
+	}
+	for _, name := range []string{".blobs", ".thumbs", ".partial", ".quarantine"} {
+		sandbox.Reserve(name)
+	}
+	return sandbox
+}
+
+func TestSandboxResolve(t *testing.T) {
+	sandbox := newTestSandbox(t)
+	for _, name := range []string{"", ".", "a.txt", "dir/a.txt", "dir/./a.txt", "a..b", "..a", ".blobsx", "dir/.blobs", "报告 (1).pdf"} {
+		fullPath, err := sandbox.Resolve(name)
+		if err != nil {
+			t.Errorf("Resolve(%q) failed: %v", name, err)
+			continue
+		}
+		if !sandbox.contains(fullPath) {
+			t.Errorf("Resolve(%q) = %s, out of root %s", name, fullPath, sandbox.Root())
+		}
+	}
+}
+
+func TestSandboxResolveHostileNames(t *testing.T) {
+	sandbox := newTestSandbox(t)
+	cases := []struct {
+		name string
+		err  error
+	}{
+		{"..", ErrOutOfSandbox},
+		{"../a.txt", ErrOutOfSandbox},
+		{"dir/../../a.txt", ErrOutOfSandbox},
+		{"dir/..", ErrOutOfSandbox},
+		{"/etc/passwd", ErrBadFileName},
+		{"//etc/passwd", ErrBadFileName},
+		{`..\a.txt`, ErrBadFileName},
+		{`dir\a.txt`, ErrBadFileName},
+		{`C:\Windows\win.ini`, ErrBadFileName},
+		{"a.txt\x00.jpg", ErrBadFileName},
+		{"\x00", ErrBadFileName},
+		{".blobs", ErrOutOfSandbox},
+		{".blobs/ab/abcdef", ErrOutOfSandbox},
+		{".thumbs/a.jpg", ErrOutOfSandbox},
+		{".partial/session", ErrOutOfSandbox},
+		{".quarantine", ErrOutOfSandbox},
+		{"./.quarantine/virus.exe", ErrOutOfSandbox},
+		{"dir/../.blobs", ErrOutOfSandbox},
+	}
+	for _, c := range cases {
+		if fullPath, err := sandbox.Resolve(c.name); err != c.err {
+			t.Errorf("Resolve(%q) = %q, %v; want error %v", c.name, fullPath, err, c.err)
+		}
+	}
+}
+
+func TestSandboxResolveSymlink(t *testing.T) {
+	sandbox := newTestSandbox(t)
+	outside := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(sandbox.Root(), "escape")); err != nil {
+		t.Skipf("symlink not supported: %v", err)
+	}
+	if err := os.Symlink(filepath.Join(outside, "secret"), filepath.Join(sandbox.Root(), "secret")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(sandbox.Root(), "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(sandbox.Root(), "dir"), filepath.Join(sandbox.Root(), "inside")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"escape", "escape/secret", "escape/new/file", "secret"} {
+		if _, err := sandbox.Resolve(name); err != ErrOutOfSandbox {
+			t.Errorf("Resolve(%q) error = %v; want %v", name, err, ErrOutOfSandbox)
+		}
+	}
+	if _, err := sandbox.Open("escape/secret"); err != ErrOutOfSandbox {
+		t.Errorf("Open through symlink error = %v; want %v", err, ErrOutOfSandbox)
+	}
+	if _, err := sandbox.Create("escape/new"); err != ErrOutOfSandbox {
+		t.Errorf("Create through symlink error = %v; want %v", err, ErrOutOfSandbox)
+	}
+	// 指向沙盒内部的符号链接可以正常使用
+	if _, err := sandbox.Resolve("inside/new/file"); err != nil {
+		t.Errorf("Resolve through inner symlink failed: %v", err)
+	}
+}
+
+func TestSandboxReservedHidden(t *testing.T) {
+	sandbox := newTestSandbox(t)
+	for _, name := range []string{".blobs", ".thumbs", ".partial", ".quarantine", "dir/.blobs"} {
+		if err := os.MkdirAll(filepath.Join(sandbox.Root(), name), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sandbox.MkdirAll(".blobs/x"); err != ErrOutOfSandbox {
+		t.Errorf("MkdirAll reserved error = %v; want %v", err, ErrOutOfSandbox)
+	}
+	if err := sandbox.Rename("dir", ".partial/dir"); err != ErrOutOfSandbox {
+		t.Errorf("Rename into reserved error = %v; want %v", err, ErrOutOfSandbox)
+	}
+	infos, err := sandbox.ReadDir("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, 0, len(infos))
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	if strings.Join(names, ",") != "dir" {
+		t.Errorf("ReadDir root = %v; want [dir]", names)
+	}
+	// 只保留根目录下的文件名, 子目录中的同名文件可以访问
+	if infos, err = sandbox.ReadDir("dir"); err != nil || len(infos) != 1 {
+		t.Errorf("ReadDir dir = %v, %v; want .blobs", infos, err)
+	}
+}
+
+func TestSandboxRootOperations(t *testing.T) {
+	sandbox := newTestSandbox(t)
+	if _, err := sandbox.Create(""); err != ErrBadFileName {
+		t.Errorf("Create root error = %v; want %v", err, ErrBadFileName)
+	}
+	if err := sandbox.Remove("."); err != ErrBadFileName {
+		t.Errorf("Remove root error = %v; want %v", err, ErrBadFileName)
+	}
+	if err := sandbox.Link("/etc/passwd", ""); err != ErrBadFileName {
+		t.Errorf("Link to root error = %v; want %v", err, ErrBadFileName)
+	}
+}
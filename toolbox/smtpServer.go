@@ -0,0 +1,257 @@
+package toolbox
+
+// 简单的SMTP接收服务, 只实现接收邮件所需的命令(HELO/EHLO/MAIL/RCPT/DATA/RSET/NOOP/QUIT)
+// 不支持认证和TLS, 应只监听本地地址, 由前面的邮件服务器(如postfix)转发邮件
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/astaxie/beego/logs"
+)
+
+// SMTPHandler 处理收到的一封邮件, data为完整的邮件内容, 返回错误时向对方回复失败
+type SMTPHandler func(from string, to []string, data []byte) error
+
+// SMTPServer 接收邮件的SMTP服务
+type SMTPServer struct {
+	Addr    string        // 监听地址
+	Domain  string        // 问候语中的域名
+	MaxSize int64         // 单封邮件的最大字节数, 默认10MB
+	Timeout time.Duration // 每条命令的超时, 默认5分钟
+	Handler SMTPHandler
+
+	mux      sync.Mutex
+	listener net.Listener
+	closed   bool
+}
+
+var errSMTPServerClosed = errors.New("smtp server closed")
+
+// 开始监听并处理连接, 直到Close被调用
+func (s *SMTPServer) ListenAndServe() error {
+	listener, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(listener)
+}
+
+// 在指定的listener上处理连接
+func (s *SMTPServer) Serve(listener net.Listener) error {
+	s.mux.Lock()
+	if s.closed {
+		s.mux.Unlock()
+		listener.Close()
+		return errSMTPServerClosed
+	}
+	s.listener = listener
+	s.mux.Unlock()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			s.mux.Lock()
+			closed := s.closed
+			s.mux.Unlock()
+			if closed {
+				return errSMTPServerClosed
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		go s.serveConn(conn)
+	}
+}
+
+// 停止监听, 已建立的连接会继续处理完
+func (s *SMTPServer) Close() error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.closed = true
+	if s.listener != nil {
+		return s.listener.Close()
+	}
+	return nil
+}
+
+// 处理一个连接上的SMTP会话
+func (s *SMTPServer) serveConn(conn net.Conn) {
+	defer conn.Close()
+	maxSize, timeout := s.MaxSize, s.Timeout
+	if maxSize <= 0 {
+		maxSize = 10 << 20
+	}
+	if timeout <= 0 {
+		timeout = 5 * time.Minute
+	}
+	domain := s.Domain
+	if domain == "" {
+		domain = "localhost"
+	}
+	text := textproto.NewConn(conn)
+	reply := func(code int, msg string) {
+		text.PrintfLine("%d %s", code, msg)
+	}
+	var from string
+	var to []string
+	reset := func() {
+		from, to = "", nil
+	}
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	reply(220, domain+" ESMTP ready")
+	for {
+		conn.SetDeadline(time.Now().Add(timeout))
+		line, err := text.ReadLine()
+		if err != nil {
+			if err != io.EOF {
+				logs.Debug("smtp read command failed: remote=%s error=%v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		cmd, arg := line, ""
+		if idx := strings.IndexByte(line, ' '); idx > 0 {
+			cmd, arg = line[:idx], strings.TrimSpace(line[idx+1:])
+		}
+		switch strings.ToUpper(cmd) {
+		case "HELO":
+			reset()
+			reply(250, domain)
+		case "EHLO":
+			reset()
+			text.PrintfLine("250-%s", domain)
+			text.PrintfLine("250-SIZE %d", maxSize)
+			text.PrintfLine("250-8BITMIME")
+			reply(250, "PIPELINING")
+		case "MAIL":
+			addr, ok := parseSMTPPath(arg, "FROM:")
+			if !ok {
+				reply(501, "syntax: MAIL FROM:<address>")
+				continue
+			}
+			reset()
+			from = addr
+			reply(250, "OK")
+		case "RCPT":
+			addr, ok := parseSMTPPath(arg, "TO:")
+			if !ok || addr == "" {
+				reply(501, "syntax: RCPT TO:<address>")
+				continue
+			}
+			if len(to) >= 100 {
+				reply(452, "too many recipients")
+				continue
+			}
+			to = append(to, addr)
+			reply(250, "OK")
+		case "DATA":
+			if len(to) == 0 {
+				reply(503, "need RCPT before DATA")
+				continue
+			}
+			reply(354, "end data with <CR><LF>.<CR><LF>")
+			data, err := readSMTPData(text.R, maxSize)
+			if err == errSMTPTooLarge {
+				reply(552, "message too large")
+				reset()
+				continue
+			}
+			if err != nil {
+				logs.Debug("smtp read data failed: remote=%s error=%v", conn.RemoteAddr(), err)
+				return
+			}
+			if err = s.Handler(from, to, data); err != nil {
+				logs.Warn("smtp handle mail failed: from=%s to=%v error=%v", from, to, err)
+				reply(554, "rejected: "+strings.Replace(err.Error(), "\n", " ", -1))
+			} else {
+				reply(250, "OK: queued")
+			}
+			reset()
+		case "RSET":
+			reset()
+			reply(250, "OK")
+		case "NOOP":
+			reply(250, "OK")
+		case "QUIT":
+			reply(221, "bye")
+			return
+		default:
+			reply(502, "command not implemented")
+		}
+	}
+}
+
+// 解析 FROM:<address> 或 TO:<address>, 忽略其后的参数
+func parseSMTPPath(arg string, prefix string) (string, bool) {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", false
+	}
+	arg = strings.TrimSpace(arg[len(prefix):])
+	if !strings.HasPrefix(arg, "<") {
+		return "", false
+	}
+	end := strings.IndexByte(arg, '>')
+	if end < 0 {
+		return "", false
+	}
+	return arg[1:end], true
+}
+
+var errSMTPTooLarge = errors.New("smtp message too large")
+
+// 读取DATA命令的内容, 直到单独一行的".", 并去掉行首用于转义的"."
+// 内容超过maxSize时继续读完剩余部分后返回errSMTPTooLarge
+func readSMTPData(r *bufio.Reader, maxSize int64) ([]byte, error) {
+	var buf bytes.Buffer
+	tooLarge, midLine := false, false
+	for {
+		line, err := r.ReadSlice('\n')
+		if err != nil && err != bufio.ErrBufferFull {
+			return nil, err
+		}
+		// 超长的行分多次读取, 只有行首需要处理结束标记和转义
+		if !midLine {
+			trimmed := bytes.TrimRight(line, "\r\n")
+			if err == nil && len(trimmed) == 1 && trimmed[0] == '.' {
+				break
+			}
+			if len(trimmed) > 0 && trimmed[0] == '.' {
+				line = line[1:]
+			}
+		}
+		midLine = err == bufio.ErrBufferFull
+		if !tooLarge {
+			buf.Write(line)
+			if int64(buf.Len()) > maxSize {
+				tooLarge = true
+				buf.Reset()
+			}
+		}
+	}
+	if tooLarge {
+		return nil, errSMTPTooLarge
+	}
+	return buf.Bytes(), nil
+}
+
+// 邮件地址的本地部分中"+"之后的子地址, 没有时返回空字符串
+func MailSubAddress(addr string) string {
+	at := strings.LastIndex(addr, "@")
+	if at < 0 {
+		at = len(addr)
+	}
+	plus := strings.IndexByte(addr[:at], '+')
+	if plus < 0 {
+		return ""
+	}
+	return addr[plus+1 : at]
+}
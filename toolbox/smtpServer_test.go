@@ -0,0 +1,173 @@
+package toolbox
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 收到的一封邮件
+type receivedMail struct {
+	from string
+	to   []string
+	data string
+}
+
+// 在本地随机端口启动SMTPServer, 返回监听地址和收到的邮件
+func startTestSMTPServer(t *testing.T, server *SMTPServer) (string, func() []receivedMail) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mux sync.Mutex
+	var mails []receivedMail
+	handler := server.Handler
+	server.Handler = func(from string, to []string, data []byte) error {
+		if handler != nil {
+			if err := handler(from, to, data); err != nil {
+				return err
+			}
+		}
+		mux.Lock()
+		defer mux.Unlock()
+		mails = append(mails, receivedMail{from: from, to: to, data: string(data)})
+		return nil
+	}
+	done := make(chan error, 1)
+	go func() { done <- server.Serve(listener) }()
+	t.Cleanup(func() {
+		server.Close()
+		if err := <-done; err != errSMTPServerClosed {
+			t.Errorf("Serve returned %v; want %v", err, errSMTPServerClosed)
+		}
+	})
+	return listener.Addr().String(), func() []receivedMail {
+		mux.Lock()
+		defer mux.Unlock()
+		return append([]receivedMail(nil), mails...)
+	}
+}
+
+func TestSMTPServerReceive(t *testing.T) {
+	addr, received := startTestSMTPServer(t, &SMTPServer{Domain: "mail.test"})
+	body := "Subject: hi\r\n\r\nline1\r\n.hidden dot\r\n..two dots\r\n" + strings.Repeat("x", 5000) + "\r\nend\r\n"
+	err := smtp.SendMail(addr, nil, "boss@example.com", []string{"reply+abc@mail.test", "other@mail.test"}, []byte(body))
+	if err != nil {
+		t.Fatalf("SendMail failed: %v", err)
+	}
+	mails := received()
+	if len(mails) != 1 {
+		t.Fatalf("received %d mails; want 1", len(mails))
+	}
+	mail := mails[0]
+	if mail.from != "boss@example.com" || strings.Join(mail.to, ",") != "reply+abc@mail.test,other@mail.test" {
+		t.Errorf("envelope = %s %v", mail.from, mail.to)
+	}
+	if mail.data != body {
+		t.Errorf("data = %q; want %q", mail.data, body)
+	}
+}
+
+// 按行发送命令并检查回复码
+func smtpExpect(t *testing.T, conn *textproto.Conn, cmd string, code int) string {
+	t.Helper()
+	if cmd != "" {
+		if err := conn.PrintfLine("%s", cmd); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, msg, err := conn.ReadResponse(code)
+	if err != nil {
+		t.Fatalf("%q: %v", cmd, err)
+	}
+	return msg
+}
+
+func TestSMTPServerCommands(t *testing.T) {
+	addr, received := startTestSMTPServer(t, &SMTPServer{
+		MaxSize: 100,
+		Handler: func(from string, to []string, data []byte) error {
+			if strings.Contains(string(data), "reject") {
+				return errors.New("bad\nmail")
+			}
+			return nil
+		},
+	})
+	raw, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := textproto.NewConn(raw)
+	defer conn.Close()
+
+	smtpExpect(t, conn, "", 220)
+	if msg := smtpExpect(t, conn, "EHLO client", 250); !strings.Contains(msg, "SIZE 100") {
+		t.Errorf("EHLO reply = %q; want SIZE 100", msg)
+	}
+	smtpExpect(t, conn, "DATA", 503)
+	smtpExpect(t, conn, "MAIL FROM:boss@example.com", 501)
+	smtpExpect(t, conn, "MAIL FROM:<> SIZE=10", 250) // 退信的发件人为空
+	smtpExpect(t, conn, "RCPT TO:<>", 501)
+	smtpExpect(t, conn, "rcpt to:<a@mail.test>", 250)
+	smtpExpect(t, conn, "DATA", 354)
+	conn.PrintfLine("%s\r\n.", strings.Repeat("too large ", 20))
+	smtpExpect(t, conn, "", 552)
+
+	// 超大邮件之后会话仍可继续
+	smtpExpect(t, conn, "MAIL FROM:<boss@example.com>", 250)
+	smtpExpect(t, conn, "RCPT TO:<a@mail.test>", 250)
+	smtpExpect(t, conn, "DATA", 354)
+	conn.PrintfLine("reject me\r\n.")
+	if msg := smtpExpect(t, conn, "", 554); strings.Contains(msg, "\n") {
+		t.Errorf("reject reply = %q, contains line break", msg)
+	}
+	smtpExpect(t, conn, "RSET", 250)
+	smtpExpect(t, conn, "NOOP", 250)
+	smtpExpect(t, conn, "VRFY a", 502)
+	smtpExpect(t, conn, "QUIT", 221)
+	if len(received()) != 0 {
+		t.Errorf("received %d mails; want 0", len(received()))
+	}
+}
+
+func TestSMTPServerTimeout(t *testing.T) {
+	addr, _ := startTestSMTPServer(t, &SMTPServer{Timeout: 100 * time.Millisecond})
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	reader.ReadString('\n') // 问候语
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, err = reader.ReadString('\n'); err == nil || isTimeout(err) {
+		t.Errorf("idle connection read = %v; want closed by server", err)
+	}
+}
+
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+func TestMailSubAddress(t *testing.T) {
+	cases := map[string]string{
+		"reply+abc@mail.test": "abc",
+		"reply+a+b@mail.test": "a+b",
+		"reply@mail.test":     "",
+		"a+b":                 "b",
+		"a@b+c":               "",
+	}
+	for addr, want := range cases {
+		if got := MailSubAddress(addr); got != want {
+			t.Errorf("MailSubAddress(%q) = %q; want %q", addr, got, want)
+		}
+	}
+}
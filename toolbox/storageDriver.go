@@ -0,0 +1,97 @@
+package toolbox
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var (
+	ErrPresignNotSupport = errors.New("presign is not supported by storage driver")
+	ErrNotLocalStorage   = errors.New("storage driver is not local disk")
+)
+
+// StorageDriver 文件数据的底层存储, key为'/'分隔的相对路径
+type StorageDriver interface {
+	// 写入数据, key已存在时覆盖
+	Put(key string, src io.Reader, size int64) error
+	// 读取数据
+	Get(key string) (io.ReadCloser, error)
+	// 判断key是否存在
+	Exist(key string) (bool, error)
+	// 删除数据, key不存在时不返回错误
+	Delete(key string) error
+	// 生成一个有效期为expire的下载链接, fileName为下载时使用的文件名, inline为true时浏览器直接打开而不是下载
+	// 不支持时返回ErrPresignNotSupport
+	PresignGet(key string, fileName string, inline bool, expire time.Duration) (string, error)
+}
+
+// LocalDriver 将数据保存在本地目录的StorageDriver
+type LocalDriver struct {
+	fs *SandboxFS
+}
+
+// 创建一个以root为根目录的LocalDriver
+func NewLocalDriver(root string) (*LocalDriver, error) {
+	fs, err := NewSandboxFS(root)
+	if err != nil {
+		return nil, err
+	}
+	return &LocalDriver{fs: fs}, nil
+}
+
+func (d *LocalDriver) Put(key string, src io.Reader, size int64) error {
+	if err := d.fs.MkdirAll(filepath.Dir(key)); err != nil {
+		return err
+	}
+	file, err := d.fs.Create(key)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(file, src)
+	return err
+}
+
+// 将本地文件移动到key, 比Put少一次复制
+func (d *LocalDriver) MoveIn(key string, localPath string) error {
+	if err := d.fs.MkdirAll(filepath.Dir(key)); err != nil {
+		return err
+	}
+	fullPath, err := d.fs.Resolve(key)
+	if err != nil {
+		return err
+	}
+	return os.Rename(localPath, fullPath)
+}
+
+func (d *LocalDriver) Get(key string) (io.ReadCloser, error) {
+	return d.fs.Open(key)
+}
+
+func (d *LocalDriver) Exist(key string) (bool, error) {
+	_, err := d.fs.Stat(key)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (d *LocalDriver) Delete(key string) error {
+	err := d.fs.Remove(key)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (d *LocalDriver) PresignGet(key string, fileName string, inline bool, expire time.Duration) (string, error) {
+	return "", ErrPresignNotSupport
+}
+
+// 获取key对应的本地路径
+func (d *LocalDriver) Path(key string) (string, error) {
+	return d.fs.Resolve(key)
+}
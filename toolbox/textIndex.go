@@ -0,0 +1,359 @@
+package toolbox
+
+// 内存中的全文索引, 用于数据量不大的站内搜索
+// 分词: 英文和数字按单词切分并转为小写, 中日韩文字按相邻两个字切分(bigram), 因此不需要词典也能搜索中文
+// 索引时中日韩文字还会按单字切分, 只输入一个字时也能搜到包含这个字的词
+// 排序: 按字段加权的BM25, 查询中的每个词都必须出现在参与搜索的某个字段中
+import (
+	"html"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+const (
+	bm25K1          = 1.2
+	bm25B           = 0.75
+	textQueryMaxLen = 100 // 查询的最大字数, 超出部分忽略
+	textSnippetLen  = 120 // 摘要的最大字数
+)
+
+// TextIndex 全文索引, 可以并发使用
+type TextIndex struct {
+	weights map[string]float64 // 字段的权重, 只索引这些字段
+
+	mux      sync.RWMutex
+	docs     map[string]*textDoc
+	terms    map[string]map[string]map[string]int // 词 -> 文档id -> 字段 -> 出现次数
+	fieldLen map[string]int                       // 字段在所有文档中的总词数, 用于计算平均长度
+}
+
+type textDoc struct {
+	fields map[string][]rune // 原文, 用于生成摘要
+	lens   map[string]int    // 字段的词数
+	terms  []string          // 文档包含的词, 删除时使用
+	meta   interface{}
+}
+
+// TextHit 一条搜索结果
+type TextHit struct {
+	ID    string
+	Score float64
+	Meta  interface{} // 索引文档时传入的数据
+}
+
+// 创建索引, weights为字段的权重
+func NewTextIndex(weights map[string]float64) *TextIndex {
+	return &TextIndex{
+		weights:  weights,
+		docs:     make(map[string]*textDoc),
+		terms:    make(map[string]map[string]map[string]int),
+		fieldLen: make(map[string]int),
+	}
+}
+
+// 是否为按bigram切分的文字
+func isBigramRune(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul)
+}
+
+// 是否为单词的组成部分
+func isWordRune(r rune) bool {
+	return (unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_') && !isBigramRune(r)
+}
+
+// 切分文档的文本, 中日韩文字同时按单字和bigram切分
+func tokenizeText(s string) []string {
+	return splitText(s, true)
+}
+
+// 切分文本, 返回的词都是小写; unigram为false时多个相连的中日韩文字只按bigram切分
+func splitText(s string, unigram bool) []string {
+	tokens := make([]string, 0)
+	runes := []rune(strings.ToLower(s))
+	for i := 0; i < len(runes); {
+		switch {
+		case isWordRune(runes[i]):
+			j := i
+			for j < len(runes) && isWordRune(runes[j]) {
+				j++
+			}
+			tokens = append(tokens, string(runes[i:j]))
+			i = j
+		case isBigramRune(runes[i]):
+			j := i
+			for j < len(runes) && isBigramRune(runes[j]) {
+				j++
+			}
+			if unigram || j-i == 1 {
+				for k := i; k < j; k++ {
+					tokens = append(tokens, string(runes[k]))
+				}
+			}
+			for k := i; k+1 < j; k++ {
+				tokens = append(tokens, string(runes[k:k+2]))
+			}
+			i = j
+		default:
+			i++
+		}
+	}
+	return tokens
+}
+
+// 切分查询并去重, 过长的查询只使用前textQueryMaxLen个字
+// 多个相连的字只使用bigram, 避免匹配只包含其中零散单字的文档, 摘要中也不会标记零散的单字
+func tokenizeQuery(query string) []string {
+	if runes := []rune(query); len(runes) > textQueryMaxLen {
+		query = string(runes[:textQueryMaxLen])
+	}
+	seen := make(map[string]bool)
+	tokens := make([]string, 0)
+	for _, t := range splitText(query, false) {
+		if !seen[t] {
+			seen[t] = true
+			tokens = append(tokens, t)
+		}
+	}
+	return tokens
+}
+
+// 添加或替换一个文档, 不在权重中的字段会被忽略
+func (ix *TextIndex) Put(id string, fields map[string]string, meta interface{}) {
+	doc := &textDoc{
+		fields: make(map[string][]rune),
+		lens:   make(map[string]int),
+		meta:   meta,
+	}
+	counts := make(map[string]map[string]int) // 词 -> 字段 -> 次数
+	for field, text := range fields {
+		if _, ok := ix.weights[field]; !ok {
+			continue
+		}
+		doc.fields[field] = []rune(text)
+		tokens := tokenizeText(text)
+		doc.lens[field] = len(tokens)
+		for _, t := range tokens {
+			if counts[t] == nil {
+				counts[t] = make(map[string]int)
+				doc.terms = append(doc.terms, t)
+			}
+			counts[t][field]++
+		}
+	}
+
+	ix.mux.Lock()
+	defer ix.mux.Unlock()
+	ix.removeLocked(id)
+	ix.docs[id] = doc
+	for field, n := range doc.lens {
+		ix.fieldLen[field] += n
+	}
+	for t, c := range counts {
+		if ix.terms[t] == nil {
+			ix.terms[t] = make(map[string]map[string]int)
+		}
+		ix.terms[t][id] = c
+	}
+}
+
+// 删除一个文档
+func (ix *TextIndex) Remove(id string) {
+	ix.mux.Lock()
+	defer ix.mux.Unlock()
+	ix.removeLocked(id)
+}
+
+func (ix *TextIndex) removeLocked(id string) {
+	doc, ok := ix.docs[id]
+	if !ok {
+		return
+	}
+	for field, n := range doc.lens {
+		ix.fieldLen[field] -= n
+	}
+	for _, t := range doc.terms {
+		delete(ix.terms[t], id)
+		if len(ix.terms[t]) == 0 {
+			delete(ix.terms, t)
+		}
+	}
+	delete(ix.docs, id)
+}
+
+// 索引中的文档数
+func (ix *TextIndex) Len() int {
+	ix.mux.RLock()
+	defer ix.mux.RUnlock()
+	return len(ix.docs)
+}
+
+// 在指定的字段中搜索, 按相关度从高到低返回所有结果
+// fields为空时搜索所有字段; filter不为nil时只返回filter(meta)为true的文档
+func (ix *TextIndex) Search(query string, fields []string, filter func(meta interface{}) bool) []TextHit {
+	tokens := tokenizeQuery(query)
+	hits := make([]TextHit, 0)
+	if len(tokens) == 0 {
+		return hits
+	}
+	if len(fields) == 0 {
+		for field := range ix.weights {
+			fields = append(fields, field)
+		}
+	}
+
+	ix.mux.RLock()
+	defer ix.mux.RUnlock()
+	n := float64(len(ix.docs))
+	avgLen := make(map[string]float64)
+	for _, field := range fields {
+		avgLen[field] = math.Max(float64(ix.fieldLen[field])/math.Max(n, 1), 1)
+	}
+	scores := make(map[string]float64)
+	for i, t := range tokens {
+		postings := ix.terms[t]
+		idf := math.Log(1 + (n-float64(len(postings))+0.5)/(float64(len(postings))+0.5))
+		matched := make(map[string]float64)
+		for id, counts := range postings {
+			if i > 0 {
+				if _, ok := scores[id]; !ok {
+					continue
+				}
+			}
+			doc := ix.docs[id]
+			score := 0.0
+			for _, field := range fields {
+				tf := float64(counts[field])
+				if tf == 0 {
+					continue
+				}
+				norm := 1 - bm25B + bm25B*float64(doc.lens[field])/avgLen[field]
+				score += ix.weights[field] * idf * tf * (bm25K1 + 1) / (tf + bm25K1*norm)
+			}
+			if score > 0 {
+				matched[id] = scores[id] + score
+			}
+		}
+		// 每个词都必须匹配, 没有匹配当前词的文档被淘汰
+		scores = matched
+		if len(scores) == 0 {
+			return hits
+		}
+	}
+	for id, score := range scores {
+		doc := ix.docs[id]
+		if filter != nil && !filter(doc.meta) {
+			continue
+		}
+		hits = append(hits, TextHit{ID: id, Score: score, Meta: doc.meta})
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Score != hits[j].Score {
+			return hits[i].Score > hits[j].Score
+		}
+		return hits[i].ID > hits[j].ID
+	})
+	return hits
+}
+
+// 生成文档中包含查询词的字段的摘要, 结果为转义后的HTML, 查询词以<em>标记
+// 返回 字段 -> 摘要, 不包含查询词的字段不在结果中
+func (ix *TextIndex) Highlight(id string, query string, fields []string) map[string]string {
+	tokens := tokenizeQuery(query)
+	res := make(map[string]string)
+	ix.mux.RLock()
+	doc, ok := ix.docs[id]
+	ix.mux.RUnlock()
+	if !ok {
+		return res
+	}
+	if len(fields) == 0 {
+		for field := range doc.fields {
+			fields = append(fields, field)
+		}
+	}
+	for _, field := range fields {
+		if snippet := highlightText(doc.fields[field], tokens); snippet != "" {
+			res[field] = snippet
+		}
+	}
+	return res
+}
+
+// 在文本中标记查询词, 从第一个匹配之前不远处截取摘要; 没有匹配时返回空字符串
+func highlightText(text []rune, tokens []string) string {
+	lower := make([]rune, len(text))
+	for i, r := range text {
+		lower[i] = unicode.ToLower(r)
+	}
+	// 标记每个字是否属于匹配的查询词, 相邻或重叠的匹配合并为一段
+	marked := make([]bool, len(text))
+	first := -1
+	for _, t := range tokens {
+		tr := []rune(t)
+		for i := 0; i+len(tr) <= len(lower); i++ {
+			if !runesEqual(lower[i:i+len(tr)], tr) {
+				continue
+			}
+			// 单词只匹配完整的单词, 避免在 "format" 中标记 "or"
+			if isWordRune(tr[0]) && ((i > 0 && isWordRune(lower[i-1])) || (i+len(tr) < len(lower) && isWordRune(lower[i+len(tr)]))) {
+				continue
+			}
+			for k := i; k < i+len(tr); k++ {
+				marked[k] = true
+			}
+			if first < 0 || i < first {
+				first = i
+			}
+		}
+	}
+	if first < 0 {
+		return ""
+	}
+	start := first - textSnippetLen/4
+	if start < 0 {
+		start = 0
+	}
+	end := start + textSnippetLen
+	if end > len(text) {
+		end = len(text)
+		if start = end - textSnippetLen; start < 0 {
+			start = 0
+		}
+	}
+
+	var b strings.Builder
+	if start > 0 {
+		b.WriteString("...")
+	}
+	for i := start; i < end; {
+		j := i
+		for j < end && marked[j] == marked[i] {
+			j++
+		}
+		part := html.EscapeString(string(text[i:j]))
+		if marked[i] {
+			part = "<em>" + part + "</em>"
+		}
+		b.WriteString(part)
+		i = j
+	}
+	if end < len(text) {
+		b.WriteString("...")
+	}
+	return b.String()
+}
+
+func runesEqual(a, b []rune) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
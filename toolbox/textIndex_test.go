@@ -0,0 +1,83 @@
+package toolbox
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestTokenizeText(t *testing.T) {
+	cases := []struct {
+		text  string
+		doc   []string
+		query []string
+	}{
+		{"Binary_Tree 2", []string{"binary_tree", "2"}, []string{"binary_tree", "2"}},
+		{"树", []string{"树"}, []string{"树"}},
+		{"二叉树", []string{"二", "叉", "树", "二叉", "叉树"}, []string{"二叉", "叉树"}},
+		{"go语言 树", []string{"go", "语", "言", "语言", "树"}, []string{"go", "语言", "树"}},
+	}
+	for _, c := range cases {
+		if got := tokenizeText(c.text); !reflect.DeepEqual(got, c.doc) {
+			t.Errorf("tokenizeText(%q) = %q; want %q", c.text, got, c.doc)
+		}
+		if got := tokenizeQuery(c.text); !reflect.DeepEqual(got, c.query) {
+			t.Errorf("tokenizeQuery(%q) = %q; want %q", c.text, got, c.query)
+		}
+	}
+}
+
+func TestTextIndexSearch(t *testing.T) {
+	ix := NewTextIndex(map[string]float64{"title": 2, "desc": 1})
+	ix.Put("1", map[string]string{"title": "二叉树的遍历", "desc": "前序 中序 后序"}, nil)
+	ix.Put("2", map[string]string{"title": "图的最短路径", "desc": "dijkstra"}, nil)
+	ix.Put("3", map[string]string{"title": "树叉二", "desc": "shuffled"}, nil)
+	ix.Put("4", map[string]string{"title": "Tree", "desc": "二叉树"}, nil)
+
+	search := func(query string) []string {
+		ids := make([]string, 0)
+		for _, hit := range ix.Search(query, nil, nil) {
+			ids = append(ids, hit.ID)
+		}
+		sort.Strings(ids)
+		return ids
+	}
+	cases := []struct {
+		query string
+		want  []string
+	}{
+		{"树", []string{"1", "3", "4"}}, // 单字匹配包含这个字的词
+		{"图", []string{"2"}},
+		{"二叉树", []string{"1", "4"}},  // 多个字时按bigram匹配, 不匹配只包含零散单字的文档
+		{"二叉树 dijkstra", []string{}}, // 每个词都必须匹配
+		{"路径 dijkstra", []string{"2"}},
+		{"tree", []string{"4"}},
+	}
+	for _, c := range cases {
+		if got := search(c.query); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("Search(%q) = %v; want %v", c.query, got, c.want)
+		}
+	}
+
+	ix.Remove("1")
+	if got := search("树"); !reflect.DeepEqual(got, []string{"3", "4"}) {
+		t.Errorf("Search after Remove = %v", got)
+	}
+}
+
+func TestTextIndexHighlight(t *testing.T) {
+	ix := NewTextIndex(map[string]float64{"title": 1})
+	ix.Put("1", map[string]string{"title": "二叉树和<树>的format"}, nil)
+	cases := map[string]string{
+		"树":        "二叉<em>树</em>和&lt;<em>树</em>&gt;的format",
+		"二叉树":      "<em>二叉树</em>和&lt;树&gt;的format",
+		"or":       "",
+		"叉 FORMAT": "二<em>叉</em>树和&lt;树&gt;的<em>format</em>",
+	}
+	for query, want := range cases {
+		got := ix.Highlight("1", query, nil)["title"]
+		if got != want {
+			t.Errorf("Highlight(%q) = %q; want %q", query, got, want)
+		}
+	}
+}
@@ -13,6 +13,7 @@ import (
 	"path"
 	"reflect"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/astaxie/beego/logs"
@@ -20,7 +21,6 @@ import (
 
 func init() {
 	rand.Seed(time.Now().UnixNano())
-	go initMailSender()
 	go initSysMonitor()
 }
 
@@ -86,7 +86,7 @@ func ServerFile(w http.ResponseWriter, filePath string, fileName string, size in
 
 	w.Header().Set("Content-Type", "application/octet-stream")
 	w.Header().Set("Content-Length", fmt.Sprint(size))
-	w.Header().Set("content-disposition", fmt.Sprintf("attachment; filename=%s", fileName))
+	w.Header().Set("content-disposition", ContentDisposition("attachment", fileName))
 	_, err = io.Copy(w, file)
 	if err != nil {
 		return err
@@ -110,7 +110,7 @@ func ServerFile2(w *http.ResponseWriter, filePath string) error {
 	}
 	(*w).Header().Set("Content-Type", "application/octet-stream")
 	(*w).Header().Set("Content-Length", fmt.Sprint(fileState.Size()))
-	(*w).Header().Set("content-disposition", fmt.Sprintf("attachment; filename=%s", fileState.Name()))
+	(*w).Header().Set("content-disposition", ContentDisposition("attachment", fileState.Name()))
 	_, err = io.Copy(*w, file)
 	if err != nil {
 		return err
@@ -118,6 +118,36 @@ func ServerFile2(w *http.ResponseWriter, filePath string) error {
 	return nil
 }
 
+// 生成Content-Disposition响应头, 文件名中可以包含空格、引号和中文等字符
+// filename为只含ASCII字符的备用名, 支持RFC 5987的客户端使用filename*中UTF-8编码的完整文件名
+func ContentDisposition(disposition string, fileName string) string {
+	fallback := strings.Map(func(r rune) rune {
+		if r < 0x20 || r >= 0x7f || r == '"' || r == '\\' {
+			return '_'
+		}
+		return r
+	}, fileName)
+	const hexDigits = "0123456789ABCDEF"
+	encoded := make([]byte, 0, len(fileName))
+	for i := 0; i < len(fileName); i++ {
+		c := fileName[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.IndexByte("!#$&+-.^_`|~", c) >= 0 {
+			encoded = append(encoded, c)
+		} else {
+			encoded = append(encoded, '%', hexDigits[c>>4], hexDigits[c&15])
+		}
+	}
+	return fmt.Sprintf(`%s; filename="%s"; filename*=UTF-8''%s`, disposition, fallback, encoded)
+}
+
+// 导出csv时防止公式注入: 以= + - @或制表符、回车开头的单元格会被Excel等软件当作公式执行, 在前面加上单引号
+func CSVSafeCell(cell string) string {
+	if cell != "" && strings.IndexByte("=+-@\t\r", cell[0]) >= 0 {
+		return "'" + cell
+	}
+	return cell
+}
+
 // 生成一个随机字符串
 func GetRandomString(l int) string {
 	str := "abcdefghijklmnopqrstuvwxyz"
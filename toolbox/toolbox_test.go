@@ -0,0 +1,40 @@
+package toolbox
+
+import (
+	"mime"
+	"strings"
+	"testing"
+)
+
+func TestContentDisposition(t *testing.T) {
+	for _, name := range []string{"a.txt", "a b (1).txt", "报告 2024.pdf", `a"b\c.txt`, "a;b=c.txt", "a\r\nSet-Cookie: x.txt", "100%.txt"} {
+		header := ContentDisposition("attachment", name)
+		if strings.ContainsAny(header, "\r\n") {
+			t.Errorf("ContentDisposition(%q) = %q, contains line break", name, header)
+			continue
+		}
+		disposition, params, err := mime.ParseMediaType(header)
+		if err != nil || disposition != "attachment" || params["filename"] != name {
+			t.Errorf("ParseMediaType(%q) = %q, %v, %v; want filename %q", header, disposition, params, err, name)
+		}
+	}
+}
+
+func TestCSVSafeCell(t *testing.T) {
+	cases := map[string]string{
+		"":                         "",
+		"hello":                    "hello",
+		"a=b":                      "a=b",
+		"=HYPERLINK(\"http://x\")": "'=HYPERLINK(\"http://x\")",
+		"+1":                       "'+1",
+		"-1+2":                     "'-1+2",
+		"@SUM(A1)":                 "'@SUM(A1)",
+		"\t=1":                     "'\t=1",
+		"\r=1":                     "'\r=1",
+	}
+	for cell, want := range cases {
+		if got := CSVSafeCell(cell); got != want {
+			t.Errorf("CSVSafeCell(%q) = %q, want %q", cell, got, want)
+		}
+	}
+}
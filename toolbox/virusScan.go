@@ -0,0 +1,154 @@
+package toolbox
+
+// 文件的病毒扫描, ClamdScanner通过clamd的INSTREAM命令扫描数据流
+// 协议: 发送"zINSTREAM\0", 之后每块数据以4字节大端长度开头, 长度为0代表结束; clamd返回"stream: OK"或"stream: ${病毒名} FOUND"
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// 扫描结果
+type ScanResult struct {
+	Infected  bool
+	Signature string // 发现的病毒名称
+}
+
+// VirusScanner 病毒扫描器
+type VirusScanner interface {
+	Scan(ctx context.Context, src io.Reader) (ScanResult, error)
+}
+
+// ------------------- clamd ---------------------
+
+const clamdChunkSize = 64 << 10
+
+// ClamdScanner 使用clamd服务扫描
+type ClamdScanner struct {
+	network string
+	addr    string
+}
+
+// 创建clamd扫描器, addr格式为 unix:/path/to/clamd.ctl 或 tcp:host:port, 省略前缀时视为tcp地址
+func NewClamdScanner(addr string) (*ClamdScanner, error) {
+	switch {
+	case strings.HasPrefix(addr, "unix:"):
+		return &ClamdScanner{network: "unix", addr: strings.TrimPrefix(addr, "unix:")}, nil
+	case strings.HasPrefix(addr, "tcp:"):
+		return &ClamdScanner{network: "tcp", addr: strings.TrimPrefix(addr, "tcp:")}, nil
+	case addr != "":
+		return &ClamdScanner{network: "tcp", addr: addr}, nil
+	}
+	return nil, errors.New("clamd address can't be empty")
+}
+
+// 检查clamd是否可用
+func (c *ClamdScanner) Ping(ctx context.Context) error {
+	reply, err := c.command(ctx, func(conn net.Conn) error {
+		_, err := conn.Write([]byte("zPING\x00"))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if reply != "PONG" {
+		return fmt.Errorf("unexpect clamd reply: %q", reply)
+	}
+	return nil
+}
+
+// 扫描数据流
+func (c *ClamdScanner) Scan(ctx context.Context, src io.Reader) (ScanResult, error) {
+	reply, err := c.command(ctx, func(conn net.Conn) error {
+		if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+			return err
+		}
+		buf := make([]byte, 4+clamdChunkSize)
+		for {
+			n, err := io.ReadFull(src, buf[4:])
+			if n > 0 {
+				binary.BigEndian.PutUint32(buf, uint32(n))
+				if _, werr := conn.Write(buf[:4+n]); werr != nil {
+					return werr
+				}
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+		}
+		_, err := conn.Write([]byte{0, 0, 0, 0})
+		return err
+	})
+	if err != nil {
+		return ScanResult{}, err
+	}
+	// 回复格式: "stream: OK" | "stream: Eicar-Signature FOUND" | "INSTREAM size limit exceeded. ERROR"
+	reply = strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case reply == "OK":
+		return ScanResult{}, nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return ScanResult{Infected: true, Signature: strings.TrimSuffix(reply, " FOUND")}, nil
+	}
+	return ScanResult{}, fmt.Errorf("clamd scan failed: %s", reply)
+}
+
+// 建立连接并发送命令, 返回去掉结尾'\0'的回复
+func (c *ClamdScanner) command(ctx context.Context, send func(conn net.Conn) error) (string, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, c.network, c.addr)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if err = send(conn); err != nil {
+		return "", err
+	}
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return strings.TrimSpace(strings.TrimRight(reply, "\x00")), nil
+}
+
+// ------------------- eicar ---------------------
+
+// EICAR测试文件的内容, 拆开书写以免源码本身被杀毒软件识别
+var eicarSignature = []byte(`X5O!P%@AP[4\PZX54(P^)7CC)7}$` + `EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`)
+
+// EicarScanner 只识别EICAR测试文件的扫描器, 用于在没有clamd的环境中测试扫描流程
+type EicarScanner struct{}
+
+func (EicarScanner) Scan(ctx context.Context, src io.Reader) (ScanResult, error) {
+	// 按照EICAR的约定, 测试文件以特征字符串开头, 总长度不超过128字节, 其后只能是空白字符
+	head := make([]byte, 129)
+	n, err := io.ReadFull(src, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return ScanResult{}, err
+	}
+	head = head[:n]
+	if n <= 128 && bytes.HasPrefix(head, eicarSignature) && len(bytes.TrimSpace(head[len(eicarSignature):])) == 0 {
+		return ScanResult{Infected: true, Signature: "Eicar-Test-Signature"}, nil
+	}
+	return ScanResult{}, nil
+}
+
+// 带超时地扫描
+func ScanWithTimeout(scanner VirusScanner, src io.Reader, timeout time.Duration) (ScanResult, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return scanner.Scan(ctx, src)
+}
@@ -0,0 +1,216 @@
+package toolbox
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 本地的clamd替身: 按INSTREAM协议接收数据, 包含EICAR特征时报告病毒
+type fakeClamd struct {
+	listener  net.Listener
+	sizeLimit int // 超过该大小时返回clamd的超限错误
+	hang      bool
+
+	mux      sync.Mutex
+	received [][]byte // 每次INSTREAM收到的完整数据
+}
+
+func newFakeClamd(t *testing.T, network, addr string) *fakeClamd {
+	t.Helper()
+	listener, err := net.Listen(network, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := &fakeClamd{listener: listener, sizeLimit: 1 << 20}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go fake.serve(conn)
+		}
+	}()
+	return fake
+}
+
+func (f *fakeClamd) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	cmd, err := reader.ReadString(0)
+	if err != nil {
+		return
+	}
+	if f.hang {
+		io.Copy(ioutil.Discard, reader)
+		return
+	}
+	switch cmd {
+	case "zPING\x00":
+		conn.Write([]byte("PONG\x00"))
+	case "zINSTREAM\x00":
+		var data []byte
+		size := make([]byte, 4)
+		for {
+			if _, err = io.ReadFull(reader, size); err != nil {
+				return
+			}
+			n := binary.BigEndian.Uint32(size)
+			if n == 0 {
+				break
+			}
+			if n > clamdChunkSize || len(data)+int(n) > f.sizeLimit {
+				conn.Write([]byte("INSTREAM size limit exceeded. ERROR\x00"))
+				return
+			}
+			chunk := make([]byte, n)
+			if _, err = io.ReadFull(reader, chunk); err != nil {
+				return
+			}
+			data = append(data, chunk...)
+		}
+		f.mux.Lock()
+		f.received = append(f.received, data)
+		f.mux.Unlock()
+		if bytes.Contains(data, eicarSignature) {
+			conn.Write([]byte("stream: Eicar-Test-Signature FOUND\x00"))
+		} else {
+			conn.Write([]byte("stream: OK\x00"))
+		}
+	default:
+		conn.Write([]byte("UNKNOWN COMMAND\x00"))
+	}
+}
+
+func (f *fakeClamd) last() []byte {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if len(f.received) == 0 {
+		return nil
+	}
+	return f.received[len(f.received)-1]
+}
+
+func TestNewClamdScanner(t *testing.T) {
+	cases := []struct{ addr, network, want string }{
+		{"unix:/run/clamd.ctl", "unix", "/run/clamd.ctl"},
+		{"tcp:127.0.0.1:3310", "tcp", "127.0.0.1:3310"},
+		{"localhost:3310", "tcp", "localhost:3310"},
+	}
+	for _, c := range cases {
+		scanner, err := NewClamdScanner(c.addr)
+		if err != nil || scanner.network != c.network || scanner.addr != c.want {
+			t.Errorf("NewClamdScanner(%q) = %+v, %v; want %s %s", c.addr, scanner, err, c.network, c.want)
+		}
+	}
+	if _, err := NewClamdScanner(""); err == nil {
+		t.Errorf("NewClamdScanner(\"\") should fail")
+	}
+}
+
+func TestClamdScanner(t *testing.T) {
+	fake := newFakeClamd(t, "tcp", "127.0.0.1:0")
+	scanner, err := NewClamdScanner("tcp:" + fake.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err = scanner.Ping(ctx); err != nil {
+		t.Fatalf("Ping failed: %v", err)
+	}
+
+	// 多个数据块, 最后一块不足64KB
+	clean := bytes.Repeat([]byte("clean data "), 3*clamdChunkSize/10)
+	infected := append(bytes.Repeat([]byte{'x'}, clamdChunkSize-10), eicarSignature...) // 特征跨越两个数据块
+	cases := []struct {
+		name string
+		data []byte
+		want ScanResult
+	}{
+		{"empty", nil, ScanResult{}},
+		{"clean", clean, ScanResult{}},
+		{"infected", infected, ScanResult{Infected: true, Signature: "Eicar-Test-Signature"}},
+	}
+	for _, c := range cases {
+		result, err := scanner.Scan(ctx, bytes.NewReader(c.data))
+		if err != nil || result != c.want {
+			t.Errorf("Scan(%s) = %+v, %v; want %+v", c.name, result, err, c.want)
+		}
+		if got := fake.last(); !bytes.Equal(got, c.data) {
+			t.Errorf("Scan(%s) sent %d bytes; want %d", c.name, len(got), len(c.data))
+		}
+	}
+
+	fake.sizeLimit = clamdChunkSize
+	_, err = scanner.Scan(ctx, bytes.NewReader(clean))
+	if err == nil || !strings.Contains(err.Error(), "size limit exceeded") {
+		t.Errorf("Scan over size limit error = %v; want size limit exceeded", err)
+	}
+}
+
+func TestClamdScannerUnix(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "clamd.ctl")
+	newFakeClamd(t, "unix", sock)
+	scanner, err := NewClamdScanner("unix:" + sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := ScanWithTimeout(scanner, bytes.NewReader(eicarSignature), 5*time.Second)
+	if err != nil || !result.Infected {
+		t.Errorf("Scan over unix socket = %+v, %v; want infected", result, err)
+	}
+}
+
+func TestClamdScannerTimeout(t *testing.T) {
+	fake := newFakeClamd(t, "tcp", "127.0.0.1:0")
+	fake.hang = true
+	scanner, _ := NewClamdScanner(fake.listener.Addr().String())
+	start := time.Now()
+	_, err := ScanWithTimeout(scanner, strings.NewReader("data"), 200*time.Millisecond)
+	if err == nil {
+		t.Errorf("Scan without reply should fail")
+	}
+	if time.Since(start) > 3*time.Second {
+		t.Errorf("Scan timeout took %v", time.Since(start))
+	}
+
+	// clamd不可用
+	addr := fake.listener.Addr().String()
+	fake.listener.Close()
+	scanner, _ = NewClamdScanner(addr)
+	if err = scanner.Ping(context.Background()); err == nil {
+		t.Errorf("Ping closed clamd should fail")
+	}
+}
+
+func TestEicarScanner(t *testing.T) {
+	cases := []struct {
+		data     string
+		infected bool
+	}{
+		{string(eicarSignature), true},
+		{string(eicarSignature) + "\r\n  ", true},
+		{string(eicarSignature) + "extra", false},
+		{"prefix" + string(eicarSignature), false},
+		{string(eicarSignature) + strings.Repeat(" ", 128), false},
+		{"", false},
+	}
+	for _, c := range cases {
+		result, err := EicarScanner{}.Scan(context.Background(), strings.NewReader(c.data))
+		if err != nil || result.Infected != c.infected {
+			t.Errorf("EicarScanner.Scan(%q) = %+v, %v; want infected=%v", c.data, result, err, c.infected)
+		}
+	}
+}